@@ -50,6 +50,7 @@ func NewAddressFromBytes(b []byte) (*Address, error) {
 
 // NewAddressFromPublicKey derives an address from a public key
 // This is a core ZeroTier feature where addresses are directly derived from public keys
+// The key is hashed as-is, so any identity type (Curve25519, compressed P-256) is accepted
 func NewAddressFromPublicKey(publicKey []byte) *Address {
 	// Hash the key
 	hash := crypto.Hash(publicKey)
@@ -74,6 +75,21 @@ func (a *Address) String() string {
 		a.bytes[0], a.bytes[1], a.bytes[2], a.bytes[3], a.bytes[4])
 }
 
+// MarshalText encodes the address as hexadecimal, e.g. for JSON identity files
+func (a *Address) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalText decodes an address from its hexadecimal form
+func (a *Address) UnmarshalText(text []byte) error {
+	parsed, err := NewAddressFromString(string(text))
+	if err != nil {
+		return err
+	}
+	a.bytes = parsed.bytes
+	return nil
+}
+
 // Compare compares two addresses and returns -1, 0, or 1 if the receiver is less than, equal to, or greater than the other
 func (a *Address) Compare(other *Address) int {
 	for i := 0; i < AddressLength; i++ {
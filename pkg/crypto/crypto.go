@@ -2,8 +2,10 @@
 package crypto
 
 import (
+	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/sha512"
 	"errors"
 	"math/big"
@@ -133,6 +135,40 @@ func DeriveSharedSecretP256(privateKey []byte, peerPublicKey []byte) ([]byte, er
 	return hashedSecret, nil
 }
 
+// SignP256 使用P256私钥对消息进行ECDSA签名（SHA-256摘要，ASN.1编码）
+func SignP256(privateKey []byte, message []byte) ([]byte, error) {
+	curve := elliptic.P256()
+
+	// 从私钥标量恢复公钥点
+	d := new(big.Int).SetBytes(privateKey)
+	if d.Sign() == 0 || d.Cmp(curve.Params().N) >= 0 {
+		return nil, errors.New("invalid private key")
+	}
+	x, y := curve.ScalarBaseMult(privateKey)
+
+	priv := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{Curve: curve, X: x, Y: y},
+		D:         d,
+	}
+
+	digest := sha256.Sum256(message)
+	return ecdsa.SignASN1(rand.Reader, priv, digest[:])
+}
+
+// VerifyP256 使用压缩格式的P256公钥验证ECDSA签名
+func VerifyP256(publicKey []byte, message []byte, signature []byte) bool {
+	curve := elliptic.P256()
+
+	x, y := elliptic.UnmarshalCompressed(curve, publicKey)
+	if x == nil || y == nil {
+		return false
+	}
+
+	pub := &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	digest := sha256.Sum256(message)
+	return ecdsa.VerifyASN1(pub, digest[:], signature)
+}
+
 // Poly1305Authenticate 计算Poly1305 MAC
 func Poly1305Authenticate(message []byte, key []byte) ([]byte, error) {
 	if len(key) != 32 {
@@ -4,24 +4,167 @@ package identity
 import (
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"strconv"
 	"strings"
 
 	"github.com/stella/virtual-switch/pkg/address"
 	"github.com/stella/virtual-switch/pkg/crypto"
 )
 
+// IdentityType selects the key algorithm behind an identity
+type IdentityType uint8
+
+const (
+	// IdentityTypeC25519 uses Curve25519 keys (the default, ZeroTier-compatible)
+	IdentityTypeC25519 IdentityType = 0
+	// IdentityTypeP256 uses NIST P-256 keys with compressed public points
+	IdentityTypeP256 IdentityType = 1
+)
+
+const (
+	// c25519PublicKeySize is the size of a Curve25519 public key
+	c25519PublicKeySize = 32
+	// p256PublicKeySize is the size of a compressed P-256 public key
+	p256PublicKeySize = 33
+)
+
+// String returns the string representation of the identity type
+func (t IdentityType) String() string {
+	switch t {
+	case IdentityTypeC25519:
+		return "c25519"
+	case IdentityTypeP256:
+		return "p256"
+	default:
+		return "unknown(" + strconv.Itoa(int(t)) + ")"
+	}
+}
+
+// IsValid reports whether the identity type is supported
+func (t IdentityType) IsValid() bool {
+	return t == IdentityTypeC25519 || t == IdentityTypeP256
+}
+
+// PublicKeySize returns the expected public key length for the identity type
+func (t IdentityType) PublicKeySize() int {
+	switch t {
+	case IdentityTypeC25519:
+		return c25519PublicKeySize
+	case IdentityTypeP256:
+		return p256PublicKeySize
+	default:
+		return 0
+	}
+}
+
+// GenerateKeyPair generates a key pair of the identity type
+func (t IdentityType) GenerateKeyPair() (*crypto.KeyPair, error) {
+	switch t {
+	case IdentityTypeC25519:
+		return crypto.GenerateKeyPair()
+	case IdentityTypeP256:
+		return crypto.GenerateP256KeyPair()
+	default:
+		return nil, errors.New("unsupported identity type: " + t.String())
+	}
+}
+
+// DeriveSharedSecret performs key agreement for the identity type
+func (t IdentityType) DeriveSharedSecret(privateKey, peerPublicKey []byte) ([]byte, error) {
+	switch t {
+	case IdentityTypeC25519:
+		return crypto.DeriveSharedSecret(privateKey, peerPublicKey)
+	case IdentityTypeP256:
+		return crypto.DeriveSharedSecretP256(privateKey, peerPublicKey)
+	default:
+		return nil, errors.New("unsupported identity type: " + t.String())
+	}
+}
+
+// MarshalText encodes the identity type by name, e.g. for JSON identity files
+func (t IdentityType) MarshalText() ([]byte, error) {
+	if !t.IsValid() {
+		return nil, errors.New("unsupported identity type: " + t.String())
+	}
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText decodes an identity type from its name or numeric form
+func (t *IdentityType) UnmarshalText(text []byte) error {
+	parsed, err := ParseIdentityType(string(text))
+	if err != nil {
+		return err
+	}
+	*t = parsed
+	return nil
+}
+
+// ErrSigningUnsupported is returned when the identity type has no signature scheme
+var ErrSigningUnsupported = errors.New("identity type does not support signatures")
+
+// Sign signs a message with a private key of the identity type
+// Curve25519 keys are key-agreement only and cannot sign
+func (t IdentityType) Sign(privateKey, message []byte) ([]byte, error) {
+	switch t {
+	case IdentityTypeP256:
+		return crypto.SignP256(privateKey, message)
+	case IdentityTypeC25519:
+		return nil, ErrSigningUnsupported
+	default:
+		return nil, errors.New("unsupported identity type: " + t.String())
+	}
+}
+
+// Verify verifies a signature made with a key of the identity type
+func (t IdentityType) Verify(publicKey, message, signature []byte) bool {
+	switch t {
+	case IdentityTypeP256:
+		return crypto.VerifyP256(publicKey, message, signature)
+	default:
+		return false
+	}
+}
+
+// ParseIdentityType parses an identity type from its name or numeric form
+func ParseIdentityType(s string) (IdentityType, error) {
+	switch strings.ToLower(s) {
+	case "", "0", "c25519", "curve25519":
+		return IdentityTypeC25519, nil
+	case "1", "p256", "p-256":
+		return IdentityTypeP256, nil
+	default:
+		return 0, errors.New("unknown identity type: " + s)
+	}
+}
+
+// identityTypeForPublicKey infers the identity type from a public key length
+// Unknown lengths fall back to Curve25519, the historical default
+func identityTypeForPublicKey(publicKey []byte) IdentityType {
+	if len(publicKey) == p256PublicKeySize {
+		return IdentityTypeP256
+	}
+	return IdentityTypeC25519
+}
+
 // Identity represents the identity information of a Stella node
 type Identity struct {
+	Type       IdentityType     // Key algorithm of the identity
 	Address    *address.Address // Node address
 	PublicKey  []byte           // Public key
 	PrivateKey []byte           // Private key (optional, used only for local storage)
 }
 
-// NewIdentity generates a new identity
+// NewIdentity generates a new Curve25519 identity
 func NewIdentity() (*Identity, error) {
+	return NewIdentityWithType(IdentityTypeC25519)
+}
+
+// NewIdentityWithType generates a new identity of the given type
+func NewIdentityWithType(t IdentityType) (*Identity, error) {
 	// Generate key pair
-	keyPair, err := crypto.GenerateKeyPair()
+	keyPair, err := t.GenerateKeyPair()
 	if err != nil {
 		return nil, err
 	}
@@ -30,6 +173,7 @@ func NewIdentity() (*Identity, error) {
 	addr := address.NewAddressFromPublicKey(keyPair.Public)
 
 	return &Identity{
+		Type:       t,
 		Address:    addr,
 		PublicKey:  keyPair.Public,
 		PrivateKey: keyPair.Private,
@@ -37,26 +181,36 @@ func NewIdentity() (*Identity, error) {
 }
 
 // NewIdentityFromPublic creates an identity from a public key (without private key)
+// The identity type is inferred from the key length
 func NewIdentityFromPublic(publicKey []byte) (*Identity, error) {
+	return NewIdentityFromPublicWithType(identityTypeForPublicKey(publicKey), publicKey)
+}
+
+// NewIdentityFromPublicWithType creates an identity of the given type from a public key
+func NewIdentityFromPublicWithType(t IdentityType, publicKey []byte) (*Identity, error) {
 	if len(publicKey) == 0 {
 		return nil, errors.New("empty public key")
 	}
+	if !t.IsValid() {
+		return nil, errors.New("unsupported identity type: " + t.String())
+	}
 
 	// Derive address from public key
 	addr := address.NewAddressFromPublicKey(publicKey)
 
 	return &Identity{
+		Type:      t,
 		Address:   addr,
 		PublicKey: publicKey,
 	}, nil
 }
 
 // NewIdentityFromString creates an identity from a string representation
-// Format: <address>:<base64-encoded-public-key>:<base64-encoded-private-key>
-// Private key part is optional
+// Format: <address>[:<type>]:<base64-encoded-public-key>[:<base64-encoded-private-key>]
+// The type field is omitted for Curve25519 identities; private key part is optional
 func NewIdentityFromString(s string) (*Identity, error) {
 	parts := strings.Split(s, ":")
-	if len(parts) < 2 || len(parts) > 3 {
+	if len(parts) < 2 || len(parts) > 4 {
 		return nil, errors.New("invalid identity string format")
 	}
 
@@ -65,21 +219,38 @@ func NewIdentityFromString(s string) (*Identity, error) {
 	if err != nil {
 		return nil, err
 	}
+	parts = parts[1:]
+
+	// Parse the optional type field; base64 keys are never a bare number
+	idType := IdentityTypeC25519
+	if len(parts) >= 2 {
+		if n, err := strconv.ParseUint(parts[0], 10, 8); err == nil {
+			idType = IdentityType(n)
+			if !idType.IsValid() {
+				return nil, errors.New("unsupported identity type: " + idType.String())
+			}
+			parts = parts[1:]
+		}
+	}
+	if len(parts) > 2 {
+		return nil, errors.New("invalid identity string format")
+	}
 
 	// Parse public key
-	publicKey, err := base64.StdEncoding.DecodeString(parts[1])
+	publicKey, err := base64.StdEncoding.DecodeString(parts[0])
 	if err != nil {
 		return nil, err
 	}
 
 	identity := &Identity{
+		Type:      idType,
 		Address:   addr,
 		PublicKey: publicKey,
 	}
 
 	// Parse private key if provided
-	if len(parts) == 3 && parts[2] != "" {
-		privateKey, err := base64.StdEncoding.DecodeString(parts[2])
+	if len(parts) == 2 && parts[1] != "" {
+		privateKey, err := base64.StdEncoding.DecodeString(parts[1])
 		if err != nil {
 			return nil, err
 		}
@@ -91,24 +262,70 @@ func NewIdentityFromString(s string) (*Identity, error) {
 
 // Serialize serializes the identity to a string
 func (id *Identity) Serialize() string {
-	result := id.Address.String() + ":" + base64.StdEncoding.EncodeToString(id.PublicKey)
-	
+	result := id.Address.String()
+
+	// The type field is only written for non-default identity types so that
+	// Curve25519 identities keep their original format
+	if id.Type != IdentityTypeC25519 {
+		result += ":" + strconv.Itoa(int(id.Type))
+	}
+
+	result += ":" + base64.StdEncoding.EncodeToString(id.PublicKey)
+
 	// Include private key only if available
 	if len(id.PrivateKey) > 0 {
 		result += ":" + base64.StdEncoding.EncodeToString(id.PrivateKey)
 	}
-	
+
 	return result
 }
 
+// UnmarshalJSON decodes an identity file
+// Files written before addresses were encoded as text store the address as an
+// empty object and have no type; the type is then inferred from the key length
+// and the address is recomputed from the public key.
+func (id *Identity) UnmarshalJSON(data []byte) error {
+	var file struct {
+		Type       *IdentityType
+		Address    json.RawMessage
+		PublicKey  []byte
+		PrivateKey []byte
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+
+	id.Type = identityTypeForPublicKey(file.PublicKey)
+	if file.Type != nil {
+		id.Type = *file.Type
+	}
+	id.PublicKey = file.PublicKey
+	id.PrivateKey = file.PrivateKey
+
+	id.Address = nil
+	if len(file.Address) > 0 && file.Address[0] == '"' {
+		id.Address = &address.Address{}
+		if err := json.Unmarshal(file.Address, id.Address); err != nil {
+			return err
+		}
+	} else if len(file.PublicKey) > 0 {
+		id.Address = address.NewAddressFromPublicKey(file.PublicKey)
+	}
+	return nil
+}
+
 // HasPrivateKey checks if the identity contains a private key
 func (id *Identity) HasPrivateKey() bool {
 	return len(id.PrivateKey) > 0
 }
 
 // Validate validates the identity
-// Checks if the address matches the public key
+// Checks if the key length matches the type and the address matches the public key
 func (id *Identity) Validate() bool {
+	if !id.Type.IsValid() || len(id.PublicKey) != id.Type.PublicKeySize() {
+		return false
+	}
+
 	// Recalculate address from public key
 	computedAddr := address.NewAddressFromPublicKey(id.PublicKey)
 	
@@ -121,8 +338,33 @@ func (id *Identity) GetSharedSecret(other *Identity) ([]byte, error) {
 	if !id.HasPrivateKey() {
 		return nil, errors.New("identity has no private key")
 	}
-	
-	return crypto.DeriveSharedSecret(id.PrivateKey, other.PublicKey)
+	if other.Type != id.Type {
+		return nil, errors.New("identity type mismatch: " + id.Type.String() + " vs " + other.Type.String())
+	}
+
+	return id.Type.DeriveSharedSecret(id.PrivateKey, other.PublicKey)
+}
+
+// Sign signs a message with the identity's private key
+func (id *Identity) Sign(message []byte) ([]byte, error) {
+	if !id.HasPrivateKey() {
+		return nil, errors.New("identity has no private key")
+	}
+	return id.Type.Sign(id.PrivateKey, message)
+}
+
+// Verify checks a signature against the identity's public key
+func (id *Identity) Verify(message, signature []byte) bool {
+	return id.Type.Verify(id.PublicKey, message, signature)
+}
+
+// PublicOnly returns a copy of the identity without the private key
+func (id *Identity) PublicOnly() *Identity {
+	return &Identity{
+		Type:      id.Type,
+		Address:   id.Address,
+		PublicKey: id.PublicKey,
+	}
 }
 
 // String returns a string representation of the identity
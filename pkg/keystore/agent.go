@@ -0,0 +1,320 @@
+package keystore
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/stella/virtual-switch/pkg/identity"
+)
+
+// Agent request operations
+const (
+	agentOpIdentity uint8 = iota + 1
+	agentOpDeriveSharedSecret
+	agentOpSign
+)
+
+// Agent response status codes
+const (
+	agentStatusOK uint8 = iota
+	agentStatusError
+)
+
+// agentMaxMessageSize bounds agent messages to keep a misbehaving peer from exhausting memory
+const agentMaxMessageSize = 64 * 1024
+
+// agentCallTimeout bounds a single request so a stuck agent cannot block key operations
+const agentCallTimeout = 5 * time.Second
+
+// Agent wire format, for both requests and responses:
+// code(1 byte: operation or status) + length(4 bytes, big endian) + payload
+
+// writeAgentMessage writes a single framed agent message
+func writeAgentMessage(w io.Writer, code uint8, payload []byte) error {
+	header := make([]byte, 5)
+	header[0] = code
+	binary.BigEndian.PutUint32(header[1:5], uint32(len(payload)))
+	if _, err := w.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readAgentMessage reads a single framed agent message
+func readAgentMessage(r io.Reader) (uint8, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[1:5])
+	if length > agentMaxMessageSize {
+		return 0, nil, errors.New("agent message too large")
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// AgentServer exposes a KeyStore over a Unix socket, similar to ssh-agent
+// The private key never leaves the agent process; clients only get results
+type AgentServer struct {
+	store      KeyStore
+	mu         sync.Mutex
+	listener   net.Listener
+	socketPath string
+	conns      map[net.Conn]struct{}
+	wg         sync.WaitGroup
+}
+
+// NewAgentServer creates an agent server for the given key store
+func NewAgentServer(store KeyStore) *AgentServer {
+	return &AgentServer{
+		store: store,
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+// ListenAndServe listens on a Unix socket path and serves agent requests
+// A stale socket at the path is replaced; any other kind of file is left alone
+func (s *AgentServer) ListenAndServe(socketPath string) error {
+	if info, err := os.Lstat(socketPath); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return errors.New("agent: " + socketPath + " exists and is not a socket")
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	listener, err := listenPrivateSocket(socketPath)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.socketPath = socketPath
+	s.mu.Unlock()
+	return s.Serve(listener)
+}
+
+// listenPrivateSocket binds a Unix socket that only the owning user can reach
+// The socket is bound inside a fresh 0700 directory, restricted to 0600 and only then
+// moved to socketPath, so it is never reachable by other users, not even briefly
+func listenPrivateSocket(socketPath string) (*net.UnixListener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(socketPath), ".agent-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(dir)
+
+	boundPath := filepath.Join(dir, "agent.sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: boundPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The socket moves away from the path it was bound to; Close removes socketPath instead
+	listener.SetUnlinkOnClose(false)
+
+	if err := os.Chmod(boundPath, 0600); err != nil {
+		listener.Close()
+		os.Remove(boundPath)
+		return nil, err
+	}
+	if err := os.Rename(boundPath, socketPath); err != nil {
+		listener.Close()
+		os.Remove(boundPath)
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Serve accepts agent connections on the listener until Close is called
+func (s *AgentServer) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops the server and closes all client connections
+func (s *AgentServer) Close() error {
+	s.mu.Lock()
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	if s.socketPath != "" {
+		os.Remove(s.socketPath)
+		s.socketPath = ""
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// serveConn handles requests from a single client connection
+func (s *AgentServer) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		op, payload, err := readAgentMessage(conn)
+		if err != nil {
+			return
+		}
+
+		result, err := s.handleRequest(op, payload)
+		if err != nil {
+			err = writeAgentMessage(conn, agentStatusError, []byte(err.Error()))
+		} else {
+			err = writeAgentMessage(conn, agentStatusOK, result)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handleRequest dispatches a single agent request to the key store
+func (s *AgentServer) handleRequest(op uint8, payload []byte) ([]byte, error) {
+	switch op {
+	case agentOpIdentity:
+		id, err := s.store.Identity()
+		if err != nil {
+			return nil, err
+		}
+		return []byte(id.PublicOnly().Serialize()), nil
+	case agentOpDeriveSharedSecret:
+		return s.store.DeriveSharedSecret(payload)
+	case agentOpSign:
+		return s.store.Sign(payload)
+	default:
+		return nil, errors.New("unknown agent operation")
+	}
+}
+
+// AgentKeyStore is a KeyStore client that forwards key operations to an agent
+// After an I/O error the connection is dropped and the next call reconnects
+type AgentKeyStore struct {
+	mu         sync.Mutex
+	socketPath string
+	conn       net.Conn
+	closed     bool
+}
+
+// NewAgentKeyStore connects to an agent listening on a Unix socket
+func NewAgentKeyStore(socketPath string) (*AgentKeyStore, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	return &AgentKeyStore{socketPath: socketPath, conn: conn}, nil
+}
+
+// call sends a request and waits for the matching response
+func (ks *AgentKeyStore) call(op uint8, payload []byte) ([]byte, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.closed {
+		return nil, ErrClosed
+	}
+	if ks.conn == nil {
+		conn, err := net.Dial("unix", ks.socketPath)
+		if err != nil {
+			return nil, err
+		}
+		ks.conn = conn
+	}
+
+	status, result, err := ks.exchange(op, payload)
+	if err != nil {
+		// A timed out or partial exchange leaves the stream out of sync with the agent
+		ks.conn.Close()
+		ks.conn = nil
+		return nil, err
+	}
+	if status != agentStatusOK {
+		return nil, errors.New("agent: " + string(result))
+	}
+	return result, nil
+}
+
+// exchange writes one request and reads its response within agentCallTimeout
+// Must be called with ks.mu held
+func (ks *AgentKeyStore) exchange(op uint8, payload []byte) (uint8, []byte, error) {
+	if err := ks.conn.SetDeadline(time.Now().Add(agentCallTimeout)); err != nil {
+		return 0, nil, err
+	}
+	if err := writeAgentMessage(ks.conn, op, payload); err != nil {
+		return 0, nil, err
+	}
+	return readAgentMessage(ks.conn)
+}
+
+// Identity returns the public identity held by the agent
+func (ks *AgentKeyStore) Identity() (*identity.Identity, error) {
+	result, err := ks.call(agentOpIdentity, nil)
+	if err != nil {
+		return nil, err
+	}
+	return identity.NewIdentityFromString(string(result))
+}
+
+// DeriveSharedSecret asks the agent to perform key agreement with a peer public key
+func (ks *AgentKeyStore) DeriveSharedSecret(peerPublicKey []byte) ([]byte, error) {
+	return ks.call(agentOpDeriveSharedSecret, peerPublicKey)
+}
+
+// Sign asks the agent to sign a message
+func (ks *AgentKeyStore) Sign(message []byte) ([]byte, error) {
+	return ks.call(agentOpSign, message)
+}
+
+// Close closes the connection to the agent
+func (ks *AgentKeyStore) Close() error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	ks.closed = true
+	if ks.conn == nil {
+		return nil
+	}
+	err := ks.conn.Close()
+	ks.conn = nil
+	return err
+}
@@ -0,0 +1,47 @@
+package keystore
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+
+	"github.com/stella/virtual-switch/pkg/identity"
+)
+
+// FileKeyStore loads a private key from a JSON identity file
+// The file uses the same format the node writes to Config.IdentityFile
+type FileKeyStore struct {
+	*MemoryKeyStore
+	path string
+}
+
+// OpenFileKeyStore opens a key store backed by the identity file at path
+func OpenFileKeyStore(path string) (*FileKeyStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	id := &identity.Identity{}
+	if err := json.Unmarshal(data, id); err != nil {
+		return nil, err
+	}
+	if !id.HasPrivateKey() {
+		return nil, errors.New("identity file has no private key: " + path)
+	}
+	if !id.Validate() {
+		return nil, errors.New("identity file is invalid: " + path)
+	}
+
+	mem, err := NewMemoryKeyStore(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileKeyStore{MemoryKeyStore: mem, path: path}, nil
+}
+
+// Path returns the identity file backing the key store
+func (ks *FileKeyStore) Path() string {
+	return ks.path
+}
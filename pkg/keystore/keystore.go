@@ -0,0 +1,83 @@
+// Package keystore provides pluggable storage backends for Stella node private keys
+package keystore
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/stella/virtual-switch/pkg/identity"
+)
+
+// ErrClosed is returned when a key store is used after Close
+var ErrClosed = errors.New("key store is closed")
+
+// KeyStore holds a node's private key and performs key operations on behalf of the node
+// Callers only ever see the public identity; the private key stays inside the backend
+type KeyStore interface {
+	// Identity returns the public identity of the stored key (without the private key)
+	Identity() (*identity.Identity, error)
+
+	// DeriveSharedSecret performs key agreement with a peer public key
+	DeriveSharedSecret(peerPublicKey []byte) ([]byte, error)
+
+	// Sign signs a message with the stored private key
+	Sign(message []byte) ([]byte, error)
+
+	// Close releases any resources held by the key store
+	Close() error
+}
+
+// MemoryKeyStore keeps an identity in process memory
+// It is mainly intended for tests and for serving keys through an agent
+type MemoryKeyStore struct {
+	id     *identity.Identity
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewMemoryKeyStore creates an in-memory key store for an identity with a private key
+func NewMemoryKeyStore(id *identity.Identity) (*MemoryKeyStore, error) {
+	if id == nil || !id.HasPrivateKey() {
+		return nil, errors.New("identity must include a private key")
+	}
+	return &MemoryKeyStore{id: id}, nil
+}
+
+// Identity returns the public identity of the stored key
+func (ks *MemoryKeyStore) Identity() (*identity.Identity, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	if ks.closed {
+		return nil, ErrClosed
+	}
+	return ks.id.PublicOnly(), nil
+}
+
+// DeriveSharedSecret performs key agreement with a peer public key
+func (ks *MemoryKeyStore) DeriveSharedSecret(peerPublicKey []byte) ([]byte, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	if ks.closed {
+		return nil, ErrClosed
+	}
+	return ks.id.Type.DeriveSharedSecret(ks.id.PrivateKey, peerPublicKey)
+}
+
+// Sign signs a message with the stored private key
+func (ks *MemoryKeyStore) Sign(message []byte) ([]byte, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	if ks.closed {
+		return nil, ErrClosed
+	}
+	return ks.id.Sign(message)
+}
+
+// Close drops the reference to the private key
+func (ks *MemoryKeyStore) Close() error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.closed = true
+	ks.id = nil
+	return nil
+}
@@ -1,13 +1,28 @@
 package node
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/stella/virtual-switch/pkg/identity"
+	"github.com/stella/virtual-switch/pkg/keystore"
+	"github.com/stella/virtual-switch/pkg/portmap"
+)
+
+// Key store backends selectable through Config.KeyStore
+const (
+	// KeyStoreFile reads the private key from IdentityFile
+	KeyStoreFile = "file"
+	// KeyStoreAgent forwards key operations to an agent listening on AgentSocket
+	KeyStoreAgent = "agent"
 )
 
 // Config represents the configuration for a Stella node
@@ -24,12 +39,31 @@ type Config struct {
 	// IdentityFile is the path to the identity file
 	IdentityFile string `json:"identity_file"`
 
+	// IdentityType selects the key type of a newly generated identity ("c25519" or "p256")
+	// Empty keeps the Curve25519 default; an existing identity file keeps its own type
+	IdentityType string `json:"identity_type,omitempty"`
+
+	// KeyStore selects the private key backend ("file" or "agent")
+	KeyStore string `json:"key_store"`
+
+	// AgentSocket is the Unix socket of the key agent when KeyStore is "agent"
+	AgentSocket string `json:"agent_socket"`
+
 	// LogLevel determines the verbosity of logging
 	LogLevel string `json:"log_level"`
 
 	// BindAddr is the address the node listens on
+	// An empty host (the default ":9993") listens on all IPv4 and IPv6 interfaces
 	BindAddr string `json:"bind_addr"`
 
+	// BindAddrs restricts listening to these local addresses (IP or IP:port)
+	// Entries without a port use the port from BindAddr
+	BindAddrs []string `json:"bind_addrs,omitempty"`
+
+	// PortMapping asks the home router to forward the UDP listen port with PCP, NAT-PMP or UPnP-IGD
+	// It is off by default because it changes the router configuration
+	PortMapping bool `json:"port_mapping"`
+
 	// ControllerURL is the URL of the controller if using one
 	ControllerURL string `json:"controller_url"`
 
@@ -53,10 +87,12 @@ func DefaultConfig() *Config {
 		DataDir:       dataDir,
 		ConfigFile:    configFile,
 		IdentityFile:  identityFile,
+		KeyStore:      KeyStoreFile,
 		LogLevel:      "info",
 		BindAddr:      ":9993",
 		ControllerURL: "",
 		AutoStart:     false,
+		PortMapping:   false,
 	}
 }
 
@@ -119,8 +155,8 @@ func (c *Config) Save() error {
 func (c *Config) LoadIdentity() (*identity.Identity, error) {
 	// Check if the identity file exists
 	if _, err := os.Stat(c.IdentityFile); os.IsNotExist(err) {
-		// Create a new identity if the file doesn't exist
-		identity, err := identity.NewIdentity()
+		// Create a new identity of the configured type if the file doesn't exist
+		identity, err := c.NewIdentity()
 		if err != nil {
 			return nil, err
 		}
@@ -150,6 +186,15 @@ func (c *Config) LoadIdentity() (*identity.Identity, error) {
 	return identity, nil
 }
 
+// NewIdentity generates a new identity of the configured IdentityType
+func (c *Config) NewIdentity() (*identity.Identity, error) {
+	identityType, err := identity.ParseIdentityType(c.IdentityType)
+	if err != nil {
+		return nil, err
+	}
+	return identity.NewIdentityWithType(identityType)
+}
+
 // SaveIdentity saves the node identity to the configured identity file
 func (c *Config) SaveIdentity(identity *identity.Identity) error {
 	// Ensure the directory exists
@@ -167,3 +212,98 @@ func (c *Config) SaveIdentity(identity *identity.Identity) error {
 	// Write to file with restrictive permissions
 	return ioutil.WriteFile(c.IdentityFile, data, 0600)
 }
+
+// OpenKeyStore opens the configured private key backend
+// The file backend creates the identity file first if it does not exist yet
+func (c *Config) OpenKeyStore() (keystore.KeyStore, error) {
+	switch c.KeyStore {
+	case "", KeyStoreFile:
+		if _, err := c.LoadIdentity(); err != nil {
+			return nil, err
+		}
+		return keystore.OpenFileKeyStore(c.IdentityFile)
+	case KeyStoreAgent:
+		if c.AgentSocket == "" {
+			return nil, errors.New("agent key store requires agent_socket")
+		}
+		return keystore.NewAgentKeyStore(c.AgentSocket)
+	default:
+		return nil, errors.New("unknown key store: " + c.KeyStore)
+	}
+}
+
+// ListenAddrs returns every host:port the node's transport binds
+// A host in BindAddr is bound alongside BindAddrs; an empty host with no BindAddrs means all interfaces
+func (c *Config) ListenAddrs() ([]string, error) {
+	host, port, err := net.SplitHostPort(c.BindAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bind_addr %q: %w", c.BindAddr, err)
+	}
+
+	var addrs []string
+	if host != "" || len(c.BindAddrs) == 0 {
+		addrs = append(addrs, net.JoinHostPort(host, port))
+	}
+
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		seen[addr] = true
+	}
+	for _, extra := range c.BindAddrs {
+		addr := extra
+		if extraHost, _, err := net.SplitHostPort(extra); err == nil {
+			if net.ParseIP(extraHost) == nil {
+				return nil, fmt.Errorf("invalid bind_addrs entry %q: host must be an IP address", extra)
+			}
+		} else {
+			ip := net.ParseIP(strings.Trim(extra, "[]"))
+			if ip == nil {
+				return nil, fmt.Errorf("invalid bind_addrs entry %q", extra)
+			}
+			addr = net.JoinHostPort(ip.String(), port)
+		}
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs, nil
+}
+
+// TransportConfig returns the UDP transport configuration for the configured listen addresses and key type
+func (c *Config) TransportConfig() (map[string]interface{}, error) {
+	addrs, err := c.ListenAddrs()
+	if err != nil {
+		return nil, err
+	}
+	transportConfig := map[string]interface{}{"bindAddrs": addrs}
+	if c.IdentityType != "" {
+		transportConfig["identityType"] = c.IdentityType
+	}
+	return transportConfig, nil
+}
+
+// NewPortMapper returns a mapper for the UDP listen port using the gateways found on the network
+// It returns nil if PortMapping is disabled. Discovery of UPnP gateways lasts until ctx is done,
+// or two seconds without a deadline.
+func (c *Config) NewPortMapper(ctx context.Context) (*portmap.Mapper, error) {
+	if !c.PortMapping {
+		return nil, nil
+	}
+
+	_, portStr, err := net.SplitHostPort(c.BindAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bind address %q: %w", c.BindAddr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("port mapping needs a fixed listen port, got %q", c.BindAddr)
+	}
+
+	clients := portmap.DefaultClients(ctx)
+	if len(clients) == 0 {
+		return nil, errors.New("no port mapping gateway found")
+	}
+	return portmap.NewMapper(port, clients...), nil
+}
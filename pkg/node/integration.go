@@ -5,7 +5,7 @@ import (
 	"os"
 	"path/filepath"
 
-	"github.com/stella/virtual-switch/pkg/identity"
+	"github.com/stella/virtual-switch/pkg/keystore"
 )
 
 // IntegratedNode represents a fully integrated node with all components connected
@@ -42,42 +42,39 @@ func CreateAndInitNode(configFile string) (*Node, *Config, error) {
 		return nil, nil, err
 	}
 
-	// Load existing identity or create a new one
-	var id *identity.Identity
-
-	// Try to load existing identity
-	if config.IdentityFile != "" {
-		id, err = config.LoadIdentity()
+	// Key operations go through a key store; the node itself only keeps the public identity
+	var ks keystore.KeyStore
+	if config.KeyStore == KeyStoreAgent || config.IdentityFile != "" {
+		// The file backend creates the identity file on first start
+		ks, err = config.OpenKeyStore()
 		if err != nil {
-			// If identity doesn't exist, create a new one
-			if os.IsNotExist(err) {
-				id, err = identity.NewIdentity()
-				if err != nil {
-					return nil, nil, err
-				}
-
-				// Save the new identity
-				err = config.SaveIdentity(id)
-				if err != nil {
-					return nil, nil, err
-				}
-			} else {
-				return nil, nil, err
-			}
+			return nil, nil, err
 		}
 	} else {
-		// Create a new identity if no identity file is specified
-		id, err = identity.NewIdentity()
+		// Without an identity file the key only lives in memory for this run
+		newId, err := config.NewIdentity()
 		if err != nil {
 			return nil, nil, err
 		}
+		ks, err = keystore.NewMemoryKeyStore(newId)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	id, err := ks.Identity()
+	if err != nil {
+		ks.Close()
+		return nil, nil, err
 	}
 
 	// Create node with the identity
 	n, err := NewNode(config.NodeID, id)
 	if err != nil {
+		ks.Close()
 		return nil, nil, err
 	}
+	n.KeyStore = ks
 
 	// Save the configuration if it's new
 	if !fileExists(configFile) {
@@ -123,7 +120,12 @@ func ShutdownNode(n *Node, config *Config) error {
 	if err != nil {
 		// Log error but continue with shutdown
 		logger := NewLogger(n.ID, config.LogLevel)
-		logger.Error("Failed to save configuration: " + err.Error())
+		logger.Error("Failed to save configuration: %v", err)
+	}
+
+	// Release the key store connection, if any
+	if n.KeyStore != nil {
+		n.KeyStore.Close()
 	}
 
 	// Stop the node
@@ -164,5 +166,30 @@ func GetNodeStatus(n *Node) map[string]interface{} {
 		}
 	}
 
+	if report := n.GetNATReport(); report != nil {
+		endpoints := make([]string, len(report.ExternalEndpoints))
+		for i, endpoint := range report.ExternalEndpoints {
+			endpoints[i] = endpoint.String()
+		}
+		status["nat"] = map[string]interface{}{
+			"type":              report.Type.String(),
+			"externalEndpoints": endpoints,
+			"detectedAt":        report.DetectedAt,
+		}
+	}
+
+	if mapping := n.GetPortMapping(); mapping != nil {
+		external := ""
+		if addr := mapping.ExternalAddr(); addr != nil {
+			external = addr.String()
+		}
+		status["portMapping"] = map[string]interface{}{
+			"protocol":         mapping.Protocol,
+			"internalPort":     mapping.InternalPort,
+			"externalEndpoint": external,
+			"expires":          mapping.Expiry(),
+		}
+	}
+
 	return status
 }
@@ -86,6 +86,11 @@ func (n *Node) Stop() error {
 	// Simulate cleanup tasks
 	logger.Debug("Cleaning up node resources...")
 
+	// Remove the router port mapping, if any
+	if err := n.StopPortMapping(); err != nil {
+		logger.Warn("Failed to remove port mapping: %v", err)
+	}
+
 	// Add a small delay to simulate cleanup
 	time.Sleep(100 * time.Millisecond)
 
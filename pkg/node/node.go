@@ -3,9 +3,14 @@ package node
 import (
 	"errors"
 	"fmt"
+	"net"
 	"sync"
+	"time"
 
 	"github.com/stella/virtual-switch/pkg/identity"
+	"github.com/stella/virtual-switch/pkg/keystore"
+	"github.com/stella/virtual-switch/pkg/portmap"
+	"github.com/stella/virtual-switch/pkg/transport"
 )
 
 // NodeState represents the current state of a node
@@ -50,6 +55,9 @@ type Node struct {
 	// Identity contains the node's cryptographic identity
 	Identity *identity.Identity
 
+	// KeyStore performs private key operations when the identity is public-only
+	KeyStore keystore.KeyStore
+
 	// State represents the current state of the node
 	State NodeState
 
@@ -61,6 +69,12 @@ type Node struct {
 
 	// err holds the last error encountered by the node
 	err error
+
+	// natReport holds the result of the last NAT detection
+	natReport *transport.NATReport
+
+	// portMapper keeps the listen port mapped on the home router, if started
+	portMapper *portmap.Mapper
 }
 
 // NewNode creates a new Stella node with the given identity
@@ -120,3 +134,85 @@ func (n *Node) IsRunning() bool {
 func (n *Node) IsStopped() bool {
 	return n.GetState() == NodeStateStopped
 }
+
+// GetNATReport returns the result of the last NAT detection, or nil if none has run
+func (n *Node) GetNATReport() *transport.NATReport {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.natReport
+}
+
+// SetNATReport records a NAT detection result for the node status
+func (n *Node) SetNATReport(report *transport.NATReport) {
+	n.mu.Lock()
+	n.natReport = report
+	n.mu.Unlock()
+}
+
+// DetectNAT classifies the node's NAT using reflection or STUN servers and records the result
+func (n *Node) DetectNAT(reflector transport.EndpointReflector, servers []net.Addr, localAddrs []net.Addr, timeout time.Duration) (*transport.NATReport, error) {
+	report, err := transport.DetectNAT(reflector, servers, localAddrs, timeout)
+	if err != nil {
+		return nil, err
+	}
+	n.SetNATReport(report)
+	return report, nil
+}
+
+// StartPortMapping starts keeping the listen port mapped on the home router
+// advertise, if not nil, is called with the mapped endpoint whenever it changes and with
+// nil when it is lost; pass RendezvousManager.SetAdvertisedEndpoint to announce it to peers.
+// The mapper keeps retrying in the background if the first attempt fails; failures to
+// advertise are logged.
+func (n *Node) StartPortMapping(mapper *portmap.Mapper, advertise func(net.Addr) error) error {
+	if mapper == nil {
+		return errors.New("port mapper cannot be nil")
+	}
+
+	n.mu.Lock()
+	if n.portMapper != nil {
+		n.mu.Unlock()
+		return errors.New("port mapping is already running")
+	}
+	n.portMapper = mapper
+	n.mu.Unlock()
+
+	if advertise != nil {
+		logger := NewLogger(n.ID, "info")
+		mapper.AddListener(func(mapping *portmap.Mapping) {
+			var endpoint net.Addr
+			if mapping != nil {
+				endpoint = mapping.ExternalAddr()
+			}
+			if err := advertise(endpoint); err != nil {
+				logger.Warn("Failed to advertise mapped endpoint %v: %v", endpoint, err)
+			}
+		})
+	}
+	return mapper.Start()
+}
+
+// StopPortMapping stops renewing the port mapping and removes it from the router
+func (n *Node) StopPortMapping() error {
+	n.mu.Lock()
+	mapper := n.portMapper
+	n.portMapper = nil
+	n.mu.Unlock()
+
+	if mapper == nil {
+		return nil
+	}
+	return mapper.Stop()
+}
+
+// GetPortMapping returns the port mapping currently held on the router, or nil
+func (n *Node) GetPortMapping() *portmap.Mapping {
+	n.mu.RLock()
+	mapper := n.portMapper
+	n.mu.RUnlock()
+
+	if mapper == nil {
+		return nil
+	}
+	return mapper.Mapping()
+}
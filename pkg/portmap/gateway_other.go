@@ -0,0 +1,13 @@
+//go:build !linux
+
+package portmap
+
+import (
+	"errors"
+	"net"
+)
+
+// DefaultGateway is not implemented on this platform; use UPnP discovery or set the gateway explicitly
+func DefaultGateway() (net.IP, error) {
+	return nil, errors.New("default gateway lookup is not supported on this platform")
+}
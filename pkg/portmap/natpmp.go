@@ -0,0 +1,119 @@
+package portmap
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// NAT-PMP constants (RFC 6886)
+const (
+	// NATPMPPort is the UDP port gateways listen on for NAT-PMP and PCP
+	NATPMPPort = 5351
+
+	natpmpVersion        = 0
+	natpmpOpExternalAddr = 0
+	natpmpOpMapUDP       = 1
+	natpmpOpReply        = 128
+)
+
+// natpmpResultText describes the NAT-PMP result codes
+var natpmpResultText = map[uint16]string{
+	1: "unsupported version",
+	2: "not authorized",
+	3: "network failure",
+	4: "out of resources",
+	5: "unsupported opcode",
+}
+
+// NATPMPClient maps ports with NAT-PMP, the protocol of older Apple and many home routers
+type NATPMPClient struct {
+	gateway *net.UDPAddr
+}
+
+// NewNATPMPClient creates a NAT-PMP client for gateway; port 0 means NATPMPPort
+func NewNATPMPClient(gateway *net.UDPAddr) *NATPMPClient {
+	addr := *gateway
+	if addr.Port == 0 {
+		addr.Port = NATPMPPort
+	}
+	return &NATPMPClient{gateway: &addr}
+}
+
+// Name returns "nat-pmp"
+func (c *NATPMPClient) Name() string {
+	return "nat-pmp"
+}
+
+// ExternalIP asks the gateway for its public address
+func (c *NATPMPClient) ExternalIP(ctx context.Context) (net.IP, error) {
+	reply, err := c.request(ctx, []byte{natpmpVersion, natpmpOpExternalAddr}, natpmpOpExternalAddr, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IPv4(reply[8], reply[9], reply[10], reply[11]), nil
+}
+
+// AddMapping requests a UDP mapping for internalPort
+func (c *NATPMPClient) AddMapping(ctx context.Context, internalPort, externalPort int, lifetime time.Duration) (*Mapping, error) {
+	// Ask for the address first, so a gateway that rejects us holds no mapping
+	externalIP, err := c.ExternalIP(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := c.request(ctx, natpmpMapRequest(internalPort, externalPort, lifetime), natpmpOpMapUDP, 16)
+	if err != nil {
+		return nil, err
+	}
+	if int(binary.BigEndian.Uint16(reply[8:10])) != internalPort {
+		return nil, fmt.Errorf("nat-pmp reply for internal port %d, expected %d", binary.BigEndian.Uint16(reply[8:10]), internalPort)
+	}
+
+	return &Mapping{
+		Protocol:     c.Name(),
+		InternalPort: internalPort,
+		ExternalIP:   externalIP,
+		ExternalPort: int(binary.BigEndian.Uint16(reply[10:12])),
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(reply[12:16])) * time.Second,
+		CreatedAt:    time.Now(),
+	}, nil
+}
+
+// DeleteMapping removes the mapping by requesting it again with a zero lifetime
+func (c *NATPMPClient) DeleteMapping(ctx context.Context, mapping *Mapping) error {
+	_, err := c.request(ctx, natpmpMapRequest(mapping.InternalPort, 0, 0), natpmpOpMapUDP, 16)
+	return err
+}
+
+// request sends a NAT-PMP request and checks the reply's opcode, length and result code
+func (c *NATPMPClient) request(ctx context.Context, request []byte, op byte, size int) ([]byte, error) {
+	reply, _, err := exchange(ctx, c.gateway, request, func(reply []byte) bool {
+		return len(reply) >= 4 && reply[0] == natpmpVersion && reply[1] == natpmpOpReply+op
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result := binary.BigEndian.Uint16(reply[2:4]); result != 0 {
+		text, known := natpmpResultText[result]
+		if !known {
+			text = fmt.Sprintf("result code %d", result)
+		}
+		return nil, fmt.Errorf("nat-pmp gateway refused request: %s", text)
+	}
+	if len(reply) < size {
+		return nil, fmt.Errorf("nat-pmp reply too short: %d bytes", len(reply))
+	}
+	return reply, nil
+}
+
+// natpmpMapRequest encodes a UDP mapping request
+func natpmpMapRequest(internalPort, externalPort int, lifetime time.Duration) []byte {
+	request := []byte{natpmpVersion, natpmpOpMapUDP, 0, 0}
+	request = binary.BigEndian.AppendUint16(request, uint16(internalPort))
+	request = binary.BigEndian.AppendUint16(request, uint16(externalPort))
+	return binary.BigEndian.AppendUint32(request, uint32(lifetime/time.Second))
+}
@@ -0,0 +1,167 @@
+package portmap
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// PCP constants (RFC 6887)
+const (
+	// PCPPort is the UDP port gateways listen on for PCP, shared with NAT-PMP
+	PCPPort = NATPMPPort
+
+	pcpVersion      = 2
+	pcpOpMap        = 1
+	pcpResponseFlag = 0x80
+	pcpHeaderSize   = 24
+	pcpMapSize      = 36
+	pcpNonceSize    = 12
+	pcpProtocolUDP  = 17
+)
+
+// pcpResultText describes the PCP result codes
+var pcpResultText = map[byte]string{
+	1:  "unsupported version",
+	2:  "not authorized",
+	3:  "malformed request",
+	4:  "unsupported opcode",
+	5:  "unsupported option",
+	6:  "malformed option",
+	7:  "network failure",
+	8:  "no resources",
+	9:  "unsupported protocol",
+	10: "user exceeded quota",
+	11: "cannot provide external",
+	12: "address mismatch",
+	13: "excessive remote peers",
+}
+
+// PCPClient maps ports with the Port Control Protocol, NAT-PMP's successor
+// Gateways that only speak NAT-PMP answer with "unsupported version", so the
+// mapper falls back to NATPMPClient.
+type PCPClient struct {
+	gateway *net.UDPAddr
+
+	// nonce identifies this client's mappings to the gateway across renewals
+	nonce [pcpNonceSize]byte
+}
+
+// NewPCPClient creates a PCP client for gateway; port 0 means PCPPort
+func NewPCPClient(gateway *net.UDPAddr) *PCPClient {
+	addr := *gateway
+	if addr.Port == 0 {
+		addr.Port = PCPPort
+	}
+	c := &PCPClient{gateway: &addr}
+	rand.Read(c.nonce[:])
+	return c
+}
+
+// Name returns "pcp"
+func (c *PCPClient) Name() string {
+	return "pcp"
+}
+
+// AddMapping sends a MAP request for internalPort
+func (c *PCPClient) AddMapping(ctx context.Context, internalPort, externalPort int, lifetime time.Duration) (*Mapping, error) {
+	reply, err := c.mapRequest(ctx, internalPort, externalPort, lifetime)
+	if err != nil {
+		return nil, err
+	}
+
+	body := reply[pcpHeaderSize:]
+	externalIP := make(net.IP, net.IPv6len)
+	copy(externalIP, body[20:36])
+	if ip4 := externalIP.To4(); ip4 != nil {
+		externalIP = ip4
+	}
+	return &Mapping{
+		Protocol:     c.Name(),
+		InternalPort: internalPort,
+		ExternalIP:   externalIP,
+		ExternalPort: int(binary.BigEndian.Uint16(body[18:20])),
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(reply[4:8])) * time.Second,
+		CreatedAt:    time.Now(),
+	}, nil
+}
+
+// DeleteMapping removes the mapping with a zero-lifetime MAP request
+func (c *PCPClient) DeleteMapping(ctx context.Context, mapping *Mapping) error {
+	_, err := c.mapRequest(ctx, mapping.InternalPort, 0, 0)
+	return err
+}
+
+// mapRequest sends a MAP request and returns the matching successful response
+func (c *PCPClient) mapRequest(ctx context.Context, internalPort, externalPort int, lifetime time.Duration) ([]byte, error) {
+	// The request carries our own address, which the gateway checks against the source
+	clientIP, err := localAddrFor(c.gateway)
+	if err != nil {
+		return nil, err
+	}
+	request := pcpMapRequest(c.nonce, clientIP, internalPort, externalPort, lifetime)
+
+	reply, _, err := exchange(ctx, c.gateway, request, func(reply []byte) bool {
+		if len(reply) < 4 {
+			return false
+		}
+		// Gateways that only speak NAT-PMP answer with a NAT-PMP "unsupported version" reply
+		if reply[0] != pcpVersion {
+			return reply[0] == natpmpVersion && reply[3] == 1
+		}
+		if reply[1] != pcpResponseFlag|pcpOpMap {
+			return false
+		}
+		// Error responses need not echo the MAP body
+		if reply[3] != 0 {
+			return true
+		}
+		return len(reply) >= pcpHeaderSize+pcpMapSize &&
+			bytes.Equal(reply[pcpHeaderSize:pcpHeaderSize+pcpNonceSize], c.nonce[:])
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result := reply[3]; result != 0 {
+		text, known := pcpResultText[result]
+		if !known {
+			text = fmt.Sprintf("result code %d", result)
+		}
+		return nil, fmt.Errorf("pcp gateway refused request: %s", text)
+	}
+	if int(binary.BigEndian.Uint16(reply[pcpHeaderSize+16:pcpHeaderSize+18])) != internalPort {
+		return nil, fmt.Errorf("pcp reply for another internal port")
+	}
+	return reply, nil
+}
+
+// pcpMapRequest encodes a MAP request for UDP
+func pcpMapRequest(nonce [pcpNonceSize]byte, clientIP net.IP, internalPort, externalPort int, lifetime time.Duration) []byte {
+	request := make([]byte, pcpHeaderSize, pcpHeaderSize+pcpMapSize)
+	request[0] = pcpVersion
+	request[1] = pcpOpMap
+	binary.BigEndian.PutUint32(request[4:8], uint32(lifetime/time.Second))
+	copy(request[8:24], clientIP.To16())
+
+	request = append(request, nonce[:]...)
+	request = append(request, pcpProtocolUDP, 0, 0, 0)
+	request = binary.BigEndian.AppendUint16(request, uint16(internalPort))
+	request = binary.BigEndian.AppendUint16(request, uint16(externalPort))
+	// Suggest the IPv4 wildcard, ::ffff:0.0.0.0, as the external address
+	return append(request, net.IPv4zero.To16()...)
+}
+
+// localAddrFor returns the local IP used to reach addr
+func localAddrFor(addr *net.UDPAddr) (net.IP, error) {
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
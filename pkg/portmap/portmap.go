@@ -0,0 +1,395 @@
+package portmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Mapper timing defaults
+const (
+	// DefaultLifetime is the lease requested from the gateway, as RFC 6886 recommends
+	DefaultLifetime = 2 * time.Hour
+	// DefaultRetryInterval is how long the mapper waits after every client failed
+	DefaultRetryInterval = 5 * time.Minute
+	// DefaultRequestTimeout bounds each request to a gateway
+	DefaultRequestTimeout = 5 * time.Second
+
+	// minRenewInterval keeps very short leases from turning into a busy loop
+	minRenewInterval = time.Second
+)
+
+// ErrNoClients is returned when a mapper has no protocol clients to try
+var ErrNoClients = errors.New("no port mapping clients configured")
+
+// Mapping is a UDP port mapping held on the gateway
+type Mapping struct {
+	// Protocol is the name of the client that created the mapping
+	Protocol string
+	// InternalPort is the local UDP port the mapping forwards to
+	InternalPort int
+	// ExternalIP is the gateway's public address; it may be nil if the gateway did not report it
+	ExternalIP net.IP
+	// ExternalPort is the public port assigned by the gateway
+	ExternalPort int
+	// Lifetime is the lease granted by the gateway; 0 means the mapping does not expire
+	Lifetime time.Duration
+	// CreatedAt is when the lease was granted or last renewed
+	CreatedAt time.Time
+}
+
+// ExternalAddr returns the mapped endpoint peers should send to, or nil without an external IP
+func (m *Mapping) ExternalAddr() net.Addr {
+	if m.ExternalIP == nil || m.ExternalIP.IsUnspecified() {
+		return nil
+	}
+	return &net.UDPAddr{IP: m.ExternalIP, Port: m.ExternalPort}
+}
+
+// Expiry returns when the lease runs out, or the zero time for permanent mappings
+func (m *Mapping) Expiry() time.Time {
+	if m.Lifetime <= 0 {
+		return time.Time{}
+	}
+	return m.CreatedAt.Add(m.Lifetime)
+}
+
+// String returns a readable description of the mapping
+func (m *Mapping) String() string {
+	external := "?:" + strconv.Itoa(m.ExternalPort)
+	if addr := m.ExternalAddr(); addr != nil {
+		external = addr.String()
+	}
+	return fmt.Sprintf("%s udp %d -> %s", m.Protocol, m.InternalPort, external)
+}
+
+// Client speaks one port mapping protocol to a gateway
+type Client interface {
+	// Name returns the protocol name, e.g. "pcp"
+	Name() string
+
+	// AddMapping requests a UDP mapping for internalPort
+	// externalPort is a hint that may be ignored; 0 lets the gateway choose.
+	// Requesting an existing mapping again renews its lease.
+	AddMapping(ctx context.Context, internalPort, externalPort int, lifetime time.Duration) (*Mapping, error)
+
+	// DeleteMapping removes a mapping created by AddMapping
+	DeleteMapping(ctx context.Context, mapping *Mapping) error
+}
+
+// Listener is called whenever the mapped endpoint changes
+// It receives nil when the mapping is lost and could not be replaced.
+type Listener func(mapping *Mapping)
+
+// Mapper keeps a UDP port mapped on the gateway with the first client that succeeds
+// Leases are renewed halfway through their lifetime. When the active client fails,
+// the remaining clients are tried in order; when all fail the mapper retries later.
+type Mapper struct {
+	internalPort int
+	clients      []Client
+
+	mu             sync.Mutex
+	lifetime       time.Duration
+	retryInterval  time.Duration
+	requestTimeout time.Duration
+	listeners      []Listener
+
+	active  Client
+	mapping *Mapping
+	err     error
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+	running bool
+}
+
+// NewMapper creates a mapper for internalPort trying clients in the given order
+func NewMapper(internalPort int, clients ...Client) *Mapper {
+	return &Mapper{
+		internalPort:   internalPort,
+		clients:        clients,
+		lifetime:       DefaultLifetime,
+		retryInterval:  DefaultRetryInterval,
+		requestTimeout: DefaultRequestTimeout,
+	}
+}
+
+// SetLifetime sets the lease requested from the gateway
+func (m *Mapper) SetLifetime(lifetime time.Duration) error {
+	if lifetime <= 0 {
+		return errors.New("mapping lifetime must be positive")
+	}
+	m.mu.Lock()
+	m.lifetime = lifetime
+	m.mu.Unlock()
+	return nil
+}
+
+// SetRetryInterval sets how long the mapper waits after every client failed
+func (m *Mapper) SetRetryInterval(interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("retry interval must be positive")
+	}
+	m.mu.Lock()
+	m.retryInterval = interval
+	m.mu.Unlock()
+	return nil
+}
+
+// SetRequestTimeout bounds each request to a gateway
+func (m *Mapper) SetRequestTimeout(timeout time.Duration) error {
+	if timeout <= 0 {
+		return errors.New("request timeout must be positive")
+	}
+	m.mu.Lock()
+	m.requestTimeout = timeout
+	m.mu.Unlock()
+	return nil
+}
+
+// AddListener registers a function called when the mapped endpoint changes
+func (m *Mapper) AddListener(listener Listener) {
+	m.mu.Lock()
+	m.listeners = append(m.listeners, listener)
+	m.mu.Unlock()
+}
+
+// Mapping returns the current mapping, or nil if none is held
+func (m *Mapper) Mapping() *Mapping {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mapping
+}
+
+// Err returns why the last mapping attempt failed, or nil if it succeeded
+func (m *Mapper) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// Start makes the first mapping attempt and keeps the mapping alive in the background
+// The returned error describes a failed first attempt; the mapper keeps retrying anyway.
+func (m *Mapper) Start() error {
+	m.mu.Lock()
+	if m.running {
+		m.mu.Unlock()
+		return errors.New("mapper is already running")
+	}
+	if len(m.clients) == 0 {
+		m.mu.Unlock()
+		return ErrNoClients
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	m.done = make(chan struct{})
+	m.running = true
+	m.mu.Unlock()
+
+	err := m.refresh()
+	go m.run()
+	return err
+}
+
+// Stop ends renewal and deletes the mapping from the gateway
+func (m *Mapper) Stop() error {
+	m.mu.Lock()
+	if !m.running {
+		m.mu.Unlock()
+		return errors.New("mapper is not running")
+	}
+	m.running = false
+	m.cancel()
+	done := m.done
+	m.mu.Unlock()
+	<-done
+
+	m.mu.Lock()
+	client, mapping, timeout := m.active, m.mapping, m.requestTimeout
+	m.active, m.mapping = nil, nil
+	m.mu.Unlock()
+	if mapping == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := client.DeleteMapping(ctx, mapping)
+	m.notify(nil)
+	return err
+}
+
+// run renews the mapping until the mapper stops
+func (m *Mapper) run() {
+	defer close(m.done)
+
+	timer := time.NewTimer(m.nextRefresh())
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			m.refresh()
+			timer.Reset(m.nextRefresh())
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// nextRefresh returns how long to wait before the next renewal or retry
+func (m *Mapper) nextRefresh() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.mapping == nil {
+		return m.retryInterval
+	}
+	// Permanent mappings are still refreshed, in case the gateway rebooted
+	lifetime := m.mapping.Lifetime
+	if lifetime <= 0 {
+		lifetime = m.lifetime
+	}
+	if interval := lifetime / 2; interval > minRenewInterval {
+		return interval
+	}
+	return minRenewInterval
+}
+
+// refresh renews the mapping with the active client, falling back to the others in order
+func (m *Mapper) refresh() error {
+	m.mu.Lock()
+	active, previous := m.active, m.mapping
+	lifetime, timeout := m.lifetime, m.requestTimeout
+	ctx := m.ctx
+	m.mu.Unlock()
+
+	order := make([]Client, 0, len(m.clients))
+	if active != nil {
+		order = append(order, active)
+	}
+	for _, client := range m.clients {
+		if client != active {
+			order = append(order, client)
+		}
+	}
+
+	var errs []error
+	for _, client := range order {
+		externalPort := 0
+		if previous != nil {
+			externalPort = previous.ExternalPort
+		}
+
+		requestCtx, cancel := context.WithTimeout(ctx, timeout)
+		mapping, err := client.AddMapping(requestCtx, m.internalPort, externalPort, lifetime)
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", client.Name(), err))
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		m.mu.Lock()
+		m.active, m.mapping, m.err = client, mapping, nil
+		m.mu.Unlock()
+		if !sameEndpoint(previous, mapping) {
+			m.notify(mapping)
+		}
+		return nil
+	}
+
+	err := errors.Join(errs...)
+	m.mu.Lock()
+	m.active, m.mapping, m.err = nil, nil, err
+	m.mu.Unlock()
+	if previous != nil {
+		m.notify(nil)
+	}
+	return err
+}
+
+// notify calls the listeners with the new mapping
+func (m *Mapper) notify(mapping *Mapping) {
+	m.mu.Lock()
+	listeners := make([]Listener, len(m.listeners))
+	copy(listeners, m.listeners)
+	m.mu.Unlock()
+
+	for _, listener := range listeners {
+		listener(mapping)
+	}
+}
+
+// sameEndpoint reports whether two mappings expose the same external endpoint
+func sameEndpoint(a, b *Mapping) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Protocol == b.Protocol && a.ExternalPort == b.ExternalPort && a.ExternalIP.Equal(b.ExternalIP)
+}
+
+// DefaultClients returns clients for the default gateway, most capable protocol first
+// PCP and NAT-PMP talk to the default gateway; UPnP-IGD is included if an
+// InternetGatewayDevice answers SSDP discovery before ctx is done.
+func DefaultClients(ctx context.Context) []Client {
+	var clients []Client
+	if gateway, err := DefaultGateway(); err == nil {
+		clients = append(clients,
+			NewPCPClient(&net.UDPAddr{IP: gateway, Port: PCPPort}),
+			NewNATPMPClient(&net.UDPAddr{IP: gateway, Port: NATPMPPort}),
+		)
+	}
+	if upnp, err := DiscoverUPnP(ctx); err == nil {
+		clients = append(clients, upnp)
+	}
+	return clients
+}
+
+// exchange sends request to gateway and returns the first reply accepted by match
+// Requests are retransmitted starting at 250ms and doubling, as RFC 6886 specifies,
+// until ctx is done.
+func exchange(ctx context.Context, gateway *net.UDPAddr, request []byte, match func([]byte) bool) ([]byte, net.Addr, error) {
+	conn, err := net.DialUDP("udp", nil, gateway)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	buffer := make([]byte, 1100)
+	wait := 250 * time.Millisecond
+	for {
+		if _, err := conn.Write(request); err != nil {
+			return nil, nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(wait))
+
+		for {
+			n, err := conn.Read(buffer)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, nil, fmt.Errorf("no answer from gateway %s: %w", gateway, ctx.Err())
+				}
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return nil, nil, err
+			}
+			if match(buffer[:n]) {
+				reply := make([]byte, n)
+				copy(reply, buffer[:n])
+				return reply, conn.LocalAddr(), nil
+			}
+		}
+		wait *= 2
+	}
+}
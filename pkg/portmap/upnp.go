@@ -0,0 +1,417 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UPnP-IGD constants
+const (
+	// SSDPAddr is the multicast group and port UPnP devices answer searches on
+	SSDPAddr = "239.255.255.250:1900"
+
+	upnpSearchTarget    = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	upnpDescription     = "stella"
+	upnpDiscoverTimeout = 2 * time.Second
+
+	// UPnP error codes the client recovers from
+	upnpErrConflict      = 718
+	upnpErrOnlyPermanent = 725
+)
+
+// upnpServiceTypes are the WAN connection services that can map ports, preferred first
+var upnpServiceTypes = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// UPnPClient maps ports through a UPnP Internet Gateway Device
+// The device description is fetched on first use to find the WAN connection
+// service; mappings are then managed with SOAP requests to its control URL.
+type UPnPClient struct {
+	location   string
+	httpClient *http.Client
+
+	mu          sync.Mutex
+	controlURL  string
+	serviceType string
+}
+
+// upnpError is a SOAP fault returned by the gateway
+type upnpError struct {
+	code        int
+	description string
+}
+
+// Error returns the UPnP error code and description
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("upnp error %d: %s", e.code, e.description)
+}
+
+// upnpRoot is the part of a device description the client needs
+type upnpRoot struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+// upnpDevice is a device with its services and embedded devices
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+// upnpService is a service entry of a device description
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// NewUPnPClient creates a client for the device description at location
+func NewUPnPClient(location string) *UPnPClient {
+	return &UPnPClient{
+		location:   location,
+		httpClient: &http.Client{},
+	}
+}
+
+// DiscoverUPnP finds an Internet Gateway Device with an SSDP search on the local network
+func DiscoverUPnP(ctx context.Context) (*UPnPClient, error) {
+	return DiscoverUPnPAt(ctx, SSDPAddr)
+}
+
+// DiscoverUPnPAt sends the SSDP search to ssdpAddr instead of the multicast group
+// It returns the first responding device that offers a WAN connection service.
+// Without a deadline on ctx the search lasts two seconds.
+func DiscoverUPnPAt(ctx context.Context, ssdpAddr string) (*UPnPClient, error) {
+	target, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return nil, err
+	}
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, upnpDiscoverTimeout)
+		defer cancel()
+	}
+
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + SSDPAddr + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n" +
+		"ST: " + upnpSearchTarget + "\r\n\r\n"
+	if _, err := conn.WriteToUDP([]byte(search), target); err != nil {
+		return nil, err
+	}
+
+	tried := make(map[string]bool)
+	buffer := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, errors.New("no UPnP gateway answered the SSDP search")
+			}
+			return nil, err
+		}
+
+		response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buffer[:n])), nil)
+		if err != nil {
+			continue
+		}
+		response.Body.Close()
+		location := response.Header.Get("Location")
+		if location == "" || tried[location] {
+			continue
+		}
+		tried[location] = true
+
+		client := NewUPnPClient(location)
+		if err := client.resolve(ctx); err == nil {
+			return client, nil
+		}
+	}
+}
+
+// Name returns "upnp"
+func (c *UPnPClient) Name() string {
+	return "upnp"
+}
+
+// ExternalIP asks the gateway for its public address
+func (c *UPnPClient) ExternalIP(ctx context.Context) (net.IP, error) {
+	result, err := c.call(ctx, "GetExternalIPAddress", nil)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(result["NewExternalIPAddress"])
+	if ip == nil {
+		return nil, fmt.Errorf("upnp gateway reported invalid external address %q", result["NewExternalIPAddress"])
+	}
+	return ip, nil
+}
+
+// AddMapping requests a UDP mapping for internalPort
+// UPnP needs an explicit external port, so internalPort is requested when no hint is given.
+// Gateways that only allow permanent leases get a permanent mapping, which the
+// mapper still refreshes periodically.
+func (c *UPnPClient) AddMapping(ctx context.Context, internalPort, externalPort int, lifetime time.Duration) (*Mapping, error) {
+	if err := c.resolve(ctx); err != nil {
+		return nil, err
+	}
+	internalClient, err := c.internalClient()
+	if err != nil {
+		return nil, err
+	}
+	if externalPort == 0 {
+		externalPort = internalPort
+	}
+
+	add := func(port int, lease time.Duration) error {
+		_, err := c.call(ctx, "AddPortMapping", [][2]string{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", strconv.Itoa(port)},
+			{"NewProtocol", "UDP"},
+			{"NewInternalPort", strconv.Itoa(internalPort)},
+			{"NewInternalClient", internalClient.String()},
+			{"NewEnabled", "1"},
+			{"NewPortMappingDescription", upnpDescription},
+			{"NewLeaseDuration", strconv.Itoa(int(lease / time.Second))},
+		})
+		return err
+	}
+
+	err = add(externalPort, lifetime)
+	var upnpErr *upnpError
+	if errors.As(err, &upnpErr) && upnpErr.code == upnpErrOnlyPermanent {
+		lifetime = 0
+		err = add(externalPort, lifetime)
+	}
+	if errors.As(err, &upnpErr) && upnpErr.code == upnpErrConflict {
+		// Someone else holds the port; try a random one instead
+		externalPort = 1024 + rand.Intn(65535-1024)
+		err = add(externalPort, lifetime)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	externalIP, err := c.ExternalIP(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Mapping{
+		Protocol:     c.Name(),
+		InternalPort: internalPort,
+		ExternalIP:   externalIP,
+		ExternalPort: externalPort,
+		Lifetime:     lifetime,
+		CreatedAt:    time.Now(),
+	}, nil
+}
+
+// DeleteMapping removes the mapping from the gateway
+func (c *UPnPClient) DeleteMapping(ctx context.Context, mapping *Mapping) error {
+	_, err := c.call(ctx, "DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(mapping.ExternalPort)},
+		{"NewProtocol", "UDP"},
+	})
+	return err
+}
+
+// resolve fetches the device description and finds the WAN connection service
+func (c *UPnPClient) resolve(ctx context.Context) error {
+	c.mu.Lock()
+	resolved := c.controlURL != ""
+	c.mu.Unlock()
+	if resolved {
+		return nil
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, c.location, nil)
+	if err != nil {
+		return err
+	}
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("upnp device description: %s", response.Status)
+	}
+
+	var root upnpRoot
+	if err := xml.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&root); err != nil {
+		return fmt.Errorf("upnp device description: %w", err)
+	}
+
+	for _, serviceType := range upnpServiceTypes {
+		service, found := findUPnPService(root.Device, serviceType)
+		if !found {
+			continue
+		}
+		base := c.location
+		if root.URLBase != "" {
+			base = root.URLBase
+		}
+		controlURL, err := resolveURL(base, service.ControlURL)
+		if err != nil {
+			return err
+		}
+
+		c.mu.Lock()
+		c.controlURL, c.serviceType = controlURL, serviceType
+		c.mu.Unlock()
+		return nil
+	}
+	return errors.New("upnp device has no WAN connection service")
+}
+
+// internalClient returns the local IP the gateway should forward to
+func (c *UPnPClient) internalClient() (net.IP, error) {
+	c.mu.Lock()
+	controlURL := c.controlURL
+	c.mu.Unlock()
+
+	u, err := url.Parse(controlURL)
+	if err != nil {
+		return nil, err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+	}
+	gateway, err := net.ResolveUDPAddr("udp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+	return localAddrFor(gateway)
+}
+
+// call invokes a SOAP action and returns the response arguments by name
+func (c *UPnPClient) call(ctx context.Context, action string, args [][2]string) (map[string]string, error) {
+	if err := c.resolve(ctx); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	controlURL, serviceType := c.controlURL, c.serviceType
+	c.mu.Unlock()
+
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + ` xmlns:u="` + serviceType + `">`)
+	for _, arg := range args {
+		body.WriteString("<" + arg[0] + ">")
+		xml.EscapeText(&body, []byte(arg[1]))
+		body.WriteString("</" + arg[0] + ">")
+	}
+	body.WriteString(`</u:` + action + `></s:Body></s:Envelope>`)
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	request.Header.Set("SOAPAction", `"`+serviceType+"#"+action+`"`)
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	result, err := parseSOAPResponse(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("upnp %s: %w", action, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		code, _ := strconv.Atoi(result["errorCode"])
+		if code == 0 {
+			return nil, fmt.Errorf("upnp %s: %s", action, response.Status)
+		}
+		return nil, &upnpError{code: code, description: result["errorDescription"]}
+	}
+	return result, nil
+}
+
+// parseSOAPResponse collects the text of every leaf element by local name
+// This covers both the action's output arguments and the UPnPError of a fault.
+func parseSOAPResponse(r io.Reader) (map[string]string, error) {
+	result := make(map[string]string)
+	decoder := xml.NewDecoder(r)
+
+	var name string
+	var text strings.Builder
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			name = t.Name.Local
+			text.Reset()
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if name == t.Name.Local {
+				result[name] = strings.TrimSpace(text.String())
+			}
+			name = ""
+		}
+	}
+}
+
+// findUPnPService searches a device tree for a service type
+func findUPnPService(device upnpDevice, serviceType string) (upnpService, bool) {
+	for _, service := range device.Services {
+		if service.ServiceType == serviceType {
+			return service, true
+		}
+	}
+	for _, embedded := range device.Devices {
+		if service, found := findUPnPService(embedded, serviceType); found {
+			return service, true
+		}
+	}
+	return upnpService{}, false
+}
+
+// resolveURL resolves a possibly relative reference against base
+func resolveURL(base, reference string) (string, error) {
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(reference)
+	if err != nil {
+		return "", err
+	}
+	return baseURL.ResolveReference(ref).String(), nil
+}
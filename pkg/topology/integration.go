@@ -253,6 +253,23 @@ func (im *IntegrationManager) UpdateNodeLatency(nodeID uuid.UUID, latency int) e
 	return im.topology.AddNode(node)
 }
 
+// UpdateNodeMTU records the path MTU discovered by a transport for the node at address
+func (im *IntegrationManager) UpdateNodeMTU(address string, mtu int) error {
+	im.rwm.RLock()
+	defer im.rwm.RUnlock()
+
+	if !im.initialized {
+		return fmt.Errorf("topology integration manager not initialized")
+	}
+
+	if mtu <= 0 {
+		return fmt.Errorf("invalid MTU: %d", mtu)
+	}
+
+	im.topology.UpdateNodeMTU(address, mtu)
+	return nil
+}
+
 // MarkNodeAsTrusted marks a node as trusted (important for ZeroTier compatibility)
 func (im *IntegrationManager) MarkNodeAsTrusted(nodeID uuid.UUID) error {
 	im.rwm.RLock()
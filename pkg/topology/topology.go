@@ -121,6 +121,31 @@ func (tm *TopologyManager) GetNode(nodeID uuid.UUID) (*Node, bool) {
 	return node, exists
 }
 
+// UpdateNodeMTU sets the MTU of every node reachable at address and returns how many were updated
+// Transports report path MTU per remote address, so nodes are matched by Address rather than ID
+func (tm *TopologyManager) UpdateNodeMTU(address string, mtu int) int {
+	tm.rwm.Lock()
+	defer tm.rwm.Unlock()
+
+	updated := 0
+	for _, node := range tm.nodes {
+		if node.Address != address || node.MTU == mtu {
+			continue
+		}
+		node.MTU = mtu
+		updated++
+
+		// Send update notification
+		tm.updateCh <- &TopologyUpdate{
+			Type:      "node",
+			Node:      node,
+			Timestamp: time.Now(),
+		}
+	}
+
+	return updated
+}
+
 // RemoveNode removes a node from the topology
 func (tm *TopologyManager) RemoveNode(nodeID uuid.UUID) error {
 	tm.rwm.Lock()
@@ -413,4 +413,24 @@ func TestTopologyManager_UpdateNode(t *testing.T) {
 	assert.True(t, exists)
 	assert.Equal(t, "new-key", retrievedNode.PublicKey)
 	assert.Equal(t, "1.1", retrievedNode.Version)
-}
\ No newline at end of file
+}
+
+func TestTopologyManager_UpdateNodeMTU(t *testing.T) {
+	tm := NewTopologyManager()
+	defer tm.Stop()
+
+	first := &Node{ID: uuid.New(), Address: "192.168.1.20:9993", MTU: 1500}
+	second := &Node{ID: uuid.New(), Address: "192.168.1.21:9993", MTU: 1500}
+	assert.NoError(t, tm.AddNode(first))
+	assert.NoError(t, tm.AddNode(second))
+
+	// Only nodes at the reported address change
+	assert.Equal(t, 1, tm.UpdateNodeMTU("192.168.1.20:9993", 1400))
+	node, _ := tm.GetNode(first.ID)
+	assert.Equal(t, 1400, node.MTU)
+	node, _ = tm.GetNode(second.ID)
+	assert.Equal(t, 1500, node.MTU)
+
+	// Unchanged values are not reported again
+	assert.Equal(t, 0, tm.UpdateNodeMTU("192.168.1.20:9993", 1400))
+}
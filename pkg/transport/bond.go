@@ -0,0 +1,802 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/stella/virtual-switch/pkg/topology"
+)
+
+// Bond timing defaults
+const (
+	// defaultBondProbeInterval is how often every path of a bond is probed
+	defaultBondProbeInterval = time.Second
+	// defaultBondDownTimeout marks a path down after this long without traffic from it
+	defaultBondDownTimeout = 3 * time.Second
+
+	// bondLatencyHysteresis is how much higher (as a fraction) another path's quality
+	// must be before the latency policy moves traffic to it
+	bondLatencyHysteresis = 0.2
+)
+
+// Bond probes are magic(4) + kind(1) + sequence(4) + timestamp(8)
+const (
+	bondProbeSize          = 17
+	bondProbeRequest  byte = 0x01
+	bondProbeResponse byte = 0x02
+)
+
+// bondProbeMagic starts every bond probe
+var bondProbeMagic = []byte{0xb0, 0x4e, 0xd1, 0x7a}
+
+// BondPolicy decides which path of a bond carries each packet
+type BondPolicy string
+
+const (
+	// BondPolicyActiveBackup sends everything over the first path that is up, in the order paths were added
+	BondPolicyActiveBackup BondPolicy = "active-backup"
+	// BondPolicyLatency sends everything over the path with the best topology quality score
+	BondPolicyLatency BondPolicy = "latency"
+	// BondPolicyBalanceXOR spreads flows over the paths by flow hash, keeping each flow on one path
+	BondPolicyBalanceXOR BondPolicy = "balance-xor"
+)
+
+// BondEventType identifies a bond event
+type BondEventType int
+
+const (
+	// BondPathUp is fired when traffic arrives on a path that was down
+	BondPathUp BondEventType = iota
+	// BondPathDown is fired when a path stays silent for the down timeout or fails to send
+	BondPathDown
+	// BondActivePathChanged is fired when active-backup or latency moves traffic to another path
+	BondActivePathChanged
+)
+
+// BondEvent describes a change of a bond's paths
+type BondEvent struct {
+	Type BondEventType
+	// Peer is the bond's peer address
+	Peer net.Addr
+	// Path is the path that went up or down, or the new active path
+	Path net.Addr
+}
+
+// BondListener is called with every bond event
+type BondListener func(event BondEvent)
+
+// FlowHashFunc maps a packet to its flow for balance-xor; packets of one flow must hash alike
+type FlowHashFunc func(data []byte) uint32
+
+// BondPathStatus is a snapshot of one path of a bond
+type BondPathStatus struct {
+	// Addr is the remote endpoint of the path
+	Addr net.Addr
+	// Path carries the path's state in topology form: Active, Latency (ms), LastActive and Trusted
+	Path topology.Path
+	// Quality is the path's quality score (higher is better)
+	Quality float64
+	// LastReceived is when traffic last arrived on the path
+	LastReceived time.Time
+}
+
+// BondStatus is a snapshot of a bond
+type BondStatus struct {
+	// Peer is the address the bond is reached at and that received traffic is reported from
+	Peer   net.Addr
+	Policy BondPolicy
+	// Active is the path carrying traffic; nil for balance-xor, which uses every path that is up
+	Active net.Addr
+	// Paths lists the paths in the order they were added
+	Paths []BondPathStatus
+}
+
+// BondedTransport wraps a Transport and bonds several paths to a peer into one
+// A peer that is reachable at several endpoints (LAN, IPv6, public IPv4) gets a bond
+// listing them. Send to the bond's peer address picks a path by the bond's policy,
+// and packets arriving on any of the paths are handed to the handler as coming from
+// the peer address, so sessions keyed by address survive a failover. Every path is
+// probed periodically, which keeps NAT mappings open, measures latency and detects
+// dead paths. Probes are answered for any source, but both ends need a
+// BondedTransport so that probes are not delivered as data.
+type BondedTransport struct {
+	Transport
+
+	mu            sync.Mutex
+	bonds         map[string]*bond // by peer address
+	paths         map[string]*bond // by path address
+	probeInterval time.Duration
+	downTimeout   time.Duration
+	quality       func(path *topology.Path) float64
+	flowHash      FlowHashFunc
+	listeners     []BondListener
+	nextProbe     uint32
+
+	// epoch is the reference for probe timestamps, so RTTs use the monotonic clock
+	epoch time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// bond is the set of paths to one peer
+type bond struct {
+	peer   net.Addr
+	policy BondPolicy
+	paths  []*bondPath
+	active *bondPath // nil for balance-xor
+}
+
+// bondPath is one endpoint of a bond
+type bondPath struct {
+	addr         net.Addr
+	path         topology.Path
+	lastReceived time.Time
+}
+
+// NewBondedTransport wraps inner with a bonding layer
+func NewBondedTransport(inner Transport) *BondedTransport {
+	ctx, cancel := context.WithCancel(context.Background())
+	// GetPathQuality only looks at the path, so the path finder needs no topology
+	pathFinder := topology.NewPathFinder(nil)
+	return &BondedTransport{
+		Transport:     inner,
+		bonds:         make(map[string]*bond),
+		paths:         make(map[string]*bond),
+		probeInterval: defaultBondProbeInterval,
+		downTimeout:   defaultBondDownTimeout,
+		quality:       pathFinder.GetPathQuality,
+		flowHash:      DefaultFlowHash,
+		epoch:         time.Now(),
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+}
+
+// validBondPolicy reports whether policy is known
+func validBondPolicy(policy BondPolicy) bool {
+	switch policy {
+	case BondPolicyActiveBackup, BondPolicyLatency, BondPolicyBalanceXOR:
+		return true
+	}
+	return false
+}
+
+// AddBond bonds paths into one link to peer
+// peer is the address Send is called with and that traffic from every path is reported
+// from; without paths, peer itself is the only path. Paths start up and are marked
+// down if nothing arrives on them within the down timeout.
+func (t *BondedTransport) AddBond(peer net.Addr, policy BondPolicy, paths ...net.Addr) error {
+	if !validBondPolicy(policy) {
+		return NewTransportError("invalid bond policy: "+string(policy), 4024, nil)
+	}
+	if len(paths) == 0 {
+		paths = []net.Addr{peer}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, exists := t.bonds[peer.String()]; exists {
+		return NewTransportError("bond to "+peer.String()+" already exists", 4025, nil)
+	}
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		if _, used := t.paths[path.String()]; used || seen[path.String()] {
+			return NewTransportError("path "+path.String()+" already belongs to a bond", 4039, nil)
+		}
+		seen[path.String()] = true
+	}
+
+	b := &bond{peer: peer, policy: policy}
+	for _, path := range paths {
+		b.paths = append(b.paths, t.newPath(path))
+		t.paths[path.String()] = b
+	}
+	t.bonds[peer.String()] = b
+	t.reselectLocked(b)
+	return nil
+}
+
+// newPath creates a path that is up until it stays silent for the down timeout
+func (t *BondedTransport) newPath(addr net.Addr) *bondPath {
+	now := time.Now()
+	return &bondPath{
+		addr:         addr,
+		path:         topology.Path{Address: addr.String(), Active: true, LastActive: now},
+		lastReceived: now,
+	}
+}
+
+// RemoveBond removes the bond to peer; Send to peer goes straight to the wrapped transport again
+func (t *BondedTransport) RemoveBond(peer net.Addr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b, exists := t.bonds[peer.String()]
+	if !exists {
+		return
+	}
+	for _, path := range b.paths {
+		delete(t.paths, path.addr.String())
+	}
+	delete(t.bonds, peer.String())
+}
+
+// AddPath adds a path to the bond to peer
+func (t *BondedTransport) AddPath(peer, path net.Addr) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b, err := t.bondLocked(peer)
+	if err != nil {
+		return err
+	}
+	if _, used := t.paths[path.String()]; used {
+		return NewTransportError("path "+path.String()+" already belongs to a bond", 4039, nil)
+	}
+	b.paths = append(b.paths, t.newPath(path))
+	t.paths[path.String()] = b
+	return nil
+}
+
+// RemovePath removes a path from the bond to peer; the last path cannot be removed
+func (t *BondedTransport) RemovePath(peer, path net.Addr) error {
+	t.mu.Lock()
+	b, err := t.bondLocked(peer)
+	if err != nil {
+		t.mu.Unlock()
+		return err
+	}
+	index := b.pathIndex(path)
+	if index < 0 {
+		t.mu.Unlock()
+		return NewTransportError("path "+path.String()+" is not part of the bond", 4026, nil)
+	}
+	if len(b.paths) == 1 {
+		t.mu.Unlock()
+		return NewTransportError("cannot remove the last path of a bond", 4027, nil)
+	}
+
+	if b.active == b.paths[index] {
+		b.active = nil
+	}
+	b.paths = append(b.paths[:index], b.paths[index+1:]...)
+	delete(t.paths, path.String())
+	events := t.reselectLocked(b)
+	t.mu.Unlock()
+
+	t.notify(events)
+	return nil
+}
+
+// SetBondPolicy changes the policy of the bond to peer
+func (t *BondedTransport) SetBondPolicy(peer net.Addr, policy BondPolicy) error {
+	if !validBondPolicy(policy) {
+		return NewTransportError("invalid bond policy: "+string(policy), 4024, nil)
+	}
+
+	t.mu.Lock()
+	b, err := t.bondLocked(peer)
+	if err != nil {
+		t.mu.Unlock()
+		return err
+	}
+	b.policy = policy
+	events := t.reselectLocked(b)
+	t.mu.Unlock()
+
+	t.notify(events)
+	return nil
+}
+
+// SetPathTrusted marks a path of the bond to peer as trusted, which raises its quality score
+func (t *BondedTransport) SetPathTrusted(peer, path net.Addr, trusted bool) error {
+	t.mu.Lock()
+	b, err := t.bondLocked(peer)
+	if err != nil {
+		t.mu.Unlock()
+		return err
+	}
+	index := b.pathIndex(path)
+	if index < 0 {
+		t.mu.Unlock()
+		return NewTransportError("path "+path.String()+" is not part of the bond", 4026, nil)
+	}
+	b.paths[index].path.Trusted = trusted
+	events := t.reselectLocked(b)
+	t.mu.Unlock()
+
+	t.notify(events)
+	return nil
+}
+
+// SetProbeTiming sets how often paths are probed and how long a silent path stays up
+func (t *BondedTransport) SetProbeTiming(interval, downTimeout time.Duration) error {
+	if interval <= 0 || downTimeout <= interval {
+		return NewTransportError("probe interval must be positive and shorter than the down timeout", 4028, nil)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.probeInterval = interval
+	t.downTimeout = downTimeout
+	return nil
+}
+
+// SetPathQuality replaces the path quality score used by the latency policy
+// The default is topology.PathFinder.GetPathQuality; nil restores it.
+func (t *BondedTransport) SetPathQuality(quality func(path *topology.Path) float64) {
+	if quality == nil {
+		quality = topology.NewPathFinder(nil).GetPathQuality
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.quality = quality
+}
+
+// SetFlowHash replaces the flow hash used by balance-xor; nil restores DefaultFlowHash
+func (t *BondedTransport) SetFlowHash(flowHash FlowHashFunc) {
+	if flowHash == nil {
+		flowHash = DefaultFlowHash
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.flowHash = flowHash
+}
+
+// AddBondListener registers a listener for path and failover events
+func (t *BondedTransport) AddBondListener(listener BondListener) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.listeners = append(t.listeners, listener)
+}
+
+// Bond returns a snapshot of the bond to peer
+func (t *BondedTransport) Bond(peer net.Addr) (BondStatus, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b, exists := t.bonds[peer.String()]
+	if !exists {
+		return BondStatus{}, false
+	}
+	status := BondStatus{Peer: b.peer, Policy: b.policy}
+	if b.active != nil {
+		status.Active = b.active.addr
+	}
+	for _, p := range b.paths {
+		status.Paths = append(status.Paths, BondPathStatus{
+			Addr:         p.addr,
+			Path:         p.path,
+			Quality:      t.qualityLocked(p),
+			LastReceived: p.lastReceived,
+		})
+	}
+	return status, true
+}
+
+// Start starts the wrapped transport with a handler that consumes probes and
+// reports bonded traffic from the peer address, then starts probing
+func (t *BondedTransport) Start(handler PacketHandler) error {
+	if err := t.Transport.Start(t.handler(handler)); err != nil {
+		return err
+	}
+	t.wg.Add(1)
+	go t.probeLoop()
+	return nil
+}
+
+// Stop stops probing and the wrapped transport
+func (t *BondedTransport) Stop() error {
+	t.cancel()
+	t.wg.Wait()
+	return t.Transport.Stop()
+}
+
+// Send sends data to dstAddr, over the path the bond's policy picks if dstAddr is a bonded peer
+// If the chosen path fails to send, it is marked down and the packet goes over the next path.
+func (t *BondedTransport) Send(dstAddr net.Addr, data []byte) error {
+	tried := make(map[string]bool)
+	for {
+		path, bonded := t.choosePath(dstAddr, data)
+		if !bonded {
+			return t.Transport.Send(dstAddr, data)
+		}
+		err := t.Transport.Send(path, data)
+		if err == nil || tried[path.String()] {
+			return err
+		}
+		tried[path.String()] = true
+		if !t.sendFailed(dstAddr, path) {
+			return err
+		}
+	}
+}
+
+// AddDeliveryListener forwards to the wrapped transport if it reports delivery outcomes
+// Results for bonded paths are reported for the bond's peer address. Failures on a
+// path that is down are not reported while another path is up, since the bond has
+// already moved the peer's traffic.
+func (t *BondedTransport) AddDeliveryListener(listener DeliveryListener) {
+	notifier, ok := t.Transport.(DeliveryNotifier)
+	if !ok {
+		return
+	}
+	notifier.AddDeliveryListener(func(result DeliveryResult) {
+		if result.DstAddr != nil {
+			t.mu.Lock()
+			b, bonded := t.paths[result.DstAddr.String()]
+			if bonded {
+				if p := b.path(result.DstAddr); !result.Delivered && p != nil && !p.path.Active && b.hasUpPath() {
+					t.mu.Unlock()
+					return
+				}
+				result.DstAddr = b.peer
+			}
+			t.mu.Unlock()
+		}
+		listener(result)
+	})
+}
+
+// handler wraps next so that probes are answered and bonded traffic comes from the peer address
+func (t *BondedTransport) handler(next PacketHandler) PacketHandler {
+	return func(srcAddr net.Addr, data []byte) error {
+		if kind, seq, stamp, ok := parseBondProbe(data); ok {
+			var rtt time.Duration
+			switch kind {
+			case bondProbeRequest:
+				t.sendProbe(srcAddr, bondProbeResponse, seq, stamp)
+			case bondProbeResponse:
+				rtt = time.Since(t.epoch) - stamp
+			}
+			t.received(srcAddr, rtt)
+			return nil
+		}
+
+		if peer := t.received(srcAddr, 0); peer != nil {
+			srcAddr = peer
+		}
+		if next != nil {
+			return next(srcAddr, data)
+		}
+		return nil
+	}
+}
+
+// received records traffic from srcAddr and returns the peer address if it is a bonded path
+// A positive rtt is a probe round trip on the path.
+func (t *BondedTransport) received(srcAddr net.Addr, rtt time.Duration) net.Addr {
+	t.mu.Lock()
+	b, bonded := t.paths[srcAddr.String()]
+	if !bonded {
+		t.mu.Unlock()
+		return nil
+	}
+	p := b.path(srcAddr)
+	now := time.Now()
+	p.lastReceived = now
+	p.path.LastActive = now
+
+	var events []BondEvent
+	changed := false
+	if !p.path.Active {
+		p.path.Active = true
+		events = append(events, BondEvent{Type: BondPathUp, Peer: b.peer, Path: p.addr})
+		changed = true
+	}
+	if rtt > 0 {
+		// Whole milliseconds, rounded up so that a measured path never reads as unmeasured (0)
+		latency := int((rtt + time.Millisecond - 1) / time.Millisecond)
+		// Same weighting as topology.PathFinder.UpdatePathLatency
+		if p.path.Latency == 0 {
+			p.path.Latency = latency
+		} else {
+			p.path.Latency = int(float64(latency)*0.7 + float64(p.path.Latency)*0.3)
+		}
+		changed = true
+	}
+	if changed {
+		events = append(events, t.reselectLocked(b)...)
+	}
+	peer := b.peer
+	t.mu.Unlock()
+
+	t.notify(events)
+	return peer
+}
+
+// sendFailed marks a path down after a send error and reports whether another path is up
+func (t *BondedTransport) sendFailed(peer, path net.Addr) bool {
+	t.mu.Lock()
+	b, exists := t.bonds[peer.String()]
+	if !exists {
+		t.mu.Unlock()
+		return false
+	}
+	var events []BondEvent
+	if p := b.path(path); p != nil && p.path.Active {
+		p.path.Active = false
+		events = append(events, BondEvent{Type: BondPathDown, Peer: b.peer, Path: p.addr})
+		events = append(events, t.reselectLocked(b)...)
+	}
+	up := b.hasUpPath()
+	t.mu.Unlock()
+
+	t.notify(events)
+	return up
+}
+
+// choosePath picks the path for a packet to dstAddr; bonded is false if dstAddr has no bond
+func (t *BondedTransport) choosePath(dstAddr net.Addr, data []byte) (net.Addr, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b, exists := t.bonds[dstAddr.String()]
+	if !exists {
+		return nil, false
+	}
+	if b.policy != BondPolicyBalanceXOR {
+		return b.active.addr, true
+	}
+
+	// Flows hash onto all paths, so flows on healthy paths stay put when another path fails
+	hash := t.flowHash(data)
+	p := b.paths[hash%uint32(len(b.paths))]
+	if !p.path.Active {
+		if up := b.upPaths(); len(up) > 0 {
+			p = up[hash%uint32(len(up))]
+		}
+	}
+	return p.addr, true
+}
+
+// reselectLocked picks the active path by the bond's policy and returns the resulting events
+// Must be called with t.mu held
+func (t *BondedTransport) reselectLocked(b *bond) []BondEvent {
+	previous := b.active
+	switch b.policy {
+	case BondPolicyBalanceXOR:
+		b.active = nil
+		return nil
+	case BondPolicyActiveBackup:
+		if up := b.upPaths(); len(up) > 0 {
+			b.active = up[0]
+		}
+	case BondPolicyLatency:
+		var best *bondPath
+		bestQuality := 0.0
+		for _, p := range b.upPaths() {
+			if quality := t.qualityLocked(p); best == nil || quality > bestQuality {
+				best, bestQuality = p, quality
+			}
+		}
+		current := b.active
+		if best != nil && (current == nil || !current.path.Active || bestQuality > t.qualityLocked(current)*(1+bondLatencyHysteresis)) {
+			b.active = best
+		}
+	}
+
+	// With every path down, keep sending over the current path, or the first one
+	if b.active == nil {
+		b.active = b.paths[0]
+	}
+	if previous != nil && b.active != previous {
+		return []BondEvent{{Type: BondActivePathChanged, Peer: b.peer, Path: b.active.addr}}
+	}
+	return nil
+}
+
+// qualityLocked scores a path
+// Must be called with t.mu held
+func (t *BondedTransport) qualityLocked(p *bondPath) float64 {
+	path := p.path
+	return t.quality(&path)
+}
+
+// probeLoop probes every path and marks silent paths down
+func (t *BondedTransport) probeLoop() {
+	defer t.wg.Done()
+
+	t.mu.Lock()
+	interval := t.probeInterval
+	t.mu.Unlock()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		t.probe()
+
+		select {
+		case <-ticker.C:
+			t.mu.Lock()
+			if t.probeInterval != interval {
+				interval = t.probeInterval
+				ticker.Reset(interval)
+			}
+			t.mu.Unlock()
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+// probe marks paths down that stayed silent for the down timeout and sends a probe on every path
+func (t *BondedTransport) probe() {
+	now := time.Now()
+	var events []BondEvent
+	var targets []net.Addr
+
+	t.mu.Lock()
+	for _, b := range t.bonds {
+		changed := false
+		for _, p := range b.paths {
+			if p.path.Active && now.Sub(p.lastReceived) > t.downTimeout {
+				p.path.Active = false
+				events = append(events, BondEvent{Type: BondPathDown, Peer: b.peer, Path: p.addr})
+				changed = true
+			}
+			targets = append(targets, p.addr)
+		}
+		if changed {
+			events = append(events, t.reselectLocked(b)...)
+		}
+	}
+	t.mu.Unlock()
+
+	t.notify(events)
+	for _, addr := range targets {
+		t.mu.Lock()
+		t.nextProbe++
+		seq := t.nextProbe
+		t.mu.Unlock()
+		t.sendProbe(addr, bondProbeRequest, seq, time.Since(t.epoch))
+	}
+}
+
+// sendProbe sends a probe without transport-level retransmission where the transport allows it
+func (t *BondedTransport) sendProbe(addr net.Addr, kind byte, seq uint32, stamp time.Duration) error {
+	probe := make([]byte, bondProbeSize)
+	copy(probe, bondProbeMagic)
+	probe[4] = kind
+	binary.BigEndian.PutUint32(probe[5:9], seq)
+	binary.BigEndian.PutUint64(probe[9:17], uint64(stamp))
+
+	if sender, ok := t.Transport.(unreliableSender); ok {
+		return sender.SendUnreliable(addr, probe)
+	}
+	return t.Transport.Send(addr, probe)
+}
+
+// parseBondProbe recognises a bond probe
+func parseBondProbe(data []byte) (kind byte, seq uint32, stamp time.Duration, ok bool) {
+	if len(data) != bondProbeSize || !bytes.HasPrefix(data, bondProbeMagic) {
+		return 0, 0, 0, false
+	}
+	kind = data[4]
+	if kind != bondProbeRequest && kind != bondProbeResponse {
+		return 0, 0, 0, false
+	}
+	return kind, binary.BigEndian.Uint32(data[5:9]), time.Duration(binary.BigEndian.Uint64(data[9:17])), true
+}
+
+// notify calls the listeners with each event
+func (t *BondedTransport) notify(events []BondEvent) {
+	if len(events) == 0 {
+		return
+	}
+	t.mu.Lock()
+	listeners := append([]BondListener(nil), t.listeners...)
+	t.mu.Unlock()
+
+	for _, event := range events {
+		for _, listener := range listeners {
+			listener(event)
+		}
+	}
+}
+
+// bondLocked returns the bond to peer
+// Must be called with t.mu held
+func (t *BondedTransport) bondLocked(peer net.Addr) (*bond, error) {
+	b, exists := t.bonds[peer.String()]
+	if !exists {
+		return nil, NewTransportError("no bond to "+peer.String(), 4040, nil)
+	}
+	return b, nil
+}
+
+// pathIndex returns the index of the path to addr, or -1
+func (b *bond) pathIndex(addr net.Addr) int {
+	key := addr.String()
+	for i, p := range b.paths {
+		if p.addr.String() == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// path returns the path to addr, or nil
+func (b *bond) path(addr net.Addr) *bondPath {
+	if index := b.pathIndex(addr); index >= 0 {
+		return b.paths[index]
+	}
+	return nil
+}
+
+// upPaths returns the paths that are up, in the order they were added
+func (b *bond) upPaths() []*bondPath {
+	var up []*bondPath
+	for _, p := range b.paths {
+		if p.path.Active {
+			up = append(up, p)
+		}
+	}
+	return up
+}
+
+// hasUpPath reports whether any path is up
+func (b *bond) hasUpPath() bool {
+	for _, p := range b.paths {
+		if p.path.Active {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultFlowHash hashes an Ethernet frame by its IP addresses and, for TCP and UDP,
+// ports, or by its MAC addresses if it carries neither IPv4 nor IPv6
+// A single 802.1Q tag is skipped. Packets too short to be frames all hash to 0.
+func DefaultFlowHash(data []byte) uint32 {
+	const ethernetHeaderSize = 14
+	if len(data) < ethernetHeaderSize {
+		return 0
+	}
+
+	h := fnv.New32a()
+	offset := 12
+	etherType := binary.BigEndian.Uint16(data[offset:])
+	if etherType == 0x8100 && len(data) >= ethernetHeaderSize+4 {
+		offset += 4
+		etherType = binary.BigEndian.Uint16(data[offset:])
+	}
+	l3 := data[offset+2:]
+
+	var protocol byte
+	var l4 []byte
+	switch {
+	case etherType == 0x0800 && len(l3) >= 20:
+		headerLen := int(l3[0]&0x0f) * 4
+		protocol = l3[9]
+		h.Write(l3[12:20])
+		// Later fragments have no ports; the first fragment's ports are skipped too so they stay together
+		fragmented := binary.BigEndian.Uint16(l3[6:8])&0x3fff != 0
+		if !fragmented && headerLen >= 20 && len(l3) >= headerLen+4 {
+			l4 = l3[headerLen:]
+		}
+	case etherType == 0x86dd && len(l3) >= 40:
+		protocol = l3[6]
+		h.Write(l3[8:40])
+		if len(l3) >= 44 {
+			l4 = l3[40:]
+		}
+	default:
+		h.Write(data[:12])
+		return h.Sum32()
+	}
+
+	h.Write([]byte{protocol})
+	if l4 != nil && (protocol == 6 || protocol == 17) {
+		h.Write(l4[:4])
+	}
+	return h.Sum32()
+}
@@ -0,0 +1,287 @@
+package transport
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stella/virtual-switch/pkg/identity"
+)
+
+// Defaults shared by the stream transports
+const (
+	// defaultMaxFrameSize is the largest packet a TCP or WebSocket transport sends or accepts
+	defaultMaxFrameSize = 64 * 1024
+	// defaultDialTimeout bounds connecting to a peer
+	defaultDialTimeout = 5 * time.Second
+	// defaultWebSocketPath is the HTTP path WebSocket upgrades are served on
+	defaultWebSocketPath = "/stella"
+)
+
+// TCPConfig configures a TCPTransport
+// Start from DefaultTCPConfig; the zero value is not valid.
+type TCPConfig struct {
+	// Addr is the listen address ("host:port"); it takes precedence over Port
+	// Default: "" (127.0.0.1 on Port)
+	Addr string
+	// Port is the loopback port to listen on when Addr is empty; 0 picks a free port
+	// Default: 0
+	Port int
+	// MaxFrameSize is the largest packet sent or accepted, in bytes
+	// Default: 64 KiB
+	MaxFrameSize int
+	// DialTimeout bounds connecting to a peer
+	// Default: 5s
+	DialTimeout time.Duration
+	// IdentityType selects the local key type ("c25519" or "p256"); empty keeps the default
+	// Default: "" (Curve25519)
+	IdentityType string
+}
+
+// DefaultTCPConfig returns the configuration NewTCPTransport starts with
+func DefaultTCPConfig() TCPConfig {
+	return TCPConfig{
+		MaxFrameSize: defaultMaxFrameSize,
+		DialTimeout:  defaultDialTimeout,
+	}
+}
+
+// Validate checks the configuration without binding anything
+func (c TCPConfig) Validate() error {
+	if err := validatePort(c.Port); err != nil {
+		return NewTransportError(err.Error(), 5010, nil)
+	}
+	if c.Addr != "" {
+		if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+			return NewTransportError("invalid listen address", 5001, err)
+		}
+	}
+	if c.MaxFrameSize < 1 {
+		return NewTransportError("maxFrameSize must be positive", 5011, nil)
+	}
+	if c.DialTimeout <= 0 {
+		return NewTransportError("dialTimeout must be positive", 5012, nil)
+	}
+	return validateIdentityType(c.IdentityType)
+}
+
+// TCPConfigFromMap converts the map form accepted by Init
+// Keys are the field names in lower camel case; unknown keys and values of the
+// wrong type are errors. Missing keys keep their defaults.
+func TCPConfigFromMap(config map[string]interface{}) (TCPConfig, error) {
+	c := DefaultTCPConfig()
+	err := decodeConfig(config, map[string]interface{}{
+		"addr":         &c.Addr,
+		"port":         &c.Port,
+		"maxFrameSize": &c.MaxFrameSize,
+		"dialTimeout":  &c.DialTimeout,
+		"identityType": &c.IdentityType,
+	})
+	return c, err
+}
+
+// WebSocketConfig configures a WebSocketTransport
+// Start from DefaultWebSocketConfig; the zero value is not valid.
+type WebSocketConfig struct {
+	// Mode is WebSocketModeServer or WebSocketModeClient; clients only dial out
+	// Default: WebSocketModeServer
+	Mode string
+	// Path is the HTTP path upgrades are served on and dialed to
+	// Default: "/stella"
+	Path string
+	// Addr is the listen address in server mode ("host:port"); it takes precedence over Port
+	// Default: "" (127.0.0.1 on Port)
+	Addr string
+	// Port is the loopback port to listen on when Addr is empty; 0 picks a free port
+	// Default: 0
+	Port int
+	// TLSConfig, if set, serves and dials wss://
+	// Default: nil
+	TLSConfig *tls.Config
+	// MaxFrameSize is the largest packet sent or accepted, in bytes
+	// Default: 64 KiB
+	MaxFrameSize int
+	// DialTimeout bounds connecting to a peer
+	// Default: 5s
+	DialTimeout time.Duration
+	// IdentityType selects the local key type ("c25519" or "p256"); empty keeps the default
+	// Default: "" (Curve25519)
+	IdentityType string
+}
+
+// DefaultWebSocketConfig returns the configuration NewWebSocketTransport starts with
+func DefaultWebSocketConfig() WebSocketConfig {
+	return WebSocketConfig{
+		Mode:         WebSocketModeServer,
+		Path:         defaultWebSocketPath,
+		MaxFrameSize: defaultMaxFrameSize,
+		DialTimeout:  defaultDialTimeout,
+	}
+}
+
+// Validate checks the configuration without binding anything
+func (c WebSocketConfig) Validate() error {
+	if c.Mode != WebSocketModeServer && c.Mode != WebSocketModeClient {
+		return NewTransportError("invalid WebSocket mode: "+c.Mode, 6001, nil)
+	}
+	if !strings.HasPrefix(c.Path, "/") {
+		return NewTransportError("WebSocket path must start with '/'", 6002, nil)
+	}
+	if err := validatePort(c.Port); err != nil {
+		return NewTransportError(err.Error(), 6014, nil)
+	}
+	if c.Addr != "" {
+		if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+			return NewTransportError("invalid listen address", 6003, err)
+		}
+	}
+	if c.MaxFrameSize < 1 {
+		return NewTransportError("maxFrameSize must be positive", 6015, nil)
+	}
+	if c.DialTimeout <= 0 {
+		return NewTransportError("dialTimeout must be positive", 6016, nil)
+	}
+	return validateIdentityType(c.IdentityType)
+}
+
+// WebSocketConfigFromMap converts the map form accepted by Init
+// Keys are the field names in lower camel case ("tlsConfig" for TLSConfig);
+// unknown keys and values of the wrong type are errors. Missing keys keep their defaults.
+func WebSocketConfigFromMap(config map[string]interface{}) (WebSocketConfig, error) {
+	c := DefaultWebSocketConfig()
+	err := decodeConfig(config, map[string]interface{}{
+		"mode":         &c.Mode,
+		"path":         &c.Path,
+		"addr":         &c.Addr,
+		"port":         &c.Port,
+		"tlsConfig":    &c.TLSConfig,
+		"maxFrameSize": &c.MaxFrameSize,
+		"dialTimeout":  &c.DialTimeout,
+		"identityType": &c.IdentityType,
+	})
+	return c, err
+}
+
+// MemoryConfig configures a MemoryTransport
+type MemoryConfig struct {
+	// Network is the in-process network to attach to; required
+	Network *MemoryNetwork
+	// Addr is the address to attach at ("ip:port"); it takes precedence over Port
+	// Default: "" (next free loopback port)
+	Addr string
+	// Port is the loopback port to attach at when Addr is empty; 0 picks the next free one
+	// Default: 0
+	Port int
+}
+
+// Validate checks the configuration without attaching to the network
+func (c MemoryConfig) Validate() error {
+	if c.Network == nil {
+		return NewTransportError("memory transport requires a network", 7001, nil)
+	}
+	if err := validatePort(c.Port); err != nil {
+		return NewTransportError(err.Error(), 7009, nil)
+	}
+	if c.Addr != "" {
+		if _, err := parseMemoryAddr(c.Addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MemoryConfigFromMap converts the map form accepted by Init
+// Unknown keys and values of the wrong type are errors.
+func MemoryConfigFromMap(config map[string]interface{}) (MemoryConfig, error) {
+	var c MemoryConfig
+	err := decodeConfig(config, map[string]interface{}{
+		"network": &c.Network,
+		"addr":    &c.Addr,
+		"port":    &c.Port,
+	})
+	return c, err
+}
+
+// parseMemoryAddr parses an "ip:port" memory network address
+func parseMemoryAddr(addr string) (*net.UDPAddr, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, NewTransportError("invalid address", 7002, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	ip := net.ParseIP(host)
+	if err != nil || ip == nil || port < 0 || port > 65535 {
+		return nil, NewTransportError("invalid address", 7002, err)
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, nil
+}
+
+// decodeConfig copies the values of a map config into the fields it names
+// fields maps each accepted key to a pointer to its field. A value must have
+// exactly the field's type, so a plain int is rejected where a time.Duration is
+// expected; nil clears pointer and slice fields.
+func decodeConfig(config map[string]interface{}, fields map[string]interface{}) error {
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		field, known := fields[key]
+		if !known {
+			return NewTransportError(unknownKeyMessage(key, fields), 1004, nil)
+		}
+
+		target := reflect.ValueOf(field).Elem()
+		value := reflect.ValueOf(config[key])
+		switch {
+		case !value.IsValid():
+			switch target.Kind() {
+			case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+				target.Set(reflect.Zero(target.Type()))
+			default:
+				return NewTransportError(fmt.Sprintf("config key %q must be %s, got nil", key, target.Type()), 1005, nil)
+			}
+		case value.Type() == target.Type():
+			target.Set(value)
+		default:
+			return NewTransportError(fmt.Sprintf("config key %q must be %s, got %s", key, target.Type(), value.Type()), 1005, nil)
+		}
+	}
+	return nil
+}
+
+// unknownKeyMessage describes an unknown key, suggesting an accepted key that differs only in case
+func unknownKeyMessage(key string, fields map[string]interface{}) string {
+	for known := range fields {
+		if strings.EqualFold(known, key) {
+			return fmt.Sprintf("unknown config key %q (did you mean %q?)", key, known)
+		}
+	}
+	return fmt.Sprintf("unknown config key %q", key)
+}
+
+// validatePort checks a port number; 0 means any free port
+func validatePort(port int) error {
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("port must be between 0 and 65535, got %d", port)
+	}
+	return nil
+}
+
+// validateIdentityType checks an identityType setting; empty keeps the default
+func validateIdentityType(typeName string) error {
+	if typeName == "" {
+		return nil
+	}
+	if _, err := identity.ParseIdentityType(typeName); err != nil {
+		return NewTransportError("invalid identityType", 3013, err)
+	}
+	return nil
+}
@@ -0,0 +1,379 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// 拥塞控制参数（字节）
+const (
+	// congestionMSS 是拥塞窗口增长的单位，近似一个典型数据包的大小
+	congestionMSS = 1200
+
+	congestionInitialWindow = 10 * congestionMSS
+	congestionMinWindow     = 2 * congestionMSS
+	congestionMaxWindow     = 1024 * congestionMSS
+
+	// congestionDefaultRTT 在还没有RTT样本时用于计算恢复期长度
+	congestionDefaultRTT = 100 * time.Millisecond
+
+	// pacingGain 使发送速率略高于 拥塞窗口/SRTT，以便探测可用带宽
+	pacingGain = 1.25
+
+	// pacingBurstInterval 决定令牌桶容量：允许以当前速率突发这段时间的数据
+	pacingBurstInterval = time.Millisecond
+
+	// congestionIdleTimeout 是拥塞控制器的空闲过期时间，过期后重新从初始窗口开始
+	congestionIdleTimeout = 10 * time.Minute
+)
+
+// CongestionStats 是单个对等节点拥塞控制器的状态快照
+type CongestionStats struct {
+	CongestionWindow   int           // 拥塞窗口（字节）
+	SlowStartThreshold int           // 慢启动阈值（字节）
+	BytesInFlight      int           // 已发送未确认的可靠数据（字节）
+	PacingRate         int64         // 当前发送速率上限（字节/秒），0表示不限速
+	SRTT               time.Duration // 平滑往返时间
+	LossEvents         uint64        // 触发窗口减半或重置的丢包事件数
+	PacedPackets       uint64        // 因发送节奏控制而被延迟的数据包数
+}
+
+// congestionController 是发往单个对等节点的AIMD拥塞控制器和令牌桶发送节奏控制器
+// 可靠数据受拥塞窗口限制；可靠和不可靠数据共享同一个令牌桶，
+// 令牌桶速率由 拥塞窗口/SRTT 推出，并受 maxRate 限制
+type congestionController struct {
+	mu sync.Mutex
+
+	// enabled 为false时只按 maxRate 限速，不使用拥塞窗口
+	enabled bool
+	maxRate int64
+
+	cwnd        int
+	ssthresh    int
+	inFlight    int
+	srtt        time.Duration
+	recoveryEnd time.Time
+
+	// 令牌桶，tokens 可以为负，表示已预约的发送时间
+	tokens     float64
+	lastRefill time.Time
+
+	// released 在在途数据减少时关闭并替换，用于唤醒等待拥塞窗口的发送方
+	released chan struct{}
+
+	lossEvents   uint64
+	pacedPackets uint64
+
+	// lastUsed 是最近一次取用控制器的时间，由 t.congestionMu 保护
+	lastUsed time.Time
+}
+
+// newCongestionController 创建拥塞控制器
+func newCongestionController(enabled bool, maxRate int64) *congestionController {
+	return &congestionController{
+		enabled:    enabled,
+		maxRate:    maxRate,
+		cwnd:       congestionInitialWindow,
+		ssthresh:   congestionMaxWindow,
+		lastRefill: time.Now(),
+		released:   make(chan struct{}),
+	}
+}
+
+// pacingRate 返回当前发送速率（字节/秒），0表示不限速
+// 调用时必须持有 c.mu
+func (c *congestionController) pacingRate() float64 {
+	var rate float64
+	if c.enabled && c.srtt > 0 {
+		rate = pacingGain * float64(c.cwnd) / c.srtt.Seconds()
+	}
+	if c.maxRate > 0 && (rate == 0 || float64(c.maxRate) < rate) {
+		rate = float64(c.maxRate)
+	}
+	return rate
+}
+
+// refill 按流逝的时间补充令牌，返回当前速率
+// 调用时必须持有 c.mu
+func (c *congestionController) refill(now time.Time) float64 {
+	rate := c.pacingRate()
+	elapsed := now.Sub(c.lastRefill)
+	c.lastRefill = now
+	if rate == 0 {
+		c.tokens = 0
+		return 0
+	}
+
+	burst := rate * pacingBurstInterval.Seconds()
+	if burst < 2*congestionMSS {
+		burst = 2 * congestionMSS
+	}
+	if elapsed > 0 {
+		c.tokens += rate * elapsed.Seconds()
+	}
+	if c.tokens > burst {
+		c.tokens = burst
+	}
+	return rate
+}
+
+// acquire 为发送 size 字节获取许可
+// 可靠数据先等待拥塞窗口空间，再按令牌桶等待发送时机；timeout 为0表示一直等待
+func (c *congestionController) acquire(ctx context.Context, size int, timeout time.Duration, reliable bool) error {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	// 等待拥塞窗口（至少允许一个数据包在途，避免大包永远发不出去）
+	reliable = reliable && c.enabled
+	c.mu.Lock()
+	for reliable && c.inFlight > 0 && c.inFlight >= c.cwnd {
+		released := c.released
+		c.mu.Unlock()
+
+		var expired <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			expired = timer.C
+		}
+		select {
+		case <-released:
+		case <-expired:
+			return NewTransportError("congestion window full", 3029, nil)
+		case <-ctx.Done():
+			return NewTransportError("transport is closed", 3002, nil)
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		c.mu.Lock()
+	}
+
+	// 按令牌桶计算发送时机，先检查再扣除，超时的发送不占用预算
+	now := time.Now()
+	var wait time.Duration
+	if rate := c.refill(now); rate > 0 && c.tokens < float64(size) {
+		wait = time.Duration((float64(size) - c.tokens) / rate * float64(time.Second))
+		if !deadline.IsZero() && now.Add(wait).After(deadline) {
+			c.mu.Unlock()
+			return NewTransportError("pacing delay exceeds write timeout", 3030, nil)
+		}
+		c.pacedPackets++
+	}
+	if c.pacingRate() > 0 {
+		c.tokens -= float64(size)
+	}
+	if reliable {
+		c.inFlight += size
+	}
+	c.mu.Unlock()
+
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			if reliable {
+				c.onDrop(size)
+			}
+			return NewTransportError("transport is closed", 3002, nil)
+		}
+	}
+	return nil
+}
+
+// charge 为重传扣除令牌但不等待，后续发送会因此被推迟
+func (c *congestionController) charge(size int, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.refill(now) > 0 {
+		c.tokens -= float64(size)
+	}
+}
+
+// onRTT 用一个新的往返时间样本更新SRTT（仅用于未重传过的数据包，Karn算法）
+func (c *congestionController) onRTT(rtt time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if rtt <= 0 {
+		return
+	}
+	if c.srtt == 0 {
+		c.srtt = rtt
+	} else {
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+}
+
+// onAck 处理一个可靠数据包被确认：减少在途数据并增长窗口
+func (c *congestionController) onAck(size int, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.enabled {
+		return
+	}
+
+	c.release(size)
+
+	// 恢复期内不增长窗口
+	if now.Before(c.recoveryEnd) {
+		return
+	}
+	if c.cwnd < c.ssthresh {
+		// 慢启动：每确认一个字节窗口增长一个字节
+		c.cwnd += size
+	} else {
+		// 拥塞避免：每个RTT大约增长一个MSS
+		growth := congestionMSS * size / c.cwnd
+		if growth < 1 {
+			growth = 1
+		}
+		c.cwnd += growth
+	}
+	if c.cwnd > congestionMaxWindow {
+		c.cwnd = congestionMaxWindow
+	}
+}
+
+// onLoss 处理一次丢包（重传）：每个恢复期只将窗口减半一次
+func (c *congestionController) onLoss(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.enabled || now.Before(c.recoveryEnd) {
+		return
+	}
+
+	c.lossEvents++
+	c.ssthresh = c.cwnd / 2
+	if c.ssthresh < congestionMinWindow {
+		c.ssthresh = congestionMinWindow
+	}
+	c.cwnd = c.ssthresh
+	c.recoveryEnd = now.Add(c.recoveryPeriod())
+}
+
+// onTimeout 处理重传超时：窗口重置为最小值，重新慢启动
+func (c *congestionController) onTimeout(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.enabled {
+		return
+	}
+
+	if !now.Before(c.recoveryEnd) {
+		c.lossEvents++
+		c.ssthresh = c.cwnd / 2
+		if c.ssthresh < congestionMinWindow {
+			c.ssthresh = congestionMinWindow
+		}
+	}
+	c.cwnd = congestionMinWindow
+	c.recoveryEnd = now.Add(c.recoveryPeriod())
+}
+
+// onDrop 处理一个不再等待确认的可靠数据包（放弃重传或发送失败）
+func (c *congestionController) onDrop(size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.enabled {
+		c.release(size)
+	}
+}
+
+// release 减少在途数据并唤醒等待拥塞窗口的发送方
+// 调用时必须持有 c.mu
+func (c *congestionController) release(size int) {
+	c.inFlight -= size
+	if c.inFlight < 0 {
+		c.inFlight = 0
+	}
+	close(c.released)
+	c.released = make(chan struct{})
+}
+
+// recoveryPeriod 返回一次丢包反应后的恢复期长度（约一个RTT）
+// 调用时必须持有 c.mu
+func (c *congestionController) recoveryPeriod() time.Duration {
+	if c.srtt > 0 {
+		return c.srtt
+	}
+	return congestionDefaultRTT
+}
+
+// stats 返回拥塞控制器的状态快照
+func (c *congestionController) stats() CongestionStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CongestionStats{
+		CongestionWindow:   c.cwnd,
+		SlowStartThreshold: c.ssthresh,
+		BytesInFlight:      c.inFlight,
+		PacingRate:         int64(c.pacingRate()),
+		SRTT:               c.srtt,
+		LossEvents:         c.lossEvents,
+		PacedPackets:       c.pacedPackets,
+	}
+}
+
+// configureCongestion 应用拥塞控制相关配置
+func (t *UDPTransport) configureCongestion(config UDPConfig) {
+	t.congestionControl = config.CongestionControl
+	t.maxSendRate = int64(config.MaxSendRate)
+}
+
+// getCongestion 获取或创建发往 addr 的拥塞控制器
+func (t *UDPTransport) getCongestion(addr *net.UDPAddr) *congestionController {
+	key := addr.String()
+
+	t.congestionMu.Lock()
+	defer t.congestionMu.Unlock()
+
+	c, exists := t.congestion[key]
+	if !exists {
+		c = newCongestionController(t.congestionControl, t.maxSendRate)
+		t.congestion[key] = c
+	}
+	c.lastUsed = time.Now()
+	return c
+}
+
+// expireCongestion 删除空闲过久的拥塞控制器
+// 仍有在途数据的控制器被待确认数据包引用，不能删除
+func (t *UDPTransport) expireCongestion(now time.Time) {
+	t.congestionMu.Lock()
+	defer t.congestionMu.Unlock()
+
+	for key, c := range t.congestion {
+		if now.Sub(c.lastUsed) <= congestionIdleTimeout {
+			continue
+		}
+		c.mu.Lock()
+		idle := c.inFlight == 0
+		c.mu.Unlock()
+		if idle {
+			delete(t.congestion, key)
+		}
+	}
+}
+
+// admit 在写出数据包前等待拥塞窗口和发送节奏许可
+func (t *UDPTransport) admit(c *congestionController, size int, reliable bool) error {
+	return c.acquire(t.ctx, size, t.getWriteTimeout(), reliable)
+}
+
+// GetCongestionStats 返回发往 addr 的拥塞控制状态
+func (t *UDPTransport) GetCongestionStats(addr net.Addr) (CongestionStats, bool) {
+	t.congestionMu.Lock()
+	c, exists := t.congestion[t.endpointKey(addr)]
+	t.congestionMu.Unlock()
+	if !exists {
+		return CongestionStats{}, false
+	}
+	return c.stats(), true
+}
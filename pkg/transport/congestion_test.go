@@ -0,0 +1,104 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCongestionControllerAIMD tests slow start, multiplicative decrease and timeout reset
+func TestCongestionControllerAIMD(t *testing.T) {
+	c := newCongestionController(true, 0)
+	now := time.Now()
+	ctx := context.Background()
+
+	// Slow start: the window grows by every acknowledged byte
+	require.NoError(t, c.acquire(ctx, congestionMSS, 0, true))
+	assert.Equal(t, congestionMSS, c.stats().BytesInFlight)
+	c.onRTT(10 * time.Millisecond)
+	c.onAck(congestionMSS, now)
+	stats := c.stats()
+	assert.Equal(t, congestionInitialWindow+congestionMSS, stats.CongestionWindow)
+	assert.Equal(t, 0, stats.BytesInFlight)
+	assert.Equal(t, 10*time.Millisecond, stats.SRTT)
+	assert.Equal(t, int64(pacingGain*float64(stats.CongestionWindow)/0.01), stats.PacingRate)
+
+	// Losses within one recovery period halve the window only once
+	c.onLoss(now)
+	c.onLoss(now.Add(5 * time.Millisecond))
+	stats = c.stats()
+	assert.Equal(t, (congestionInitialWindow+congestionMSS)/2, stats.CongestionWindow)
+	assert.Equal(t, stats.CongestionWindow, stats.SlowStartThreshold)
+	assert.Equal(t, uint64(1), stats.LossEvents)
+
+	// Congestion avoidance: about one MSS per window of acknowledged data
+	after := now.Add(20 * time.Millisecond)
+	window := stats.CongestionWindow
+	c.onAck(window, after)
+	assert.Equal(t, window+congestionMSS, c.stats().CongestionWindow)
+
+	// A retransmission timeout restarts slow start from the minimum window
+	c.onTimeout(after.Add(20 * time.Millisecond))
+	stats = c.stats()
+	assert.Equal(t, congestionMinWindow, stats.CongestionWindow)
+	assert.Equal(t, uint64(2), stats.LossEvents)
+}
+
+// TestCongestionControllerWindowLimit tests that reliable sends block on a full window
+func TestCongestionControllerWindowLimit(t *testing.T) {
+	c := newCongestionController(true, 0)
+	ctx := context.Background()
+
+	for sent := 0; sent < congestionInitialWindow; sent += congestionMSS {
+		require.NoError(t, c.acquire(ctx, congestionMSS, 0, true))
+	}
+
+	// Unreliable packets are not limited by the window
+	require.NoError(t, c.acquire(ctx, congestionMSS, 10*time.Millisecond, false))
+
+	err := c.acquire(ctx, congestionMSS, 20*time.Millisecond, true)
+	var transportErr *TransportError
+	require.True(t, errors.As(err, &transportErr))
+	assert.Equal(t, 3029, transportErr.Code)
+
+	// An acknowledgment wakes a blocked sender
+	done := make(chan error, 1)
+	go func() { done <- c.acquire(ctx, congestionMSS, time.Second, true) }()
+	time.Sleep(10 * time.Millisecond)
+	c.onAck(congestionMSS, time.Now())
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("sender was not woken by the acknowledgment")
+	}
+}
+
+// TestCongestionControllerPacing tests the token bucket rate limit
+func TestCongestionControllerPacing(t *testing.T) {
+	c := newCongestionController(false, 100000)
+	ctx := context.Background()
+
+	// 2 MSS of burst, then 1000 bytes every 10ms
+	start := time.Now()
+	for i := 0; i < 12; i++ {
+		require.NoError(t, c.acquire(ctx, 1000, 0, false))
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+	stats := c.stats()
+	assert.Equal(t, int64(100000), stats.PacingRate)
+	assert.Greater(t, stats.PacedPackets, uint64(0))
+
+	// A delay beyond the write timeout is refused without spending budget
+	for i := 0; i < 5; i++ {
+		c.charge(1000, time.Now())
+	}
+	err := c.acquire(ctx, 1000, 5*time.Millisecond, false)
+	var transportErr *TransportError
+	require.True(t, errors.As(err, &transportErr))
+	assert.Equal(t, 3030, transportErr.Code)
+}
@@ -0,0 +1,335 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultInboundQueueSize is the number of received packets a connection buffers
+// before new ones are dropped
+const DefaultInboundQueueSize = 256
+
+// peerConnection is a Connection to one remote address over a shared transport
+// Outgoing data goes straight to the transport. Incoming packets are routed to the
+// connection by DefaultConnectionManager.Handler and wait in a bounded queue until
+// Receive reads them; when the queue is full new packets are dropped and listeners
+// get an EventError.
+type peerConnection struct {
+	manager   *DefaultConnectionManager
+	transport Transport
+	localAddr net.Addr
+
+	mu           sync.Mutex
+	remoteAddr   net.Addr
+	state        ConnectionState
+	queue        [][]byte
+	queueSize    int
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	// lastReceived and lastSent record traffic in either direction, keepalives included
+	lastReceived time.Time
+	lastSent     time.Time
+
+	// wake is closed and replaced whenever data arrives or the state changes
+	wake chan struct{}
+}
+
+// newPeerConnection creates a connection in the connected state
+func newPeerConnection(manager *DefaultConnectionManager, localAddr, remoteAddr net.Addr, queueSize int) *peerConnection {
+	now := time.Now()
+	return &peerConnection{
+		manager:      manager,
+		transport:    manager.transport,
+		localAddr:    localAddr,
+		remoteAddr:   remoteAddr,
+		state:        StateConnected,
+		queueSize:    queueSize,
+		lastReceived: now,
+		lastSent:     now,
+		wake:         make(chan struct{}),
+	}
+}
+
+// GetState returns the connection state
+func (c *peerConnection) GetState() ConnectionState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// GetRemoteAddr returns the remote address
+func (c *peerConnection) GetRemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remoteAddr
+}
+
+// GetLocalAddr returns the local address
+func (c *peerConnection) GetLocalAddr() net.Addr {
+	return c.localAddr
+}
+
+// LastReceived returns when the peer was last heard from, or when the connection was made
+func (c *peerConnection) LastReceived() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastReceived
+}
+
+// LastSent returns when data or a keepalive was last sent, or when the connection was made
+func (c *peerConnection) LastSent() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastSent
+}
+
+// SetReadTimeout sets how long Receive waits for data; 0 waits indefinitely
+func (c *peerConnection) SetReadTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return NewTransportError("read timeout cannot be negative", 4016, nil)
+	}
+	c.mu.Lock()
+	c.readTimeout = timeout
+	c.mu.Unlock()
+	return nil
+}
+
+// SetWriteTimeout sets how long Send waits for the transport; 0 waits indefinitely
+func (c *peerConnection) SetWriteTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return NewTransportError("write timeout cannot be negative", 4034, nil)
+	}
+	c.mu.Lock()
+	c.writeTimeout = timeout
+	c.mu.Unlock()
+	return nil
+}
+
+// Connect reconnects a disconnected connection and registers it with the manager again
+// remoteAddr may be nil or must match the connection's remote address.
+func (c *peerConnection) Connect(remoteAddr net.Addr) error {
+	c.mu.Lock()
+	if remoteAddr != nil && remoteAddr.String() != c.remoteAddr.String() {
+		c.mu.Unlock()
+		return NewTransportError("connection belongs to "+c.remoteAddr.String(), 4021, nil)
+	}
+	if c.state != StateDisconnected {
+		c.mu.Unlock()
+		return nil
+	}
+	c.setStateLocked(StateConnecting)
+	c.mu.Unlock()
+
+	if err := c.manager.register(c); err != nil {
+		c.mu.Lock()
+		c.setStateLocked(StateDisconnected)
+		c.mu.Unlock()
+		return err
+	}
+
+	c.mu.Lock()
+	// A reconnected peer gets a full timeout before it is considered dead again
+	c.lastReceived = time.Now()
+	c.setStateLocked(StateConnected)
+	c.mu.Unlock()
+	c.manager.notifyListeners(c, EventConnected, nil, nil)
+	return nil
+}
+
+// Disconnect closes the connection and removes it from the manager
+// Packets already queued can still be read; Receive then reports io.EOF.
+func (c *peerConnection) Disconnect() error {
+	if !c.close() {
+		return nil
+	}
+	c.manager.unregister(c)
+	c.manager.notifyListeners(c, EventDisconnected, nil, nil)
+	return nil
+}
+
+// Send sends data to the remote address through the transport
+func (c *peerConnection) Send(data []byte) error {
+	return c.send(data, func(remoteAddr net.Addr) error {
+		return c.transport.Send(remoteAddr, data)
+	})
+}
+
+// SendClass sends data to the remote endpoint in the given traffic class
+func (c *peerConnection) SendClass(data []byte, class TrafficClass) error {
+	return c.send(data, func(remoteAddr net.Addr) error {
+		return sendWithClass(c.transport, remoteAddr, data, class)
+	})
+}
+
+// send checks the connection state and calls write, bounded by the write timeout
+func (c *peerConnection) send(data []byte, write func(remoteAddr net.Addr) error) error {
+	c.mu.Lock()
+	state, remoteAddr, timeout := c.state, c.remoteAddr, c.writeTimeout
+	c.mu.Unlock()
+	if state != StateConnected {
+		return NewTransportError("connection to "+remoteAddr.String()+" is "+state.String(), 4017, nil)
+	}
+
+	if timeout == 0 {
+		return c.sent(len(data), write(remoteAddr))
+	}
+
+	result := make(chan error, 1)
+	go func() { result <- write(remoteAddr) }()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return c.sent(len(data), err)
+	case <-timer.C:
+		return NewTransportError("write to "+remoteAddr.String()+" timed out", 4019, nil)
+	}
+}
+
+// unreliableSender is implemented by transports that can send without ACKs or retransmission
+type unreliableSender interface {
+	SendUnreliable(dstAddr net.Addr, data []byte) error
+}
+
+// sendKeepalive sends an empty packet to the peer
+// Transports with an unreliable path use it, so keepalives are never retransmitted
+// and never count as failed deliveries.
+func (c *peerConnection) sendKeepalive() error {
+	c.mu.Lock()
+	state, remoteAddr := c.state, c.remoteAddr
+	c.mu.Unlock()
+	if state != StateConnected {
+		return nil
+	}
+
+	if sender, ok := c.transport.(unreliableSender); ok {
+		return c.sent(0, sender.SendUnreliable(remoteAddr, nil))
+	}
+	return c.sent(0, c.transport.Send(remoteAddr, nil))
+}
+
+// sent records a successful send of size bytes and returns err unchanged
+func (c *peerConnection) sent(size int, err error) error {
+	if err == nil {
+		c.mu.Lock()
+		c.lastSent = time.Now()
+		remoteAddr := c.remoteAddr
+		c.mu.Unlock()
+		c.manager.stats.sent(remoteAddr, size)
+	}
+	return err
+}
+
+// Receive copies the next queued packet into buffer
+// It waits up to the read timeout for a packet to arrive. A packet larger than buffer
+// is truncated and reported with an error, like a datagram socket.
+func (c *peerConnection) Receive(buffer []byte) (int, error) {
+	c.mu.Lock()
+	timeout := c.readTimeout
+	c.mu.Unlock()
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		c.mu.Lock()
+		if len(c.queue) > 0 {
+			data := c.queue[0]
+			c.queue[0] = nil
+			c.queue = c.queue[1:]
+			c.mu.Unlock()
+
+			n := copy(buffer, data)
+			if n < len(data) {
+				return n, NewTransportError("packet truncated to fit the receive buffer", 4020, nil)
+			}
+			return n, nil
+		}
+		if c.state == StateDisconnected {
+			c.mu.Unlock()
+			return 0, NewTransportError("connection is closed", 4036, io.EOF)
+		}
+		wake := c.wake
+		c.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-deadline:
+			return 0, NewTransportError("read timed out", 4018, nil)
+		}
+	}
+}
+
+// deliver queues a received packet, returning false if the queue is full or the connection closed
+func (c *peerConnection) deliver(data []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state != StateConnected {
+		return false
+	}
+	// The peer is alive even if its packet has to be dropped
+	c.lastReceived = time.Now()
+	if len(c.queue) >= c.queueSize {
+		return false
+	}
+	packet := make([]byte, len(data))
+	copy(packet, data)
+	c.queue = append(c.queue, packet)
+	c.signalLocked()
+	return true
+}
+
+// touch records a keepalive from the peer
+func (c *peerConnection) touch() {
+	c.mu.Lock()
+	c.lastReceived = time.Now()
+	c.mu.Unlock()
+}
+
+// idle reports how long the connection has gone without receiving and without sending
+func (c *peerConnection) idle(now time.Time) (received, sent time.Duration, connected bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return now.Sub(c.lastReceived), now.Sub(c.lastSent), c.state == StateConnected
+}
+
+// queueDepth returns the number of packets waiting for Receive
+func (c *peerConnection) queueDepth() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.queue)
+}
+
+// close moves the connection to the disconnected state, returning false if it already was
+func (c *peerConnection) close() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == StateDisconnected {
+		return false
+	}
+	c.setStateLocked(StateDisconnected)
+	return true
+}
+
+// setStateLocked changes the state and wakes waiting readers
+// Must be called with c.mu held
+func (c *peerConnection) setStateLocked(state ConnectionState) {
+	c.state = state
+	c.signalLocked()
+}
+
+// signalLocked wakes every goroutine waiting in Receive
+// Must be called with c.mu held
+func (c *peerConnection) signalLocked() {
+	close(c.wake)
+	c.wake = make(chan struct{})
+}
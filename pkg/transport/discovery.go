@@ -21,6 +21,10 @@ const (
 	DiscoveryTypeResponse
 	DiscoveryTypePing
 	DiscoveryTypePong
+	// DiscoveryTypeCookie answers a Hello under load with a cookie: header + cookie
+	DiscoveryTypeCookie
+	// DiscoveryTypeHelloCookie is a Hello repeated with a cookie: header + cookie + public key
+	DiscoveryTypeHelloCookie
 )
 
 // DiscoveryManager is responsible for node discovery and peer management
@@ -57,6 +61,18 @@ type DiscoveryManager struct {
 
 	// Maximum retry attempts
 	maxRetries int
+
+	// Flood protection for incoming messages, nil if disabled
+	guard *HandshakeGuard
+
+	// Hellos awaiting a response, keyed by address string, with any cookie the peer sent back
+	hellos map[string]*discoveryHello
+}
+
+// discoveryHello is a Hello we sent and have not had a response to
+type discoveryHello struct {
+	sent   time.Time
+	cookie []byte
 }
 
 // DiscoveredPeer represents a peer found through the discovery protocol
@@ -90,6 +106,7 @@ func NewDiscoveryManager(localIdentity *identity.Identity, transport Transport)
 		localIdentity:     localIdentity,
 		transport:         transport,
 		peers:             make(map[string]*DiscoveredPeer),
+		hellos:            make(map[string]*discoveryHello),
 		ctx:               ctx,
 		cancel:            cancel,
 		rand:              random,
@@ -117,13 +134,37 @@ func (dm *DiscoveryManager) Stop() error {
 	return nil
 }
 
+// SetHandshakeGuard rate-limits incoming discovery messages per source and requires
+// Hellos to carry a cookie while the guard is under load; nil disables it
+func (dm *DiscoveryManager) SetHandshakeGuard(guard *HandshakeGuard) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	dm.guard = guard
+}
+
 // SendDiscoveryHello 向指定地址发送发现Hello消息
 func (dm *DiscoveryManager) SendDiscoveryHello(addr net.Addr) error {
+	// Remember the Hello so that a cookie sent back for it is accepted
+	key := addr.String()
+	dm.mu.Lock()
+	hello, exists := dm.hellos[key]
+	if !exists {
+		hello = &discoveryHello{}
+		dm.hellos[key] = hello
+	}
+	hello.sent = time.Now()
+	cookie := hello.cookie
+	dm.mu.Unlock()
+
 	// Construct Hello message
 	message := dm.buildDiscoveryMessage(DiscoveryTypeHello)
+	if cookie != nil {
+		withCookie := dm.buildDiscoveryMessage(DiscoveryTypeHelloCookie)
+		message = append(append(withCookie[:10:10], cookie...), withCookie[10:]...)
+	}
 
 	// Send message through transport layer
-	return dm.transport.Send(addr, message)
+	return sendWithClass(dm.transport, addr, message, TrafficClassControl)
 }
 
 // SendDiscoveryPing 向指定地址发送Ping消息
@@ -132,7 +173,7 @@ func (dm *DiscoveryManager) SendDiscoveryPing(addr net.Addr) error {
 	message := dm.buildDiscoveryMessage(DiscoveryTypePing)
 
 	// 通过传输层发送消息
-	return dm.transport.Send(addr, message)
+	return sendWithClass(dm.transport, addr, message, TrafficClassControl)
 }
 
 // HandleDiscoveryMessage 处理接收到的发现消息
@@ -151,10 +192,40 @@ func (dm *DiscoveryManager) HandleDiscoveryMessage(addr net.Addr, data []byte) e
 		return fmt.Errorf("unsupported discovery protocol version: %d", version)
 	}
 
+	// Rate limiting, and cookies for Hellos under load
+	dm.mu.RLock()
+	guard := dm.guard
+	dm.mu.RUnlock()
+	if msgType == DiscoveryTypeHelloCookie && len(data) < 10+CookieSize {
+		return fmt.Errorf("invalid hello message format")
+	}
+	if guard != nil {
+		if msgType == DiscoveryTypeHello || msgType == DiscoveryTypeHelloCookie {
+			var cookie []byte
+			if msgType == DiscoveryTypeHelloCookie {
+				cookie = data[10 : 10+CookieSize]
+			}
+			switch guard.Admit(addr, cookie) {
+			case GuardDrop:
+				return fmt.Errorf("discovery hello from %s rate limited", addr)
+			case GuardChallenge:
+				// Stateless: the peer is only recorded once the Hello comes back with the cookie
+				message := dm.buildDiscoveryMessage(DiscoveryTypeCookie)
+				return sendWithClass(dm.transport, addr, append(message[:10:10], guard.Cookie(addr)...), TrafficClassControl)
+			}
+		} else if !guard.Allow(addr) {
+			return fmt.Errorf("discovery message from %s rate limited", addr)
+		}
+	}
+
 	// Handle different message types
 	switch msgType {
 	case DiscoveryTypeHello:
 		return dm.handleHelloMessage(addr, data)
+	case DiscoveryTypeHelloCookie:
+		return dm.handleHelloMessage(addr, append(data[:10:10], data[10+CookieSize:]...))
+	case DiscoveryTypeCookie:
+		return dm.handleCookieMessage(addr, data)
 	case DiscoveryTypeResponse:
 		return dm.handleResponseMessage(addr, data)
 	case DiscoveryTypePing:
@@ -227,7 +298,7 @@ func (dm *DiscoveryManager) handleHelloMessage(addr net.Addr, data []byte) error
 
 	// Send response message
 	response := dm.buildDiscoveryMessage(DiscoveryTypeResponse)
-	return dm.transport.Send(addr, response)
+	return sendWithClass(dm.transport, addr, response, TrafficClassControl)
 }
 
 // handleResponseMessage processes Response messages
@@ -246,16 +317,38 @@ func (dm *DiscoveryManager) handleResponseMessage(addr net.Addr, data []byte) er
 	}
 
 	// 保存对等节点信息
+	dm.mu.Lock()
+	delete(dm.hellos, addr.String())
+	dm.mu.Unlock()
 	dm.addOrUpdatePeer(peerIdentity, addr, true)
 
 	return nil
 }
 
+// handleCookieMessage stores the cookie for a Hello we sent and repeats the Hello with it
+// Cookies for addresses we have not said Hello to are ignored
+func (dm *DiscoveryManager) handleCookieMessage(addr net.Addr, data []byte) error {
+	if len(data) != 10+CookieSize {
+		return fmt.Errorf("invalid cookie message format")
+	}
+
+	dm.mu.Lock()
+	hello, exists := dm.hellos[addr.String()]
+	if !exists || time.Since(hello.sent) > dm.discoveryTimeout || string(hello.cookie) == string(data[10:]) {
+		dm.mu.Unlock()
+		return nil
+	}
+	hello.cookie = append([]byte(nil), data[10:]...)
+	dm.mu.Unlock()
+
+	return dm.SendDiscoveryHello(addr)
+}
+
 // handlePingMessage processes Ping messages
 func (dm *DiscoveryManager) handlePingMessage(addr net.Addr, _ []byte) error {
 	// Send Pong response
 	pong := dm.buildDiscoveryMessage(DiscoveryTypePong)
-	return dm.transport.Send(addr, pong)
+	return sendWithClass(dm.transport, addr, pong, TrafficClassControl)
 }
 
 // handlePongMessage processes Pong messages
@@ -330,6 +423,11 @@ func (dm *DiscoveryManager) cleanupExpiredPeers() {
 					delete(dm.peers, addr)
 				}
 			}
+			for addr, hello := range dm.hellos {
+				if now.Sub(hello.sent) > dm.discoveryTimeout {
+					delete(dm.hellos, addr)
+				}
+			}
 			dm.mu.Unlock()
 		case <-dm.ctx.Done():
 			return
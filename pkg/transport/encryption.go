@@ -0,0 +1,266 @@
+package transport
+
+import (
+	"crypto/rand"
+	"sync"
+
+	"github.com/stella/virtual-switch/pkg/crypto"
+	"github.com/stella/virtual-switch/pkg/identity"
+	"github.com/stella/virtual-switch/pkg/keystore"
+)
+
+// sessionCrypto 保存加密传输共用的密钥材料和会话密钥缓存
+// 各传输实现通过嵌入该结构获得统一的公钥管理和密钥协商行为
+type sessionCrypto struct {
+	cryptoMux        sync.RWMutex
+	keyPair          *crypto.KeyPair
+	keyType          identity.IdentityType // 本地密钥类型，决定密钥协商算法
+	keyStore         keystore.KeyStore     // 外部密钥存储，设置后私钥不在传输层中
+	peerKeys         map[string][]byte     // 地址到公钥的映射
+	sessionKeys      map[string][]byte     // 地址到已派生会话密钥的缓存
+	cipherSuite      uint8                 // 使用的加密套件
+	enableEncryption bool                  // 是否启用加密
+}
+
+// initSessionCrypto 生成临时密钥对并设置默认加密参数
+func (c *sessionCrypto) initSessionCrypto() {
+	// 生成密钥对
+	keyPair, err := crypto.GenerateKeyPair()
+	if err != nil {
+		// 如果密钥生成失败，使用默认空密钥
+		keyPair = &crypto.KeyPair{}
+	}
+
+	c.keyPair = keyPair
+	c.keyType = identity.IdentityTypeC25519
+	c.peerKeys = make(map[string][]byte)
+	c.sessionKeys = make(map[string][]byte)
+	c.cipherSuite = crypto.CipherC25519_POLY1305_SALSA2012
+	c.enableEncryption = true
+}
+
+// applyKeyType 处理 identityType 配置项，空字符串保持当前类型
+func (c *sessionCrypto) applyKeyType(typeName string) error {
+	if typeName == "" {
+		return nil
+	}
+	// 配置本地密钥类型，类型变化时重新生成临时密钥对
+	keyType, err := identity.ParseIdentityType(typeName)
+	if err != nil {
+		return NewTransportError("invalid identityType", 3013, err)
+	}
+	if keyType != c.keyType {
+		keyPair, err := keyType.GenerateKeyPair()
+		if err != nil {
+			return NewTransportError("failed to generate key pair", 3014, err)
+		}
+		c.cryptoMux.Lock()
+		c.keyType = keyType
+		c.keyPair = keyPair
+		c.keyStore = nil
+		c.sessionKeys = make(map[string][]byte)
+		c.cryptoMux.Unlock()
+	}
+	return nil
+}
+
+// SetPeerPublicKey 设置对等节点的公钥
+func (c *sessionCrypto) SetPeerPublicKey(addr string, publicKey []byte) {
+	c.cryptoMux.Lock()
+	defer c.cryptoMux.Unlock()
+	c.peerKeys[addr] = make([]byte, len(publicKey))
+	copy(c.peerKeys[addr], publicKey)
+	delete(c.sessionKeys, addr)
+}
+
+// movePeerKey 将对等节点的公钥和会话密钥从旧地址移到新地址
+func (c *sessionCrypto) movePeerKey(oldAddr, newAddr string) {
+	c.cryptoMux.Lock()
+	defer c.cryptoMux.Unlock()
+	if key, exists := c.peerKeys[oldAddr]; exists {
+		c.peerKeys[newAddr] = key
+		delete(c.peerKeys, oldAddr)
+	}
+	if key, exists := c.sessionKeys[oldAddr]; exists {
+		c.sessionKeys[newAddr] = key
+		delete(c.sessionKeys, oldAddr)
+	}
+}
+
+// removePeerKey 删除对等节点在某个地址上的公钥和会话密钥
+func (c *sessionCrypto) removePeerKey(addr string) {
+	c.cryptoMux.Lock()
+	defer c.cryptoMux.Unlock()
+	delete(c.peerKeys, addr)
+	delete(c.sessionKeys, addr)
+}
+
+// GetPublicKey 获取本地传输的公钥
+func (c *sessionCrypto) GetPublicKey() []byte {
+	c.cryptoMux.RLock()
+	defer c.cryptoMux.RUnlock()
+	return c.keyPair.Public
+}
+
+// SetIdentity 使用节点身份的密钥对替换传输层的临时密钥对
+// 密钥协商算法随身份类型切换，对等节点必须使用相同类型的密钥
+func (c *sessionCrypto) SetIdentity(id *identity.Identity) error {
+	if id == nil || !id.HasPrivateKey() {
+		return NewTransportError("identity must include a private key", 3011, nil)
+	}
+	if !id.Type.IsValid() {
+		return NewTransportError("unsupported identity type: "+id.Type.String(), 3012, nil)
+	}
+
+	c.cryptoMux.Lock()
+	defer c.cryptoMux.Unlock()
+	c.keyType = id.Type
+	c.keyPair = &crypto.KeyPair{Public: id.PublicKey, Private: id.PrivateKey}
+	c.keyStore = nil
+	c.sessionKeys = make(map[string][]byte)
+	return nil
+}
+
+// SetKeyStore 使用外部密钥存储进行密钥协商，传输层只保留公钥
+// 派生出的会话密钥按对等节点缓存，避免每个数据包都访问密钥存储
+func (c *sessionCrypto) SetKeyStore(ks keystore.KeyStore) error {
+	if ks == nil {
+		return NewTransportError("key store cannot be nil", 3015, nil)
+	}
+
+	id, err := ks.Identity()
+	if err != nil {
+		return NewTransportError("failed to read identity from key store", 3016, err)
+	}
+	if !id.Type.IsValid() {
+		return NewTransportError("unsupported identity type: "+id.Type.String(), 3012, nil)
+	}
+
+	c.cryptoMux.Lock()
+	defer c.cryptoMux.Unlock()
+	c.keyType = id.Type
+	c.keyPair = &crypto.KeyPair{Public: id.PublicKey}
+	c.keyStore = ks
+	c.sessionKeys = make(map[string][]byte)
+	return nil
+}
+
+// GetKeyType 获取本地密钥类型
+func (c *sessionCrypto) GetKeyType() identity.IdentityType {
+	c.cryptoMux.RLock()
+	defer c.cryptoMux.RUnlock()
+	return c.keyType
+}
+
+// deriveSessionKey 根据密钥类型与对等节点派生会话密钥
+// 如果没有该地址的可用公钥，返回 ok=false
+func (c *sessionCrypto) deriveSessionKey(addr string) (key []byte, ok bool, err error) {
+	c.cryptoMux.RLock()
+	if cached, exists := c.sessionKeys[addr]; exists {
+		c.cryptoMux.RUnlock()
+		return cached, true, nil
+	}
+	peerKey, exists := c.peerKeys[addr]
+	keyType := c.keyType
+	keyStore := c.keyStore
+	privateKey := c.keyPair.Private
+	c.cryptoMux.RUnlock()
+
+	if !exists || len(peerKey) != keyType.PublicKeySize() {
+		return nil, false, nil
+	}
+
+	var sharedSecret []byte
+	if keyStore != nil {
+		sharedSecret, err = keyStore.DeriveSharedSecret(peerKey)
+	} else {
+		sharedSecret, err = keyType.DeriveSharedSecret(privateKey, peerKey)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if len(sharedSecret) < 32 {
+		return nil, false, NewTransportError("shared secret too short", 3017, nil)
+	}
+
+	// 使用共享密钥的前32字节作为会话密钥
+	key = sharedSecret[:32]
+
+	c.cryptoMux.Lock()
+	// 仅当公钥在派生期间未被替换时才缓存
+	if current, exists := c.peerKeys[addr]; exists && string(current) == string(peerKey) {
+		c.sessionKeys[addr] = key
+	}
+	c.cryptoMux.Unlock()
+
+	return key, true, nil
+}
+
+// SetEncryptionEnabled 启用或禁用加密功能
+func (c *sessionCrypto) SetEncryptionEnabled(enabled bool) {
+	c.enableEncryption = enabled
+}
+
+// 流式传输（TCP、WebSocket）的帧加密格式：
+// 加密标志(1字节) + [nonce(8字节)] + 数据
+// 只有实际加密的帧才设置标志并携带nonce
+const (
+	frameFlagPlain     uint8 = 0x00
+	frameFlagEncrypted uint8 = 0x01
+)
+
+// sealFrame 按对等节点密钥加密帧负载，没有对等节点公钥时以明文发送
+func (c *sessionCrypto) sealFrame(addr string, data []byte) ([]byte, error) {
+	if c.enableEncryption {
+		key, ok, err := c.deriveSessionKey(addr)
+		if err != nil {
+			return nil, NewTransportError("failed to derive shared secret", 3009, err)
+		}
+		if ok {
+			nonce := make([]byte, 8)
+			if _, err := rand.Read(nonce); err != nil {
+				return nil, NewTransportError("failed to generate nonce", 3008, err)
+			}
+
+			encryptedData, err := crypto.EncryptSalsa2012(data, key, nonce)
+			if err != nil {
+				return nil, NewTransportError("failed to encrypt data", 3010, err)
+			}
+
+			frame := make([]byte, 0, len(encryptedData)+9)
+			frame = append(frame, frameFlagEncrypted)
+			frame = append(frame, nonce...)
+			return append(frame, encryptedData...), nil
+		}
+	}
+
+	frame := make([]byte, 0, len(data)+1)
+	frame = append(frame, frameFlagPlain)
+	return append(frame, data...), nil
+}
+
+// openFrame 解析并在需要时解密帧负载
+func (c *sessionCrypto) openFrame(addr string, frame []byte) ([]byte, error) {
+	if len(frame) < 1 {
+		return nil, NewTransportError("empty frame", 3018, nil)
+	}
+
+	switch frame[0] {
+	case frameFlagPlain:
+		return frame[1:], nil
+	case frameFlagEncrypted:
+		if len(frame) < 9 {
+			return nil, NewTransportError("encrypted frame too short", 3019, nil)
+		}
+		key, ok, err := c.deriveSessionKey(addr)
+		if err != nil {
+			return nil, NewTransportError("failed to derive shared secret", 3009, err)
+		}
+		if !ok {
+			return nil, NewTransportError("no public key for encrypted frame from "+addr, 3020, nil)
+		}
+		return crypto.DecryptSalsa2012(frame[9:], key, frame[1:9])
+	default:
+		return nil, NewTransportError("unknown frame flag", 3021, nil)
+	}
+}
@@ -9,6 +9,10 @@ type TransportType string
 const (
 	TransportTypeUDP TransportType = "udp"
 	TransportTypeTCP TransportType = "tcp"
+	// TransportTypeWebSocket tunnels packets over WebSocket for networks that only allow HTTP(S)
+	TransportTypeWebSocket TransportType = "websocket"
+	// TransportTypeMemory delivers packets through an in-process MemoryNetwork
+	TransportTypeMemory TransportType = "memory"
 )
 
 func NewTransport(transportType TransportType, config map[string]interface{}) (Transport, error) {
@@ -20,7 +24,23 @@ func NewTransport(transportType TransportType, config map[string]interface{}) (T
 		}
 		return transport, nil
 	case TransportTypeTCP:
-		return nil, errors.New("TCP transport not implemented yet")
+		transport := NewTCPTransport()
+		if err := transport.Init(config); err != nil {
+			return nil, err
+		}
+		return transport, nil
+	case TransportTypeWebSocket:
+		transport := NewWebSocketTransport()
+		if err := transport.Init(config); err != nil {
+			return nil, err
+		}
+		return transport, nil
+	case TransportTypeMemory:
+		transport := NewMemoryTransport()
+		if err := transport.Init(config); err != nil {
+			return nil, err
+		}
+		return transport, nil
 	default:
 		return nil, errors.New("unsupported transport type")
 	}
@@ -0,0 +1,339 @@
+package transport
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// CookieSize is the length of a handshake cookie
+const CookieSize = 16
+
+// guardLoadWindow is the period over which handshakes are counted to detect load,
+// and how long a node stays under load after the count last exceeded the threshold
+const guardLoadWindow = time.Second
+
+// HandshakeGuardConfig configures a HandshakeGuard
+// Start from DefaultHandshakeGuardConfig; the zero value is not valid.
+type HandshakeGuardConfig struct {
+	// Rate is how many handshake and discovery messages per second one source may send
+	// Default: 5
+	Rate float64
+	// Burst is how many messages one source may send at once
+	// Default: 10
+	Burst int
+	// MaxSources is how many sources have their own bucket; when the table is full,
+	// new sources share a single bucket, so a flood from spoofed addresses cannot
+	// exhaust memory or crowd out sources already in the table
+	// Default: 4096
+	MaxSources int
+	// LoadThreshold is the number of handshakes per second, from all sources, above
+	// which handshakes must carry a cookie; 0 requires cookies all the time
+	// Default: 200
+	LoadThreshold int
+	// CookieLifetime is how often the cookie secret rotates; a cookie stays valid
+	// for between one and two lifetimes
+	// Default: 2 minutes
+	CookieLifetime time.Duration
+}
+
+// DefaultHandshakeGuardConfig returns limits suitable for a public relay node
+func DefaultHandshakeGuardConfig() HandshakeGuardConfig {
+	return HandshakeGuardConfig{
+		Rate:           5,
+		Burst:          10,
+		MaxSources:     4096,
+		LoadThreshold:  200,
+		CookieLifetime: 2 * time.Minute,
+	}
+}
+
+// Validate checks the configuration
+func (c HandshakeGuardConfig) Validate() error {
+	if c.Rate <= 0 {
+		return NewTransportError("handshake rate must be positive", 9018, nil)
+	}
+	if c.Burst < 1 {
+		return NewTransportError("handshake burst must be at least 1", 9019, nil)
+	}
+	if c.MaxSources < 1 {
+		return NewTransportError("maxSources must be positive", 9020, nil)
+	}
+	if c.LoadThreshold < 0 {
+		return NewTransportError("loadThreshold cannot be negative", 9021, nil)
+	}
+	if c.CookieLifetime <= 0 {
+		return NewTransportError("cookieLifetime must be positive", 9022, nil)
+	}
+	return nil
+}
+
+// GuardVerdict is what a HandshakeGuard decided about a message
+type GuardVerdict int
+
+const (
+	// GuardAccept lets the message through
+	GuardAccept GuardVerdict = iota
+	// GuardDrop drops the message because its source exceeded its rate
+	GuardDrop
+	// GuardChallenge drops the handshake and answers with a cookie, which the
+	// sender must echo to prove it receives packets at its source address
+	GuardChallenge
+)
+
+// GuardStats counts a HandshakeGuard's decisions
+type GuardStats struct {
+	Accepted    uint64 `json:"accepted"`     // messages let through
+	RateLimited uint64 `json:"rate_limited"` // messages dropped by a source's bucket
+	Challenged  uint64 `json:"challenged"`   // handshakes answered with a cookie
+	BadCookies  uint64 `json:"bad_cookies"`  // handshakes with a wrong or expired cookie
+	Sources     int    `json:"sources"`      // sources with their own bucket
+	UnderLoad   bool   `json:"under_load"`   // whether cookies are currently required
+}
+
+// HandshakeGuard protects handshake and discovery handling from floods
+// Every message is charged to a per-source token bucket. Under load, handshakes
+// must also carry a stateless cookie: an HMAC of the source address under a
+// rotating secret, as in WireGuard and DTLS. A node answering a cookieless
+// handshake with a cookie keeps no state for it, and the answer is smaller than
+// the handshake, so spoofed floods neither allocate state nor get amplified.
+// One guard may be shared by the discovery and rendezvous managers of a node.
+type HandshakeGuard struct {
+	mu     sync.Mutex
+	config HandshakeGuardConfig
+
+	buckets  map[string]*tokenBucket
+	overflow tokenBucket
+	pruned   time.Time // when the full bucket table was last pruned
+
+	secret         [32]byte
+	previousSecret [32]byte
+	rotated        time.Time
+
+	windowStart time.Time
+	windowCount int
+	loadUntil   time.Time
+
+	stats GuardStats
+}
+
+// tokenBucket is one source's rate limit
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewHandshakeGuard creates a guard with the given limits
+func NewHandshakeGuard(config HandshakeGuardConfig) (*HandshakeGuard, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	g := &HandshakeGuard{
+		config:  config,
+		buckets: make(map[string]*tokenBucket),
+	}
+	if err := g.rotate(time.Now()); err != nil {
+		return nil, err
+	}
+	g.previousSecret = g.secret
+	g.overflow = tokenBucket{tokens: float64(config.Burst), last: time.Now()}
+	return g, nil
+}
+
+// Admit decides about a handshake from addr carrying cookie (nil if it has none)
+// A cookie is checked before the rate limit, so a cookieless flood under load
+// is answered without creating a bucket for each spoofed source.
+func (g *HandshakeGuard) Admit(addr net.Addr, cookie []byte) GuardVerdict {
+	now := time.Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.countHandshake(now) {
+		if cookie == nil {
+			g.stats.Challenged++
+			return GuardChallenge
+		}
+		if !g.validCookie(addr, cookie, now) {
+			g.stats.BadCookies++
+			g.stats.Challenged++
+			return GuardChallenge
+		}
+	}
+	return g.take(addr, now)
+}
+
+// Allow charges a non-handshake message from addr to its source's bucket
+func (g *HandshakeGuard) Allow(addr net.Addr) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.take(addr, time.Now()) == GuardAccept
+}
+
+// Cookie returns the cookie a handshake from addr must carry
+func (g *HandshakeGuard) Cookie(addr net.Addr) []byte {
+	now := time.Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.maybeRotate(now)
+	return cookieFor(g.secret[:], addr)
+}
+
+// UnderLoad reports whether handshakes currently need a cookie
+func (g *HandshakeGuard) UnderLoad() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.underLoad(time.Now())
+}
+
+// Stats returns a snapshot of the guard's counters
+func (g *HandshakeGuard) Stats() GuardStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	stats := g.stats
+	stats.Sources = len(g.buckets)
+	stats.UnderLoad = g.underLoad(time.Now())
+	return stats
+}
+
+// countHandshake records a handshake and reports whether the node is under load
+// Must be called with g.mu held
+func (g *HandshakeGuard) countHandshake(now time.Time) bool {
+	if now.Sub(g.windowStart) >= guardLoadWindow {
+		g.windowStart = now
+		g.windowCount = 0
+	}
+	g.windowCount++
+	if g.windowCount > g.config.LoadThreshold {
+		g.loadUntil = now.Add(guardLoadWindow)
+	}
+	return g.underLoad(now)
+}
+
+// underLoad reports whether cookies are required
+// Must be called with g.mu held
+func (g *HandshakeGuard) underLoad(now time.Time) bool {
+	return g.config.LoadThreshold == 0 || now.Before(g.loadUntil)
+}
+
+// take spends a token from addr's bucket
+// Must be called with g.mu held
+func (g *HandshakeGuard) take(addr net.Addr, now time.Time) GuardVerdict {
+	bucket := g.bucket(sourceKey(addr), now)
+	bucket.tokens += now.Sub(bucket.last).Seconds() * g.config.Rate
+	if burst := float64(g.config.Burst); bucket.tokens > burst {
+		bucket.tokens = burst
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		g.stats.RateLimited++
+		return GuardDrop
+	}
+	bucket.tokens--
+	g.stats.Accepted++
+	return GuardAccept
+}
+
+// bucket returns the bucket for a source, pruning refilled buckets when the table is full
+// The table is scanned at most once per refill period; new sources share the
+// overflow bucket in between, so a flood of new sources costs O(1) per message.
+// Must be called with g.mu held
+func (g *HandshakeGuard) bucket(key string, now time.Time) *tokenBucket {
+	if bucket, exists := g.buckets[key]; exists {
+		return bucket
+	}
+	if len(g.buckets) >= g.config.MaxSources {
+		// A bucket that has refilled completely behaves like a new one
+		refill := time.Duration(float64(g.config.Burst) / g.config.Rate * float64(time.Second))
+		if now.Sub(g.pruned) < refill {
+			return &g.overflow
+		}
+		g.pruned = now
+		for k, bucket := range g.buckets {
+			if now.Sub(bucket.last) >= refill {
+				delete(g.buckets, k)
+			}
+		}
+		if len(g.buckets) >= g.config.MaxSources {
+			return &g.overflow
+		}
+	}
+	bucket := &tokenBucket{tokens: float64(g.config.Burst), last: now}
+	g.buckets[key] = bucket
+	return bucket
+}
+
+// validCookie checks a cookie against the current and previous secrets
+// Must be called with g.mu held
+func (g *HandshakeGuard) validCookie(addr net.Addr, cookie []byte, now time.Time) bool {
+	g.maybeRotate(now)
+	return hmac.Equal(cookie, cookieFor(g.secret[:], addr)) ||
+		hmac.Equal(cookie, cookieFor(g.previousSecret[:], addr))
+}
+
+// maybeRotate replaces the cookie secret once it is older than CookieLifetime
+// Must be called with g.mu held
+func (g *HandshakeGuard) maybeRotate(now time.Time) {
+	if now.Sub(g.rotated) >= g.config.CookieLifetime {
+		// Keep the old secret if no randomness is available; cookies just live longer
+		g.rotate(now)
+	}
+}
+
+// rotate generates a new cookie secret and keeps the current one as the previous
+func (g *HandshakeGuard) rotate(now time.Time) error {
+	var secret [32]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return NewTransportError("failed to generate cookie secret", 9025, err)
+	}
+	g.previousSecret = g.secret
+	g.secret = secret
+	g.rotated = now
+	return nil
+}
+
+// cookieFor computes the cookie for addr under secret
+func cookieFor(secret []byte, addr net.Addr) []byte {
+	mac := hmac.New(sha256.New, secret)
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		mac.Write(udpAddr.IP.To16())
+		var port [2]byte
+		binary.BigEndian.PutUint16(port[:], uint16(udpAddr.Port))
+		mac.Write(port[:])
+	} else {
+		mac.Write([]byte(addr.String()))
+	}
+	return mac.Sum(nil)[:CookieSize]
+}
+
+// sourceKey groups addresses into rate-limited sources: one per IPv4 address and
+// one per IPv6 /64, since a single host usually controls a whole /64
+func sourceKey(addr net.Addr) string {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return addr.String()
+		}
+		ip = net.ParseIP(host)
+		if ip == nil {
+			return host
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
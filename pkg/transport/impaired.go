@@ -0,0 +1,369 @@
+package transport
+
+import (
+	"container/heap"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultReorderDelay is the extra hold applied to reordered packets when Impairment.ReorderDelay is zero
+const defaultReorderDelay = 10 * time.Millisecond
+
+// Impairment describes how packets to a destination are degraded
+// The zero value passes packets through untouched
+type Impairment struct {
+	// Loss is the probability (0-1) that a packet is dropped
+	Loss float64
+
+	// Latency is the fixed one-way delay added to every packet
+	Latency time.Duration
+
+	// Jitter adds a uniformly distributed delay in [-Jitter, +Jitter]
+	Jitter time.Duration
+
+	// Reorder is the probability (0-1) that a packet is held back by ReorderDelay
+	// so that later packets overtake it
+	Reorder float64
+
+	// ReorderDelay is the extra hold for reordered packets (default 10ms)
+	ReorderDelay time.Duration
+
+	// Duplicate is the probability (0-1) that a packet is sent twice
+	Duplicate float64
+
+	// Corrupt is the probability (0-1) that a single bit of a packet is flipped
+	Corrupt float64
+
+	// Bandwidth caps throughput in bytes per second; 0 means unlimited
+	Bandwidth int
+
+	// MaxQueueDelay drops packets that would wait longer than this for
+	// bandwidth; 0 means the queue is unbounded
+	MaxQueueDelay time.Duration
+
+	// MaxPacketSize silently drops packets larger than this many bytes,
+	// like a path with a smaller MTU than the sender assumes; 0 means no limit
+	MaxPacketSize int
+}
+
+// Validate checks that probabilities are in [0, 1] and durations are not negative
+func (i Impairment) Validate() error {
+	for _, p := range []float64{i.Loss, i.Reorder, i.Duplicate, i.Corrupt} {
+		if p < 0 || p > 1 {
+			return NewTransportError("impairment probability must be between 0 and 1", 8001, nil)
+		}
+	}
+	if i.Latency < 0 || i.Jitter < 0 || i.ReorderDelay < 0 || i.MaxQueueDelay < 0 || i.Bandwidth < 0 || i.MaxPacketSize < 0 {
+		return NewTransportError("impairment values cannot be negative", 8002, nil)
+	}
+	return nil
+}
+
+// isZero reports whether the impairment leaves packets untouched
+func (i Impairment) isZero() bool {
+	return i == Impairment{}
+}
+
+// ImpairmentStats counts what the impairment layer did to outgoing packets
+type ImpairmentStats struct {
+	Packets    uint64 // packets that went through an impairment
+	Dropped    uint64 // packets lost or dropped by the bandwidth queue
+	Duplicated uint64
+	Corrupted  uint64
+	Reordered  uint64
+}
+
+// ImpairedTransport wraps a Transport and degrades outgoing packets per destination
+// If the wrapped transport implements LinkWriterSetter (as UDPTransport does),
+// impairments apply on the wire, so ACKs and retransmissions are affected too;
+// otherwise they apply to Send. Random decisions come from a seeded source so a
+// given seed and packet sequence always lose, duplicate and corrupt the same packets.
+type ImpairedTransport struct {
+	Transport
+
+	mu                sync.Mutex
+	rng               *rand.Rand
+	defaultImpairment Impairment
+	impairments       map[string]Impairment
+	linkFree          map[string]time.Time // when each destination's bandwidth queue drains
+	stats             ImpairmentStats
+	hooked            bool
+
+	// Scheduler for delayed packets, started on first use
+	queue     impairedQueue
+	nextSeq   uint64
+	wake      chan struct{}
+	stopCh    chan struct{}
+	running   bool
+	stopped   bool
+	schedWait sync.WaitGroup
+}
+
+// impairedPacket is a packet waiting for its departure time
+type impairedPacket struct {
+	due   time.Time
+	seq   uint64
+	data  []byte
+	write func([]byte) error
+}
+
+// impairedQueue orders delayed packets by departure time, then by arrival
+type impairedQueue []*impairedPacket
+
+func (q impairedQueue) Len() int { return len(q) }
+
+func (q impairedQueue) Less(i, j int) bool {
+	if q[i].due.Equal(q[j].due) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].due.Before(q[j].due)
+}
+
+func (q impairedQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *impairedQueue) Push(x interface{}) { *q = append(*q, x.(*impairedPacket)) }
+
+func (q *impairedQueue) Pop() interface{} {
+	old := *q
+	packet := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return packet
+}
+
+// NewImpairedTransport wraps inner with an impairment layer using the given random seed
+func NewImpairedTransport(inner Transport, seed int64) *ImpairedTransport {
+	t := &ImpairedTransport{
+		Transport:   inner,
+		rng:         rand.New(rand.NewSource(seed)),
+		impairments: make(map[string]Impairment),
+		linkFree:    make(map[string]time.Time),
+		wake:        make(chan struct{}, 1),
+		stopCh:      make(chan struct{}),
+	}
+
+	if setter, ok := inner.(LinkWriterSetter); ok {
+		setter.SetLinkWriter(t.impair)
+		t.hooked = true
+	}
+
+	return t
+}
+
+// SetDefaultImpairment sets the impairment for destinations without their own
+func (t *ImpairedTransport) SetDefaultImpairment(impairment Impairment) error {
+	if err := impairment.Validate(); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.defaultImpairment = impairment
+	t.mu.Unlock()
+	return nil
+}
+
+// SetImpairment sets the impairment for packets to addr
+func (t *ImpairedTransport) SetImpairment(addr net.Addr, impairment Impairment) error {
+	if err := impairment.Validate(); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.impairments[addr.String()] = impairment
+	t.mu.Unlock()
+	return nil
+}
+
+// ClearImpairment removes the impairment for addr, falling back to the default
+func (t *ImpairedTransport) ClearImpairment(addr net.Addr) {
+	t.mu.Lock()
+	delete(t.impairments, addr.String())
+	t.mu.Unlock()
+}
+
+// Stats returns a snapshot of the impairment counters
+func (t *ImpairedTransport) Stats() ImpairmentStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats
+}
+
+// AddDeliveryListener forwards to the wrapped transport if it reports delivery outcomes
+func (t *ImpairedTransport) AddDeliveryListener(listener DeliveryListener) {
+	if notifier, ok := t.Transport.(DeliveryNotifier); ok {
+		notifier.AddDeliveryListener(listener)
+	}
+}
+
+// Send sends a packet through the impairment layer
+func (t *ImpairedTransport) Send(dstAddr net.Addr, data []byte) error {
+	if t.hooked {
+		// The wrapped transport hands every datagram to impair
+		return t.Transport.Send(dstAddr, data)
+	}
+	return t.impair(dstAddr, data, func(packet []byte) error {
+		return t.Transport.Send(dstAddr, packet)
+	})
+}
+
+// Stop discards delayed packets and stops the wrapped transport
+func (t *ImpairedTransport) Stop() error {
+	t.mu.Lock()
+	if !t.stopped {
+		t.stopped = true
+		close(t.stopCh)
+		t.queue = nil
+	}
+	t.mu.Unlock()
+	t.schedWait.Wait()
+
+	return t.Transport.Stop()
+}
+
+// impair applies the destination's impairment to a packet and schedules its copies
+func (t *ImpairedTransport) impair(dstAddr net.Addr, data []byte, write func([]byte) error) error {
+	key := dstAddr.String()
+
+	t.mu.Lock()
+	impairment, exists := t.impairments[key]
+	if !exists {
+		impairment = t.defaultImpairment
+	}
+	if impairment.isZero() || t.stopped {
+		t.mu.Unlock()
+		if t.stopped {
+			return nil
+		}
+		return write(data)
+	}
+
+	t.stats.Packets++
+	if impairment.MaxPacketSize > 0 && len(data) > impairment.MaxPacketSize {
+		t.stats.Dropped++
+		t.mu.Unlock()
+		return nil
+	}
+	if t.rng.Float64() < impairment.Loss {
+		t.stats.Dropped++
+		t.mu.Unlock()
+		return nil
+	}
+
+	copies := 1
+	if t.rng.Float64() < impairment.Duplicate {
+		copies = 2
+		t.stats.Duplicated++
+	}
+
+	// Undelayed packets are written directly unless delayed ones are waiting
+	var immediate [][]byte
+
+	now := time.Now()
+	for i := 0; i < copies; i++ {
+		packet := make([]byte, len(data))
+		copy(packet, data)
+
+		if len(packet) > 0 && t.rng.Float64() < impairment.Corrupt {
+			bit := t.rng.Intn(len(packet) * 8)
+			packet[bit/8] ^= 1 << uint(bit%8)
+			t.stats.Corrupted++
+		}
+
+		delay := impairment.Latency
+		if impairment.Jitter > 0 {
+			delay += time.Duration(t.rng.Int63n(int64(2*impairment.Jitter)+1)) - impairment.Jitter
+		}
+		if t.rng.Float64() < impairment.Reorder {
+			reorderDelay := impairment.ReorderDelay
+			if reorderDelay == 0 {
+				reorderDelay = defaultReorderDelay
+			}
+			delay += reorderDelay
+			t.stats.Reordered++
+		}
+		if delay < 0 {
+			delay = 0
+		}
+
+		// Serialize through the destination's bandwidth queue
+		if impairment.Bandwidth > 0 {
+			departure := now
+			if free := t.linkFree[key]; free.After(departure) {
+				departure = free
+			}
+			queueDelay := departure.Sub(now)
+			if impairment.MaxQueueDelay > 0 && queueDelay > impairment.MaxQueueDelay {
+				t.stats.Dropped++
+				continue
+			}
+			txTime := time.Duration(int64(len(packet)) * int64(time.Second) / int64(impairment.Bandwidth))
+			t.linkFree[key] = departure.Add(txTime)
+			delay += queueDelay + txTime
+		}
+
+		if delay == 0 && len(t.queue) == 0 {
+			immediate = append(immediate, packet)
+			continue
+		}
+
+		t.nextSeq++
+		heap.Push(&t.queue, &impairedPacket{due: now.Add(delay), seq: t.nextSeq, data: packet, write: write})
+	}
+
+	if len(t.queue) > 0 && !t.running {
+		t.running = true
+		t.schedWait.Add(1)
+		go t.scheduler()
+	}
+	t.mu.Unlock()
+
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+
+	var err error
+	for _, packet := range immediate {
+		if writeErr := write(packet); writeErr != nil {
+			err = writeErr
+		}
+	}
+	return err
+}
+
+// scheduler writes delayed packets when they are due
+func (t *ImpairedTransport) scheduler() {
+	defer t.schedWait.Done()
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		t.mu.Lock()
+		if t.stopped {
+			t.mu.Unlock()
+			return
+		}
+
+		wait := time.Hour
+		if len(t.queue) > 0 {
+			next := t.queue[0]
+			if wait = time.Until(next.due); wait <= 0 {
+				heap.Pop(&t.queue)
+				t.mu.Unlock()
+				// Delayed writes have nobody to report errors to
+				next.write(next.data)
+				continue
+			}
+		}
+		t.mu.Unlock()
+
+		timer.Reset(wait)
+		select {
+		case <-t.stopCh:
+			return
+		case <-t.wake:
+		case <-timer.C:
+		}
+	}
+}
@@ -86,6 +86,87 @@ type Transport interface {
 	GetLocalAddr() net.Addr
 }
 
+// LinkWriteFunc intercepts a datagram on its way to the wire
+// dstAddr is the destination address
+// data is the complete datagram, including transport headers
+// write puts bytes on the wire; the hook may call it later, more than once, or not at all
+
+type LinkWriteFunc func(dstAddr net.Addr, data []byte, write func([]byte) error) error
+
+// LinkWriterSetter is implemented by transports that expose every datagram they
+// write, including internal traffic such as ACKs and retransmissions
+
+type LinkWriterSetter interface {
+	// SetLinkWriter installs a hook for outgoing datagrams; nil restores direct writes
+	SetLinkWriter(writer LinkWriteFunc)
+}
+
+// RawHandler inspects a datagram before the transport processes it
+// It returns true if it consumed the datagram
+
+type RawHandler func(srcAddr net.Addr, data []byte) bool
+
+// RawDatagramTransport is implemented by transports that can exchange datagrams
+// outside their own framing on the same socket, e.g. for STUN
+
+type RawDatagramTransport interface {
+	// SendRaw writes data to dstAddr as a single datagram without transport headers
+	SendRaw(dstAddr net.Addr, data []byte) error
+
+	// AddRawHandler registers a handler that sees every datagram before the transport does
+	AddRawHandler(handler RawHandler)
+}
+
+// DeliveryResult describes the outcome of a reliable send
+
+type DeliveryResult struct {
+	// DstAddr is the destination the packet was sent to
+	DstAddr net.Addr
+	// SequenceNum is the transport sequence number of the packet
+	SequenceNum uint32
+	// Delivered is true if the peer acknowledged the packet
+	Delivered bool
+	// Retries is the number of retransmissions made
+	Retries int
+	// RTT is the time from the first send to the ACK, set only when delivered
+	RTT time.Duration
+	// Err explains why delivery failed
+	Err error
+}
+
+// DeliveryListener is called with the outcome of every reliable send
+
+type DeliveryListener func(result DeliveryResult)
+
+// DeliveryNotifier is implemented by transports that report delivery outcomes
+
+type DeliveryNotifier interface {
+	// AddDeliveryListener registers a listener for delivery outcomes
+	AddDeliveryListener(listener DeliveryListener)
+}
+
+// StatsProvider is implemented by transports and managers that count their traffic
+
+type StatsProvider interface {
+	// Stats returns a snapshot of transport-wide and per-peer counters
+	Stats() TransportStats
+}
+
+// ClassSender is implemented by transports that schedule packets by traffic class
+
+type ClassSender interface {
+	// SendClass sends a packet to dstAddr in the given traffic class
+	SendClass(dstAddr net.Addr, data []byte, class TrafficClass) error
+}
+
+// ClassConnection is implemented by connections that can tag packets with a traffic class
+// Over a transport without classes, SendClass behaves like Send
+
+type ClassConnection interface {
+	// SendClass sends a packet to the remote endpoint in the given traffic class
+	SendClass(data []byte, class TrafficClass) error
+}
+
 // Connection represents a specific connection between two endpoints
 // It provides more fine-grained control over a specific connection
 
@@ -125,6 +206,17 @@ type Connection interface {
 	SetWriteTimeout(timeout time.Duration) error
 }
 
+// ActivityTracker is implemented by connections that record when traffic last
+// passed in each direction, keepalives included
+
+type ActivityTracker interface {
+	// LastReceived returns when the peer was last heard from
+	LastReceived() time.Time
+
+	// LastSent returns when data was last sent to the peer
+	LastSent() time.Time
+}
+
 // ConnectionManager manages multiple connections
 // It provides functions to create, get, and close connections
 
@@ -0,0 +1,60 @@
+package transport
+
+import "container/list"
+
+// lruKeys 按最近使用顺序记录状态表的键，最久未用的在前
+// 按来源地址保存的状态表用它在表满时以O(1)淘汰最久未用的条目，
+// 伪造来源的洪泛因此只能挤掉旧状态，而不能让状态表无限增长
+// 不是并发安全的，由所属状态表的锁保护
+type lruKeys struct {
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+// newLRUKeys 创建空的键顺序
+func newLRUKeys() *lruKeys {
+	return &lruKeys{order: list.New(), elements: make(map[string]*list.Element)}
+}
+
+// touch 把键移到最近使用的位置，不存在时加入
+func (k *lruKeys) touch(key string) {
+	if element, exists := k.elements[key]; exists {
+		k.order.MoveToBack(element)
+		return
+	}
+	k.elements[key] = k.order.PushBack(key)
+}
+
+// remove 删除键
+func (k *lruKeys) remove(key string) {
+	if element, exists := k.elements[key]; exists {
+		k.order.Remove(element)
+		delete(k.elements, key)
+	}
+}
+
+// rename 把键改名并保持其位置，用于端点迁移
+func (k *lruKeys) rename(oldKey, newKey string) {
+	element, exists := k.elements[oldKey]
+	if !exists {
+		return
+	}
+	k.remove(newKey)
+	delete(k.elements, oldKey)
+	element.Value = newKey
+	k.elements[newKey] = element
+}
+
+// oldest 返回最久未用的键
+func (k *lruKeys) oldest() (string, bool) {
+	front := k.order.Front()
+	if front == nil {
+		return "", false
+	}
+	return front.Value.(string), true
+}
+
+// len 返回键的个数
+func (k *lruKeys) len() int {
+	return k.order.Len()
+}
@@ -3,99 +3,350 @@ package transport
 import (
 	"errors"
 	"net"
+	"sort"
 	"sync"
 	"time"
 )
 
-// simpleConnection is a minimal Connection implementation
-
-type simpleConnection struct {
-	localAddr  net.Addr
-	remoteAddr net.Addr
-	transport  *UDPTransport
+// getConnectionKey generates a key for the connection map based on the remote address
+func (m *DefaultConnectionManager) getConnectionKey(addr net.Addr) string {
+	return addr.String()
 }
 
-// GetState returns connection state
-func (c *simpleConnection) GetState() ConnectionState {
-	return StateConnected
+// DefaultConnectionManager implements the ConnectionManager interface
+// It manages a collection of connections and provides methods to add, remove, and find connections
+
+type DefaultConnectionManager struct {
+	// connections is a map of remote addresses to connections
+	connections map[string]Connection
+
+	// mu protects the connections map from concurrent access
+	mu sync.RWMutex
+
+	// listeners is a list of connection event listeners
+	listeners []ConnectionListener
+
+	// listenerMu protects the listeners slice from concurrent access
+	listenerMu sync.RWMutex
+
+	// transport is the transport that created this manager
+	transport Transport
+
+	// deliveryFailures counts consecutive failed deliveries per remote address
+	deliveryFailures map[string]int
+
+	// failureThreshold is the number of consecutive failed deliveries after
+	// which a connection is considered disconnected
+	failureThreshold int
+
+	// queueSize is the inbound queue length of connections created from now on
+	queueSize int
+
+	// keepaliveInterval is how long a connection may go without sending before
+	// a keepalive is sent; 0 disables keepalives
+	keepaliveInterval time.Duration
+
+	// deadPeerTimeout is how long a peer may stay silent before its connection
+	// is disconnected; 0 disables dead-peer detection
+	deadPeerTimeout time.Duration
+
+	// stats counts the traffic of managed connections
+	stats *statsTable
+
+	// livenessMu serializes SetKeepalive so only one liveness loop runs
+	livenessMu sync.Mutex
+
+	// livenessStop ends the liveness loop; nil while it is not running
+	livenessStop chan struct{}
+	livenessDone chan struct{}
 }
 
-// GetRemoteAddr returns remote address
-func (c *simpleConnection) GetRemoteAddr() net.Addr {
-	return c.remoteAddr
+// minLivenessCheck keeps very short keepalive settings from turning into a busy loop
+const minLivenessCheck = 10 * time.Millisecond
+
+// DefaultFailureThreshold is the default number of consecutive failed deliveries
+// before a connection is reported as disconnected
+const DefaultFailureThreshold = 3
+
+// AddConnectionListener adds a connection listener
+func (m *DefaultConnectionManager) AddConnectionListener(listener ConnectionListener) {
+	m.AddListener(listener)
 }
 
-// GetLocalAddr returns local address
-func (c *simpleConnection) GetLocalAddr() net.Addr {
-	return c.localAddr
+// NewDefaultConnectionManager creates a new connection manager
+func NewDefaultConnectionManager(transport Transport) *DefaultConnectionManager {
+	m := &DefaultConnectionManager{
+		connections:      make(map[string]Connection),
+		transport:        transport,
+		deliveryFailures: make(map[string]int),
+		failureThreshold: DefaultFailureThreshold,
+		queueSize:        DefaultInboundQueueSize,
+		stats:            newStatsTable(),
+	}
+
+	// Track delivery outcomes so peers that stop ACKing are reported
+	if notifier, ok := transport.(DeliveryNotifier); ok {
+		notifier.AddDeliveryListener(m.handleDeliveryResult)
+	}
+
+	return m
 }
 
-// SetReadTimeout sets read timeout
-func (c *simpleConnection) SetReadTimeout(timeout time.Duration) error {
+// SetFailureThreshold sets how many consecutive failed deliveries disconnect a connection
+func (m *DefaultConnectionManager) SetFailureThreshold(threshold int) error {
+	if threshold < 1 {
+		return NewTransportError("failure threshold must be at least 1", 4015, nil)
+	}
+
+	m.mu.Lock()
+	m.failureThreshold = threshold
+	m.mu.Unlock()
 	return nil
 }
 
-// SetWriteTimeout sets write timeout
-func (c *simpleConnection) SetWriteTimeout(timeout time.Duration) error {
+// SetQueueSize sets how many received packets each new connection buffers for Receive
+func (m *DefaultConnectionManager) SetQueueSize(size int) error {
+	if size < 1 {
+		return NewTransportError("inbound queue size must be at least 1", 4035, nil)
+	}
+
+	m.mu.Lock()
+	m.queueSize = size
+	m.mu.Unlock()
 	return nil
 }
 
-// Connect connects to remote address
-func (c *simpleConnection) Connect(remoteAddr net.Addr) error {
+// SetKeepalive enables keepalives and dead-peer detection on managed connections
+// A connection that has sent nothing for interval sends an empty keepalive packet,
+// which keeps NAT mappings open and tells the peer it is alive. A connection that
+// has received nothing, keepalives included, for timeout is disconnected and
+// listeners get EventDisconnected with an error. Either value may be 0 to disable
+// that part; SetKeepalive(0, 0) stops liveness tracking altogether.
+func (m *DefaultConnectionManager) SetKeepalive(interval, timeout time.Duration) error {
+	if interval < 0 || timeout < 0 {
+		return NewTransportError("keepalive interval and timeout cannot be negative", 4037, nil)
+	}
+	if interval > 0 && timeout > 0 && timeout <= interval {
+		return NewTransportError("dead-peer timeout must be longer than the keepalive interval", 4038, nil)
+	}
+
+	m.livenessMu.Lock()
+	defer m.livenessMu.Unlock()
+
+	m.mu.Lock()
+	m.keepaliveInterval, m.deadPeerTimeout = interval, timeout
+	stop, done := m.livenessStop, m.livenessDone
+	m.livenessStop, m.livenessDone = nil, nil
+	m.mu.Unlock()
+
+	// Restart the loop so it checks at a period that suits the new settings
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	if interval == 0 && timeout == 0 {
+		return nil
+	}
+
+	period := interval
+	if period == 0 || (timeout > 0 && timeout < period) {
+		period = timeout
+	}
+	period /= 4
+	if period < minLivenessCheck {
+		period = minLivenessCheck
+	}
+
+	stop, done = make(chan struct{}), make(chan struct{})
+	m.mu.Lock()
+	m.livenessStop, m.livenessDone = stop, done
+	m.mu.Unlock()
+	go m.livenessLoop(period, stop, done)
 	return nil
 }
 
-// Disconnect disconnects the connection
-func (c *simpleConnection) Disconnect() error {
-	return nil
+// livenessLoop checks connections every period until stop is closed
+func (m *DefaultConnectionManager) livenessLoop(period time.Duration, stop, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			m.checkLiveness(now)
+		case <-stop:
+			return
+		}
+	}
 }
 
-// Send sends data
-func (c *simpleConnection) Send(data []byte) error {
-	return c.transport.Send(c.remoteAddr, data)
+// checkLiveness disconnects silent peers and sends keepalives on idle connections
+func (m *DefaultConnectionManager) checkLiveness(now time.Time) {
+	m.mu.RLock()
+	interval, timeout := m.keepaliveInterval, m.deadPeerTimeout
+	peers := make([]*peerConnection, 0, len(m.connections))
+	for _, conn := range m.connections {
+		if peer, ok := conn.(*peerConnection); ok {
+			peers = append(peers, peer)
+		}
+	}
+	m.mu.RUnlock()
+
+	for _, peer := range peers {
+		received, sent, connected := peer.idle(now)
+		if !connected {
+			continue
+		}
+
+		if timeout > 0 && received > timeout {
+			if !peer.close() {
+				continue
+			}
+			m.unregister(peer)
+			err := NewTransportError("no packets from "+peer.GetRemoteAddr().String()+" for "+received.Round(time.Millisecond).String(), 4023, nil)
+			m.notifyListeners(peer, EventDisconnected, nil, err)
+			continue
+		}
+
+		if interval > 0 && sent >= interval {
+			if err := peer.sendKeepalive(); err != nil {
+				m.notifyListeners(peer, EventError, nil, err)
+			}
+		}
+	}
 }
 
-// Receive receives data
-func (c *simpleConnection) Receive(buffer []byte) (int, error) {
-	return 0, nil
+// Handler wraps next so that packets from managed connections are queued on them
+// Pass it to the transport's Start. Packets from addresses without a connection are
+// passed on to next. Every queued packet fires EventDataReceived; a packet arriving
+// at a full queue is dropped and fires EventError. Empty packets from managed
+// peers are keepalives: they only refresh the connection's liveness.
+func (m *DefaultConnectionManager) Handler(next PacketHandler) PacketHandler {
+	return func(srcAddr net.Addr, data []byte) error {
+		m.mu.RLock()
+		conn, exists := m.connections[m.getConnectionKey(srcAddr)]
+		m.mu.RUnlock()
+		peer, managed := conn.(*peerConnection)
+		if !exists || !managed {
+			if next != nil {
+				return next(srcAddr, data)
+			}
+			return nil
+		}
+
+		m.stats.received(srcAddr, len(data))
+		if len(data) == 0 {
+			peer.touch()
+			return nil
+		}
+		if !peer.deliver(data) {
+			m.stats.dropped(srcAddr)
+			err := NewTransportError("inbound queue for "+srcAddr.String()+" is full", 4022, nil)
+			m.notifyListeners(peer, EventError, nil, err)
+			return err
+		}
+		m.notifyListeners(peer, EventDataReceived, data, nil)
+		return nil
+	}
 }
 
-// getConnectionKey generates a key for the connection map based on the remote address
-func (m *DefaultConnectionManager) getConnectionKey(addr net.Addr) string {
-	return addr.String()
+// register adds a reconnecting connection back to the map
+func (m *DefaultConnectionManager) register(conn *peerConnection) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := m.getConnectionKey(conn.GetRemoteAddr())
+	if existing, exists := m.connections[key]; exists && existing != Connection(conn) {
+		return NewTransportError("connection already exists", 4003, nil)
+	}
+	m.connections[key] = conn
+	delete(m.deliveryFailures, key)
+	return nil
 }
 
-// DefaultConnectionManager implements the ConnectionManager interface
-// It manages a collection of connections and provides methods to add, remove, and find connections
+// unregister removes a connection from the map if it is still the one stored
+func (m *DefaultConnectionManager) unregister(conn *peerConnection) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-type DefaultConnectionManager struct {
-	// connections is a map of remote addresses to connections
-	connections map[string]Connection
+	key := m.getConnectionKey(conn.GetRemoteAddr())
+	if existing, exists := m.connections[key]; exists && existing == Connection(conn) {
+		delete(m.connections, key)
+		delete(m.deliveryFailures, key)
+	}
+}
 
-	// mu protects the connections map from concurrent access
-	mu sync.RWMutex
+// handleDeliveryResult reports failed deliveries to listeners
+// Every failure on a managed connection emits EventError; once failureThreshold
+// consecutive deliveries have failed the connection is removed and EventDisconnected
+// is emitted. A successful delivery resets the count.
+func (m *DefaultConnectionManager) handleDeliveryResult(result DeliveryResult) {
+	if result.DstAddr == nil {
+		return
+	}
+	key := m.getConnectionKey(result.DstAddr)
 
-	// listeners is a list of connection event listeners
-	listeners []ConnectionListener
+	m.mu.Lock()
+	conn, exists := m.connections[key]
+	if !exists {
+		m.mu.Unlock()
+		return
+	}
 
-	// listenerMu protects the listeners slice from concurrent access
-	listenerMu sync.RWMutex
+	m.stats.retransmitted(result.DstAddr, result.Retries)
+	if result.Delivered {
+		delete(m.deliveryFailures, key)
+		m.mu.Unlock()
+		if result.Retries == 0 {
+			m.stats.rtt(result.DstAddr, result.RTT)
+		}
+		return
+	}
+	m.stats.gaveUp(result.DstAddr)
 
-	// transport is the transport that created this manager
-	transport Transport
-}
+	m.deliveryFailures[key]++
+	disconnected := m.deliveryFailures[key] >= m.failureThreshold
+	if disconnected {
+		delete(m.connections, key)
+		delete(m.deliveryFailures, key)
+	}
+	m.mu.Unlock()
 
-// AddConnectionListener adds a connection listener
-func (m *DefaultConnectionManager) AddConnectionListener(listener ConnectionListener) {
-	m.AddListener(listener)
+	if peer, ok := conn.(*peerConnection); ok && disconnected {
+		peer.close()
+	}
+
+	m.notifyListeners(conn, EventError, nil, result.Err)
+	if disconnected {
+		m.notifyListeners(conn, EventDisconnected, nil, result.Err)
+	}
 }
 
-// NewDefaultConnectionManager creates a new connection manager
-func NewDefaultConnectionManager(transport Transport) *DefaultConnectionManager {
-	return &DefaultConnectionManager{
-		connections: make(map[string]Connection),
-		transport:   transport,
+// Stats returns a snapshot of the traffic on managed connections
+// Totals cover every connection the manager has had; Peers lists the current ones,
+// with QueueDepth counting packets waiting for Receive. Retransmits, give-ups and
+// RTT samples come from the transport's delivery results, so they stay zero on
+// transports that do not report them.
+func (m *DefaultConnectionManager) Stats() TransportStats {
+	snapshot := TransportStats{TrafficStats: m.stats.totals()}
+	for _, conn := range m.GetConnections() {
+		remoteAddr := conn.GetRemoteAddr()
+		peer, exists := m.stats.peer(remoteAddr.String())
+		if !exists {
+			peer = PeerStats{Addr: remoteAddr.String()}
+		}
+		if managed, ok := conn.(*peerConnection); ok {
+			peer.QueueDepth = managed.queueDepth()
+			peer.LastSent, peer.LastReceived = managed.LastSent(), managed.LastReceived()
+		}
+		snapshot.QueueDepth += peer.QueueDepth
+		snapshot.Peers = append(snapshot.Peers, peer)
 	}
+	sort.Slice(snapshot.Peers, func(i, j int) bool {
+		return snapshot.Peers[i].Addr < snapshot.Peers[j].Addr
+	})
+	return snapshot
 }
 
 // AddConnection adds a new connection to the manager
@@ -150,10 +401,18 @@ func (m *DefaultConnectionManager) RemoveConnection(conn Connection) error {
 }
 
 // CloseAllConnections closes all connections
+// Connections created by the manager are disconnected and fire EventDisconnected
 func (m *DefaultConnectionManager) CloseAllConnections() error {
+	for _, conn := range m.GetConnections() {
+		if peer, ok := conn.(*peerConnection); ok {
+			peer.Disconnect()
+		}
+	}
+
 	m.mu.Lock()
-	// Clear all connections
+	// Clear any connections added from outside
 	m.connections = make(map[string]Connection)
+	m.deliveryFailures = make(map[string]int)
 	m.mu.Unlock()
 	return nil
 }
@@ -177,39 +436,39 @@ func (m *DefaultConnectionManager) RemoveConnectionByAddr(addr net.Addr) error {
 	delete(m.connections, addrStr)
 	m.mu.Unlock()
 
+	if peer, ok := conn.(*peerConnection); ok {
+		peer.close()
+	}
+
 	// Notify listeners
 	m.notifyListeners(conn, EventDisconnected, []byte{}, nil)
 	return nil
 }
 
 // CreateConnection creates a new connection
+// The connection sends through the manager's transport and receives the packets
+// Handler routes to it; an existing connection to remoteAddr is returned as is.
 func (m *DefaultConnectionManager) CreateConnection(remoteAddr net.Addr) (Connection, error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	if remoteAddr == nil {
+		return nil, errors.New("cannot create connection with nil address")
+	}
+	if m.transport == nil {
+		return nil, errors.New("connection manager has no transport")
+	}
 
+	m.mu.Lock()
 	key := m.getConnectionKey(remoteAddr)
 
 	// Check if connection already exists
 	if conn, exists := m.connections[key]; exists {
+		m.mu.Unlock()
 		return conn, nil
 	}
 
-	// Create connection based on transport type
-	var newConn Connection
-
-	if t, ok := m.transport.(*UDPTransport); ok {
-		// Create a simple connection implementation
-		newConn = &simpleConnection{
-			localAddr:  m.transport.GetLocalAddr(), // Set local address directly
-			remoteAddr: remoteAddr,
-			transport:  t,
-		}
-	} else {
-		return nil, errors.New("unsupported transport type")
-	}
-
 	// Store the connection
+	newConn := newPeerConnection(m, m.transport.GetLocalAddr(), remoteAddr, m.queueSize)
 	m.connections[key] = newConn
+	m.mu.Unlock()
 
 	// Notify listeners about the new connection with proper event
 	m.notifyListeners(newConn, EventConnected, []byte{}, nil)
@@ -224,16 +483,21 @@ func (m *DefaultConnectionManager) CloseConnection(remoteAddr net.Addr) error {
 	}
 
 	m.mu.Lock()
-	defer m.mu.Unlock()
-
 	key := m.getConnectionKey(remoteAddr)
 	conn, exists := m.connections[key]
 	if !exists {
+		m.mu.Unlock()
 		return errors.New("connection not found")
 	}
 
 	// Remove from map
 	delete(m.connections, key)
+	delete(m.deliveryFailures, key)
+	m.mu.Unlock()
+
+	if peer, ok := conn.(*peerConnection); ok {
+		peer.close()
+	}
 
 	// Notify listeners about the removed connection with proper event
 	m.notifyListeners(conn, EventDisconnected, []byte{}, nil)
@@ -286,19 +550,7 @@ func (m *DefaultConnectionManager) GetOrCreateConnection(localAddr, remoteAddr n
 	}
 
 	// Create new connection
-	var newConn Connection
-
-	switch t := m.transport.(type) {
-	case *UDPTransport:
-		// Create a simple connection implementation
-		newConn = &simpleConnection{
-			localAddr:  localAddr,
-			remoteAddr: remoteAddr,
-			transport:  t,
-		}
-		// Try to connect
-		newConn.Connect(remoteAddr)
-	}
+	newConn := newPeerConnection(m, localAddr, remoteAddr, m.queueSize)
 
 	// Store the new connection
 	m.connections[key] = newConn
@@ -335,8 +587,15 @@ func (m *DefaultConnectionManager) ClearConnections() error {
 	}
 	// Clear the map
 	m.connections = make(map[string]Connection)
+	m.deliveryFailures = make(map[string]int)
 	m.mu.Unlock()
 
+	for _, conn := range conns {
+		if peer, ok := conn.(*peerConnection); ok {
+			peer.close()
+		}
+	}
+
 	// Notify listeners for each removed connection
 	for _, conn := range conns {
 		m.notifyListeners(conn, EventDisconnected, []byte{}, nil)
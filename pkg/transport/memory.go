@@ -0,0 +1,312 @@
+package transport
+
+import (
+	"net"
+	"sync"
+)
+
+// memoryNetworkFirstPort is the first port handed out to transports without a configured address
+const memoryNetworkFirstPort = 20000
+
+// MemoryNetwork is an in-process packet fabric shared by MemoryTransport instances
+// Packets are copied on send and delivered in FIFO order per receiver, each
+// receiver's handler running on a single goroutine. WaitIdle blocks until every
+// queued packet has been handled, which makes multi-node tests deterministic.
+type MemoryNetwork struct {
+	mu        sync.Mutex
+	idle      *sync.Cond
+	endpoints map[string]*MemoryTransport
+	nextPort  int
+
+	// nats translate packets between private networks and the rest of the fabric
+	nats []*MemoryNAT
+
+	// inFlight counts packets queued or being handled
+	inFlight  int
+	delivered uint64
+	dropped   uint64
+}
+
+// memoryPacket is a packet queued for delivery
+type memoryPacket struct {
+	src  net.Addr
+	data []byte
+}
+
+// NewMemoryNetwork creates an empty in-process network
+func NewMemoryNetwork() *MemoryNetwork {
+	n := &MemoryNetwork{
+		endpoints: make(map[string]*MemoryTransport),
+		nextPort:  memoryNetworkFirstPort,
+	}
+	n.idle = sync.NewCond(&n.mu)
+	return n
+}
+
+// attach registers a transport at addr, or at the next free loopback port if addr is nil
+func (n *MemoryNetwork) attach(t *MemoryTransport, addr *net.UDPAddr) (*net.UDPAddr, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if addr == nil || addr.Port == 0 {
+		ip := net.ParseIP("127.0.0.1")
+		if addr != nil && addr.IP != nil {
+			ip = addr.IP
+		}
+		for {
+			candidate := &net.UDPAddr{IP: ip, Port: n.nextPort}
+			n.nextPort++
+			if _, exists := n.endpoints[candidate.String()]; !exists {
+				addr = candidate
+				break
+			}
+		}
+	}
+
+	key := addr.String()
+	if _, exists := n.endpoints[key]; exists {
+		return nil, NewTransportError("address already in use: "+key, 7003, nil)
+	}
+	n.endpoints[key] = t
+	return addr, nil
+}
+
+// detach removes a transport from the network and discards its queued packets
+func (n *MemoryNetwork) detach(t *MemoryTransport, addr *net.UDPAddr) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if current, exists := n.endpoints[addr.String()]; exists && current == t {
+		delete(n.endpoints, addr.String())
+	}
+}
+
+// deliver queues a packet for the transport bound to dst
+// Packets to unknown addresses, or blocked by a NAT, are dropped silently, as on a real network
+func (n *MemoryNetwork) deliver(src net.Addr, dst net.Addr, data []byte) {
+	n.mu.Lock()
+	src, dst, routed := n.route(src, dst)
+	if !routed {
+		n.dropped++
+		n.mu.Unlock()
+		return
+	}
+	endpoint, exists := n.endpoints[dst.String()]
+	if !exists {
+		n.dropped++
+		n.mu.Unlock()
+		return
+	}
+	n.inFlight++
+	n.mu.Unlock()
+
+	packet := memoryPacket{src: src, data: make([]byte, len(data))}
+	copy(packet.data, data)
+	if !endpoint.enqueue(packet) {
+		n.done(false)
+	}
+}
+
+// done marks a queued packet as handled or discarded
+func (n *MemoryNetwork) done(handled bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.inFlight--
+	if handled {
+		n.delivered++
+	} else {
+		n.dropped++
+	}
+	if n.inFlight == 0 {
+		n.idle.Broadcast()
+	}
+}
+
+// WaitIdle blocks until no packets are queued or being handled
+// Packets sent by handlers are included, so this waits for whole exchanges to settle
+func (n *MemoryNetwork) WaitIdle() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for n.inFlight > 0 {
+		n.idle.Wait()
+	}
+}
+
+// Delivered returns the number of packets handed to a handler
+func (n *MemoryNetwork) Delivered() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.delivered
+}
+
+// Dropped returns the number of packets that could not be delivered
+func (n *MemoryNetwork) Dropped() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.dropped
+}
+
+// MemoryTransport implements the Transport interface on top of a MemoryNetwork
+// Addresses are *net.UDPAddr values so code written for the UDP transport
+// works unchanged.
+type MemoryTransport struct {
+	BaseTransport
+
+	network *MemoryNetwork
+	addr    *net.UDPAddr
+
+	queueMu sync.Mutex
+	queueCv *sync.Cond
+	queue   []memoryPacket
+	started bool // packets are only queued between Start and Stop
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+// NewMemoryTransport creates a new in-memory transport instance
+func NewMemoryTransport() *MemoryTransport {
+	t := &MemoryTransport{
+		BaseTransport: *NewBaseTransport(),
+	}
+	t.queueCv = sync.NewCond(&t.queueMu)
+	return t
+}
+
+// Init attaches the transport to the network given by the "network" config key
+// "addr" (or "port") selects the address; otherwise the next free loopback port is used
+func (t *MemoryTransport) Init(config map[string]interface{}) error {
+	c, err := MemoryConfigFromMap(config)
+	if err != nil {
+		return err
+	}
+	return t.Configure(c)
+}
+
+// Configure validates the configuration and attaches the transport to its network
+func (t *MemoryTransport) Configure(config MemoryConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	var addr *net.UDPAddr
+	if config.Port > 0 {
+		addr = &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: config.Port}
+	}
+	if config.Addr != "" {
+		parsedAddr, err := parseMemoryAddr(config.Addr)
+		if err != nil {
+			return err
+		}
+		addr = parsedAddr
+	}
+
+	boundAddr, err := config.Network.attach(t, addr)
+	if err != nil {
+		return err
+	}
+
+	t.network = config.Network
+	t.addr = boundAddr
+	t.setLocalAddr(boundAddr)
+	return nil
+}
+
+// Start begins delivering queued packets to the handler
+func (t *MemoryTransport) Start(handler PacketHandler) error {
+	if t.network == nil {
+		return NewTransportError("transport is not initialized", 7004, nil)
+	}
+
+	if err := t.BaseTransport.Start(handler); err != nil {
+		return err
+	}
+
+	t.queueMu.Lock()
+	t.started = true
+	t.queueMu.Unlock()
+
+	t.wg.Add(1)
+	go t.deliveryLoop()
+	return nil
+}
+
+// Stop detaches the transport from the network and discards queued packets
+func (t *MemoryTransport) Stop() error {
+	if err := t.BaseTransport.Stop(); err != nil {
+		return err
+	}
+
+	if t.network != nil {
+		t.network.detach(t, t.addr)
+	}
+
+	t.queueMu.Lock()
+	t.stopped = true
+	discarded := len(t.queue)
+	t.queue = nil
+	t.queueCv.Broadcast()
+	t.queueMu.Unlock()
+
+	for i := 0; i < discarded; i++ {
+		t.network.done(false)
+	}
+
+	t.wg.Wait()
+	return nil
+}
+
+// Send queues a copy of data for the transport bound to dstAddr
+func (t *MemoryTransport) Send(dstAddr net.Addr, data []byte) error {
+	if t.isClosed() {
+		return NewTransportError("transport is closed", 7005, nil)
+	}
+	if t.network == nil {
+		return NewTransportError("transport is not initialized", 7004, nil)
+	}
+	if dstAddr == nil {
+		return NewTransportError("destination address cannot be nil", 7006, nil)
+	}
+
+	t.network.deliver(t.addr, dstAddr, data)
+	return nil
+}
+
+// enqueue adds a packet to the receive queue, returning false if the transport is not running
+// A configured transport that has not been started drops packets, like a socket nobody reads,
+// so WaitIdle does not wait for a delivery loop that does not exist yet
+func (t *MemoryTransport) enqueue(packet memoryPacket) bool {
+	t.queueMu.Lock()
+	defer t.queueMu.Unlock()
+
+	if !t.started || t.stopped {
+		return false
+	}
+	t.queue = append(t.queue, packet)
+	t.queueCv.Signal()
+	return true
+}
+
+// deliveryLoop hands queued packets to the handler one at a time
+func (t *MemoryTransport) deliveryLoop() {
+	defer t.wg.Done()
+
+	for {
+		t.queueMu.Lock()
+		for len(t.queue) == 0 && !t.stopped {
+			t.queueCv.Wait()
+		}
+		if t.stopped {
+			t.queueMu.Unlock()
+			return
+		}
+		packet := t.queue[0]
+		t.queue = t.queue[1:]
+		t.queueMu.Unlock()
+
+		if handler := t.getHandler(); handler != nil {
+			handler(packet.src, packet.data)
+		}
+		t.network.done(true)
+	}
+}
@@ -0,0 +1,334 @@
+package transport
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// memoryNATFirstPort is the first public port a MemoryNAT hands out
+const memoryNATFirstPort = 40000
+
+// NATConfig describes a NAT gateway added to a MemoryNetwork
+type NATConfig struct {
+	// Type is the mapping and filtering behaviour
+	Type NATType
+	// PublicIP is the address the NAT translates private endpoints to
+	PublicIP string
+	// PrivateNetwork is the CIDR of the endpoints behind the NAT, e.g. "10.1.0.0/24"
+	PrivateNetwork string
+	// MappingTimeout expires mappings that carried no traffic for this long; 0 keeps them forever
+	MappingTimeout time.Duration
+}
+
+// MemoryNAT simulates a NAT gateway between a private network and the rest of a MemoryNetwork
+// Packets from the private network to outside addresses get their source rewritten to
+// the public IP; packets to the public IP are forwarded only through an existing mapping
+// that the filtering rules allow, and are dropped otherwise.
+type MemoryNAT struct {
+	mu sync.Mutex
+
+	natType        NATType
+	publicIP       net.IP
+	private        *net.IPNet
+	mappingTimeout time.Duration
+	nextPort       int
+
+	// mappings is keyed by private endpoint, plus the destination for symmetric NATs
+	mappings map[string]*natMapping
+	byPort   map[int]*natMapping
+
+	// forwards are static port mappings keyed by private endpoint, like a router's port forwarding
+	forwards map[string]*natMapping
+
+	translated uint64
+	blocked    uint64
+}
+
+// natMapping is one translation between a private endpoint and a public port
+type natMapping struct {
+	key      string
+	private  *net.UDPAddr
+	public   *net.UDPAddr
+	permits  map[string]bool
+	lastUsed time.Time
+
+	// forwarded mappings accept packets from anyone and never expire; their permits
+	// record the senders replies go back to
+	forwarded bool
+}
+
+// AddNAT places the endpoints in config.PrivateNetwork behind a simulated NAT
+// Transports attach to private addresses with the "addr" config key as usual.
+func (n *MemoryNetwork) AddNAT(config NATConfig) (*MemoryNAT, error) {
+	publicIP := net.ParseIP(config.PublicIP)
+	if publicIP == nil {
+		return nil, NewTransportError("invalid NAT public IP: "+config.PublicIP, 7007, nil)
+	}
+	_, private, err := net.ParseCIDR(config.PrivateNetwork)
+	if err != nil {
+		return nil, NewTransportError("invalid NAT private network: "+config.PrivateNetwork, 7010, err)
+	}
+	if private.Contains(publicIP) {
+		return nil, NewTransportError("NAT public IP must be outside its private network", 7011, nil)
+	}
+	if config.Type < NATFullCone || config.Type > NATSymmetric {
+		return nil, NewTransportError("unknown NAT type", 7012, nil)
+	}
+	if config.MappingTimeout < 0 {
+		return nil, NewTransportError("NAT mapping timeout cannot be negative", 7013, nil)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, other := range n.nats {
+		if other.publicIP.Equal(publicIP) || other.private.Contains(publicIP) || private.Contains(other.publicIP) {
+			return nil, NewTransportError("NAT overlaps an existing NAT", 7014, nil)
+		}
+	}
+
+	nat := &MemoryNAT{
+		natType:        config.Type,
+		publicIP:       publicIP,
+		private:        private,
+		mappingTimeout: config.MappingTimeout,
+		nextPort:       memoryNATFirstPort,
+		mappings:       make(map[string]*natMapping),
+		byPort:         make(map[int]*natMapping),
+		forwards:       make(map[string]*natMapping),
+	}
+	n.nats = append(n.nats, nat)
+	return nat, nil
+}
+
+// route applies NAT translation to a packet, returning false if a NAT drops it
+// Must be called with n.mu held
+func (n *MemoryNetwork) route(src net.Addr, dst net.Addr) (net.Addr, net.Addr, bool) {
+	srcUDP, srcOK := src.(*net.UDPAddr)
+	dstUDP, dstOK := dst.(*net.UDPAddr)
+	if len(n.nats) == 0 || !srcOK || !dstOK {
+		return src, dst, true
+	}
+
+	now := time.Now()
+	for _, nat := range n.nats {
+		if nat.private.Contains(srcUDP.IP) && !nat.private.Contains(dstUDP.IP) {
+			srcUDP = nat.outbound(srcUDP, dstUDP, now)
+			break
+		}
+	}
+	for _, nat := range n.nats {
+		if nat.publicIP.Equal(dstUDP.IP) {
+			private, allowed := nat.inbound(srcUDP, dstUDP, now)
+			if !allowed {
+				return nil, nil, false
+			}
+			dstUDP = private
+			break
+		}
+	}
+	return srcUDP, dstUDP, true
+}
+
+// outbound translates a private source endpoint and opens the filter for dst
+func (nat *MemoryNAT) outbound(src *net.UDPAddr, dst *net.UDPAddr, now time.Time) *net.UDPAddr {
+	nat.mu.Lock()
+	defer nat.mu.Unlock()
+
+	key := src.String()
+	// Replies to peers that came in through a forwarded port leave through it
+	if forward, exists := nat.forwards[key]; exists && forward.permits[dst.String()] {
+		forward.lastUsed = now
+		nat.translated++
+		return forward.public
+	}
+	if nat.natType == NATSymmetric {
+		key += "->" + dst.String()
+	}
+
+	mapping, exists := nat.mappings[key]
+	if exists && nat.expired(mapping, now) {
+		nat.remove(mapping)
+		exists = false
+	}
+	if !exists {
+		mapping = &natMapping{
+			key:     key,
+			private: src,
+			public:  &net.UDPAddr{IP: nat.publicIP, Port: nat.allocatePort()},
+			permits: make(map[string]bool),
+		}
+		nat.mappings[key] = mapping
+		nat.byPort[mapping.public.Port] = mapping
+	}
+
+	mapping.permits[nat.permitKey(dst)] = true
+	mapping.lastUsed = now
+	nat.translated++
+	return mapping.public
+}
+
+// inbound finds the private endpoint for a packet to the public IP, applying the filtering rules
+func (nat *MemoryNAT) inbound(src *net.UDPAddr, dst *net.UDPAddr, now time.Time) (*net.UDPAddr, bool) {
+	nat.mu.Lock()
+	defer nat.mu.Unlock()
+
+	mapping, exists := nat.byPort[dst.Port]
+	if exists && nat.expired(mapping, now) {
+		nat.remove(mapping)
+		exists = false
+	}
+	if !exists || (nat.natType != NATFullCone && !mapping.forwarded && !mapping.permits[nat.permitKey(src)]) {
+		nat.blocked++
+		return nil, false
+	}
+
+	if mapping.forwarded {
+		mapping.permits[src.String()] = true
+	}
+	mapping.lastUsed = now
+	nat.translated++
+	return mapping.private, true
+}
+
+// AddPortMapping forwards publicPort to the private endpoint, as NAT-PMP, PCP or UPnP would
+// Forwarded ports accept packets from anyone and never expire. Replies to those senders
+// leave through the forwarded port; other outbound packets keep using the NAT type's own
+// mappings, so behind a symmetric NAT the forwarded port is the only endpoint peers can
+// reach. A publicPort of 0 picks a free port. It returns the public endpoint.
+func (nat *MemoryNAT) AddPortMapping(private string, publicPort int) (*net.UDPAddr, error) {
+	privateAddr, err := net.ResolveUDPAddr("udp", private)
+	if err != nil {
+		return nil, NewTransportError("invalid private endpoint: "+private, 7008, err)
+	}
+	if !nat.private.Contains(privateAddr.IP) {
+		return nil, NewTransportError("endpoint "+private+" is not behind this NAT", 7015, nil)
+	}
+	if publicPort < 0 || publicPort > 65535 {
+		return nil, NewTransportError("invalid public port", 7016, nil)
+	}
+
+	nat.mu.Lock()
+	defer nat.mu.Unlock()
+
+	key := privateAddr.String()
+	if existing, exists := nat.forwards[key]; exists {
+		if publicPort == 0 || publicPort == existing.public.Port {
+			return existing.public, nil
+		}
+		nat.remove(existing)
+	}
+	if used, exists := nat.byPort[publicPort]; exists {
+		if used.forwarded {
+			return nil, NewTransportError("public port "+strconv.Itoa(publicPort)+" is already forwarded", 7017, nil)
+		}
+		nat.remove(used)
+	}
+	if publicPort == 0 {
+		publicPort = nat.allocatePort()
+	}
+
+	mapping := &natMapping{
+		key:       key,
+		private:   privateAddr,
+		public:    &net.UDPAddr{IP: nat.publicIP, Port: publicPort},
+		permits:   make(map[string]bool),
+		lastUsed:  time.Now(),
+		forwarded: true,
+	}
+	nat.forwards[key] = mapping
+	nat.byPort[publicPort] = mapping
+	return mapping.public, nil
+}
+
+// RemovePortMapping removes a port forwarded with AddPortMapping
+func (nat *MemoryNAT) RemovePortMapping(publicPort int) {
+	nat.mu.Lock()
+	defer nat.mu.Unlock()
+
+	if mapping, exists := nat.byPort[publicPort]; exists && mapping.forwarded {
+		nat.remove(mapping)
+	}
+}
+
+// permitKey returns the filter key for a remote endpoint
+// Must be called with nat.mu held
+func (nat *MemoryNAT) permitKey(remote *net.UDPAddr) string {
+	if nat.natType == NATRestrictedCone {
+		return remote.IP.String()
+	}
+	return remote.String()
+}
+
+// allocatePort returns the next unused public port
+// Must be called with nat.mu held
+func (nat *MemoryNAT) allocatePort() int {
+	for {
+		port := nat.nextPort
+		nat.nextPort++
+		if nat.nextPort > 65535 {
+			nat.nextPort = memoryNATFirstPort
+		}
+		if _, used := nat.byPort[port]; !used {
+			return port
+		}
+	}
+}
+
+// expired reports whether a mapping has been idle longer than the mapping timeout
+// Must be called with nat.mu held
+func (nat *MemoryNAT) expired(mapping *natMapping, now time.Time) bool {
+	return !mapping.forwarded && nat.mappingTimeout > 0 && now.Sub(mapping.lastUsed) > nat.mappingTimeout
+}
+
+// remove deletes a mapping
+// Must be called with nat.mu held
+func (nat *MemoryNAT) remove(mapping *natMapping) {
+	if mapping.forwarded {
+		delete(nat.forwards, mapping.key)
+	} else {
+		delete(nat.mappings, mapping.key)
+	}
+	delete(nat.byPort, mapping.public.Port)
+}
+
+// Type returns the NAT's mapping and filtering behaviour
+func (nat *MemoryNAT) Type() NATType {
+	return nat.natType
+}
+
+// PublicIP returns the address private endpoints are translated to
+func (nat *MemoryNAT) PublicIP() net.IP {
+	return nat.publicIP
+}
+
+// Mappings returns the number of live mappings
+func (nat *MemoryNAT) Mappings() int {
+	nat.mu.Lock()
+	defer nat.mu.Unlock()
+
+	now := time.Now()
+	count := 0
+	for _, mapping := range nat.mappings {
+		if !nat.expired(mapping, now) {
+			count++
+		}
+	}
+	return count
+}
+
+// Translated returns the number of packets translated in either direction
+func (nat *MemoryNAT) Translated() uint64 {
+	nat.mu.Lock()
+	defer nat.mu.Unlock()
+	return nat.translated
+}
+
+// Blocked returns the number of inbound packets dropped for lack of a mapping or permit
+func (nat *MemoryNAT) Blocked() uint64 {
+	nat.mu.Lock()
+	defer nat.mu.Unlock()
+	return nat.blocked
+}
@@ -0,0 +1,193 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// defaultReflectTimeout is how long DetectNAT waits for each reflection when no timeout is given
+const defaultReflectTimeout = time.Second
+
+// NATType describes the mapping and filtering behaviour of a NAT
+// The cone and symmetric types configure MemoryNAT; DetectNAT can also report
+// NATNone, NATBlocked and NATUnknown.
+type NATType int
+
+const (
+	// NATFullCone maps each private endpoint to one public port and accepts packets from anyone
+	NATFullCone NATType = iota
+	// NATRestrictedCone accepts packets only from IPs the private endpoint has sent to
+	NATRestrictedCone
+	// NATPortRestrictedCone accepts packets only from IP:port pairs the private endpoint has sent to
+	NATPortRestrictedCone
+	// NATSymmetric allocates a new public port per destination and filters like a port-restricted cone
+	NATSymmetric
+	// NATNone means the node's local endpoint is its external endpoint
+	NATNone
+	// NATBlocked means no reflection server answered
+	NATBlocked
+	// NATUnknown means the servers could not run every test, e.g. they ignore change requests
+	NATUnknown
+)
+
+// String returns the string representation of the NAT type
+func (t NATType) String() string {
+	switch t {
+	case NATFullCone:
+		return "full-cone"
+	case NATRestrictedCone:
+		return "restricted-cone"
+	case NATPortRestrictedCone:
+		return "port-restricted-cone"
+	case NATSymmetric:
+		return "symmetric"
+	case NATNone:
+		return "none"
+	case NATBlocked:
+		return "blocked"
+	case NATUnknown:
+		return "unknown"
+	default:
+		return "unknown"
+	}
+}
+
+// ChangeRequest asks a reflection server to answer from a different address
+
+type ChangeRequest struct {
+	// ChangeIP answers from a different IP (and port)
+	ChangeIP bool
+	// ChangePort answers from the same IP but a different port
+	ChangePort bool
+}
+
+// EndpointReflector asks a server which endpoint a query arrived from
+// RendezvousManager implements it between nodes and STUNClient against STUN servers
+
+type EndpointReflector interface {
+	// Reflect returns the external endpoint server saw the query from
+	// RendezvousManager fails with code 9014 if the server cannot honour change and 9015 if no
+	// answer arrives in time; STUNClient uses 9036 and 9037
+	Reflect(server net.Addr, change ChangeRequest, timeout time.Duration) (net.Addr, error)
+}
+
+// NATReport is the result of NAT detection
+
+type NATReport struct {
+	// Type is the detected NAT behaviour
+	Type NATType
+	// ExternalEndpoints are the distinct endpoints the servers saw, in server order
+	ExternalEndpoints []net.Addr
+	// DetectedAt is when detection finished
+	DetectedAt time.Time
+}
+
+// DetectNAT classifies the NAT in front of localAddrs with the classic reflection tests
+// The node queries every server to learn its external endpoints; different endpoints
+// for different servers mean a symmetric NAT. It then asks the first server to answer
+// from another IP (full cone if it arrives) and from another port only (restricted cone
+// if it arrives, port-restricted otherwise). At least two servers on different IPs are needed.
+func DetectNAT(reflector EndpointReflector, servers []net.Addr, localAddrs []net.Addr, timeout time.Duration) (*NATReport, error) {
+	if len(servers) < 2 {
+		return nil, NewTransportError("NAT detection needs at least two reflection servers", 9016, nil)
+	}
+	if timeout <= 0 {
+		timeout = defaultReflectTimeout
+	}
+
+	report := &NATReport{Type: NATUnknown}
+	defer func() { report.DetectedAt = time.Now() }()
+
+	// Mapping: the endpoint every server sees
+	answered := 0
+	varies := false
+	for _, server := range servers {
+		endpoint, err := reflector.Reflect(server, ChangeRequest{}, timeout)
+		if err != nil {
+			continue
+		}
+		answered++
+		if len(report.ExternalEndpoints) > 0 && report.ExternalEndpoints[0].String() != endpoint.String() {
+			varies = true
+		}
+		if !containsAddr(report.ExternalEndpoints, endpoint) {
+			report.ExternalEndpoints = append(report.ExternalEndpoints, endpoint)
+		}
+	}
+
+	switch {
+	case answered == 0:
+		report.Type = NATBlocked
+		return report, nil
+	case varies:
+		report.Type = NATSymmetric
+		return report, nil
+	case isLocalEndpoint(report.ExternalEndpoints[0], localAddrs):
+		report.Type = NATNone
+		return report, nil
+	case answered < 2:
+		return report, nil
+	}
+
+	// Filtering: which sources can reach the mapping
+	if _, err := reflector.Reflect(servers[0], ChangeRequest{ChangeIP: true, ChangePort: true}, timeout); err == nil {
+		report.Type = NATFullCone
+		return report, nil
+	} else if isReflectUnsupported(err) {
+		return report, nil
+	}
+	if _, err := reflector.Reflect(servers[0], ChangeRequest{ChangePort: true}, timeout); err == nil {
+		report.Type = NATRestrictedCone
+	} else if !isReflectUnsupported(err) {
+		report.Type = NATPortRestrictedCone
+	}
+	return report, nil
+}
+
+// isReflectUnsupported reports whether a reflection failed because the server cannot change its address
+func isReflectUnsupported(err error) bool {
+	var transportErr *TransportError
+	return errors.As(err, &transportErr) && (transportErr.Code == 9014 || transportErr.Code == 9036)
+}
+
+// isLocalEndpoint reports whether endpoint is one of the local addresses
+// A wildcard local address matches any interface address with the same port
+func isLocalEndpoint(endpoint net.Addr, localAddrs []net.Addr) bool {
+	external, ok := endpoint.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+
+	var interfaceAddrs []net.Addr
+	for _, addr := range localAddrs {
+		local, ok := addr.(*net.UDPAddr)
+		if !ok || local.Port != external.Port {
+			continue
+		}
+		if local.IP.Equal(external.IP) {
+			return true
+		}
+		if local.IP == nil || local.IP.IsUnspecified() {
+			if interfaceAddrs == nil {
+				interfaceAddrs, _ = net.InterfaceAddrs()
+			}
+			for _, ifaceAddr := range interfaceAddrs {
+				if ipNet, ok := ifaceAddr.(*net.IPNet); ok && ipNet.IP.Equal(external.IP) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// containsAddr reports whether addrs contains addr
+func containsAddr(addrs []net.Addr, addr net.Addr) bool {
+	for _, existing := range addrs {
+		if existing.String() == addr.String() {
+			return true
+		}
+	}
+	return false
+}
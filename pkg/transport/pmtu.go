@@ -0,0 +1,451 @@
+package transport
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// 路径MTU探测和分片使用的数据包类型（仅在启用ACK处理或滑动窗口模式时使用）
+// 分片：类型(1字节) + 消息ID(4字节) + 分片序号(1字节) + 分片总数(1字节) + 分片数据
+// 探测：类型(1字节) + 探测ID(4字节) + 填充
+// 探测确认：类型(1字节) + 探测ID(4字节) + 收到的探测包长度(2字节)
+const (
+	packetTypeFragment     uint8 = 5
+	packetTypePMTUProbe    uint8 = 6
+	packetTypePMTUProbeAck uint8 = 7
+)
+
+const (
+	fragmentHeaderSize  = 7
+	pmtuProbeHeaderSize = 5
+	pmtuProbeAckSize    = 7
+
+	// pmtuBase 是不经探测即认为可用的路径MTU（IPv6最小MTU）
+	pmtuBase = 1280
+
+	// pmtuMaxLimit 是可配置的最大路径MTU上限
+	pmtuMaxLimit = 65535
+
+	// pmtuProbeAttempts 是同一大小的探测连续丢失多少次后认为该大小不可达
+	pmtuProbeAttempts = 3
+
+	// pmtuRaiseInterval 是搜索完成后重新尝试更大MTU的间隔
+	pmtuRaiseInterval = 10 * time.Minute
+
+	// pmtuIdleTimeout 是路径状态的空闲过期时间
+	pmtuIdleTimeout = 10 * time.Minute
+
+	// 分片重组限制：重组表满时淘汰最早的消息，单个来源最多占用 fragmentMaxPerSource 个位置
+	fragmentMaxCount          = 64
+	fragmentMaxReassemblies   = 256
+	fragmentMaxPerSource      = 16
+	fragmentReassemblyTimeout = 5 * time.Second
+
+	// IP和UDP头部开销，路径MTU减去它才是UDP负载的上限
+	ipv4UDPOverhead = 28
+	ipv6UDPOverhead = 48
+)
+
+// 路径MTU探测默认参数
+const (
+	defaultMaxPathMTU       = 1500
+	defaultPMTUProbeTimeout = 500 * time.Millisecond
+)
+
+// PathMTUListener 在到某个对等节点的路径MTU变化时调用
+type PathMTUListener func(addr net.Addr, mtu int)
+
+// pathMTU 是到单个对等节点的分组层路径MTU探测状态（RFC 8899 风格）
+// 在 [low, high] 区间内二分搜索，low 始终是已确认可达的大小
+type pathMTU struct {
+	addr *net.UDPAddr
+	mtu  int // 已确认的路径MTU（包括IP和UDP头部）
+
+	low       int
+	high      int
+	searching bool
+
+	// 当前在途的探测，probeSize 为0表示没有
+	probeSize     int
+	probeID       uint32
+	probeDeadline time.Time
+	probeAttempts int
+
+	nextSearch time.Time
+	lastUsed   time.Time
+}
+
+// fragmentBuffer 是正在重组的分片消息
+type fragmentBuffer struct {
+	parts    [][]byte
+	received int
+	expires  time.Time
+	source   string        // 限制重组数的来源，见 sourceKey
+	element  *list.Element // 在 t.fragmentOrder 中的位置
+}
+
+// udpOverhead 返回到 addr 的IP和UDP头部开销
+func udpOverhead(addr *net.UDPAddr) int {
+	if addr.IP.To4() != nil {
+		return ipv4UDPOverhead
+	}
+	return ipv6UDPOverhead
+}
+
+// configurePathMTU 应用路径MTU探测相关配置
+func (t *UDPTransport) configurePathMTU(config UDPConfig) {
+	t.pmtuDiscovery = config.PathMTUDiscovery
+	t.maxPathMTU = config.MaxPathMTU
+	t.pmtuProbeTimeout = config.PMTUProbeTimeout
+}
+
+// pmtuActive 判断是否处理探测和分片数据包；其他模式下对端无法识别探测和分片数据包
+func (t *UDPTransport) pmtuActive() bool {
+	return t.ackHandlerEnabled || t.windowed
+}
+
+// pmtuSending 判断是否向对端发送探测包并对超过路径MTU的数据包分片
+func (t *UDPTransport) pmtuSending() bool {
+	return t.pmtuDiscovery && t.pmtuActive()
+}
+
+// getPathMTU 获取或创建到 addr 的路径MTU状态
+// 调用时必须持有 t.pmtuMu
+func (t *UDPTransport) getPathMTU(addr *net.UDPAddr, now time.Time) *pathMTU {
+	key := addr.String()
+	p, exists := t.pmtuPaths[key]
+	if !exists {
+		p = &pathMTU{addr: addr, mtu: pmtuBase, low: pmtuBase, high: t.maxPathMTU}
+		if !t.pmtuDiscovery {
+			// 不探测时直接使用配置的最大路径MTU
+			p.mtu, p.low = t.maxPathMTU, t.maxPathMTU
+		}
+		p.searching = p.low < p.high
+		t.pmtuPaths[key] = p
+	}
+	p.lastUsed = now
+	return p
+}
+
+// maxDatagramSize 返回发往 addr 的单个UDP数据包的最大负载
+func (t *UDPTransport) maxDatagramSize(addr *net.UDPAddr) int {
+	t.pmtuMu.Lock()
+	p := t.getPathMTU(addr, time.Now())
+	mtu := p.mtu
+	t.pmtuMu.Unlock()
+	return mtu - t.datagramOverhead(addr)
+}
+
+// datagramOverhead 返回发往 addr 的数据包在负载之外的开销，包括IP和UDP头部以及认证信封
+func (t *UDPTransport) datagramOverhead(addr *net.UDPAddr) int {
+	return udpOverhead(addr) + t.envelopeOverheadFor(addr)
+}
+
+// writeFragments 将超过路径MTU的数据包拆分为分片写出
+func (t *UDPTransport) writeFragments(conn *net.UDPConn, data []byte, udpAddr *net.UDPAddr, limit int) error {
+	chunkSize := limit - fragmentHeaderSize
+	count := (len(data) + chunkSize - 1) / chunkSize
+	if count > fragmentMaxCount {
+		return NewTransportError(fmt.Sprintf("packet of %d bytes exceeds %d fragments", len(data), fragmentMaxCount), 3032, nil)
+	}
+
+	msgID := atomic.AddUint32(&t.nextFragmentID, 1)
+	fragments := make([]outgoingDatagram, 0, count)
+	for i := 0; i < count; i++ {
+		chunk := data[i*chunkSize:]
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		fragment := make([]byte, fragmentHeaderSize+len(chunk))
+		fragment[0] = packetTypeFragment
+		binary.BigEndian.PutUint32(fragment[1:5], msgID)
+		fragment[5] = uint8(i)
+		fragment[6] = uint8(count)
+		copy(fragment[fragmentHeaderSize:], chunk)
+		fragments = append(fragments, outgoingDatagram{data: fragment, addr: udpAddr})
+	}
+	return t.writeDatagrams(conn, fragments)
+}
+
+// handleFragment 收集分片，全部到达后把重组的数据包交给 handler 重新处理
+func (t *UDPTransport) handleFragment(srcAddr net.Addr, data []byte, handler PacketHandler) error {
+	if len(data) <= fragmentHeaderSize {
+		return nil
+	}
+	msgID := binary.BigEndian.Uint32(data[1:5])
+	index, count := int(data[5]), int(data[6])
+	if count < 2 || count > fragmentMaxCount || index >= count {
+		return nil
+	}
+
+	key := fmt.Sprintf("%s/%d", srcAddr, msgID)
+	now := time.Now()
+
+	t.pmtuMu.Lock()
+	buffer, exists := t.fragments[key]
+	if !exists {
+		if buffer = t.addFragmentBuffer(key, sourceKey(srcAddr), count, now); buffer == nil {
+			// 该来源的重组数已达上限，丢弃新消息
+			t.pmtuMu.Unlock()
+			return nil
+		}
+	}
+	if len(buffer.parts) != count || buffer.parts[index] != nil {
+		// 分片总数不一致或重复分片
+		t.pmtuMu.Unlock()
+		return nil
+	}
+	buffer.parts[index] = append([]byte(nil), data[fragmentHeaderSize:]...)
+	buffer.received++
+	if buffer.received < count {
+		t.pmtuMu.Unlock()
+		return nil
+	}
+	t.removeFragmentBuffer(key)
+	t.pmtuMu.Unlock()
+
+	var packet []byte
+	for _, part := range buffer.parts {
+		packet = append(packet, part...)
+	}
+	// 不允许嵌套分片
+	if packet[0] == packetTypeFragment {
+		return nil
+	}
+	return handler(srcAddr, packet)
+}
+
+// addFragmentBuffer 为新消息创建重组缓冲区，来源的重组数已达上限时返回nil
+// 重组表已满时淘汰最早的消息，伪造来源的洪泛不能让正常的分片消息一直无法重组
+// 调用时必须持有 t.pmtuMu
+func (t *UDPTransport) addFragmentBuffer(key, source string, count int, now time.Time) *fragmentBuffer {
+	if t.fragmentSources[source] >= fragmentMaxPerSource {
+		return nil
+	}
+	if len(t.fragments) >= fragmentMaxReassemblies {
+		t.removeFragmentBuffer(t.fragmentOrder.Front().Value.(string))
+	}
+
+	buffer := &fragmentBuffer{
+		parts:   make([][]byte, count),
+		expires: now.Add(fragmentReassemblyTimeout),
+		source:  source,
+	}
+	buffer.element = t.fragmentOrder.PushBack(key)
+	t.fragments[key] = buffer
+	t.fragmentSources[source]++
+	return buffer
+}
+
+// removeFragmentBuffer 删除重组缓冲区
+// 调用时必须持有 t.pmtuMu
+func (t *UDPTransport) removeFragmentBuffer(key string) {
+	buffer, exists := t.fragments[key]
+	if !exists {
+		return
+	}
+	delete(t.fragments, key)
+	t.fragmentOrder.Remove(buffer.element)
+	if t.fragmentSources[buffer.source] <= 1 {
+		delete(t.fragmentSources, buffer.source)
+	} else {
+		t.fragmentSources[buffer.source]--
+	}
+}
+
+// handlePMTUProbe 回复探测确认，携带实际收到的长度以识别被截断的探测包
+func (t *UDPTransport) handlePMTUProbe(srcAddr net.Addr, data []byte) {
+	udpAddr, ok := srcAddr.(*net.UDPAddr)
+	if !ok || len(data) < pmtuProbeHeaderSize {
+		return
+	}
+	ack := make([]byte, pmtuProbeAckSize)
+	ack[0] = packetTypePMTUProbeAck
+	copy(ack[1:5], data[1:5])
+	binary.BigEndian.PutUint16(ack[5:7], uint16(len(data)))
+	t.writeDatagram(t.conn, ack, udpAddr)
+}
+
+// handlePMTUProbeAck 处理探测确认，把探测大小确认为新的路径MTU下限
+func (t *UDPTransport) handlePMTUProbeAck(srcAddr net.Addr, data []byte) {
+	if len(data) < pmtuProbeAckSize {
+		return
+	}
+	probeID := binary.BigEndian.Uint32(data[1:5])
+	length := int(binary.BigEndian.Uint16(data[5:7]))
+
+	t.pmtuMu.Lock()
+	p, exists := t.pmtuPaths[srcAddr.String()]
+	if !exists || p.probeSize == 0 || p.probeID != probeID || length != p.probeSize-t.datagramOverhead(p.addr) {
+		t.pmtuMu.Unlock()
+		return
+	}
+	p.low = p.probeSize
+	p.probeSize = 0
+	changed := p.mtu != p.low
+	p.mtu = p.low
+	addr, mtu := p.addr, p.mtu
+	t.pmtuMu.Unlock()
+
+	if changed {
+		t.notifyPathMTU(addr, mtu)
+	}
+}
+
+// pathMTUFailure 在可靠数据包放弃重传时调用
+// 大于基础MTU的数据包持续丢失可能是路径MTU变小（黑洞），回退到基础MTU并重新搜索
+func (t *UDPTransport) pathMTUFailure(addr *net.UDPAddr, datagramSize int) {
+	if !t.pmtuDiscovery || datagramSize <= pmtuBase-udpOverhead(addr) {
+		return
+	}
+
+	t.pmtuMu.Lock()
+	p, exists := t.pmtuPaths[addr.String()]
+	if !exists || p.mtu == pmtuBase {
+		t.pmtuMu.Unlock()
+		return
+	}
+	p.mtu, p.low, p.high = pmtuBase, pmtuBase, t.maxPathMTU
+	p.probeSize = 0
+	p.searching = true
+	t.pmtuMu.Unlock()
+
+	t.notifyPathMTU(addr, pmtuBase)
+}
+
+// nextProbe 推进单个路径的探测状态，返回需要发送的探测大小，0表示不需要
+// 调用时必须持有 t.pmtuMu
+func (t *UDPTransport) nextProbe(p *pathMTU, now time.Time) int {
+	if !p.searching {
+		if now.Before(p.nextSearch) {
+			return 0
+		}
+		// 定期尝试更大的MTU，路径可能已经变化
+		p.low, p.high = p.mtu, t.maxPathMTU
+		p.searching = p.low < p.high
+		if !p.searching {
+			return 0
+		}
+	}
+
+	if p.probeSize != 0 {
+		if now.Before(p.probeDeadline) {
+			return 0
+		}
+		p.probeAttempts++
+		if p.probeAttempts >= pmtuProbeAttempts {
+			// 该大小不可达，缩小搜索上限
+			p.high = p.probeSize - 1
+			p.probeSize = 0
+		}
+	}
+
+	if p.probeSize == 0 {
+		if p.low >= p.high {
+			p.searching = false
+			p.nextSearch = now.Add(pmtuRaiseInterval)
+			return 0
+		}
+		p.probeSize = (p.low + p.high + 1) / 2
+		p.probeAttempts = 0
+	}
+
+	t.pmtuProbeSeq++
+	p.probeID = t.pmtuProbeSeq
+	p.probeDeadline = now.Add(t.pmtuProbeTimeout)
+	return p.probeSize
+}
+
+// pmtuLoop 定期发送探测、处理探测超时并清理过期的路径和分片状态
+func (t *UDPTransport) pmtuLoop() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(windowClockGranularity)
+	defer ticker.Stop()
+
+	type probe struct {
+		addr *net.UDPAddr
+		id   uint32
+		size int
+	}
+
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case now := <-ticker.C:
+			var probes []probe
+
+			t.pmtuMu.Lock()
+			for key, p := range t.pmtuPaths {
+				if now.Sub(p.lastUsed) > pmtuIdleTimeout {
+					delete(t.pmtuPaths, key)
+					continue
+				}
+				if size := t.nextProbe(p, now); size > 0 {
+					probes = append(probes, probe{addr: p.addr, id: p.probeID, size: size})
+				}
+			}
+			// 重组缓冲区按创建顺序排列，过期时间也是同样的顺序
+			for front := t.fragmentOrder.Front(); front != nil; front = t.fragmentOrder.Front() {
+				key := front.Value.(string)
+				if !now.After(t.fragments[key].expires) {
+					break
+				}
+				t.removeFragmentBuffer(key)
+			}
+			t.pmtuMu.Unlock()
+
+			for _, p := range probes {
+				packet := make([]byte, p.size-t.datagramOverhead(p.addr))
+				packet[0] = packetTypePMTUProbe
+				binary.BigEndian.PutUint32(packet[1:5], p.id)
+				// 探测包也占用发送预算，但不等待
+				t.getCongestion(p.addr).charge(len(packet), now)
+				t.writeDatagram(t.conn, packet, p.addr)
+			}
+		}
+	}
+}
+
+// AddPathMTUListener 注册路径MTU变化监听器
+func (t *UDPTransport) AddPathMTUListener(listener PathMTUListener) {
+	if listener == nil {
+		return
+	}
+	t.pmtuMu.Lock()
+	t.pmtuListeners = append(t.pmtuListeners, listener)
+	t.pmtuMu.Unlock()
+}
+
+// notifyPathMTU 通知所有路径MTU监听器
+// 调用时不能持有 t.pmtuMu
+func (t *UDPTransport) notifyPathMTU(addr *net.UDPAddr, mtu int) {
+	t.pmtuMu.Lock()
+	listeners := make([]PathMTUListener, len(t.pmtuListeners))
+	copy(listeners, t.pmtuListeners)
+	t.pmtuMu.Unlock()
+
+	for _, listener := range listeners {
+		listener(addr, mtu)
+	}
+}
+
+// PathMTU 返回到 addr 的已确认路径MTU（包括IP和UDP头部），以及探测是否已完成
+// 尚未向 addr 发送过数据时返回 0, false
+func (t *UDPTransport) PathMTU(addr net.Addr) (int, bool) {
+	key := t.endpointKey(addr)
+
+	t.pmtuMu.Lock()
+	defer t.pmtuMu.Unlock()
+
+	p, exists := t.pmtuPaths[key]
+	if !exists {
+		return 0, false
+	}
+	return p.mtu, !p.searching
+}
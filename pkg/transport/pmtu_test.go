@@ -0,0 +1,130 @@
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPathMTUSearch tests that probing converges on the largest size the path carries
+func TestPathMTUSearch(t *testing.T) {
+	tr := NewUDPTransport()
+	tr.pmtuDiscovery = true
+	tr.pmtuProbeTimeout = 10 * time.Millisecond
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 9993}
+
+	var reported []int
+	tr.AddPathMTUListener(func(addr net.Addr, mtu int) { reported = append(reported, mtu) })
+
+	const pathLimit = 1420
+	now := time.Now()
+	tr.pmtuMu.Lock()
+	p := tr.getPathMTU(addr, now)
+	tr.pmtuMu.Unlock()
+
+	for i := 0; i < 100; i++ {
+		tr.pmtuMu.Lock()
+		size := tr.nextProbe(p, now)
+		probeID := p.probeID
+		searching := p.searching
+		tr.pmtuMu.Unlock()
+		if !searching {
+			break
+		}
+
+		if size > 0 && size <= pathLimit {
+			ack := make([]byte, pmtuProbeAckSize)
+			ack[0] = packetTypePMTUProbeAck
+			binary.BigEndian.PutUint32(ack[1:5], probeID)
+			binary.BigEndian.PutUint16(ack[5:7], uint16(size-ipv4UDPOverhead))
+			tr.handlePMTUProbeAck(addr, ack)
+		}
+		now = now.Add(tr.pmtuProbeTimeout)
+	}
+
+	mtu, complete := tr.PathMTU(addr)
+	assert.True(t, complete)
+	assert.Equal(t, pathLimit, mtu)
+	require.NotEmpty(t, reported)
+	assert.Equal(t, pathLimit, reported[len(reported)-1])
+	assert.Equal(t, pathLimit-ipv4UDPOverhead, tr.maxDatagramSize(addr))
+
+	// A lost oversized packet falls back to the base MTU
+	tr.pathMTUFailure(addr, 1400)
+	mtu, complete = tr.PathMTU(addr)
+	assert.False(t, complete)
+	assert.Equal(t, pmtuBase, mtu)
+}
+
+// TestFragmentReassembly tests out-of-order and duplicate fragments
+func TestFragmentReassembly(t *testing.T) {
+	tr := NewUDPTransport()
+	src := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 9993}
+
+	var delivered [][]byte
+	handler := func(addr net.Addr, data []byte) error {
+		delivered = append(delivered, data)
+		return nil
+	}
+	fragment := func(msgID uint32, index, count int, chunk string) []byte {
+		data := make([]byte, fragmentHeaderSize, fragmentHeaderSize+len(chunk))
+		data[0] = packetTypeFragment
+		binary.BigEndian.PutUint32(data[1:5], msgID)
+		data[5], data[6] = uint8(index), uint8(count)
+		return append(data, chunk...)
+	}
+
+	require.NoError(t, tr.handleFragment(src, fragment(7, 2, 3, "ghi"), handler))
+	require.NoError(t, tr.handleFragment(src, fragment(7, 0, 3, "abc"), handler))
+	require.NoError(t, tr.handleFragment(src, fragment(7, 0, 3, "xxx"), handler))
+	assert.Empty(t, delivered)
+	require.NoError(t, tr.handleFragment(src, fragment(7, 1, 3, "def"), handler))
+
+	require.Len(t, delivered, 1)
+	assert.Equal(t, "abcdefghi", string(delivered[0]))
+	assert.Empty(t, tr.fragments)
+
+	// Inconsistent fragment counts are ignored
+	require.NoError(t, tr.handleFragment(src, fragment(8, 0, 2, "ab"), handler))
+	require.NoError(t, tr.handleFragment(src, fragment(8, 1, 3, "cd"), handler))
+	assert.Len(t, delivered, 1)
+}
+
+// TestFragmentReassemblyLimits tests the per-source limit and eviction of the oldest message
+func TestFragmentReassemblyLimits(t *testing.T) {
+	tr := NewUDPTransport()
+	handler := func(addr net.Addr, data []byte) error { return nil }
+	first := func(msgID uint32) []byte {
+		data := make([]byte, fragmentHeaderSize+1)
+		data[0] = packetTypeFragment
+		binary.BigEndian.PutUint32(data[1:5], msgID)
+		data[5], data[6] = 0, 2
+		return data
+	}
+
+	// One source cannot hold more than its share of the table
+	flooder := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 9993}
+	for id := uint32(0); id < 2*fragmentMaxPerSource; id++ {
+		require.NoError(t, tr.handleFragment(flooder, first(id), handler))
+	}
+	assert.Len(t, tr.fragments, fragmentMaxPerSource)
+
+	// When the table is full, new messages replace the oldest ones
+	for i := 0; i < fragmentMaxReassemblies; i++ {
+		src := &net.UDPAddr{IP: net.IPv4(198, 51, byte(i>>8), byte(i)), Port: 9993}
+		require.NoError(t, tr.handleFragment(src, first(1), handler))
+	}
+	assert.Len(t, tr.fragments, fragmentMaxReassemblies)
+	assert.Equal(t, fragmentMaxReassemblies, tr.fragmentOrder.Len())
+	assert.NotContains(t, tr.fragmentSources, sourceKey(flooder))
+
+	genuine := &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 9993}
+	require.NoError(t, tr.handleFragment(genuine, first(1), handler))
+	assert.Contains(t, tr.fragments, fmt.Sprintf("%s/%d", genuine, 1))
+	assert.Len(t, tr.fragments, fragmentMaxReassemblies)
+}
@@ -0,0 +1,143 @@
+package transport
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/stella/virtual-switch/pkg/address"
+	"github.com/stella/virtual-switch/pkg/packet"
+)
+
+// Reflection change flags, matching the STUN CHANGE-REQUEST bits
+const (
+	reflectFlagChangeIP   byte = 0x04
+	reflectFlagChangePort byte = 0x02
+)
+
+// reflectReply is the answer to a reflection query
+type reflectReply struct {
+	endpoint net.Addr
+	err      error
+}
+
+// SetReflectionAlternates sets the transports used to answer change requests
+// changePort must be bound to the same IP as the main transport on another port;
+// changeAddr to another IP and port. Either may be nil, in which case such requests
+// are answered with an ERROR. The transports only send, so their handlers can be no-ops.
+func (rm *RendezvousManager) SetReflectionAlternates(changePort, changeAddr Transport) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.changePortSender = changePort
+	rm.changeAddrSender = changeAddr
+}
+
+// Reflect asks another node which endpoint our query arrived from
+// Queries are resent every quarter of the timeout until an answer arrives.
+func (rm *RendezvousManager) Reflect(server net.Addr, change ChangeRequest, timeout time.Duration) (net.Addr, error) {
+	if timeout <= 0 {
+		timeout = defaultReflectTimeout
+	}
+
+	var id [4]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, NewTransportError("failed to generate reflection ID", 9033, err)
+	}
+	txid := binary.BigEndian.Uint32(id[:])
+
+	var flags byte
+	if change.ChangeIP {
+		flags |= reflectFlagChangeIP
+	}
+	if change.ChangePort {
+		flags |= reflectFlagChangePort
+	}
+	query := append([]byte{rendezvousPurposeReflect, flags}, id[:]...)
+
+	reply := make(chan reflectReply, 1)
+	rm.mu.Lock()
+	rm.reflections[txid] = reply
+	rm.mu.Unlock()
+	defer func() {
+		rm.mu.Lock()
+		delete(rm.reflections, txid)
+		rm.mu.Unlock()
+	}()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	retry := time.NewTicker(timeout / 4)
+	defer retry.Stop()
+
+	if err := rm.sendPacket(server, nil, packet.VerbHELLO, query); err != nil {
+		return nil, err
+	}
+	for {
+		select {
+		case result := <-reply:
+			return result.endpoint, result.err
+		case <-retry.C:
+			rm.sendPacket(server, nil, packet.VerbHELLO, query)
+		case <-deadline.C:
+			return nil, NewTransportError("no reflection from "+server.String(), 9015, nil)
+		case <-rm.ctx.Done():
+			return nil, NewTransportError("rendezvous manager stopped", 9002, nil)
+		}
+	}
+}
+
+// handleReflect answers a reflection query with the endpoint it arrived from
+func (rm *RendezvousManager) handleReflect(srcAddr net.Addr, src *address.Address, payload []byte) error {
+	if len(payload) < 5 {
+		return NewTransportError("invalid reflection query", 9034, nil)
+	}
+	flags, id := payload[0], payload[1:5]
+
+	rm.mu.Lock()
+	sender := rm.transport
+	switch {
+	case flags&reflectFlagChangeIP != 0:
+		sender = rm.changeAddrSender
+	case flags&reflectFlagChangePort != 0:
+		sender = rm.changePortSender
+	}
+	rm.mu.Unlock()
+
+	if sender == nil {
+		return rm.sendPacket(srcAddr, src, packet.VerbERROR, append([]byte{byte(packet.VerbHELLO)}, id...))
+	}
+	reply, err := appendEndpoint(append([]byte{rendezvousPurposeReflect}, id...), srcAddr)
+	if err != nil {
+		return err
+	}
+	return rm.sendPacketVia(sender, srcAddr, src, packet.VerbOK, reply)
+}
+
+// handleReflectReply completes a reflection query
+// Answers are matched by ID alone, since change requests come back from other addresses
+func (rm *RendezvousManager) handleReflectReply(payload []byte) error {
+	if len(payload) < 4 {
+		return NewTransportError("invalid reflection reply", 9035, nil)
+	}
+	endpoint, err := parseEndpoint(payload[4:])
+	if err != nil {
+		return err
+	}
+	rm.resolveReflection(binary.BigEndian.Uint32(payload[:4]), reflectReply{endpoint: endpoint})
+	return nil
+}
+
+// resolveReflection hands a reply to the query waiting for it, if any
+func (rm *RendezvousManager) resolveReflection(txid uint32, result reflectReply) {
+	rm.mu.Lock()
+	reply, exists := rm.reflections[txid]
+	rm.mu.Unlock()
+	if !exists {
+		return
+	}
+	select {
+	case reply <- result:
+	default:
+	}
+}
@@ -0,0 +1,979 @@
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/stella/virtual-switch/pkg/address"
+	"github.com/stella/virtual-switch/pkg/identity"
+	"github.com/stella/virtual-switch/pkg/packet"
+)
+
+// Rendezvous timing defaults
+const (
+	// rendezvousRegisterInterval keeps the member's NAT mapping towards the coordinator open
+	rendezvousRegisterInterval = 20 * time.Second
+	// rendezvousMemberTimeout expires members that stopped registering
+	rendezvousMemberTimeout = 2 * time.Minute
+	// rendezvousPathTimeout expires direct paths that received nothing for this long
+	rendezvousPathTimeout = 2 * time.Minute
+	// rendezvousIntroduceInterval limits how often relayed traffic re-introduces the same pair
+	rendezvousIntroduceInterval = 5 * time.Second
+
+	defaultPunchInterval = 200 * time.Millisecond
+	defaultPunchAttempts = 10
+)
+
+// HELLO and OK payload purposes
+const (
+	rendezvousPurposeRegister byte = 0x00
+	rendezvousPurposePunch    byte = 0x01
+	rendezvousPurposeReflect  byte = 0x02
+	// rendezvousPurposeCookie is an OK carrying a cookie the HELLO must be repeated with
+	rendezvousPurposeCookie byte = 0x03
+)
+
+// rendezvousFlagCookie marks a HELLO whose purpose byte is followed by a cookie
+const rendezvousFlagCookie byte = 0x80
+
+// rendezvousAnyAddress addresses whichever node receives the packet
+// Members send registrations and introduction requests to it, since they only know the coordinator's endpoint
+var rendezvousAnyAddress, _ = address.NewAddressFromBytes(make([]byte, address.AddressLength))
+
+// rendezvousFlagRequest marks a RENDEZVOUS sent by a member asking the coordinator for an introduction
+const rendezvousFlagRequest byte = 0x01
+
+// PunchResult describes the outcome of a hole punching attempt
+
+type PunchResult struct {
+	// Peer is the node address of the remote member
+	Peer *address.Address
+	// Endpoint is the direct path to the peer, set only when Direct is true
+	Endpoint net.Addr
+	// Direct is true if the peer answered on a direct path
+	Direct bool
+	// Attempts is the number of punch packets sent
+	Attempts int
+	// Err explains why no direct path was found
+	Err error
+}
+
+// PunchListener is called with the outcome of every hole punching attempt
+
+type PunchListener func(result PunchResult)
+
+// FrameHandler receives application data sent with RendezvousManager.Send
+
+type FrameHandler func(peer *address.Address, data []byte)
+
+// RendezvousManager introduces members behind NAT to each other and punches direct paths
+// Every manager can coordinate: members register with a mutually reachable node, which
+// records their public endpoint, relays frames between them and sends each side a
+// RENDEZVOUS carrying the other's endpoint. Both members then send HELLO packets to each
+// other at the same time, opening their NAT mappings, and switch to the direct path once
+// an OK comes back.
+
+type RendezvousManager struct {
+	// Local node address used as the source of every packet
+	localAddress *address.Address
+
+	// Transport layer reference for sending rendezvous packets
+	transport Transport
+
+	mu sync.Mutex
+
+	// Coordinator this node registers with, nil if it only coordinates
+	coordinator    net.Addr
+	publicEndpoint net.Addr
+
+	// Endpoint announced in registrations besides the observed one, e.g. a router port mapping
+	advertisedEndpoint net.Addr
+
+	// Coordinator side: endpoints observed for registered members, keyed by node address
+	members    map[string]*rendezvousMember
+	introduced map[string]time.Time
+
+	// Member side: punching attempts in progress and established direct paths
+	punches map[string]*punchState
+	paths   map[string]*directPath
+
+	punchInterval time.Duration
+	punchAttempts int
+
+	listeners    []PunchListener
+	frameHandler FrameHandler
+
+	// Flood protection for incoming HELLOs and introduction requests, nil if disabled
+	guard *HandshakeGuard
+
+	// Cookies received from nodes we send HELLOs to, keyed by endpoint
+	cookies map[string]*rendezvousCookie
+
+	// Reflection: queries awaiting an answer, and transports for answering change requests
+	reflections      map[uint32]chan reflectReply
+	changePortSender Transport
+	changeAddrSender Transport
+
+	// Context for canceling the rendezvous manager
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// rendezvousMember is a member registered with this coordinator
+type rendezvousMember struct {
+	endpoint   net.Addr
+	advertised net.Addr // nil unless the member announced one
+	lastSeen   time.Time
+}
+
+// rendezvousCookie is a cookie a node asked us to repeat our HELLOs with
+type rendezvousCookie struct {
+	value    []byte
+	received time.Time
+}
+
+// punchState tracks one hole punching attempt
+type punchState struct {
+	peer      *address.Address
+	endpoints []net.Addr // candidates from the coordinator's introductions, empty until one arrives
+	confirmed bool       // a punch from the peer arrived, so endpoints holds only its source
+	sent      int
+	waited    int
+	waiters   []chan PunchResult
+	done      chan struct{}
+}
+
+// directPath is an established direct path to a peer
+type directPath struct {
+	endpoint net.Addr
+	lastSeen time.Time
+}
+
+// NewRendezvousManager creates a new rendezvous manager
+func NewRendezvousManager(localIdentity *identity.Identity, transport Transport) *RendezvousManager {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &RendezvousManager{
+		localAddress:  localIdentity.Address,
+		transport:     transport,
+		members:       make(map[string]*rendezvousMember),
+		introduced:    make(map[string]time.Time),
+		punches:       make(map[string]*punchState),
+		paths:         make(map[string]*directPath),
+		reflections:   make(map[uint32]chan reflectReply),
+		cookies:       make(map[string]*rendezvousCookie),
+		punchInterval: defaultPunchInterval,
+		punchAttempts: defaultPunchAttempts,
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+}
+
+// SetCoordinator sets the mutually reachable node this member registers with
+func (rm *RendezvousManager) SetCoordinator(addr net.Addr) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.coordinator = addr
+	rm.publicEndpoint = nil
+}
+
+// SetHandshakeGuard rate-limits incoming HELLOs and introduction requests per source,
+// and requires HELLOs to carry a cookie while the guard is under load; nil disables it
+func (rm *RendezvousManager) SetHandshakeGuard(guard *HandshakeGuard) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.guard = guard
+}
+
+// SetPunchTiming sets the interval between punch packets and how many are sent before giving up
+func (rm *RendezvousManager) SetPunchTiming(interval time.Duration, attempts int) error {
+	if interval <= 0 || attempts <= 0 {
+		return NewTransportError("punch interval and attempts must be positive", 9001, nil)
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.punchInterval = interval
+	rm.punchAttempts = attempts
+	return nil
+}
+
+// SetFrameHandler sets the handler for application data received with Send
+func (rm *RendezvousManager) SetFrameHandler(handler FrameHandler) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.frameHandler = handler
+}
+
+// AddPunchListener registers a listener for hole punching outcomes
+func (rm *RendezvousManager) AddPunchListener(listener PunchListener) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.listeners = append(rm.listeners, listener)
+}
+
+// Start registers with the coordinator and starts periodic maintenance
+func (rm *RendezvousManager) Start() error {
+	if err := rm.Register(); err != nil {
+		return err
+	}
+	go rm.maintenanceLoop()
+	return nil
+}
+
+// Stop stops the rendezvous manager and fails punching attempts in progress
+func (rm *RendezvousManager) Stop() error {
+	rm.cancel()
+
+	rm.mu.Lock()
+	var failed []PunchResult
+	for key, state := range rm.punches {
+		failed = append(failed, rm.finishPunch(key, state, nil, NewTransportError("rendezvous manager stopped", 9002, nil)))
+	}
+	rm.mu.Unlock()
+
+	for _, result := range failed {
+		rm.notify(result)
+	}
+	return nil
+}
+
+// SetAdvertisedEndpoint announces an endpoint to the coordinator besides the one it observes
+// Peers punch towards both, so a port mapped on the router (see pkg/portmap) gives them
+// a way in even when the observed mapping does not. nil withdraws the endpoint.
+// If a coordinator is set the registration is sent again right away.
+func (rm *RendezvousManager) SetAdvertisedEndpoint(addr net.Addr) error {
+	if addr != nil {
+		if _, err := appendEndpoint(nil, addr); err != nil {
+			return err
+		}
+	}
+
+	rm.mu.Lock()
+	rm.advertisedEndpoint = addr
+	rm.mu.Unlock()
+	return rm.Register()
+}
+
+// AdvertisedEndpoint returns the endpoint set with SetAdvertisedEndpoint
+func (rm *RendezvousManager) AdvertisedEndpoint() net.Addr {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	return rm.advertisedEndpoint
+}
+
+// Register sends a registration to the coordinator, which answers with our public endpoint
+// The registration carries the advertised endpoint, if any. It does nothing if no
+// coordinator is set.
+func (rm *RendezvousManager) Register() error {
+	rm.mu.Lock()
+	coordinator, advertised := rm.coordinator, rm.advertisedEndpoint
+	rm.mu.Unlock()
+	if coordinator == nil {
+		return nil
+	}
+
+	payload := []byte{rendezvousPurposeRegister}
+	if advertised != nil {
+		var err error
+		if payload, err = appendEndpoint(payload, advertised); err != nil {
+			return err
+		}
+	}
+	return rm.sendPacket(coordinator, nil, packet.VerbHELLO, payload)
+}
+
+// PublicEndpoint returns our endpoint as seen by the coordinator, or nil before registration completes
+func (rm *RendezvousManager) PublicEndpoint() net.Addr {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	return rm.publicEndpoint
+}
+
+// MemberAdvertisedEndpoint returns the endpoint a registered member announced, if any
+func (rm *RendezvousManager) MemberAdvertisedEndpoint(peer *address.Address) (net.Addr, bool) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	member, exists := rm.members[peer.String()]
+	if !exists || member.advertised == nil {
+		return nil, false
+	}
+	return member.advertised, true
+}
+
+// MemberEndpoint returns the endpoint a registered member was last seen at
+func (rm *RendezvousManager) MemberEndpoint(peer *address.Address) (net.Addr, bool) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	member, exists := rm.members[peer.String()]
+	if !exists {
+		return nil, false
+	}
+	return member.endpoint, true
+}
+
+// DirectPath returns the direct path to peer, if one has been punched and is still alive
+func (rm *RendezvousManager) DirectPath(peer *address.Address) (net.Addr, bool) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	path, exists := rm.paths[peer.String()]
+	if !exists || time.Since(path.lastSeen) > rendezvousPathTimeout {
+		return nil, false
+	}
+	return path.endpoint, true
+}
+
+// Connect asks the coordinator to introduce us to peer and punches a direct path
+// The returned channel receives the outcome once; it is immediate if a direct path already exists
+func (rm *RendezvousManager) Connect(peer *address.Address) (<-chan PunchResult, error) {
+	result := make(chan PunchResult, 1)
+	key := peer.String()
+
+	rm.mu.Lock()
+	if path, exists := rm.paths[key]; exists && time.Since(path.lastSeen) <= rendezvousPathTimeout {
+		rm.mu.Unlock()
+		result <- PunchResult{Peer: peer, Endpoint: path.endpoint, Direct: true}
+		return result, nil
+	}
+	coordinator := rm.coordinator
+	if coordinator == nil {
+		rm.mu.Unlock()
+		return nil, NewTransportError("no rendezvous coordinator configured", 9003, nil)
+	}
+	state := rm.startPunch(peer)
+	state.waiters = append(state.waiters, result)
+	rm.mu.Unlock()
+
+	request := make([]byte, 1, 1+address.AddressLength)
+	request[0] = rendezvousFlagRequest
+	request = append(request, peer.Bytes()...)
+	if err := rm.sendPacket(coordinator, nil, packet.VerbRENDEZVOUS, request); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Send sends application data to peer over the direct path, or relayed by the coordinator
+func (rm *RendezvousManager) Send(peer *address.Address, data []byte) error {
+	rm.mu.Lock()
+	dst := rm.coordinator
+	if path, exists := rm.paths[peer.String()]; exists && time.Since(path.lastSeen) <= rendezvousPathTimeout {
+		dst = path.endpoint
+	}
+	rm.mu.Unlock()
+
+	if dst == nil {
+		return NewTransportError("no path to peer "+peer.String(), 9004, nil)
+	}
+	return rm.sendPacket(dst, peer, packet.VerbFRAME, data)
+}
+
+// Handler wraps next so that rendezvous packets are consumed and everything else is passed on
+func (rm *RendezvousManager) Handler(next PacketHandler) PacketHandler {
+	return func(srcAddr net.Addr, data []byte) error {
+		if pkt, ok := rm.parsePacket(data); ok {
+			return rm.handlePacket(srcAddr, pkt)
+		}
+		if next != nil {
+			return next(srcAddr, data)
+		}
+		return nil
+	}
+}
+
+// HandleRendezvousMessage processes a received rendezvous packet
+func (rm *RendezvousManager) HandleRendezvousMessage(srcAddr net.Addr, data []byte) error {
+	pkt, ok := rm.parsePacket(data)
+	if !ok {
+		return NewTransportError("not a rendezvous packet", 9005, nil)
+	}
+	return rm.handlePacket(srcAddr, pkt)
+}
+
+// parsePacket recognises rendezvous packets: valid headers addressed to us or to a member we relay for
+func (rm *RendezvousManager) parsePacket(data []byte) (*packet.Packet, bool) {
+	if len(data) < packet.PacketIdxPayload+1 {
+		return nil, false
+	}
+	pkt, err := packet.NewPacketFromData(data)
+	if err != nil || !pkt.IsValid() {
+		return nil, false
+	}
+
+	switch pkt.Verb() {
+	case packet.VerbHELLO, packet.VerbOK, packet.VerbERROR, packet.VerbRENDEZVOUS, packet.VerbFRAME:
+	default:
+		return nil, false
+	}
+
+	dst := pkt.Destination()
+	if dst.Equals(rm.localAddress) || dst.Equals(rendezvousAnyAddress) {
+		return pkt, true
+	}
+	rm.mu.Lock()
+	_, relayed := rm.members[dst.String()]
+	rm.mu.Unlock()
+	return pkt, relayed
+}
+
+// handlePacket dispatches a parsed rendezvous packet
+func (rm *RendezvousManager) handlePacket(srcAddr net.Addr, pkt *packet.Packet) error {
+	if dst := pkt.Destination(); !dst.Equals(rm.localAddress) && !dst.Equals(rendezvousAnyAddress) {
+		return rm.relay(srcAddr, pkt)
+	}
+
+	payload := pkt.Payload()[1:]
+	switch pkt.Verb() {
+	case packet.VerbHELLO:
+		return rm.handleHello(srcAddr, pkt.Source(), payload)
+	case packet.VerbOK:
+		return rm.handleOK(srcAddr, pkt.Source(), payload)
+	case packet.VerbERROR:
+		return rm.handleError(srcAddr, payload)
+	case packet.VerbRENDEZVOUS:
+		return rm.handleRendezvous(srcAddr, pkt.Source(), payload)
+	default:
+		return rm.handleFrame(srcAddr, pkt.Source(), payload)
+	}
+}
+
+// relay forwards a packet to the member it is addressed to
+// Relayed frames between two registered members trigger an introduction, like ZeroTier roots do
+func (rm *RendezvousManager) relay(srcAddr net.Addr, pkt *packet.Packet) error {
+	if pkt.Hops() >= packet.ProtocolMaxHops {
+		return NewTransportError("rendezvous packet exceeded hop limit", 9006, nil)
+	}
+
+	dst := pkt.Destination()
+	src := pkt.Source()
+	rm.mu.Lock()
+	member, exists := rm.members[dst.String()]
+	sender, senderKnown := rm.members[src.String()]
+	introduce := exists && senderKnown && pkt.Verb() == packet.VerbFRAME && sender.endpoint.String() == srcAddr.String()
+	rm.mu.Unlock()
+	if !exists {
+		return NewTransportError("unknown rendezvous destination "+dst.String(), 9007, nil)
+	}
+
+	pkt.IncrementHops()
+	if err := rm.transport.Send(member.endpoint, pkt.Data); err != nil {
+		return err
+	}
+	if introduce {
+		return rm.introduce(src, dst, false)
+	}
+	return nil
+}
+
+// handleHello registers a member or answers a punch packet
+func (rm *RendezvousManager) handleHello(srcAddr net.Addr, src *address.Address, payload []byte) error {
+	if len(payload) < 1 {
+		return NewTransportError("invalid rendezvous HELLO", 9008, nil)
+	}
+
+	var cookie []byte
+	if payload[0]&rendezvousFlagCookie != 0 {
+		if len(payload) < 1+CookieSize {
+			return NewTransportError("invalid rendezvous HELLO", 9008, nil)
+		}
+		cookie = payload[1 : 1+CookieSize]
+		payload = append([]byte{payload[0] &^ rendezvousFlagCookie}, payload[1+CookieSize:]...)
+	}
+
+	rm.mu.Lock()
+	guard := rm.guard
+	rm.mu.Unlock()
+	if guard != nil {
+		switch guard.Admit(srcAddr, cookie) {
+		case GuardDrop:
+			return NewTransportError("rendezvous HELLO from "+srcAddr.String()+" rate limited", 9023, nil)
+		case GuardChallenge:
+			// Stateless: nothing is recorded until the HELLO comes back with the cookie
+			return rm.sendPacket(srcAddr, src, packet.VerbOK, append([]byte{rendezvousPurposeCookie}, guard.Cookie(srcAddr)...))
+		}
+	}
+
+	if payload[0] == rendezvousPurposeReflect {
+		return rm.handleReflect(srcAddr, src, payload[1:])
+	}
+
+	var advertised net.Addr
+	if payload[0] == rendezvousPurposeRegister && len(payload) > 1 {
+		endpoint, err := parseEndpoint(payload[1:])
+		if err != nil {
+			return err
+		}
+		advertised = endpoint
+	}
+
+	now := time.Now()
+	rm.mu.Lock()
+	switch payload[0] {
+	case rendezvousPurposeRegister:
+		// Registrations are not authenticated, so a live member is only refreshed from the
+		// endpoint it registered from; another host claiming its address has to wait until
+		// the member expires instead of taking over its relayed frames and introductions
+		key := src.String()
+		if member, exists := rm.members[key]; exists && member.endpoint.String() != srcAddr.String() &&
+			now.Sub(member.lastSeen) <= rendezvousMemberTimeout {
+			rm.mu.Unlock()
+			return NewTransportError("node "+key+" is registered from another endpoint", 9024, nil)
+		}
+		rm.members[key] = &rendezvousMember{endpoint: srcAddr, advertised: advertised, lastSeen: now}
+	case rendezvousPurposePunch:
+		// The peer's packet got through; answer on the endpoint it actually used
+		if state, exists := rm.punches[src.String()]; exists {
+			state.endpoints = []net.Addr{srcAddr}
+			state.confirmed = true
+		}
+	default:
+		rm.mu.Unlock()
+		return NewTransportError("invalid rendezvous HELLO", 9008, nil)
+	}
+	rm.mu.Unlock()
+
+	reply, err := appendEndpoint([]byte{payload[0]}, srcAddr)
+	if err != nil {
+		return err
+	}
+	return rm.sendPacket(srcAddr, src, packet.VerbOK, reply)
+}
+
+// handleOK completes a registration or a punch
+func (rm *RendezvousManager) handleOK(srcAddr net.Addr, src *address.Address, payload []byte) error {
+	if len(payload) < 1 {
+		return NewTransportError("invalid rendezvous OK", 9026, nil)
+	}
+
+	switch payload[0] {
+	case rendezvousPurposeRegister:
+		endpoint, err := parseEndpoint(payload[1:])
+		if err != nil {
+			return err
+		}
+		rm.mu.Lock()
+		if rm.coordinator != nil && rm.coordinator.String() == srcAddr.String() {
+			rm.publicEndpoint = endpoint
+		}
+		rm.mu.Unlock()
+		return nil
+
+	case rendezvousPurposePunch:
+		key := src.String()
+		rm.mu.Lock()
+		rm.paths[key] = &directPath{endpoint: srcAddr, lastSeen: time.Now()}
+		state, punching := rm.punches[key]
+		if !punching {
+			rm.mu.Unlock()
+			return nil
+		}
+		result := rm.finishPunch(key, state, srcAddr, nil)
+		rm.mu.Unlock()
+		rm.notify(result)
+		return nil
+
+	case rendezvousPurposeReflect:
+		return rm.handleReflectReply(payload[1:])
+
+	case rendezvousPurposeCookie:
+		if len(payload) != 1+CookieSize {
+			return NewTransportError("invalid rendezvous OK", 9026, nil)
+		}
+		return rm.handleCookie(srcAddr, payload[1:])
+
+	default:
+		return NewTransportError("invalid rendezvous OK", 9026, nil)
+	}
+}
+
+// handleCookie stores a cookie from a node we are sending HELLOs to
+// Cookies are only taken from the coordinator, punch candidates and, while a
+// reflection is in progress, reflection servers, so unsolicited ones allocate
+// nothing. A new cookie from the coordinator repeats the registration at once;
+// punches and reflections pick it up on their next retry.
+func (rm *RendezvousManager) handleCookie(srcAddr net.Addr, cookie []byte) error {
+	key := srcAddr.String()
+
+	rm.mu.Lock()
+	coordinator := rm.coordinator != nil && rm.coordinator.String() == key
+	expected := coordinator || len(rm.reflections) > 0
+	for _, state := range rm.punches {
+		expected = expected || containsAddr(state.endpoints, srcAddr)
+	}
+	if !expected {
+		rm.mu.Unlock()
+		return nil
+	}
+	previous, exists := rm.cookies[key]
+	fresh := !exists || string(previous.value) != string(cookie)
+	rm.cookies[key] = &rendezvousCookie{value: append([]byte(nil), cookie...), received: time.Now()}
+	rm.mu.Unlock()
+
+	if coordinator && fresh {
+		return rm.Register()
+	}
+	return nil
+}
+
+// handleError fails a punch the coordinator could not introduce, or a reflection it could not answer
+func (rm *RendezvousManager) handleError(srcAddr net.Addr, payload []byte) error {
+	if len(payload) >= 5 && packet.Verb(payload[0]) == packet.VerbHELLO {
+		rm.resolveReflection(binary.BigEndian.Uint32(payload[1:5]), reflectReply{
+			err: NewTransportError("reflection server cannot answer from another address", 9014, nil),
+		})
+		return nil
+	}
+	if len(payload) < 1+address.AddressLength || packet.Verb(payload[0]) != packet.VerbRENDEZVOUS {
+		return NewTransportError("invalid rendezvous ERROR", 9027, nil)
+	}
+	peer, _ := address.NewAddressFromBytes(payload[1 : 1+address.AddressLength])
+
+	key := peer.String()
+	rm.mu.Lock()
+	state, exists := rm.punches[key]
+	if !exists || rm.coordinator == nil || rm.coordinator.String() != srcAddr.String() {
+		rm.mu.Unlock()
+		return nil
+	}
+	result := rm.finishPunch(key, state, nil, NewTransportError("peer "+key+" is not registered with the coordinator", 9009, nil))
+	rm.mu.Unlock()
+	rm.notify(result)
+	return nil
+}
+
+// handleRendezvous answers an introduction request (coordinator) or starts punching (member)
+func (rm *RendezvousManager) handleRendezvous(srcAddr net.Addr, src *address.Address, payload []byte) error {
+	if len(payload) < 1+address.AddressLength {
+		return NewTransportError("invalid RENDEZVOUS", 9028, nil)
+	}
+	peer, _ := address.NewAddressFromBytes(payload[1 : 1+address.AddressLength])
+
+	if payload[0]&rendezvousFlagRequest != 0 {
+		rm.mu.Lock()
+		_, registered := rm.members[src.String()]
+		guard := rm.guard
+		rm.mu.Unlock()
+		// Each introduction sends two or four packets, so requests count against the rate limit
+		if guard != nil && !guard.Allow(srcAddr) {
+			return NewTransportError("RENDEZVOUS request from "+srcAddr.String()+" rate limited", 9023, nil)
+		}
+		if !registered {
+			return NewTransportError("RENDEZVOUS request from unregistered member "+src.String(), 9032, nil)
+		}
+		return rm.introduce(src, peer, true)
+	}
+
+	// Only the coordinator may point us at an endpoint
+	endpoint, err := parseEndpoint(payload[1+address.AddressLength:])
+	if err != nil {
+		return err
+	}
+	rm.mu.Lock()
+	if rm.coordinator == nil || rm.coordinator.String() != srcAddr.String() {
+		rm.mu.Unlock()
+		return NewTransportError("RENDEZVOUS from unexpected node "+srcAddr.String(), 9010, nil)
+	}
+	state := rm.startPunch(peer)
+	if state.confirmed || containsAddr(state.endpoints, endpoint) {
+		rm.mu.Unlock()
+		return nil
+	}
+	// The first introduction starts a punch round; later candidates join it
+	if len(state.endpoints) == 0 {
+		state.sent++
+	}
+	state.endpoints = append(state.endpoints, endpoint)
+	rm.mu.Unlock()
+
+	// Punch each new candidate immediately; the punch loop sends the rest
+	return rm.sendPacket(endpoint, peer, packet.VerbHELLO, []byte{rendezvousPurposePunch})
+}
+
+// handleFrame delivers relayed or direct application data
+func (rm *RendezvousManager) handleFrame(srcAddr net.Addr, src *address.Address, payload []byte) error {
+	rm.mu.Lock()
+	if path, exists := rm.paths[src.String()]; exists && path.endpoint.String() == srcAddr.String() {
+		path.lastSeen = time.Now()
+	}
+	handler := rm.frameHandler
+	rm.mu.Unlock()
+
+	if handler != nil {
+		handler(src, payload)
+	}
+	return nil
+}
+
+// introduce sends each of two registered members a RENDEZVOUS with the other's endpoint
+// An advertised endpoint that differs from the observed one is sent in a second RENDEZVOUS.
+// requested introductions answer the requester with an ERROR if the peer is unknown
+func (rm *RendezvousManager) introduce(a, b *address.Address, requested bool) error {
+	now := time.Now()
+	pair := a.String() + "/" + b.String()
+	if a.Compare(b) > 0 {
+		pair = b.String() + "/" + a.String()
+	}
+
+	rm.mu.Lock()
+	memberA, knownA := rm.members[a.String()]
+	memberB, knownB := rm.members[b.String()]
+	if !knownA {
+		rm.mu.Unlock()
+		return nil
+	}
+	if !knownB {
+		rm.mu.Unlock()
+		if requested {
+			return rm.sendPacket(memberA.endpoint, a, packet.VerbERROR, append([]byte{byte(packet.VerbRENDEZVOUS)}, b.Bytes()...))
+		}
+		return nil
+	}
+	if last, exists := rm.introduced[pair]; exists && !requested && now.Sub(last) < rendezvousIntroduceInterval {
+		rm.mu.Unlock()
+		return nil
+	}
+	rm.introduced[pair] = now
+	endpointA, endpointB := memberA.endpoint, memberB.endpoint
+	candidatesA, candidatesB := memberA.candidates(), memberB.candidates()
+	rm.mu.Unlock()
+
+	for _, candidate := range candidatesB {
+		if err := rm.sendIntroduction(endpointA, a, b, candidate); err != nil {
+			return err
+		}
+	}
+	for _, candidate := range candidatesA {
+		if err := rm.sendIntroduction(endpointB, b, a, candidate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendIntroduction tells member (at addr) to punch towards peer at endpoint
+func (rm *RendezvousManager) sendIntroduction(addr net.Addr, member, peer *address.Address, endpoint net.Addr) error {
+	payload, err := appendEndpoint(append([]byte{0}, peer.Bytes()...), endpoint)
+	if err != nil {
+		return err
+	}
+	return rm.sendPacket(addr, member, packet.VerbRENDEZVOUS, payload)
+}
+
+// candidates returns the endpoints peers should punch towards, observed first
+func (m *rendezvousMember) candidates() []net.Addr {
+	if m.advertised == nil || m.advertised.String() == m.endpoint.String() {
+		return []net.Addr{m.endpoint}
+	}
+	return []net.Addr{m.endpoint, m.advertised}
+}
+
+// startPunch returns the punch state for peer, creating it and starting its loop if needed
+// Must be called with rm.mu held
+func (rm *RendezvousManager) startPunch(peer *address.Address) *punchState {
+	key := peer.String()
+	if state, exists := rm.punches[key]; exists {
+		return state
+	}
+
+	state := &punchState{peer: peer, done: make(chan struct{})}
+	rm.punches[key] = state
+	go rm.punchLoop(key, state, rm.punchInterval, rm.punchAttempts)
+	return state
+}
+
+// punchLoop sends punch packets until the peer answers or the attempts run out
+// Before the introduction arrives it waits up to the same number of intervals
+func (rm *RendezvousManager) punchLoop(key string, state *punchState, interval time.Duration, attempts int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-state.done:
+			return
+		case <-rm.ctx.Done():
+			return
+		}
+
+		rm.mu.Lock()
+		if rm.punches[key] != state {
+			rm.mu.Unlock()
+			return
+		}
+
+		var failure error
+		switch {
+		case len(state.endpoints) == 0:
+			state.waited++
+			if state.waited >= attempts {
+				failure = NewTransportError("no introduction from the rendezvous coordinator", 9011, nil)
+			}
+		case state.sent >= attempts:
+			failure = NewTransportError("hole punching to "+key+" timed out", 9012, nil)
+		}
+		if failure != nil {
+			result := rm.finishPunch(key, state, nil, failure)
+			rm.mu.Unlock()
+			rm.notify(result)
+			return
+		}
+
+		targets := make([]net.Addr, len(state.endpoints))
+		copy(targets, state.endpoints)
+		if len(targets) > 0 {
+			state.sent++
+		}
+		rm.mu.Unlock()
+
+		for _, target := range targets {
+			rm.sendPacket(target, state.peer, packet.VerbHELLO, []byte{rendezvousPurposePunch})
+		}
+	}
+}
+
+// finishPunch removes a punch state and hands the result to its waiters
+// Must be called with rm.mu held; the caller notifies listeners after unlocking
+func (rm *RendezvousManager) finishPunch(key string, state *punchState, endpoint net.Addr, err error) PunchResult {
+	delete(rm.punches, key)
+	close(state.done)
+
+	result := PunchResult{
+		Peer:     state.peer,
+		Endpoint: endpoint,
+		Direct:   err == nil,
+		Attempts: state.sent,
+		Err:      err,
+	}
+	for _, waiter := range state.waiters {
+		waiter <- result
+	}
+	return result
+}
+
+// notify calls the punch listeners
+func (rm *RendezvousManager) notify(result PunchResult) {
+	rm.mu.Lock()
+	listeners := make([]PunchListener, len(rm.listeners))
+	copy(listeners, rm.listeners)
+	rm.mu.Unlock()
+
+	for _, listener := range listeners {
+		listener(result)
+	}
+}
+
+// maintenanceLoop re-registers with the coordinator and expires members and paths
+func (rm *RendezvousManager) maintenanceLoop() {
+	ticker := time.NewTicker(rendezvousRegisterInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			rm.Register()
+
+			now := time.Now()
+			rm.mu.Lock()
+			for key, member := range rm.members {
+				if now.Sub(member.lastSeen) > rendezvousMemberTimeout {
+					delete(rm.members, key)
+				}
+			}
+			for key, path := range rm.paths {
+				if now.Sub(path.lastSeen) > rendezvousPathTimeout {
+					delete(rm.paths, key)
+				}
+			}
+			for pair, last := range rm.introduced {
+				if now.Sub(last) > rendezvousIntroduceInterval {
+					delete(rm.introduced, pair)
+				}
+			}
+			for key, cookie := range rm.cookies {
+				if now.Sub(cookie.received) > rendezvousMemberTimeout {
+					delete(rm.cookies, key)
+				}
+			}
+			rm.mu.Unlock()
+		case <-rm.ctx.Done():
+			return
+		}
+	}
+}
+
+// sendPacket builds a packet with the given verb and payload and sends it to addr
+// A nil dst addresses the coordinator, whose node address members do not need to know
+func (rm *RendezvousManager) sendPacket(addr net.Addr, dst *address.Address, verb packet.Verb, payload []byte) error {
+	return rm.sendPacketVia(rm.transport, addr, dst, verb, payload)
+}
+
+// sendPacketVia is sendPacket over a specific transport
+func (rm *RendezvousManager) sendPacketVia(t Transport, addr net.Addr, dst *address.Address, verb packet.Verb, payload []byte) error {
+	if dst == nil {
+		dst = rendezvousAnyAddress
+	}
+	pkt, err := packet.NewPacket(dst, rm.localAddress)
+	if err != nil {
+		return NewTransportError("failed to build rendezvous packet", 9029, err)
+	}
+	if verb == packet.VerbHELLO && len(payload) > 0 {
+		rm.mu.Lock()
+		cookie, exists := rm.cookies[addr.String()]
+		rm.mu.Unlock()
+		if exists {
+			withCookie := append([]byte{payload[0] | rendezvousFlagCookie}, cookie.value...)
+			payload = append(withCookie, payload[1:]...)
+		}
+	}
+	pkt.SetVerb(verb)
+	pkt.SetPayload(append([]byte{pkt.Data[packet.PacketIdxEncryptedFlagsAndVerb]}, payload...))
+	if verb == packet.VerbFRAME {
+		// Relayed frames carry application data; the transport classifies them
+		return t.Send(addr, pkt.Data)
+	}
+	return sendWithClass(t, addr, pkt.Data, TrafficClassControl)
+}
+
+// appendEndpoint appends an endpoint as port(2) + address length(1) + IP
+func appendEndpoint(b []byte, addr net.Addr) ([]byte, error) {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	default:
+		return nil, NewTransportError("unsupported endpoint address "+addr.String(), 9013, nil)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		ip = ip.To16()
+	}
+
+	b = binary.BigEndian.AppendUint16(b, uint16(port))
+	b = append(b, byte(len(ip)))
+	return append(b, ip...), nil
+}
+
+// parseEndpoint reads an endpoint written by appendEndpoint
+func parseEndpoint(b []byte) (*net.UDPAddr, error) {
+	if len(b) < 3 {
+		return nil, NewTransportError("truncated endpoint", 9030, nil)
+	}
+	length := int(b[2])
+	if (length != net.IPv4len && length != net.IPv6len) || len(b) < 3+length {
+		return nil, NewTransportError("invalid endpoint", 9031, nil)
+	}
+	ip := make(net.IP, length)
+	copy(ip, b[3:3+length])
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(b))}, nil
+}
@@ -0,0 +1,163 @@
+package transport
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// replayWindowSize 是重复检测窗口的大小（序列号个数），必须是64的倍数
+const replayWindowSize = 1024
+
+// replayWindowIdleTimeout 是对等节点接收状态的空闲过期时间
+const replayWindowIdleTimeout = 2 * time.Minute
+
+// replayMaxSources 是同时保留重复检测窗口的来源数上限，满时淘汰最久未用的来源
+const replayMaxSources = 4096
+
+// replayWindow 记录单个对等节点最近收到的序列号，用于抑制重传导致的重复交付
+// 位图按 序列号 % replayWindowSize 环形索引，覆盖 (highest-replayWindowSize, highest]
+type replayWindow struct {
+	highest  uint32
+	bitmap   [replayWindowSize / 64]uint64
+	lastSeen time.Time
+}
+
+// newReplayWindow 以第一个收到的序列号初始化窗口
+func newReplayWindow(seq uint32, now time.Time) *replayWindow {
+	w := &replayWindow{highest: seq, lastSeen: now}
+	w.set(seq)
+	return w
+}
+
+// accept 判断序列号是否第一次出现，并记录该序列号
+// 使用序列号算术比较，支持序列号回绕；只有被接受的序列号才刷新空闲时间
+func (w *replayWindow) accept(seq uint32, now time.Time) bool {
+	// 有符号差值：正数表示比已见最大序列号更新
+	diff := int32(seq - w.highest)
+
+	if diff > 0 {
+		// 窗口前移，清除被新序列号占用的位
+		if diff >= replayWindowSize {
+			w.bitmap = [replayWindowSize / 64]uint64{}
+		} else {
+			for i := uint32(1); i <= uint32(diff); i++ {
+				w.clear(w.highest + i)
+			}
+		}
+		w.highest = seq
+		w.set(seq)
+		w.lastSeen = now
+		return true
+	}
+
+	// 远落后于窗口的序列号无法判断是否重复，直接丢弃；
+	// 对端重启由随机初始序列号和空闲过期处理，被丢弃的数据包不会使窗口保持活跃
+	offset := uint32(-int64(diff))
+	if offset >= replayWindowSize {
+		return false
+	}
+
+	if w.isSet(seq) {
+		return false
+	}
+	w.set(seq)
+	w.lastSeen = now
+	return true
+}
+
+func (w *replayWindow) set(seq uint32) {
+	bit := seq % replayWindowSize
+	w.bitmap[bit/64] |= 1 << (bit % 64)
+}
+
+func (w *replayWindow) clear(seq uint32) {
+	bit := seq % replayWindowSize
+	w.bitmap[bit/64] &^= 1 << (bit % 64)
+}
+
+func (w *replayWindow) isSet(seq uint32) bool {
+	bit := seq % replayWindowSize
+	return w.bitmap[bit/64]&(1<<(bit%64)) != 0
+}
+
+// replayFilter 按对等节点地址维护重复检测窗口
+type replayFilter struct {
+	mu      sync.Mutex
+	windows map[string]*replayWindow
+	order   *lruKeys // windows 的键，最久未用的在前
+}
+
+// newReplayFilter 创建空的重复检测过滤器
+func newReplayFilter() *replayFilter {
+	return &replayFilter{windows: make(map[string]*replayWindow), order: newLRUKeys()}
+}
+
+// accept 判断来自 addr 的序列号是否第一次出现
+// 调用方只能在数据包通过认证后调用，伪造或损坏的数据包不能推进窗口
+// 新来源只有 admit 返回true时才创建窗口，否则数据包照常交付但不记录：
+// 重复检测只用于抑制重传，调用时数据包已经ACK，丢弃会丢数据
+func (f *replayFilter) accept(addr string, seq uint32, admit func() bool) bool {
+	now := time.Now()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w, exists := f.windows[addr]
+	if !exists {
+		if admit != nil && !admit() {
+			return true
+		}
+		if f.order.len() >= replayMaxSources {
+			oldestAddr, _ := f.order.oldest()
+			delete(f.windows, oldestAddr)
+			f.order.remove(oldestAddr)
+		}
+	}
+	f.order.touch(addr)
+	if !exists || now.Sub(w.lastSeen) > replayWindowIdleTimeout {
+		f.windows[addr] = newReplayWindow(seq, now)
+		return true
+	}
+	return w.accept(seq, now)
+}
+
+// move 将重复检测状态从旧地址移到新地址
+func (f *replayFilter) move(oldAddr, newAddr string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if w, exists := f.windows[oldAddr]; exists {
+		f.windows[newAddr] = w
+		delete(f.windows, oldAddr)
+		f.order.rename(oldAddr, newAddr)
+	}
+}
+
+// expire 删除空闲过久的对等节点状态
+func (f *replayFilter) expire(now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for addr, w := range f.windows {
+		if now.Sub(w.lastSeen) > replayWindowIdleTimeout {
+			delete(f.windows, addr)
+			f.order.remove(addr)
+		}
+	}
+}
+
+// randomSequenceStart 生成随机的初始序列号（非0）
+// 随机起点使重启后的发送方大概率落在接收方窗口之外，不会被误判为重复；
+// 落后于窗口的新序列在接收方窗口空闲过期后被接受
+func randomSequenceStart() uint32 {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 1
+	}
+	if seq := binary.BigEndian.Uint32(b[:]); seq != 0 {
+		return seq
+	}
+	return 1
+}
@@ -0,0 +1,100 @@
+package transport
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestReplayWindowDuplicates tests duplicate and out-of-order detection within the window
+func TestReplayWindowDuplicates(t *testing.T) {
+	now := time.Now()
+	w := newReplayWindow(100, now)
+
+	assert.False(t, w.accept(100, now), "Repeated sequence number must be rejected")
+	assert.True(t, w.accept(102, now))
+	assert.True(t, w.accept(101, now), "Late packet inside the window must be accepted once")
+	assert.False(t, w.accept(101, now))
+	assert.False(t, w.accept(102, now))
+
+	// Jump ahead by most of the window; old entries near the edge are still tracked
+	assert.True(t, w.accept(100+replayWindowSize-1, now))
+	assert.False(t, w.accept(101, now))
+	assert.True(t, w.accept(103, now))
+
+	// Sliding past an entry clears its slot for the new sequence number
+	assert.True(t, w.accept(100+replayWindowSize+1, now))
+	assert.False(t, w.accept(100+replayWindowSize+1, now))
+}
+
+// TestReplayWindowWraparound tests serial number arithmetic across the 32-bit boundary
+func TestReplayWindowWraparound(t *testing.T) {
+	now := time.Now()
+	w := newReplayWindow(0xFFFFFFF0, now)
+
+	for seq := uint32(0xFFFFFFF1); seq != 5; seq++ {
+		if seq == 0 {
+			continue // the sender skips 0
+		}
+		assert.True(t, w.accept(seq, now), "seq %d", seq)
+	}
+	assert.Equal(t, uint32(4), w.highest)
+
+	// Retransmissions from before the wrap are still recognised
+	assert.False(t, w.accept(0xFFFFFFF8, now))
+	assert.False(t, w.accept(2, now))
+	assert.True(t, w.accept(5, now))
+}
+
+// TestReplayFilterRestart tests that sequence numbers behind the window are dropped until the window expires
+func TestReplayFilterRestart(t *testing.T) {
+	f := newReplayFilter()
+
+	assert.True(t, f.accept("peer", 5000, nil))
+	assert.False(t, f.accept("peer", 5000, nil))
+	assert.True(t, f.accept("other", 5000, nil), "Windows are tracked per peer")
+
+	// Far behind the window: duplicates cannot be ruled out, so the packet is dropped
+	assert.False(t, f.accept("peer", 5000-2*replayWindowSize, nil))
+	assert.False(t, f.accept("peer", 5000-replayWindowSize, nil))
+	assert.Equal(t, uint32(5000), f.windows["peer"].highest)
+
+	// Dropped packets do not keep the window alive; once it is idle a restarted sender is accepted
+	f.windows["peer"].lastSeen = time.Now().Add(-replayWindowIdleTimeout - time.Second)
+	lastSeen := f.windows["peer"].lastSeen
+	assert.False(t, f.windows["peer"].accept(5000-2*replayWindowSize, time.Now()))
+	assert.Equal(t, lastSeen, f.windows["peer"].lastSeen)
+	assert.True(t, f.accept("peer", 5000-2*replayWindowSize, nil))
+	assert.False(t, f.accept("peer", 5000-2*replayWindowSize, nil))
+
+	// Idle state expires
+	f.windows["peer"].lastSeen = time.Now().Add(-2 * replayWindowIdleTimeout)
+	f.expire(time.Now())
+	assert.NotContains(t, f.windows, "peer")
+	assert.Contains(t, f.windows, "other")
+}
+
+// TestReplayFilterLimit tests that new sources need admission and the least recently used source is evicted
+func TestReplayFilterLimit(t *testing.T) {
+	f := newReplayFilter()
+	deny := func() bool { return false }
+
+	// A source that is not admitted is delivered but not tracked
+	assert.True(t, f.accept("peer", 1, deny))
+	assert.True(t, f.accept("peer", 1, deny))
+	assert.Empty(t, f.windows)
+
+	for i := 0; i < replayMaxSources; i++ {
+		assert.True(t, f.accept(fmt.Sprintf("peer-%d", i), 1, nil))
+	}
+	assert.False(t, f.accept("peer-0", 1, nil))
+	assert.True(t, f.accept("new", 1, nil))
+	assert.Len(t, f.windows, replayMaxSources)
+	assert.Contains(t, f.windows, "peer-0")
+	assert.NotContains(t, f.windows, "peer-1")
+
+	// Tracked sources are not charged again
+	assert.False(t, f.accept("new", 1, deny))
+}
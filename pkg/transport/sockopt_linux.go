@@ -0,0 +1,95 @@
+//go:build linux
+
+package transport
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// setDontFragment 设置DF位并忽略内核缓存的路径MTU（IP_PMTUDISC_PROBE），
+// 过大的探测包会被路径丢弃而不是被分片，路径MTU由探测自行判断
+func setDontFragment(conn *net.UDPConn) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		// IPv4和IPv6套接字各自只接受对应的选项，任一成功即可
+		errV4 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+		errV6 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE)
+		if errV4 != nil && errV6 != nil {
+			sockErr = errV4
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// enablePacketInfo 让通配地址套接字在接收时报告数据包的目的地址（IP_PKTINFO / IPV6_RECVPKTINFO）
+func enablePacketInfo(conn *net.UDPConn) bool {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	enabled := false
+	rawConn.Control(func(fd uintptr) {
+		errV4 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+		errV6 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVPKTINFO, 1)
+		enabled = errV4 == nil || errV6 == nil
+	})
+	return enabled
+}
+
+// parsePacketInfo 从控制消息中取出数据包的目的地址，即回复时应使用的源地址
+func parsePacketInfo(oob []byte) net.IP {
+	messages, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+
+	for _, m := range messages {
+		switch {
+		case m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_PKTINFO && len(m.Data) >= syscall.SizeofInet4Pktinfo:
+			info := (*syscall.Inet4Pktinfo)(unsafe.Pointer(&m.Data[0]))
+			return net.IP(append([]byte(nil), info.Addr[:]...))
+		case m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_PKTINFO && len(m.Data) >= syscall.SizeofInet6Pktinfo:
+			info := (*syscall.Inet6Pktinfo)(unsafe.Pointer(&m.Data[0]))
+			return net.IP(append([]byte(nil), info.Addr[:]...))
+		}
+	}
+	return nil
+}
+
+// packetInfoOOB 构建指定源地址的控制消息，ipv4 表示套接字的地址族
+func packetInfoOOB(localIP net.IP, ipv4 bool) []byte {
+	if ipv4 {
+		ip := localIP.To4()
+		if ip == nil {
+			return nil
+		}
+		oob := make([]byte, syscall.CmsgSpace(syscall.SizeofInet4Pktinfo))
+		header := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+		header.Level = syscall.IPPROTO_IP
+		header.Type = syscall.IP_PKTINFO
+		header.SetLen(syscall.CmsgLen(syscall.SizeofInet4Pktinfo))
+		info := (*syscall.Inet4Pktinfo)(unsafe.Pointer(&oob[syscall.CmsgLen(0)]))
+		copy(info.Spec_dst[:], ip)
+		return oob
+	}
+
+	oob := make([]byte, syscall.CmsgSpace(syscall.SizeofInet6Pktinfo))
+	header := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	header.Level = syscall.IPPROTO_IPV6
+	header.Type = syscall.IPV6_PKTINFO
+	header.SetLen(syscall.CmsgLen(syscall.SizeofInet6Pktinfo))
+	info := (*syscall.Inet6Pktinfo)(unsafe.Pointer(&oob[syscall.CmsgLen(0)]))
+	copy(info.Addr[:], localIP.To16())
+	return oob
+}
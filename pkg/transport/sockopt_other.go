@@ -0,0 +1,25 @@
+//go:build !linux
+
+package transport
+
+import "net"
+
+// setDontFragment 在非Linux平台上不设置DF位，探测包可能被分片，路径MTU探测结果偏乐观
+func setDontFragment(conn *net.UDPConn) error {
+	return nil
+}
+
+// enablePacketInfo 在非Linux平台上不支持，通配地址套接字的回复源地址由内核选择
+func enablePacketInfo(conn *net.UDPConn) bool {
+	return false
+}
+
+// parsePacketInfo 在非Linux平台上不支持
+func parsePacketInfo(oob []byte) net.IP {
+	return nil
+}
+
+// packetInfoOOB 在非Linux平台上不支持
+func packetInfoOOB(localIP net.IP, ipv4 bool) []byte {
+	return nil
+}
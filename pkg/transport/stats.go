@@ -0,0 +1,262 @@
+package transport
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxStatsPeers bounds how many remote addresses keep their own counters
+// When it is exceeded the least recently active quarter is forgotten; their
+// traffic stays in the transport-wide totals.
+const maxStatsPeers = 4096
+
+// RTTStats summarizes round-trip time samples
+type RTTStats struct {
+	// Samples is the number of RTT samples taken
+	Samples uint64 `json:"samples"`
+	// Last is the most recent sample
+	Last time.Duration `json:"last"`
+	// Smoothed is an exponentially weighted average of the samples (RFC 6298, alpha 1/8)
+	Smoothed time.Duration `json:"smoothed"`
+	// Min is the smallest sample seen
+	Min time.Duration `json:"min"`
+}
+
+// add records one sample
+func (r *RTTStats) add(rtt time.Duration) {
+	if r.Samples == 0 {
+		r.Smoothed, r.Min = rtt, rtt
+	} else {
+		r.Smoothed = (7*r.Smoothed + rtt) / 8
+		if rtt < r.Min {
+			r.Min = rtt
+		}
+	}
+	r.Last = rtt
+	r.Samples++
+}
+
+// TrafficStats counts what a transport or connection manager did
+type TrafficStats struct {
+	// PacketsSent and BytesSent count packets handed to the network, retransmissions included
+	PacketsSent uint64 `json:"packetsSent"`
+	BytesSent   uint64 `json:"bytesSent"`
+	// PacketsReceived and BytesReceived count packets taken from the network
+	PacketsReceived uint64 `json:"packetsReceived"`
+	BytesReceived   uint64 `json:"bytesReceived"`
+	// Retransmits counts reliable packets sent again after a timeout or loss signal
+	Retransmits uint64 `json:"retransmits"`
+	// GiveUps counts reliable packets abandoned after the last retry
+	GiveUps uint64 `json:"giveUps"`
+	// DecryptFailures counts encrypted packets that could not be decrypted
+	DecryptFailures uint64 `json:"decryptFailures"`
+	// Drops counts received packets discarded because a queue was full
+	Drops uint64 `json:"drops"`
+	// RTT summarizes acknowledgement round-trip times of packets sent once
+	RTT RTTStats `json:"rtt"`
+}
+
+// PeerStats is a snapshot of the counters for one remote address
+type PeerStats struct {
+	TrafficStats
+
+	// Addr is the remote address
+	Addr string `json:"addr"`
+	// QueueDepth is the number of packets queued for this peer at snapshot time
+	QueueDepth int `json:"queueDepth"`
+	// LastSent and LastReceived are when traffic last went to and came from the peer
+	LastSent     time.Time `json:"lastSent"`
+	LastReceived time.Time `json:"lastReceived"`
+}
+
+// TransportStats is a snapshot of transport-wide and per-peer counters
+type TransportStats struct {
+	TrafficStats
+
+	// QueueDepth is the sum of the peers' queue depths
+	QueueDepth int `json:"queueDepth"`
+	// Peers holds per-peer counters sorted by address
+	Peers []PeerStats `json:"peers"`
+}
+
+// Peer returns the counters for addr, if the snapshot has them
+func (s TransportStats) Peer(addr net.Addr) (PeerStats, bool) {
+	key := addr.String()
+	for _, peer := range s.Peers {
+		if peer.Addr == key {
+			return peer, true
+		}
+	}
+	return PeerStats{}, false
+}
+
+// statsTable accumulates transport-wide and per-peer counters
+type statsTable struct {
+	mu    sync.Mutex
+	total TrafficStats
+	peers map[string]*PeerStats
+}
+
+// newStatsTable creates an empty table
+func newStatsTable() *statsTable {
+	return &statsTable{peers: make(map[string]*PeerStats)}
+}
+
+// record applies update to the totals and to the counters for addr
+func (s *statsTable) record(addr net.Addr, update func(stats *TrafficStats, peer *PeerStats)) {
+	if addr == nil {
+		return
+	}
+	key := addr.String()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peer, exists := s.peers[key]
+	if !exists {
+		if len(s.peers) >= maxStatsPeers {
+			s.evictLocked()
+		}
+		peer = &PeerStats{Addr: key}
+		s.peers[key] = peer
+	}
+	update(&s.total, nil)
+	update(&peer.TrafficStats, peer)
+}
+
+// evictLocked forgets the least recently active quarter of the peers
+// Must be called with s.mu held
+func (s *statsTable) evictLocked() {
+	peers := make([]*PeerStats, 0, len(s.peers))
+	for _, peer := range s.peers {
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return lastActive(peers[i]).Before(lastActive(peers[j]))
+	})
+	for _, peer := range peers[:len(peers)/4+1] {
+		delete(s.peers, peer.Addr)
+	}
+}
+
+// lastActive returns when traffic last passed in either direction
+func lastActive(peer *PeerStats) time.Time {
+	if peer.LastSent.After(peer.LastReceived) {
+		return peer.LastSent
+	}
+	return peer.LastReceived
+}
+
+// sent records a packet of size bytes sent to addr
+func (s *statsTable) sent(addr net.Addr, size int) {
+	now := time.Now()
+	s.record(addr, func(stats *TrafficStats, peer *PeerStats) {
+		stats.PacketsSent++
+		stats.BytesSent += uint64(size)
+		if peer != nil {
+			peer.LastSent = now
+		}
+	})
+}
+
+// received records a packet of size bytes received from addr
+func (s *statsTable) received(addr net.Addr, size int) {
+	now := time.Now()
+	s.record(addr, func(stats *TrafficStats, peer *PeerStats) {
+		stats.PacketsReceived++
+		stats.BytesReceived += uint64(size)
+		if peer != nil {
+			peer.LastReceived = now
+		}
+	})
+}
+
+// retransmitted records count retransmissions to addr
+func (s *statsTable) retransmitted(addr net.Addr, count int) {
+	if count <= 0 {
+		return
+	}
+	s.record(addr, func(stats *TrafficStats, peer *PeerStats) {
+		stats.Retransmits += uint64(count)
+	})
+}
+
+// gaveUp records a reliable packet to addr that was never acknowledged
+func (s *statsTable) gaveUp(addr net.Addr) {
+	s.record(addr, func(stats *TrafficStats, peer *PeerStats) {
+		stats.GiveUps++
+	})
+}
+
+// decryptFailed records a packet from addr that could not be decrypted
+func (s *statsTable) decryptFailed(addr net.Addr) {
+	s.record(addr, func(stats *TrafficStats, peer *PeerStats) {
+		stats.DecryptFailures++
+	})
+}
+
+// dropped records a packet from addr discarded on a full queue
+func (s *statsTable) dropped(addr net.Addr) {
+	s.record(addr, func(stats *TrafficStats, peer *PeerStats) {
+		stats.Drops++
+	})
+}
+
+// rtt records an acknowledgement round-trip time to addr
+func (s *statsTable) rtt(addr net.Addr, rtt time.Duration) {
+	if rtt <= 0 {
+		return
+	}
+	s.record(addr, func(stats *TrafficStats, peer *PeerStats) {
+		stats.RTT.add(rtt)
+	})
+}
+
+// peer returns the counters for one address
+func (s *statsTable) peer(addr string) (PeerStats, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peer, exists := s.peers[addr]
+	if !exists {
+		return PeerStats{}, false
+	}
+	return *peer, true
+}
+
+// totals returns the transport-wide counters
+func (s *statsTable) totals() TrafficStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.total
+}
+
+// snapshot copies the counters
+// include decides which peers are listed and reports their queue depth; nil lists
+// every peer with a depth of 0.
+func (s *statsTable) snapshot(include func(addr string) (queueDepth int, ok bool)) TransportStats {
+	s.mu.Lock()
+	snapshot := TransportStats{TrafficStats: s.total}
+	peers := make([]PeerStats, 0, len(s.peers))
+	for _, peer := range s.peers {
+		peers = append(peers, *peer)
+	}
+	s.mu.Unlock()
+
+	for _, peer := range peers {
+		if include != nil {
+			depth, ok := include(peer.Addr)
+			if !ok {
+				continue
+			}
+			peer.QueueDepth = depth
+		}
+		snapshot.QueueDepth += peer.QueueDepth
+		snapshot.Peers = append(snapshot.Peers, peer)
+	}
+	sort.Slice(snapshot.Peers, func(i, j int) bool {
+		return snapshot.Peers[i].Addr < snapshot.Peers[j].Addr
+	})
+	return snapshot
+}
@@ -0,0 +1,274 @@
+package transport
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// STUN message constants (RFC 5389, CHANGE-REQUEST from RFC 5780)
+const (
+	stunHeaderSize  = 20
+	stunMagicCookie = 0x2112A442
+
+	stunBindingRequest  = 0x0001
+	stunBindingSuccess  = 0x0101
+	stunBindingError    = 0x0111
+	stunAttrMapped      = 0x0001
+	stunAttrChange      = 0x0003
+	stunAttrErrorCode   = 0x0009
+	stunAttrXORMapped   = 0x0020
+	stunChangeIPFlag    = 0x04
+	stunChangePortFlag  = 0x02
+	stunErrUnknownAttr  = 420
+	stunErrBadRequest   = 400
+	stunAddrFamilyIPv4  = 0x01
+	stunAddrFamilyIPv6  = 0x02
+	stunTransactionSize = 12
+)
+
+// stunResponse is a parsed binding response
+type stunResponse struct {
+	mapped    *net.UDPAddr
+	errorCode int
+}
+
+// STUNClient sends STUN binding requests over a transport to learn its external endpoint
+// With a RawDatagramTransport (such as UDPTransport) requests share the transport's
+// socket, so the reported mapping is the one peers see; the client registers a raw
+// handler for responses when it is created. Other transports must route incoming
+// datagrams through Handler.
+type STUNClient struct {
+	transport Transport
+
+	mu      sync.Mutex
+	pending map[[stunTransactionSize]byte]chan stunResponse
+}
+
+// NewSTUNClient creates a STUN client on top of transport
+func NewSTUNClient(transport Transport) *STUNClient {
+	c := &STUNClient{
+		transport: transport,
+		pending:   make(map[[stunTransactionSize]byte]chan stunResponse),
+	}
+	if raw, ok := transport.(RawDatagramTransport); ok {
+		raw.AddRawHandler(c.HandleSTUNMessage)
+	}
+	return c
+}
+
+// Handler wraps next so that STUN responses are consumed and everything else is passed on
+func (c *STUNClient) Handler(next PacketHandler) PacketHandler {
+	return func(srcAddr net.Addr, data []byte) error {
+		if c.HandleSTUNMessage(srcAddr, data) {
+			return nil
+		}
+		if next != nil {
+			return next(srcAddr, data)
+		}
+		return nil
+	}
+}
+
+// HandleSTUNMessage processes a STUN response, returning false if data is not one
+func (c *STUNClient) HandleSTUNMessage(srcAddr net.Addr, data []byte) bool {
+	msgType, txid, ok := parseSTUNHeader(data)
+	if !ok || (msgType != stunBindingSuccess && msgType != stunBindingError) {
+		return false
+	}
+
+	response := parseSTUNResponse(data, txid)
+	if msgType == stunBindingError && response.errorCode == 0 {
+		response.errorCode = stunErrBadRequest
+	}
+
+	c.mu.Lock()
+	reply, exists := c.pending[txid]
+	c.mu.Unlock()
+	if exists {
+		select {
+		case reply <- response:
+		default:
+		}
+	}
+	return true
+}
+
+// Reflect sends a binding request to server and returns the mapped address it reports
+// Change requests use the CHANGE-REQUEST attribute; servers that do not support it
+// fail with code 9036. Requests are resent every quarter of the timeout.
+func (c *STUNClient) Reflect(server net.Addr, change ChangeRequest, timeout time.Duration) (net.Addr, error) {
+	if timeout <= 0 {
+		timeout = defaultReflectTimeout
+	}
+
+	var txid [stunTransactionSize]byte
+	if _, err := rand.Read(txid[:]); err != nil {
+		return nil, NewTransportError("failed to generate STUN transaction ID", 9017, err)
+	}
+	request := buildSTUNRequest(txid, change)
+
+	reply := make(chan stunResponse, 1)
+	c.mu.Lock()
+	c.pending[txid] = reply
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, txid)
+		c.mu.Unlock()
+	}()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	retry := time.NewTicker(timeout / 4)
+	defer retry.Stop()
+
+	if err := c.send(server, request); err != nil {
+		return nil, err
+	}
+	for {
+		select {
+		case response := <-reply:
+			switch {
+			case response.errorCode == stunErrUnknownAttr && (change.ChangeIP || change.ChangePort):
+				return nil, NewTransportError("STUN server does not support CHANGE-REQUEST", 9036, nil)
+			case response.errorCode != 0:
+				return nil, NewTransportError("STUN error "+strconv.Itoa(response.errorCode), 9038, nil)
+			case response.mapped == nil:
+				return nil, NewTransportError("STUN response without a mapped address", 9039, nil)
+			}
+			return response.mapped, nil
+		case <-retry.C:
+			c.send(server, request)
+		case <-deadline.C:
+			return nil, NewTransportError("no STUN response from "+server.String(), 9037, nil)
+		}
+	}
+}
+
+// send writes a request outside the transport's framing when possible
+func (c *STUNClient) send(server net.Addr, request []byte) error {
+	if raw, ok := c.transport.(RawDatagramTransport); ok {
+		return raw.SendRaw(server, request)
+	}
+	return c.transport.Send(server, request)
+}
+
+// buildSTUNRequest encodes a binding request, with a CHANGE-REQUEST attribute if needed
+func buildSTUNRequest(txid [stunTransactionSize]byte, change ChangeRequest) []byte {
+	var attrs []byte
+	if change.ChangeIP || change.ChangePort {
+		var flags uint32
+		if change.ChangeIP {
+			flags |= stunChangeIPFlag
+		}
+		if change.ChangePort {
+			flags |= stunChangePortFlag
+		}
+		attrs = binary.BigEndian.AppendUint16(attrs, stunAttrChange)
+		attrs = binary.BigEndian.AppendUint16(attrs, 4)
+		attrs = binary.BigEndian.AppendUint32(attrs, flags)
+	}
+
+	msg := make([]byte, stunHeaderSize, stunHeaderSize+len(attrs))
+	binary.BigEndian.PutUint16(msg[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint16(msg[2:4], uint16(len(attrs)))
+	binary.BigEndian.PutUint32(msg[4:8], stunMagicCookie)
+	copy(msg[8:], txid[:])
+	return append(msg, attrs...)
+}
+
+// parseSTUNHeader validates a STUN header and returns its type and transaction ID
+func parseSTUNHeader(data []byte) (uint16, [stunTransactionSize]byte, bool) {
+	var txid [stunTransactionSize]byte
+	if len(data) < stunHeaderSize || data[0]&0xc0 != 0 ||
+		binary.BigEndian.Uint32(data[4:8]) != stunMagicCookie {
+		return 0, txid, false
+	}
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+	if length%4 != 0 || stunHeaderSize+length != len(data) {
+		return 0, txid, false
+	}
+	copy(txid[:], data[8:stunHeaderSize])
+	return binary.BigEndian.Uint16(data[0:2]), txid, true
+}
+
+// parseSTUNResponse reads the mapped address and error code from a response
+// XOR-MAPPED-ADDRESS is preferred over MAPPED-ADDRESS
+func parseSTUNResponse(data []byte, txid [stunTransactionSize]byte) stunResponse {
+	var response stunResponse
+	var plainMapped *net.UDPAddr
+
+	attrs := data[stunHeaderSize:]
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:2])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if 4+attrLen > len(attrs) {
+			break
+		}
+		value := attrs[4 : 4+attrLen]
+
+		switch attrType {
+		case stunAttrXORMapped:
+			response.mapped = parseSTUNAddress(value, true, txid)
+		case stunAttrMapped:
+			plainMapped = parseSTUNAddress(value, false, txid)
+		case stunAttrErrorCode:
+			if len(value) >= 4 {
+				response.errorCode = int(value[2]&0x07)*100 + int(value[3])
+			}
+		}
+
+		// Attributes are padded to a multiple of 4 bytes
+		padded := (attrLen + 3) &^ 3
+		if 4+padded > len(attrs) {
+			break
+		}
+		attrs = attrs[4+padded:]
+	}
+
+	if response.mapped == nil {
+		response.mapped = plainMapped
+	}
+	return response
+}
+
+// parseSTUNAddress decodes a (XOR-)MAPPED-ADDRESS value
+func parseSTUNAddress(value []byte, xored bool, txid [stunTransactionSize]byte) *net.UDPAddr {
+	if len(value) < 4 {
+		return nil
+	}
+
+	var ip net.IP
+	switch value[1] {
+	case stunAddrFamilyIPv4:
+		if len(value) < 8 {
+			return nil
+		}
+		ip = make(net.IP, net.IPv4len)
+		copy(ip, value[4:8])
+	case stunAddrFamilyIPv6:
+		if len(value) < 20 {
+			return nil
+		}
+		ip = make(net.IP, net.IPv6len)
+		copy(ip, value[4:20])
+	default:
+		return nil
+	}
+	port := binary.BigEndian.Uint16(value[2:4])
+
+	if xored {
+		port ^= uint16(stunMagicCookie >> 16)
+		var key [16]byte
+		binary.BigEndian.PutUint32(key[0:4], stunMagicCookie)
+		copy(key[4:], txid[:])
+		for i := range ip {
+			ip[i] ^= key[i]
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}
+}
@@ -0,0 +1,62 @@
+package transport
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSTUNMessages tests request encoding and response parsing
+func TestSTUNMessages(t *testing.T) {
+	var txid [stunTransactionSize]byte
+	for i := range txid {
+		txid[i] = byte(i + 1)
+	}
+
+	request := buildSTUNRequest(txid, ChangeRequest{ChangePort: true})
+	msgType, parsedID, ok := parseSTUNHeader(request)
+	require.True(t, ok)
+	assert.Equal(t, uint16(stunBindingRequest), msgType)
+	assert.Equal(t, txid, parsedID)
+	assert.Equal(t, uint32(stunChangePortFlag), binary.BigEndian.Uint32(request[24:28]))
+
+	// XOR-MAPPED-ADDRESS for IPv6 uses the cookie and transaction ID as the key
+	expected := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 9993}
+	value := []byte{0, stunAddrFamilyIPv6}
+	value = binary.BigEndian.AppendUint16(value, uint16(expected.Port)^uint16(stunMagicCookie>>16))
+	key := binary.BigEndian.AppendUint32(nil, stunMagicCookie)
+	key = append(key, txid[:]...)
+	for i, b := range expected.IP.To16() {
+		value = append(value, b^key[i])
+	}
+
+	response := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(response[0:2], stunBindingSuccess)
+	binary.BigEndian.PutUint32(response[4:8], stunMagicCookie)
+	copy(response[8:], txid[:])
+	// An unknown attribute with padding comes first
+	response = append(response, 0x80, 0x22, 0x00, 0x03, 'a', 'b', 'c', 0)
+	response = binary.BigEndian.AppendUint16(response, stunAttrXORMapped)
+	response = binary.BigEndian.AppendUint16(response, uint16(len(value)))
+	response = append(response, value...)
+	binary.BigEndian.PutUint16(response[2:4], uint16(len(response)-stunHeaderSize))
+
+	_, _, ok = parseSTUNHeader(response)
+	require.True(t, ok)
+	parsed := parseSTUNResponse(response, txid)
+	assert.Equal(t, expected.String(), parsed.mapped.String())
+
+	// Error responses carry class and number
+	errResponse := append(response[:stunHeaderSize:stunHeaderSize], 0x00, 0x09, 0x00, 0x04, 0, 0, 4, 20)
+	binary.BigEndian.PutUint16(errResponse[2:4], 8)
+	assert.Equal(t, stunErrUnknownAttr, parseSTUNResponse(errResponse, txid).errorCode)
+
+	// Non-STUN data is rejected
+	_, _, ok = parseSTUNHeader([]byte{1, 0, 0, 0, 0})
+	assert.False(t, ok)
+	_, _, ok = parseSTUNHeader(append(request, 0))
+	assert.False(t, ok)
+}
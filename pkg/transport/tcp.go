@@ -0,0 +1,404 @@
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TCP frame types
+const (
+	// tcpFrameHello is the first frame on a dialed connection and carries the
+	// dialer's listen port so the acceptor can reuse the connection for replies
+	tcpFrameHello uint8 = iota + 1
+	// tcpFrameData carries a (possibly encrypted) packet
+	tcpFrameData
+)
+
+// tcpFrameHeaderSize is the size of the length prefix plus frame type
+const tcpFrameHeaderSize = 5
+
+// TCPTransport implements the Transport interface over TCP with length-prefixed framing
+// Each peer gets a single connection that is reused for both directions; the
+// handler always sees the peer's listen address as the source address so that
+// replies go back over the same connection
+type TCPTransport struct {
+	BaseTransport
+	sessionCrypto
+
+	listener   *net.TCPListener
+	listenAddr *net.TCPAddr
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+
+	// peers maps a peer's canonical (listen) address to its connection; conns
+	// holds every open connection, registered or not, so Stop can close them all
+	peersMu sync.Mutex
+	peers   map[string]*tcpPeer
+	conns   map[net.Conn]struct{}
+
+	maxFrameSize int
+	dialTimeout  time.Duration
+}
+
+// tcpPeer is a framed connection to a single peer
+type tcpPeer struct {
+	conn    net.Conn
+	addr    *net.TCPAddr
+	writeMu sync.Mutex
+}
+
+// NewTCPTransport creates a new TCP transport instance with encryption support
+func NewTCPTransport() *TCPTransport {
+	t := &TCPTransport{
+		BaseTransport: *NewBaseTransport(),
+		peers:         make(map[string]*tcpPeer),
+		conns:         make(map[net.Conn]struct{}),
+		maxFrameSize:  defaultMaxFrameSize,
+		dialTimeout:   defaultDialTimeout,
+	}
+	t.initSessionCrypto()
+	return t
+}
+
+// Init initializes the TCP transport from a map config; see TCPConfigFromMap
+func (t *TCPTransport) Init(config map[string]interface{}) error {
+	c, err := TCPConfigFromMap(config)
+	if err != nil {
+		return err
+	}
+	return t.Configure(c)
+}
+
+// Configure validates the configuration and binds the listening socket
+func (t *TCPTransport) Configure(config TCPConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	if err := t.applyKeyType(config.IdentityType); err != nil {
+		return err
+	}
+
+	// Loopback and a random port by default, like the UDP transport
+	t.listenAddr = &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: config.Port}
+	if config.Addr != "" {
+		parsedAddr, err := net.ResolveTCPAddr("tcp", config.Addr)
+		if err != nil {
+			return NewTransportError("invalid listen address", 5001, err)
+		}
+		t.listenAddr = parsedAddr
+	}
+
+	t.maxFrameSize = config.MaxFrameSize
+	t.dialTimeout = config.DialTimeout
+
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+
+	listener, err := net.ListenTCP("tcp", t.listenAddr)
+	if err != nil {
+		return NewTransportError("failed to bind TCP port", 5002, err)
+	}
+
+	t.listener = listener
+	t.listenAddr = listener.Addr().(*net.TCPAddr)
+	t.setLocalAddr(t.listenAddr)
+	return nil
+}
+
+// Start begins accepting TCP connections
+func (t *TCPTransport) Start(handler PacketHandler) error {
+	if t.listener == nil {
+		return NewTransportError("transport is not initialized", 5003, nil)
+	}
+
+	if err := t.BaseTransport.Start(handler); err != nil {
+		return err
+	}
+
+	t.wg.Add(1)
+	go t.acceptLoop()
+
+	return nil
+}
+
+// Stop closes the listener and all peer connections
+func (t *TCPTransport) Stop() error {
+	if err := t.BaseTransport.Stop(); err != nil {
+		return err
+	}
+
+	if t.cancel != nil {
+		t.cancel()
+	}
+
+	var closeErr error
+	if t.listener != nil {
+		closeErr = t.listener.Close()
+	}
+
+	t.peersMu.Lock()
+	for key := range t.peers {
+		delete(t.peers, key)
+	}
+	for conn := range t.conns {
+		conn.Close()
+		delete(t.conns, conn)
+	}
+	t.peersMu.Unlock()
+
+	t.wg.Wait()
+	return closeErr
+}
+
+// Send sends a packet to the peer at dstAddr, dialing a connection if needed
+func (t *TCPTransport) Send(dstAddr net.Addr, data []byte) error {
+	if t.isClosed() {
+		return NewTransportError("transport is closed", 5004, nil)
+	}
+
+	tcpAddr, ok := dstAddr.(*net.TCPAddr)
+	if !ok {
+		resolvedAddr, err := net.ResolveTCPAddr("tcp", dstAddr.String())
+		if err != nil {
+			return NewTransportError("invalid destination address", 5005, err)
+		}
+		tcpAddr = resolvedAddr
+	}
+	key := tcpAddr.String()
+
+	frame, err := t.sealFrame(key, data)
+	if err != nil {
+		return err
+	}
+	if len(frame)+1 > t.maxFrameSize {
+		return NewTransportError("packet exceeds maximum frame size", 5006, nil)
+	}
+
+	peer, err := t.getOrDialPeer(tcpAddr)
+	if err != nil {
+		return err
+	}
+
+	if err := t.writeFrame(peer, tcpFrameData, frame); err != nil {
+		// Drop the broken connection so the next send redials
+		t.removePeer(key, peer)
+		return NewTransportError("failed to send TCP frame", 5007, err)
+	}
+
+	return nil
+}
+
+// PeerCount returns the number of peers with an open connection
+func (t *TCPTransport) PeerCount() int {
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+	return len(t.peers)
+}
+
+// getOrDialPeer returns the connection for a peer, dialing a new one if needed
+func (t *TCPTransport) getOrDialPeer(addr *net.TCPAddr) (*tcpPeer, error) {
+	key := addr.String()
+
+	t.peersMu.Lock()
+	peer, exists := t.peers[key]
+	t.peersMu.Unlock()
+	if exists {
+		return peer, nil
+	}
+
+	dialer := net.Dialer{Timeout: t.dialTimeout}
+	conn, err := dialer.DialContext(t.ctx, "tcp", key)
+	if err != nil {
+		return nil, NewTransportError("failed to connect to peer", 5008, err)
+	}
+
+	peer = &tcpPeer{conn: conn, addr: addr}
+
+	// Announce our listen port so the peer can reply over this connection
+	hello := make([]byte, 2)
+	binary.BigEndian.PutUint16(hello, uint16(t.listenAddr.Port))
+	if err := t.writeFrame(peer, tcpFrameHello, hello); err != nil {
+		conn.Close()
+		return nil, NewTransportError("failed to send TCP hello", 5009, err)
+	}
+
+	// Another goroutine may have connected in the meantime; keep the first one
+	t.peersMu.Lock()
+	if t.ctx.Err() != nil {
+		t.peersMu.Unlock()
+		conn.Close()
+		return nil, NewTransportError("transport is closed", 5004, nil)
+	}
+	if existing, exists := t.peers[key]; exists {
+		t.peersMu.Unlock()
+		conn.Close()
+		return existing, nil
+	}
+	t.peers[key] = peer
+	t.conns[conn] = struct{}{}
+	// Added under the lock so Stop cannot be waiting yet
+	t.wg.Add(1)
+	t.peersMu.Unlock()
+
+	go func() {
+		defer t.wg.Done()
+		t.readLoop(peer)
+	}()
+
+	return peer, nil
+}
+
+// removePeer closes and forgets a peer connection if it is still the registered one
+func (t *TCPTransport) removePeer(key string, peer *tcpPeer) {
+	t.peersMu.Lock()
+	if current, exists := t.peers[key]; exists && current == peer {
+		delete(t.peers, key)
+	}
+	t.peersMu.Unlock()
+	t.closeConn(peer.conn)
+}
+
+// closeConn closes a connection and stops tracking it
+func (t *TCPTransport) closeConn(conn net.Conn) {
+	t.peersMu.Lock()
+	delete(t.conns, conn)
+	t.peersMu.Unlock()
+	conn.Close()
+}
+
+// acceptLoop accepts inbound connections
+func (t *TCPTransport) acceptLoop() {
+	defer t.wg.Done()
+
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			if t.ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		// Tracked under the lock so Stop closes it even before its hello arrives
+		t.peersMu.Lock()
+		if t.ctx.Err() != nil {
+			t.peersMu.Unlock()
+			conn.Close()
+			return
+		}
+		t.conns[conn] = struct{}{}
+		t.wg.Add(1)
+		t.peersMu.Unlock()
+		go t.handleInbound(conn)
+	}
+}
+
+// handleInbound waits for the hello frame and then serves an inbound connection
+func (t *TCPTransport) handleInbound(conn net.Conn) {
+	defer t.wg.Done()
+
+	// The hello frame must arrive within the read timeout
+	if readTimeout := t.getReadTimeout(); readTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+	}
+	frameType, body, err := t.readFrame(conn)
+	if err != nil || frameType != tcpFrameHello || len(body) != 2 {
+		t.closeConn(conn)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// The canonical address is the remote IP with the announced listen port
+	remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		t.closeConn(conn)
+		return
+	}
+	addr := &net.TCPAddr{IP: remote.IP, Port: int(binary.BigEndian.Uint16(body)), Zone: remote.Zone}
+	peer := &tcpPeer{conn: conn, addr: addr}
+
+	// Reuse this connection for replies unless we already have one
+	key := addr.String()
+	t.peersMu.Lock()
+	if t.ctx.Err() != nil {
+		// Stop already closed every connection
+		t.peersMu.Unlock()
+		conn.Close()
+		return
+	}
+	if _, exists := t.peers[key]; !exists {
+		t.peers[key] = peer
+	}
+	t.peersMu.Unlock()
+
+	t.readLoop(peer)
+}
+
+// readLoop delivers data frames from a peer connection to the handler
+func (t *TCPTransport) readLoop(peer *tcpPeer) {
+	key := peer.addr.String()
+	defer t.removePeer(key, peer)
+
+	for {
+		frameType, body, err := t.readFrame(peer.conn)
+		if err != nil {
+			return
+		}
+		if frameType != tcpFrameData {
+			continue
+		}
+
+		data, err := t.openFrame(key, body)
+		if err != nil {
+			continue
+		}
+
+		handler := t.getHandler()
+		if handler != nil {
+			handler(peer.addr, data)
+		}
+	}
+}
+
+// writeFrame writes a length-prefixed frame: length(4) + type(1) + body
+// The length covers the type byte and the body
+func (t *TCPTransport) writeFrame(peer *tcpPeer, frameType uint8, body []byte) error {
+	frame := make([]byte, tcpFrameHeaderSize+len(body))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(body)+1))
+	frame[4] = frameType
+	copy(frame[tcpFrameHeaderSize:], body)
+
+	peer.writeMu.Lock()
+	defer peer.writeMu.Unlock()
+
+	if writeTimeout := t.getWriteTimeout(); writeTimeout > 0 {
+		peer.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	}
+	_, err := peer.conn.Write(frame)
+	return err
+}
+
+// readFrame reads a single length-prefixed frame
+func (t *TCPTransport) readFrame(conn net.Conn) (uint8, []byte, error) {
+	header := make([]byte, tcpFrameHeaderSize)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, nil, err
+	}
+
+	length := int(binary.BigEndian.Uint32(header[0:4]))
+	if length < 1 || length > t.maxFrameSize {
+		return 0, nil, errors.New("invalid TCP frame length: " + strconv.Itoa(length))
+	}
+
+	body := make([]byte, length-1)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return 0, nil, err
+	}
+	return header[4], body, nil
+}
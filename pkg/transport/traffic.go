@@ -0,0 +1,352 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultTrafficQueueLimit is how many packets of one class may wait for one destination
+const defaultTrafficQueueLimit = 256
+
+// TrafficClass says how urgently a packet must leave
+type TrafficClass int
+
+const (
+	// TrafficClassControl is for keepalives, discovery and signaling, which keep the session alive
+	TrafficClassControl TrafficClass = iota
+	// TrafficClassRealtime is for latency-sensitive data such as game state and voice
+	TrafficClassRealtime
+	// TrafficClassBulk is for throughput-bound data such as file copies
+	TrafficClassBulk
+
+	// trafficClassCount is the number of traffic classes
+	trafficClassCount = 3
+)
+
+// String returns the name of the traffic class
+func (c TrafficClass) String() string {
+	switch c {
+	case TrafficClassControl:
+		return "control"
+	case TrafficClassRealtime:
+		return "realtime"
+	case TrafficClassBulk:
+		return "bulk"
+	default:
+		return fmt.Sprintf("TrafficClass(%d)", int(c))
+	}
+}
+
+// valid reports whether c is one of the defined classes
+func (c TrafficClass) valid() bool {
+	return c >= TrafficClassControl && c < trafficClassCount
+}
+
+// SchedulingPolicy decides which class sends next when several are waiting
+type SchedulingPolicy string
+
+const (
+	// SchedulingStrict always sends the most urgent waiting class first; bulk only
+	// sends when control and realtime have nothing waiting
+	SchedulingStrict SchedulingPolicy = "strict"
+	// SchedulingWeighted shares sends between waiting classes in proportion to their
+	// weights, so bulk keeps a minimum share under sustained realtime load
+	SchedulingWeighted SchedulingPolicy = "weighted"
+)
+
+// TrafficSchedulerConfig configures a ScheduledTransport
+// Start from DefaultTrafficSchedulerConfig; the zero value is not valid.
+type TrafficSchedulerConfig struct {
+	// Policy is SchedulingStrict or SchedulingWeighted
+	// Default: SchedulingStrict
+	Policy SchedulingPolicy
+	// Weights are the packets each class may send per weighted round; used by SchedulingWeighted
+	// Default: control 8, realtime 4, bulk 1
+	Weights map[TrafficClass]int
+	// QueueLimit is how many packets of one class may wait for one destination;
+	// further packets of that class are dropped with an error
+	// Default: 256
+	QueueLimit int
+}
+
+// DefaultTrafficSchedulerConfig returns a strict-priority configuration
+func DefaultTrafficSchedulerConfig() TrafficSchedulerConfig {
+	return TrafficSchedulerConfig{
+		Policy: SchedulingStrict,
+		Weights: map[TrafficClass]int{
+			TrafficClassControl:  8,
+			TrafficClassRealtime: 4,
+			TrafficClassBulk:     1,
+		},
+		QueueLimit: defaultTrafficQueueLimit,
+	}
+}
+
+// Validate checks the configuration
+func (c TrafficSchedulerConfig) Validate() error {
+	if c.Policy != SchedulingStrict && c.Policy != SchedulingWeighted {
+		return NewTransportError("invalid scheduling policy: "+string(c.Policy), 4029, nil)
+	}
+	if c.Policy == SchedulingWeighted {
+		for class := TrafficClassControl; class < trafficClassCount; class++ {
+			if c.Weights[class] < 1 {
+				return NewTransportError("weight for "+class.String()+" traffic must be at least 1", 4030, nil)
+			}
+		}
+	}
+	for class := range c.Weights {
+		if !class.valid() {
+			return NewTransportError("weight for unknown "+class.String(), 4041, nil)
+		}
+	}
+	if c.QueueLimit < 1 {
+		return NewTransportError("queueLimit must be positive", 4031, nil)
+	}
+	return nil
+}
+
+// TrafficClassifier picks the class of a packet sent without one
+// reliable is false for packets sent with SendUnreliable.
+type TrafficClassifier func(dstAddr net.Addr, data []byte, reliable bool) TrafficClass
+
+// DefaultTrafficClassifier treats empty packets (keepalives) as control, unreliable
+// packets as realtime and everything else as bulk
+func DefaultTrafficClassifier(dstAddr net.Addr, data []byte, reliable bool) TrafficClass {
+	switch {
+	case len(data) == 0:
+		return TrafficClassControl
+	case !reliable:
+		return TrafficClassRealtime
+	default:
+		return TrafficClassBulk
+	}
+}
+
+// TrafficClassStats counts the packets of one class
+type TrafficClassStats struct {
+	Sent     uint64        `json:"sent"`      // packets handed to the wrapped transport
+	Dropped  uint64        `json:"dropped"`   // packets refused because the class queue was full
+	Waited   uint64        `json:"waited"`    // packets that queued behind another send
+	Queued   int           `json:"queued"`    // packets waiting now
+	WaitTime time.Duration `json:"wait_time"` // total time spent queued
+	MaxWait  time.Duration `json:"max_wait"`  // longest time a packet spent queued
+}
+
+// ClassStats is a snapshot of a ScheduledTransport's per-class counters
+type ClassStats struct {
+	Control  TrafficClassStats `json:"control"`
+	Realtime TrafficClassStats `json:"realtime"`
+	Bulk     TrafficClassStats `json:"bulk"`
+}
+
+// ScheduledTransport wraps a Transport and orders sends to each destination by traffic class
+// Only one send per destination is in the wrapped transport at a time; the others
+// wait in a queue per class, and when a send finishes the policy picks the next one.
+// Pacing and congestion control in the wrapped transport therefore delay bulk
+// packets instead of the realtime packets queued behind them. Sends are still
+// synchronous: Send returns once the wrapped transport has taken the packet.
+type ScheduledTransport struct {
+	Transport
+
+	mu         sync.Mutex
+	config     TrafficSchedulerConfig
+	classifier TrafficClassifier
+	gates      map[string]*sendGate
+	stats      [trafficClassCount]TrafficClassStats
+}
+
+// sendGate serializes the sends to one destination
+type sendGate struct {
+	busy    bool
+	waiting [trafficClassCount][]*gateWaiter
+	turns   [trafficClassCount]int // sends left in the current weighted round
+}
+
+// gateWaiter is a send waiting for its turn
+type gateWaiter struct {
+	ready    chan struct{}
+	enqueued time.Time
+}
+
+// NewScheduledTransport wraps inner with per-class send queues
+func NewScheduledTransport(inner Transport, config TrafficSchedulerConfig) (*ScheduledTransport, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	weights := make(map[TrafficClass]int, len(config.Weights))
+	for class, weight := range config.Weights {
+		weights[class] = weight
+	}
+	config.Weights = weights
+
+	return &ScheduledTransport{
+		Transport:  inner,
+		config:     config,
+		classifier: DefaultTrafficClassifier,
+		gates:      make(map[string]*sendGate),
+	}, nil
+}
+
+// SetClassifier sets how packets sent without a class are classified; nil restores DefaultTrafficClassifier
+func (t *ScheduledTransport) SetClassifier(classifier TrafficClassifier) {
+	if classifier == nil {
+		classifier = DefaultTrafficClassifier
+	}
+	t.mu.Lock()
+	t.classifier = classifier
+	t.mu.Unlock()
+}
+
+// Send classifies the packet and sends it when its class gets a turn
+func (t *ScheduledTransport) Send(dstAddr net.Addr, data []byte) error {
+	return t.schedule(dstAddr, t.classify(dstAddr, data, true), func() error {
+		return t.Transport.Send(dstAddr, data)
+	})
+}
+
+// SendUnreliable classifies the packet and sends it without ACKs if the wrapped transport supports it
+func (t *ScheduledTransport) SendUnreliable(dstAddr net.Addr, data []byte) error {
+	return t.schedule(dstAddr, t.classify(dstAddr, data, false), func() error {
+		if sender, ok := t.Transport.(unreliableSender); ok {
+			return sender.SendUnreliable(dstAddr, data)
+		}
+		return t.Transport.Send(dstAddr, data)
+	})
+}
+
+// SendClass sends a packet in the given class
+func (t *ScheduledTransport) SendClass(dstAddr net.Addr, data []byte, class TrafficClass) error {
+	return t.schedule(dstAddr, class, func() error {
+		return t.Transport.Send(dstAddr, data)
+	})
+}
+
+// AddDeliveryListener forwards to the wrapped transport if it reports delivery outcomes
+func (t *ScheduledTransport) AddDeliveryListener(listener DeliveryListener) {
+	if notifier, ok := t.Transport.(DeliveryNotifier); ok {
+		notifier.AddDeliveryListener(listener)
+	}
+}
+
+// ClassStats returns a snapshot of the per-class counters
+func (t *ScheduledTransport) ClassStats() ClassStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return ClassStats{
+		Control:  t.stats[TrafficClassControl],
+		Realtime: t.stats[TrafficClassRealtime],
+		Bulk:     t.stats[TrafficClassBulk],
+	}
+}
+
+// classify picks the class of an untagged packet
+func (t *ScheduledTransport) classify(dstAddr net.Addr, data []byte, reliable bool) TrafficClass {
+	t.mu.Lock()
+	classifier := t.classifier
+	t.mu.Unlock()
+	return classifier(dstAddr, data, reliable)
+}
+
+// schedule waits for the class's turn at the destination, then calls send
+func (t *ScheduledTransport) schedule(dstAddr net.Addr, class TrafficClass, send func() error) error {
+	if !class.valid() {
+		return NewTransportError("invalid traffic class: "+class.String(), 4033, nil)
+	}
+	key := dstAddr.String()
+
+	t.mu.Lock()
+	gate, exists := t.gates[key]
+	if !exists {
+		gate = &sendGate{}
+		t.gates[key] = gate
+	}
+	stats := &t.stats[class]
+
+	if !gate.busy {
+		gate.busy = true
+		stats.Sent++
+		t.mu.Unlock()
+	} else {
+		if len(gate.waiting[class]) >= t.config.QueueLimit {
+			stats.Dropped++
+			t.mu.Unlock()
+			return NewTransportError(class.String()+" queue to "+key+" is full", 4032, nil)
+		}
+		waiter := &gateWaiter{ready: make(chan struct{}), enqueued: time.Now()}
+		gate.waiting[class] = append(gate.waiting[class], waiter)
+		stats.Queued++
+		t.mu.Unlock()
+
+		// The previous sender hands the gate over; it stays busy meanwhile
+		<-waiter.ready
+	}
+
+	err := send()
+	t.release(key, gate)
+	return err
+}
+
+// release hands the destination's gate to the next waiting send, or frees it
+func (t *ScheduledTransport) release(key string, gate *sendGate) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	class, waiter := t.next(gate)
+	if waiter == nil {
+		gate.busy = false
+		delete(t.gates, key)
+		return
+	}
+
+	wait := time.Since(waiter.enqueued)
+	stats := &t.stats[class]
+	stats.Queued--
+	stats.Waited++
+	stats.Sent++
+	stats.WaitTime += wait
+	if wait > stats.MaxWait {
+		stats.MaxWait = wait
+	}
+	close(waiter.ready)
+}
+
+// next removes and returns the waiter the policy sends next, or nil if none is waiting
+// Weighted scheduling is a round robin in which each class sends up to its weight
+// per round; a new round starts when no waiting class has sends left.
+func (t *ScheduledTransport) next(gate *sendGate) (TrafficClass, *gateWaiter) {
+	for round := 0; round < 2; round++ {
+		for class := TrafficClassControl; class < trafficClassCount; class++ {
+			queue := gate.waiting[class]
+			if len(queue) == 0 {
+				continue
+			}
+			if t.config.Policy == SchedulingWeighted {
+				if gate.turns[class] == 0 {
+					continue
+				}
+				gate.turns[class]--
+			}
+			waiter := queue[0]
+			queue[0] = nil
+			gate.waiting[class] = queue[1:]
+			return class, waiter
+		}
+		if t.config.Policy != SchedulingWeighted {
+			break
+		}
+		for class := TrafficClassControl; class < trafficClassCount; class++ {
+			gate.turns[class] = t.config.Weights[class]
+		}
+	}
+	return 0, nil
+}
+
+// sendWithClass sends data in the given class if the transport schedules by class
+func sendWithClass(t Transport, dstAddr net.Addr, data []byte, class TrafficClass) error {
+	if sender, ok := t.(ClassSender); ok {
+		return sender.SendClass(dstAddr, data, class)
+	}
+	return t.Send(dstAddr, data)
+}
@@ -1,16 +1,16 @@
 package transport
 
 import (
+	"container/list"
 	"context"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
 	"time"
 
-	"golang.org/x/crypto/curve25519"
-
 	"github.com/stella/virtual-switch/pkg/crypto"
 )
 
@@ -24,6 +24,16 @@ type UDPTransport struct {
 	wg         sync.WaitGroup
 	bufferSize int
 
+	// 多地址绑定：每个本地地址一个套接字，conn 是第一个（主）套接字
+	bindAddrs         []*net.UDPAddr
+	optionalBindAddrs map[string]bool
+	boundAddrs        []*net.UDPAddr
+	sockMu            sync.RWMutex
+	sockets           []*udpSocket
+	replyPaths        map[string]*replyPath
+	replyPathOrder    *lruKeys // replyPaths 的键，最久未用的在前
+	lastReplyPrune    time.Time
+
 	// 超时重传相关字段
 	mux               sync.RWMutex
 	pendingPackets    map[string]*pendingPacket
@@ -33,12 +43,84 @@ type UDPTransport struct {
 	retryExponential  bool
 	ackHandlerEnabled bool
 
+	// 接收端按对等节点的重复检测，重复数据包仍然ACK但不再交付
+	replay *replayFilter
+
+	// 滑动窗口可靠性模式（SACK）相关字段
+	windowed        bool
+	windowSize      int
+	initialRTO      time.Duration
+	minRTO          time.Duration
+	maxRTO          time.Duration
+	windowMu        sync.Mutex
+	sendWindows     map[string]*sendWindow
+	recvWindows     map[string]*recvWindow
+	recvWindowOrder *lruKeys // recvWindows 的键，最久未用的在前
+
+	// 按对等节点的拥塞控制和发送节奏控制，可靠和不可靠数据共享发送预算
+	congestionControl bool
+	maxSendRate       int64
+	congestionMu      sync.Mutex
+	congestion        map[string]*congestionController
+
+	// 按对等节点的路径MTU探测和超过路径MTU的数据包分片
+	pmtuDiscovery    bool
+	maxPathMTU       int
+	pmtuProbeTimeout time.Duration
+	pmtuMu           sync.Mutex
+	pmtuPaths        map[string]*pathMTU
+	pmtuListeners    []PathMTUListener
+	pmtuProbeSeq     uint32
+	fragments        map[string]*fragmentBuffer
+	fragmentOrder    *list.List     // 按创建顺序排列的重组键，最早的在前
+	fragmentSources  map[string]int // 每个来源正在重组的消息数
+	nextFragmentID   uint32
+
+	// 不可靠数据包的前向纠错：按对等节点分组发送XOR校验包，组大小随对端报告的丢包率调整
+	fecEnabled       bool
+	fecGroupSize     int
+	fecMinGroupSize  int
+	fecFlushInterval time.Duration
+	fecMu            sync.Mutex
+	fecSenders       map[string]*fecSender
+	fecReceivers     map[string]*fecReceiver
+	fecReceiverOrder *lruKeys // fecReceivers 的键，最久未用的在前
+
+	// 按节点地址登记的对等节点：数据报带认证信封，通过认证的新端点触发会话迁移
+	roamMu            sync.RWMutex
+	nodePeers         map[string]*nodePeer // 节点地址到对等节点
+	nodeEndpoints     map[string]*nodePeer // 当前端点到对等节点
+	endpointListeners []EndpointListener
+	migrateMu         sync.Mutex // 串行化端点迁移
+	localNode         []byte     // 本地节点地址缓存
+	localNodeKey      []byte     // 计算缓存时的本地公钥
+
+	// 投递结果监听器，在收到ACK或放弃重传时调用
+	deliveryListeners []DeliveryListener
+
 	// 加密相关字段
-	cryptoMux        sync.RWMutex
-	keyPair          *crypto.KeyPair
-	peerKeys         map[string][]byte // 地址到公钥的映射
-	cipherSuite      uint8             // 使用的加密套件
-	enableEncryption bool              // 是否启用加密
+	sessionCrypto
+
+	// 链路写出钩子，设置后所有数据包（包括ACK和重传）都经由它写出
+	linkWriter LinkWriteFunc
+
+	// 原始数据报处理器，在传输层处理之前查看每个数据报（如STUN响应）
+	rawHandlers []RawHandler
+
+	// 为新来源创建接收状态前的按来源限速，nil 表示不限速
+	guardMu sync.RWMutex
+	guard   *HandshakeGuard
+
+	// 传输层和按对等节点的收发统计
+	stats *statsTable
+
+	// 批量收发和接收处理：每次系统调用最多收发 batchSize 个数据报，
+	// 接收缓冲区来自缓冲池，数据报按源地址分派给 handlerWorkers 个处理协程
+	batchSize      int
+	handlerWorkers int
+	borrowBuffers  bool
+	buffers        *sync.Pool
+	workers        *handlerPool
 
 	// 用于测试的标志
 	isTestMode bool
@@ -52,67 +134,102 @@ type pendingPacket struct {
 	retries     int
 	sendTime    time.Time
 	nextRetry   time.Time
-	nonce       []byte // 用于加密的nonce
+	nonce       []byte                // 用于加密的nonce
+	result      chan DeliveryResult   // 可选的单次投递结果通道
+	congestion  *congestionController // 发往目标地址的拥塞控制器
 }
 
 // NewUDPTransport creates a new UDP transport instance with encryption support
 func NewUDPTransport() *UDPTransport {
-	// 生成密钥对
-	keyPair, err := crypto.GenerateKeyPair()
-	if err != nil {
-		// 如果密钥生成失败，使用默认空密钥
-		keyPair = &crypto.KeyPair{}
-	}
 	t := &UDPTransport{
 		BaseTransport:     *NewBaseTransport(),
-		bufferSize:        4096,
+		bufferSize:        defaultBufferSize,
 		pendingPackets:    make(map[string]*pendingPacket),
-		nextSequenceNum:   1, // 从1开始，0用于特殊目的（如ACK）
-		maxRetries:        3,
-		retryInterval:     500 * time.Millisecond,
+		nextSequenceNum:   randomSequenceStart(), // 随机起点，0用于特殊目的（如ACK）
+		maxRetries:        defaultMaxRetries,
+		retryInterval:     defaultRetryInterval,
 		retryExponential:  true,
 		ackHandlerEnabled: true,
-		// 加密相关初始化
-		keyPair:          keyPair,
-		peerKeys:         make(map[string][]byte),
-		cipherSuite:      crypto.CipherC25519_POLY1305_SALSA2012,
-		enableEncryption: true,
-		isTestMode:       false,
+		replay:            newReplayFilter(),
+		replyPaths:        make(map[string]*replyPath),
+		replyPathOrder:    newLRUKeys(),
+		windowSize:        defaultWindowSize,
+		initialRTO:        defaultInitialRTO,
+		minRTO:            defaultMinRTO,
+		maxRTO:            defaultMaxRTO,
+		sendWindows:       make(map[string]*sendWindow),
+		recvWindows:       make(map[string]*recvWindow),
+		recvWindowOrder:   newLRUKeys(),
+		congestionControl: true,
+		congestion:        make(map[string]*congestionController),
+		maxPathMTU:        defaultMaxPathMTU,
+		pmtuProbeTimeout:  defaultPMTUProbeTimeout,
+		pmtuPaths:         make(map[string]*pathMTU),
+		fragments:         make(map[string]*fragmentBuffer),
+		fragmentOrder:     list.New(),
+		fragmentSources:   make(map[string]int),
+		fecGroupSize:      defaultFECGroupSize,
+		fecMinGroupSize:   defaultFECMinGroupSize,
+		fecFlushInterval:  defaultFECFlushInterval,
+		fecSenders:        make(map[string]*fecSender),
+		fecReceivers:      make(map[string]*fecReceiver),
+		fecReceiverOrder:  newLRUKeys(),
+		nodePeers:         make(map[string]*nodePeer),
+		nodeEndpoints:     make(map[string]*nodePeer),
+		stats:             newStatsTable(),
+		batchSize:         defaultBatchSize,
+		handlerWorkers:    defaultHandlerWorkers(),
+		isTestMode:        false,
 	}
+	// 加密相关初始化
+	t.initSessionCrypto()
 	return t
 }
 
-// SetPeerPublicKey 设置对等节点的公钥
-func (t *UDPTransport) SetPeerPublicKey(addr string, publicKey []byte) {
-	t.cryptoMux.Lock()
-	defer t.cryptoMux.Unlock()
-	t.peerKeys[addr] = make([]byte, len(publicKey))
-	copy(t.peerKeys[addr], publicKey)
-}
-
-// GetPublicKey 获取本地传输的公钥
-func (t *UDPTransport) GetPublicKey() []byte {
-	t.cryptoMux.RLock()
-	defer t.cryptoMux.RUnlock()
-	return t.keyPair.Public
-}
-
-// SetEncryptionEnabled 启用或禁用加密功能
-func (t *UDPTransport) SetEncryptionEnabled(enabled bool) {
-	t.enableEncryption = enabled
+// Init 从 map 配置初始化UDP传输实例，见 UDPConfigFromMap
+func (t *UDPTransport) Init(config map[string]interface{}) error {
+	c, err := UDPConfigFromMap(config)
+	if err != nil {
+		return err
+	}
+	return t.Configure(c)
 }
 
-// Init 初始化UDP传输实例
-func (t *UDPTransport) Init(config map[string]interface{}) error {
-	// 设置默认值
-	t.retryInterval = 500 // 默认重试间隔500毫秒
-	t.maxRetries = 3      // 默认最大重试次数3次
+// Configure 检查配置并初始化UDP传输实例，绑定监听套接字
+func (t *UDPTransport) Configure(config UDPConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
 
 	// 创建上下文
 	t.ctx, t.cancel = context.WithCancel(context.Background())
 
+	// 配置本地密钥类型
+	if err := t.applyKeyType(config.IdentityType); err != nil {
+		return err
+	}
+
+	// 配置超时重传参数
+	t.maxRetries = config.MaxRetries
+	t.retryInterval = config.RetryInterval
+	t.retryExponential = config.RetryExponential
+	t.ackHandlerEnabled = config.AckHandlerEnabled
+
+	// 配置可靠性模式、拥塞控制、路径MTU探测、前向纠错和批量收发
+	t.configureWindow(config)
+	t.configureCongestion(config)
+	t.configurePathMTU(config)
+	t.configureFEC(config)
+	t.configureBatching(config)
+
+	// 接收缓冲区必须能容纳最大的探测包，否则探测包会被截断
+	t.bufferSize = config.BufferSize
+	if t.bufferSize < t.maxPathMTU {
+		t.bufferSize = t.maxPathMTU
+	}
+
 	// 检查是否为测试模式
-	if testMode, ok := config["test_mode"].(bool); ok && testMode {
+	if config.TestMode {
 		t.isTestMode = true
 		// 在测试模式下，不进行实际的网络操作
 		// 模拟一个监听地址
@@ -122,42 +239,23 @@ func (t *UDPTransport) Init(config map[string]interface{}) error {
 
 	// 使用本地回环地址和随机端口，避免权限和端口冲突问题
 	t.listenAddr = &net.UDPAddr{
-		Port: 0, // 使用0表示随机分配可用端口
+		Port: config.Port, // 0表示随机分配可用端口
 		IP:   net.ParseIP("127.0.0.1"),
 	}
 
-	// Apply config if provided
-	if port, ok := config["port"].(int); ok && port > 0 {
-		t.listenAddr.Port = port
-	}
-
 	// 处理addr配置参数
-	if addr, ok := config["addr"].(string); ok && addr != "" {
-		parsedAddr, err := net.ResolveUDPAddr("udp", addr)
-		if err == nil {
-			t.listenAddr = parsedAddr
+	if config.Addr != "" {
+		parsedAddr, err := net.ResolveUDPAddr("udp", config.Addr)
+		if err != nil {
+			return NewTransportError("invalid listen address: "+config.Addr, 3038, err)
 		}
+		t.listenAddr = parsedAddr
 	}
 
-	if bufferSize, ok := config["bufferSize"].(int); ok && bufferSize > 0 {
-		t.bufferSize = bufferSize
-	}
-
-	// 配置超时重传参数
-	if maxRetries, ok := config["maxRetries"].(int); ok && maxRetries >= 0 {
-		t.maxRetries = maxRetries
-	}
-
-	if retryInterval, ok := config["retryInterval"].(time.Duration); ok && retryInterval > 0 {
-		t.retryInterval = retryInterval
-	}
-
-	if retryExponential, ok := config["retryExponential"].(bool); ok {
-		t.retryExponential = retryExponential
-	}
-
-	if ackHandlerEnabled, ok := config["ackHandlerEnabled"].(bool); ok {
-		t.ackHandlerEnabled = ackHandlerEnabled
+	// 配置了多个监听地址时逐个绑定，不使用下面的单地址重试逻辑
+	t.configureBindAddrs(config)
+	if len(t.bindAddrs) > 0 {
+		return t.bindSockets(t.bindAddrs)
 	}
 
 	// 尝试多次绑定端口，避免临时端口冲突
@@ -195,13 +293,8 @@ func (t *UDPTransport) Init(config map[string]interface{}) error {
 		return fmt.Errorf("failed to bind UDP port after %d attempts: %w", maxRetries, err)
 	}
 
-	t.conn = conn
-
 	// 更新实际绑定的地址（可能包含随机分配的端口）
-	actualAddr := conn.LocalAddr()
-	if udpAddr, ok := actualAddr.(*net.UDPAddr); ok {
-		t.listenAddr = udpAddr
-	}
+	t.setSockets([]*udpSocket{t.newSocket(conn)})
 
 	return nil
 }
@@ -223,14 +316,8 @@ func (t *UDPTransport) sendACK(dstAddr net.Addr, sequenceNum uint32) error {
 		udpAddr = resolvedAddr
 	}
 
-	// Set write deadline
-	writeTimeout := t.getWriteTimeout()
-	if writeTimeout > 0 {
-		t.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
-	}
-
 	// Send ACK
-	_, err := t.conn.WriteToUDP(ackData, udpAddr)
+	err := t.writePacket(t.conn, ackData, udpAddr)
 	if err != nil {
 		return NewTransportError("failed to send ACK", 3007, err)
 	}
@@ -245,8 +332,66 @@ func (t *UDPTransport) handleACK(srcAddr net.Addr, sequenceNum uint32) {
 
 	// 从待确认列表中移除
 	t.mux.Lock()
+	packet, exists := t.pendingPackets[packetID]
 	delete(t.pendingPackets, packetID)
 	t.mux.Unlock()
+
+	// 重复的ACK不再通知
+	if exists {
+		if packet.congestion != nil {
+			// Karn算法：重传过的数据包没有有效的RTT样本
+			now := time.Now()
+			if packet.retries == 0 {
+				packet.congestion.onRTT(now.Sub(packet.sendTime))
+			}
+			packet.congestion.onAck(len(packet.data), now)
+		}
+		if packet.retries == 0 {
+			t.stats.rtt(srcAddr, time.Since(packet.sendTime))
+		}
+		t.notifyDelivery(packet, DeliveryResult{
+			Delivered: true,
+			RTT:       time.Since(packet.sendTime),
+		})
+	}
+}
+
+// AddDeliveryListener 注册投递结果监听器
+func (t *UDPTransport) AddDeliveryListener(listener DeliveryListener) {
+	if listener == nil {
+		return
+	}
+	t.mux.Lock()
+	t.deliveryListeners = append(t.deliveryListeners, listener)
+	t.mux.Unlock()
+}
+
+// notifyDelivery 将投递结果发送到数据包的结果通道并通知所有监听器
+// 调用时不能持有 t.mux
+func (t *UDPTransport) notifyDelivery(packet *pendingPacket, result DeliveryResult) {
+	result.DstAddr = packet.dstAddr
+	result.SequenceNum = packet.sequenceNum
+	result.Retries = packet.retries
+	t.publishDelivery(result, packet.result)
+}
+
+// publishDelivery 将投递结果发送到结果通道（可为nil）并通知所有监听器
+// 调用时不能持有 t.mux
+func (t *UDPTransport) publishDelivery(result DeliveryResult, resultCh chan DeliveryResult) {
+	result.DstAddr = t.nodeAddrFor(result.DstAddr)
+	if resultCh != nil {
+		// 通道容量为1且每个数据包只通知一次，不会阻塞
+		resultCh <- result
+	}
+
+	t.mux.RLock()
+	listeners := make([]DeliveryListener, len(t.deliveryListeners))
+	copy(listeners, t.deliveryListeners)
+	t.mux.RUnlock()
+
+	for _, listener := range listeners {
+		listener(result)
+	}
 }
 
 // retransmissionManager 管理数据包超时重传
@@ -257,68 +402,94 @@ func (t *UDPTransport) retransmissionManager() {
 	ticker := time.NewTicker(100 * time.Millisecond)
 	defer ticker.Stop()
 
+	// 每秒清理一次空闲对等节点的重复检测状态和拥塞控制器
+	lastExpire := time.Now()
+
 	for {
 		select {
 		case <-t.ctx.Done():
 			return
 		case now := <-ticker.C:
+			if now.Sub(lastExpire) >= time.Second {
+				t.replay.expire(now)
+				t.expireCongestion(now)
+				lastExpire = now
+			}
+
+			// 放弃重传的数据包在解锁后统一通知
+			var failed []*pendingPacket
+
+			// 需要重传的数据包，在锁外统一发送，避免扫描期间阻塞发送和ACK处理
+			type retransmission struct {
+				data       []byte
+				addr       *net.UDPAddr
+				congestion *congestionController
+			}
+			var retransmissions []retransmission
+
 			t.mux.Lock()
 			// 检查所有待确认的数据包
 			for packetID, packet := range t.pendingPackets {
 				// 检查是否需要重传
-				if now.After(packet.nextRetry) {
-					// 检查是否达到最大重传次数
-					if packet.retries >= t.maxRetries {
-						// 达到最大重传次数，放弃重传
+				if !now.After(packet.nextRetry) {
+					continue
+				}
+
+				// 检查是否达到最大重传次数
+				if packet.retries >= t.maxRetries {
+					// 达到最大重传次数，放弃重传
+					delete(t.pendingPackets, packetID)
+					failed = append(failed, packet)
+					continue
+				}
+
+				// 准备重传数据
+				udpAddr, _ := packet.dstAddr.(*net.UDPAddr)
+				if udpAddr == nil {
+					// 如果地址无效，尝试解析
+					resolvedAddr, err := net.ResolveUDPAddr("udp", packet.dstAddr.String())
+					if err != nil {
+						// 解析失败，放弃重传
 						delete(t.pendingPackets, packetID)
+						failed = append(failed, packet)
 						continue
 					}
+					udpAddr = resolvedAddr
+				}
 
-					// 准备重传
-					packet.retries++
-
-					// 计算下次重传时间
-					nextRetryInterval := t.calculateRetryInterval(packet.retries)
-					packet.nextRetry = now.Add(nextRetryInterval)
-
-					// 准备重传数据
-					udpAddr, _ := packet.dstAddr.(*net.UDPAddr)
-					if udpAddr == nil {
-						// 如果地址无效，尝试解析
-						resolvedAddr, err := net.ResolveUDPAddr("udp", packet.dstAddr.String())
-						if err != nil {
-							// 解析失败，放弃重传
-							delete(t.pendingPackets, packetID)
-							continue
-						}
-						udpAddr = resolvedAddr
-					}
-
-					// 保存当前状态，解锁后发送
-					savedPacket := *packet
-					savedUDPAddr := *udpAddr
-					savedConn := t.conn
-
-					// 在锁外执行发送操作
-					t.mux.Unlock()
-
-					// Set write deadline
-					writeTimeout := t.getWriteTimeout()
-					if writeTimeout > 0 {
-						savedConn.SetWriteDeadline(time.Now().Add(writeTimeout))
-					}
+				// 准备重传并计算下次重传时间
+				packet.retries++
+				packet.nextRetry = now.Add(t.calculateRetryInterval(packet.retries))
+				retransmissions = append(retransmissions, retransmission{data: packet.data, addr: udpAddr, congestion: packet.congestion})
+			}
+			conn := t.conn
+			t.mux.Unlock()
 
-					// 重传数据包
-					_, err := savedConn.WriteToUDP(savedPacket.data, &savedUDPAddr)
-					if err != nil {
-						// 发送失败，但继续保留在待确认列表中，下次可能会重试
-					}
+			packets := make([]outgoingDatagram, 0, len(retransmissions))
+			for _, r := range retransmissions {
+				// 超时重传视为丢包，重传也占用发送预算
+				if r.congestion != nil {
+					r.congestion.onLoss(now)
+					r.congestion.charge(len(r.data), now)
+				}
+				packets = append(packets, outgoingDatagram{data: r.data, addr: r.addr})
+				t.stats.retransmitted(r.addr, 1)
+			}
+			// 发送失败时保留在待确认列表中，下次可能会重试
+			t.writePackets(conn, packets)
 
-					// 重新加锁继续处理其他数据包
-					t.mux.Lock()
+			for _, packet := range failed {
+				t.stats.gaveUp(packet.dstAddr)
+				if packet.congestion != nil {
+					packet.congestion.onDrop(len(packet.data))
 				}
+				if udpAddr, ok := packet.dstAddr.(*net.UDPAddr); ok {
+					t.pathMTUFailure(udpAddr, len(packet.data))
+				}
+				t.notifyDelivery(packet, DeliveryResult{
+					Err: NewTransportError(fmt.Sprintf("no ACK from %s after %d retries", packet.dstAddr, packet.retries), 3023, nil),
+				})
 			}
-			t.mux.Unlock()
 		}
 	}
 }
@@ -335,29 +506,43 @@ func (t *UDPTransport) Start(handler PacketHandler) error {
 	// Create context
 	t.ctx, t.cancel = context.WithCancel(context.Background())
 
-	// Bind UDP socket
-	conn, err := net.ListenUDP("udp", t.listenAddr)
-	if err != nil {
-		t.cancel()
-		return NewTransportError("failed to bind UDP port", 3001, err)
+	// Bind UDP socket, reusing the socket already bound by Init
+	if t.conn == nil {
+		addrs := t.boundAddrs
+		if len(addrs) == 0 {
+			addrs = []*net.UDPAddr{t.listenAddr}
+		}
+		if err := t.bindSockets(addrs); err != nil {
+			t.cancel()
+			return err
+		}
 	}
+	t.setLocalAddr(t.conn.LocalAddr())
 
-	t.conn = conn
-	t.setLocalAddr(conn.LocalAddr())
-
-	// 包装原始处理器以处理ACK和数据
-	wrappedHandler := t.wrapPacketHandler(handler)
+	// 包装原始处理器以处理认证信封、ACK和数据
+	wrappedHandler := t.authenticateNodes(t.wrapPacketHandler(t.nodeHandler(handler)))
 
 	// Set handler and state
 	if err := t.BaseTransport.Start(wrappedHandler); err != nil {
-		t.conn.Close()
+		t.closeSockets()
+		t.conn = nil
 		t.cancel()
 		return err
 	}
 
-	// Start receive loop
-	t.wg.Add(1)
-	go t.receiveLoop()
+	// Start the handler workers and one receive loop per bound socket
+	t.buffers = newBufferPool(t.bufferSize)
+	t.startWorkers()
+	t.sockMu.RLock()
+	for _, socket := range t.sockets {
+		t.wg.Add(1)
+		if socket.batch != nil {
+			go t.receiveBatchLoop(socket)
+		} else {
+			go t.receiveLoop(socket)
+		}
+	}
+	t.sockMu.RUnlock()
 
 	// Start retransmission manager if ACK handling is enabled
 	if t.ackHandlerEnabled {
@@ -365,6 +550,24 @@ func (t *UDPTransport) Start(handler PacketHandler) error {
 		go t.retransmissionManager()
 	}
 
+	// 滑动窗口模式使用独立的RTO定时器
+	if t.windowed {
+		t.wg.Add(1)
+		go t.windowTimerLoop()
+	}
+
+	// 路径MTU探测
+	if t.pmtuActive() {
+		t.wg.Add(1)
+		go t.pmtuLoop()
+	}
+
+	// 前向纠错的校验包补发和接收组超时
+	if t.fecActive() {
+		t.wg.Add(1)
+		go t.fecLoop()
+	}
+
 	return nil
 }
 
@@ -379,18 +582,48 @@ func (t *UDPTransport) Stop() error {
 		t.cancel()
 	}
 
-	// 等待所有goroutine退出
+	// 先关闭UDP连接以唤醒阻塞在读操作上的接收循环
+	closeErr := t.closeSockets()
+
+	// 等待所有goroutine退出，再处理完已分派给处理协程的数据报
 	t.wg.Wait()
+	t.stopWorkers()
+	t.conn = nil
 
-	// 关闭UDP连接
-	if t.conn != nil {
-		if err := t.conn.Close(); err != nil {
-			return err
-		}
-		t.conn = nil
+	// 尚未确认的数据包不会再重传，通知其投递失败
+	t.mux.Lock()
+	abandoned := make([]*pendingPacket, 0, len(t.pendingPackets))
+	for packetID, packet := range t.pendingPackets {
+		abandoned = append(abandoned, packet)
+		delete(t.pendingPackets, packetID)
 	}
+	t.mux.Unlock()
 
-	return nil
+	for _, packet := range abandoned {
+		t.notifyDelivery(packet, DeliveryResult{
+			Err: NewTransportError("transport stopped before delivery was confirmed", 3024, nil),
+		})
+	}
+	t.failWindows()
+
+	t.congestionMu.Lock()
+	t.congestion = make(map[string]*congestionController)
+	t.congestionMu.Unlock()
+
+	t.pmtuMu.Lock()
+	t.pmtuPaths = make(map[string]*pathMTU)
+	t.fragments = make(map[string]*fragmentBuffer)
+	t.fragmentOrder = list.New()
+	t.fragmentSources = make(map[string]int)
+	t.pmtuMu.Unlock()
+
+	t.fecMu.Lock()
+	t.fecSenders = make(map[string]*fecSender)
+	t.fecReceivers = make(map[string]*fecReceiver)
+	t.fecReceiverOrder = newLRUKeys()
+	t.fecMu.Unlock()
+
+	return closeErr
 }
 
 // packetType 定义数据包类型
@@ -399,9 +632,68 @@ const (
 	packetTypeACK
 )
 
+// packetTypeUnreliable 不需要确认的数据包：类型(1字节) + 帧（加密标志 + [nonce] + 数据）
+// 仅在启用ACK处理或滑动窗口模式时使用，其他模式下所有数据包本来就不需要确认
+const packetTypeUnreliable uint8 = 4
+
 // wrapPacketHandler 包装原始处理器以处理ACK和数据，支持加密数据包的解密
 func (t *UDPTransport) wrapPacketHandler(originalHandler PacketHandler) PacketHandler {
-	return func(srcAddr net.Addr, data []byte) error {
+	var wrapped PacketHandler
+	wrapped = func(srcAddr net.Addr, data []byte) error {
+		// 不属于传输层协议的数据报（如STUN）
+		if t.handleRaw(srcAddr, data) {
+			return nil
+		}
+
+		// 分片和路径MTU探测
+		if t.pmtuActive() && len(data) > 0 {
+			switch data[0] {
+			case packetTypeFragment:
+				// 重组完成的数据包重新经过本处理器
+				return t.handleFragment(srcAddr, data, wrapped)
+			case packetTypePMTUProbe:
+				t.handlePMTUProbe(srcAddr, data)
+				return nil
+			case packetTypePMTUProbeAck:
+				t.handlePMTUProbeAck(srcAddr, data)
+				return nil
+			}
+		}
+
+		// 不需要确认的数据包
+		if (t.windowed || t.ackHandlerEnabled) && len(data) > 0 && data[0] == packetTypeUnreliable {
+			payload, err := t.openFrame(srcAddr.String(), data[1:])
+			if err != nil {
+				t.frameFailed(srcAddr, data[1:])
+				return err
+			}
+			return originalHandler(srcAddr, payload)
+		}
+
+		// 前向纠错的数据包、校验包和丢包报告，未启用FEC的一端也能接收
+		if (t.windowed || t.ackHandlerEnabled) && len(data) > 0 {
+			switch data[0] {
+			case packetTypeFECData:
+				return t.handleFECData(srcAddr, data, originalHandler)
+			case packetTypeFECParity:
+				return t.handleFECParity(srcAddr, data, originalHandler)
+			case packetTypeFECReport:
+				t.handleFECReport(srcAddr, data)
+				return nil
+			}
+		}
+
+		// 滑动窗口模式的数据包和SACK
+		if t.windowed && len(data) > 0 {
+			switch data[0] {
+			case packetTypeWindowData:
+				return t.handleWindowData(srcAddr, data, originalHandler)
+			case packetTypeSACK:
+				t.handleSACK(srcAddr, data)
+				return nil
+			}
+		}
+
 		// 处理启用了ACK的情况
 		if t.ackHandlerEnabled {
 			// 如果数据长度小于5（1字节类型+4字节序列号），直接传递给原始处理器
@@ -445,30 +737,32 @@ func (t *UDPTransport) wrapPacketHandler(originalHandler PacketHandler) PacketHa
 
 					// 解密数据（如果需要）
 					if isEncrypted && len(actualData) > 0 && nonce != nil {
-						// 获取对等节点公钥
-						t.cryptoMux.RLock()
-						peerKey, exists := t.peerKeys[srcAddr.String()]
-						t.cryptoMux.RUnlock()
-
-						if exists && len(peerKey) == curve25519.PointSize {
-							// 派生共享密钥
-							sharedSecret, err := crypto.DeriveSharedSecret(t.keyPair.Private, peerKey)
+						decrypted := false
+						// 按密钥类型派生会话密钥
+						decryptionKey, ok, err := t.deriveSessionKey(srcAddr.String())
+						if ok && err == nil {
+							// 解密数据
+							decryptedData, err := crypto.DecryptSalsa2012(actualData, decryptionKey, nonce)
 							if err == nil {
-								// 使用共享密钥的前32字节进行解密
-								decryptionKey := sharedSecret[:32]
-
-								// 解密数据
-								decryptedData, err := crypto.DecryptSalsa2012(actualData, decryptionKey, nonce)
-								if err == nil {
-									actualData = decryptedData
-								}
+								actualData = decryptedData
+								decrypted = true
 							}
 						}
+						if !decrypted {
+							// 无法解密的数据包不ACK，也不记录序列号，避免伪造的数据包推进重复检测窗口
+							t.stats.decryptFailed(srcAddr)
+							return nil
+						}
 					}
 
-					// 发送ACK
+					// 发送ACK（重复数据包也要ACK，因为对端可能没收到上一次的ACK）
 					t.sendACK(srcAddr, sequenceNum)
 
+					// 重传产生的重复数据包不再交付
+					if !t.replay.accept(srcAddr.String(), sequenceNum, func() bool { return t.admitSource(srcAddr) }) {
+						return nil
+					}
+
 					// 调用原始处理器处理实际数据
 					return originalHandler(srcAddr, actualData)
 				}
@@ -484,30 +778,22 @@ func (t *UDPTransport) wrapPacketHandler(originalHandler PacketHandler) PacketHa
 				nonce := data[1:9]
 				encryptedData := data[9:]
 
-				// 获取对等节点公钥
-				t.cryptoMux.RLock()
-				peerKey, exists := t.peerKeys[srcAddr.String()]
-				t.cryptoMux.RUnlock()
-
-				if exists && len(peerKey) == curve25519.PointSize {
-					// 派生共享密钥
-					sharedSecret, err := crypto.DeriveSharedSecret(t.keyPair.Private, peerKey)
+				// 按密钥类型派生会话密钥
+				decryptionKey, ok, err := t.deriveSessionKey(srcAddr.String())
+				if ok && err == nil {
+					// 解密数据
+					decryptedData, err := crypto.DecryptSalsa2012(encryptedData, decryptionKey, nonce)
 					if err == nil {
-						// 使用共享密钥的前32字节进行解密
-						decryptionKey := sharedSecret[:32]
-
-						// 解密数据
-						decryptedData, err := crypto.DecryptSalsa2012(encryptedData, decryptionKey, nonce)
-						if err == nil {
-							return originalHandler(srcAddr, decryptedData)
-						}
+						return originalHandler(srcAddr, decryptedData)
 					}
 				}
+				t.stats.decryptFailed(srcAddr)
 			}
 		}
 
 		return originalHandler(srcAddr, data)
 	}
+	return wrapped
 }
 
 // generatePacketID 为数据包生成唯一ID
@@ -531,10 +817,76 @@ func (t *UDPTransport) calculateRetryInterval(retries int) time.Duration {
 
 // Send sends a UDP packet with timeout, retransmission and encryption support
 func (t *UDPTransport) Send(dstAddr net.Addr, data []byte) error {
+	return t.send(dstAddr, data, nil)
+}
+
+// SendWithResult 发送数据包并返回投递结果通道
+// 收到ACK或放弃重传时，通道中会收到恰好一个结果；需要启用ACK处理
+func (t *UDPTransport) SendWithResult(dstAddr net.Addr, data []byte) (<-chan DeliveryResult, error) {
+	if !t.ackHandlerEnabled && !t.windowed {
+		return nil, NewTransportError("delivery results require ACK handling", 3022, nil)
+	}
+
+	result := make(chan DeliveryResult, 1)
+	if err := t.send(dstAddr, data, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// SendUnreliable 发送不需要确认、不会重传的数据包，适用于游戏状态等过时即无用的数据
+// 与可靠数据共享同一对等节点的发送节奏预算，但不占用拥塞窗口；启用FEC时按组附带校验包
+func (t *UDPTransport) SendUnreliable(dstAddr net.Addr, data []byte) error {
+	if t.isTestMode || (!t.ackHandlerEnabled && !t.windowed) {
+		return t.send(dstAddr, data, nil)
+	}
+
+	if t.isClosed() {
+		return NewTransportError("transport is closed", 3002, nil)
+	}
+
+	dstAddr, err := t.resolveNodeAddr(dstAddr)
+	if err != nil {
+		return err
+	}
+	udpAddr, ok := dstAddr.(*net.UDPAddr)
+	if !ok {
+		resolvedAddr, err := net.ResolveUDPAddr("udp", dstAddr.String())
+		if err != nil {
+			return NewTransportError("invalid destination address", 3003, err)
+		}
+		udpAddr = resolvedAddr
+	}
+
+	frame, err := t.sealFrame(udpAddr.String(), data)
+	if err != nil {
+		return err
+	}
+	if t.fecActive() {
+		return t.sendFEC(udpAddr, frame)
+	}
+	packetData := make([]byte, 1+len(frame))
+	packetData[0] = packetTypeUnreliable
+	copy(packetData[1:], frame)
+
+	if err := t.admit(t.getCongestion(udpAddr), len(packetData), false); err != nil {
+		return err
+	}
+	if err := t.writePacket(t.conn, packetData, udpAddr); err != nil {
+		return NewTransportError("failed to send UDP packet", 3005, err)
+	}
+	return nil
+}
+
+// send 发送数据包，启用ACK处理时将结果通道记录到待确认数据包中
+func (t *UDPTransport) send(dstAddr net.Addr, data []byte, result chan DeliveryResult) error {
 	// 为测试模式添加特殊处理
 	if t.isTestMode {
 		// 在测试模式下，我们不实际发送数据，而是模拟成功
 		// 这可以让加密测试在不依赖网络的情况下运行
+		if result != nil {
+			result <- DeliveryResult{DstAddr: dstAddr, Delivered: true}
+		}
 		return nil
 	}
 
@@ -542,6 +894,12 @@ func (t *UDPTransport) Send(dstAddr net.Addr, data []byte) error {
 		return NewTransportError("transport is closed", 3002, nil)
 	}
 
+	// 按节点地址发送时使用节点当前的端点
+	dstAddr, err := t.resolveNodeAddr(dstAddr)
+	if err != nil {
+		return err
+	}
+
 	// Resolve UDP address
 	udpAddr, ok := dstAddr.(*net.UDPAddr)
 	if !ok {
@@ -552,6 +910,11 @@ func (t *UDPTransport) Send(dstAddr net.Addr, data []byte) error {
 		udpAddr = resolvedAddr
 	}
 
+	// 滑动窗口模式
+	if t.windowed {
+		return t.sendWindowed(udpAddr, data, result)
+	}
+
 	var packetData []byte
 	var sequenceNum uint32 = 0
 	var nonce []byte
@@ -562,11 +925,16 @@ func (t *UDPTransport) Send(dstAddr net.Addr, data []byte) error {
 		t.mux.Lock()
 		sequenceNum = t.nextSequenceNum
 		t.nextSequenceNum++
+		// 回绕时跳过0
+		if t.nextSequenceNum == 0 {
+			t.nextSequenceNum = 1
+		}
 		t.mux.Unlock()
 	}
 
 	// 处理加密
 	payload := data
+	encrypted := false
 	if t.enableEncryption {
 		// 生成nonce
 		nonce = make([]byte, 8)
@@ -574,22 +942,14 @@ func (t *UDPTransport) Send(dstAddr net.Addr, data []byte) error {
 			return NewTransportError("failed to generate nonce", 3008, err)
 		}
 
-		// 获取对等节点公钥
-		t.cryptoMux.RLock()
-		peerKey, exists := t.peerKeys[dstAddr.String()]
-		t.cryptoMux.RUnlock()
+		// 按密钥类型派生会话密钥
+		encryptionKey, ok, err := t.deriveSessionKey(dstAddr.String())
+		if err != nil {
+			return NewTransportError("failed to derive shared secret", 3009, err)
+		}
 
 		// 如果有对等节点公钥，则加密数据
-		if exists && len(peerKey) == curve25519.PointSize {
-			// 派生共享密钥
-			sharedSecret, err := crypto.DeriveSharedSecret(t.keyPair.Private, peerKey)
-			if err != nil {
-				return NewTransportError("failed to derive shared secret", 3009, err)
-			}
-
-			// 使用共享密钥的前32字节进行加密
-			encryptionKey := sharedSecret[:32]
-
+		if ok {
 			// 加密数据
 			encryptedData, err := crypto.EncryptSalsa2012(data, encryptionKey, nonce)
 			if err != nil {
@@ -597,13 +957,14 @@ func (t *UDPTransport) Send(dstAddr net.Addr, data []byte) error {
 			}
 
 			payload = encryptedData
+			encrypted = true
 		}
 	}
 
 	// 构建数据包
 	if t.ackHandlerEnabled {
-		// 添加加密标志和nonce信息
-		if t.enableEncryption && nonce != nil {
+		// 只有实际加密的数据才携带加密标志和nonce，对端据此统计解密失败
+		if encrypted {
 			// 数据包格式：类型(1字节) + 序列号(4字节) + 加密标志(1字节) + 非ce(8字节) + 数据
 			packetData = make([]byte, len(payload)+14)
 			packetData[0] = packetTypeData
@@ -619,8 +980,8 @@ func (t *UDPTransport) Send(dstAddr net.Addr, data []byte) error {
 			copy(packetData[5:], payload)
 		}
 	} else {
-		// 不启用ACK处理
-		if t.enableEncryption && nonce != nil {
+		// 不启用ACK处理，只有实际加密的数据才携带加密头
+		if encrypted {
 			// 数据包格式：加密标志(1字节) + nonce(8字节) + 数据
 			packetData = make([]byte, len(payload)+9)
 			packetData[0] = 0x01 // 加密标志
@@ -632,19 +993,14 @@ func (t *UDPTransport) Send(dstAddr net.Addr, data []byte) error {
 		}
 	}
 
-	// Set write deadline
-	writeTimeout := t.getWriteTimeout()
-	if writeTimeout > 0 {
-		t.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
-	}
-
-	// Send data
-	_, err := t.conn.WriteToUDP(packetData, udpAddr)
-	if err != nil {
-		return NewTransportError("failed to send UDP packet", 3005, err)
+	// 等待拥塞窗口和发送节奏许可，只有需要ACK的数据包占用拥塞窗口
+	congestion := t.getCongestion(udpAddr)
+	if err := t.admit(congestion, len(packetData), t.ackHandlerEnabled); err != nil {
+		return err
 	}
 
-	// 如果启用了ACK处理，添加到待确认列表
+	// 如果启用了ACK处理，先加入待确认列表，避免ACK早于登记到达
+	var packetID string
 	if t.ackHandlerEnabled {
 		now := time.Now()
 		nextRetry := now.Add(t.retryInterval)
@@ -657,23 +1013,181 @@ func (t *UDPTransport) Send(dstAddr net.Addr, data []byte) error {
 			sendTime:    now,
 			nextRetry:   nextRetry,
 			nonce:       nonce, // 保存nonce用于重传
+			result:      result,
+			congestion:  congestion,
 		}
 
 		// 添加到待处理列表
-		packetID := t.generatePacketID(dstAddr, sequenceNum)
+		packetID = t.generatePacketID(dstAddr, sequenceNum)
 		t.mux.Lock()
 		t.pendingPackets[packetID] = packet
 		t.mux.Unlock()
 	}
 
+	// Send data
+	err = t.writePacket(t.conn, packetData, udpAddr)
+	if err != nil {
+		// 发送失败直接返回错误，不再等待ACK
+		if t.ackHandlerEnabled {
+			t.mux.Lock()
+			delete(t.pendingPackets, packetID)
+			t.mux.Unlock()
+			congestion.onDrop(len(packetData))
+		}
+		return NewTransportError("failed to send UDP packet", 3005, err)
+	}
+
+	return nil
+}
+
+// writePacket 向指定地址写出一个完整的数据包，启用路径MTU探测且超过路径MTU时拆分为多个分片
+func (t *UDPTransport) writePacket(conn *net.UDPConn, data []byte, udpAddr *net.UDPAddr) error {
+	if t.pmtuSending() {
+		if limit := t.maxDatagramSize(udpAddr); len(data) > limit {
+			return t.writeFragments(conn, data, udpAddr, limit)
+		}
+	}
+	return t.writeDatagram(conn, data, udpAddr)
+}
+
+// writeDatagram 向指定地址写出一个UDP数据包，发往已登记节点时加上认证信封
+func (t *UDPTransport) writeDatagram(conn *net.UDPConn, data []byte, udpAddr *net.UDPAddr) error {
+	return t.writeLink(conn, t.sealEnvelope(udpAddr, data), udpAddr)
+}
+
+// writeLink 向指定地址原样写出一个UDP数据包
+// 设置了链路写出钩子时，由钩子决定何时以及是否真正写出
+func (t *UDPTransport) writeLink(conn *net.UDPConn, data []byte, udpAddr *net.UDPAddr) error {
+	write := func(packet []byte) error {
+		return t.writeTo(conn, packet, udpAddr)
+	}
+
+	t.mux.RLock()
+	linkWriter := t.linkWriter
+	t.mux.RUnlock()
+
+	if linkWriter != nil {
+		return linkWriter(udpAddr, data, write)
+	}
+	return write(data)
+}
+
+// configureSocket 在启用路径MTU探测时设置DF位，失败时探测结果可能偏乐观但不影响收发
+func (t *UDPTransport) configureSocket(conn *net.UDPConn) {
+	if t.pmtuSending() {
+		setDontFragment(conn)
+	}
+}
+
+// SetHandshakeGuard 设置按来源限速：为新来源创建接收窗口、重复检测、FEC和回复路径状态前
+// 都要经过它，伪造来源的洪泛只能按速率创建状态；传入nil关闭限速
+// 可以与发现和会合管理器共用同一个防护
+func (t *UDPTransport) SetHandshakeGuard(guard *HandshakeGuard) {
+	t.guardMu.Lock()
+	t.guard = guard
+	t.guardMu.Unlock()
+}
+
+// admitSource 判断是否允许为来自 addr 的新来源创建状态
+func (t *UDPTransport) admitSource(addr net.Addr) bool {
+	t.guardMu.RLock()
+	guard := t.guard
+	t.guardMu.RUnlock()
+	return guard == nil || guard.Allow(addr)
+}
+
+// SetLinkWriter 设置链路写出钩子，传入nil恢复直接写出
+func (t *UDPTransport) SetLinkWriter(writer LinkWriteFunc) {
+	t.mux.Lock()
+	t.linkWriter = writer
+	t.mux.Unlock()
+}
+
+// SendRaw 不加传输层头部、不加密地写出一个数据报，与普通数据共用套接字
+func (t *UDPTransport) SendRaw(dstAddr net.Addr, data []byte) error {
+	if t.isTestMode {
+		return nil
+	}
+	if t.isClosed() {
+		return NewTransportError("transport is closed", 3002, nil)
+	}
+
+	udpAddr, ok := dstAddr.(*net.UDPAddr)
+	if !ok {
+		resolvedAddr, err := net.ResolveUDPAddr("udp", dstAddr.String())
+		if err != nil {
+			return NewTransportError("invalid destination address", 3003, err)
+		}
+		udpAddr = resolvedAddr
+	}
+
+	if err := t.writeLink(t.conn, data, udpAddr); err != nil {
+		return NewTransportError("failed to send UDP packet", 3005, err)
+	}
 	return nil
 }
 
-// receiveLoop handles incoming packets
-func (t *UDPTransport) receiveLoop() {
+// AddRawHandler 注册原始数据报处理器，处理器返回true表示已消费该数据报
+func (t *UDPTransport) AddRawHandler(handler RawHandler) {
+	t.mux.Lock()
+	t.rawHandlers = append(t.rawHandlers, handler)
+	t.mux.Unlock()
+}
+
+// handleRaw 依次调用原始数据报处理器，返回数据报是否已被消费
+func (t *UDPTransport) handleRaw(srcAddr net.Addr, data []byte) bool {
+	t.mux.RLock()
+	handlers := t.rawHandlers
+	t.mux.RUnlock()
+
+	for _, handler := range handlers {
+		if handler(srcAddr, data) {
+			return true
+		}
+	}
+	return false
+}
+
+// 读取出错后的退避时间范围
+const (
+	receiveErrorMinBackoff = 5 * time.Millisecond
+	receiveErrorMaxBackoff = time.Second
+)
+
+// receiveErrorBackoff 处理接收循环的读取错误，返回循环是否应该继续
+// 超时立即重试；传输停止或套接字已关闭时退出；其他错误按指数退避等待，
+// 避免持续出错的套接字让接收循环空转占满CPU
+func (t *UDPTransport) receiveErrorBackoff(err error, backoff *time.Duration) bool {
+	if t.ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+		return false
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+
+	if *backoff == 0 {
+		*backoff = receiveErrorMinBackoff
+	} else if *backoff *= 2; *backoff > receiveErrorMaxBackoff {
+		*backoff = receiveErrorMaxBackoff
+	}
+	timer := time.NewTimer(*backoff)
+	defer timer.Stop()
+	select {
+	case <-t.ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// receiveLoop handles incoming packets one read at a time
+func (t *UDPTransport) receiveLoop(socket *udpSocket) {
 	defer t.wg.Done()
-	buffer := make([]byte, t.bufferSize)
+	buffer := t.getBuffer()
+	defer func() { t.buffers.Put(buffer) }()
+	oob := make([]byte, 128)
 
+	var backoff time.Duration
 	for {
 		select {
 		case <-t.ctx.Done():
@@ -682,32 +1196,37 @@ func (t *UDPTransport) receiveLoop() {
 			// Set read deadline
 			readTimeout := t.getReadTimeout()
 			if readTimeout > 0 {
-				t.conn.SetReadDeadline(time.Now().Add(readTimeout))
+				socket.conn.SetReadDeadline(time.Now().Add(readTimeout))
 			} else {
-				t.conn.SetReadDeadline(time.Time{})
+				socket.conn.SetReadDeadline(time.Time{})
 			}
 
-			// Read packet
-			n, addr, err := t.conn.ReadFromUDP(buffer)
+			// Read packet, with its destination address on wildcard sockets
+			var n int
+			var addr *net.UDPAddr
+			var localIP net.IP
+			var err error
+			if socket.pktinfo {
+				var oobn int
+				n, oobn, _, addr, err = socket.conn.ReadMsgUDP(*buffer, oob)
+				if err == nil {
+					localIP = parsePacketInfo(oob[:oobn])
+				}
+			} else {
+				n, addr, err = socket.conn.ReadFromUDP(*buffer)
+			}
 			if err != nil {
-				// Handle timeouts
-				if netErr, ok := err.(net.Error); ok && (netErr.Timeout() || t.ctx.Err() != nil) {
-					continue
+				// Timeouts retry at once; other errors back off, and a closed socket ends the loop
+				if !t.receiveErrorBackoff(err, &backoff) {
+					return
 				}
-				// Other errors may indicate a serious problem
-				// Just log the error for now as handler only takes addr and data
 				continue
 			}
+			backoff = 0
 
-			if n > 0 {
-				// Copy data and call handler
-				data := make([]byte, n)
-				copy(data, buffer[:n])
-
-				handler := t.getHandler()
-				if handler != nil {
-					handler(addr, data)
-				}
+			// Hand the packet to the handler; a borrowed buffer is replaced
+			if t.deliverDatagram(socket, addr, localIP, buffer, n) {
+				buffer = t.getBuffer()
 			}
 		}
 	}
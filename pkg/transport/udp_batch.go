@@ -0,0 +1,232 @@
+package transport
+
+import (
+	"net"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultBatchSize 是每次 recvmmsg/sendmmsg 系统调用收发的最大数据报数
+	defaultBatchSize = 32
+
+	// handlerQueueSize 是每个处理协程的队列长度，队列满时接收循环等待，由套接字缓冲区承担突发
+	handlerQueueSize = 256
+)
+
+// udpDatagram 是等待处理器处理的数据报
+type udpDatagram struct {
+	addr *net.UDPAddr
+	data []byte
+	// buf 是借出的接收缓冲区，处理器返回后归还缓冲池；复制模式下为nil
+	buf *[]byte
+}
+
+// outgoingDatagram 是等待写出的数据报
+type outgoingDatagram struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+// handlerPool 是处理收到的数据报的工作协程池
+// 同一源地址的数据报总是由同一个协程按到达顺序处理
+type handlerPool struct {
+	queues []chan udpDatagram
+	wg     sync.WaitGroup
+}
+
+// configureBatching 应用批量收发、缓冲区借出和处理协程数配置
+func (t *UDPTransport) configureBatching(config UDPConfig) {
+	t.batchSize = config.BatchSize
+	t.handlerWorkers = config.HandlerWorkers
+	t.borrowBuffers = config.BorrowBuffers
+}
+
+// defaultHandlerWorkers 返回默认的处理协程数
+func defaultHandlerWorkers() int {
+	return runtime.GOMAXPROCS(0)
+}
+
+// newBufferPool 创建接收缓冲区池，每个缓冲区可以容纳一个最大的数据报
+func newBufferPool(size int) *sync.Pool {
+	return &sync.Pool{New: func() interface{} {
+		buffer := make([]byte, size)
+		return &buffer
+	}}
+}
+
+// getBuffer 从缓冲池取出一个接收缓冲区
+func (t *UDPTransport) getBuffer() *[]byte {
+	return t.buffers.Get().(*[]byte)
+}
+
+// startWorkers 启动处理协程，handlerWorkers 为0时在接收循环中直接调用处理器
+func (t *UDPTransport) startWorkers() {
+	if t.handlerWorkers == 0 {
+		t.workers = nil
+		return
+	}
+
+	pool := &handlerPool{queues: make([]chan udpDatagram, t.handlerWorkers)}
+	for i := range pool.queues {
+		queue := make(chan udpDatagram, handlerQueueSize)
+		pool.queues[i] = queue
+		pool.wg.Add(1)
+		go func() {
+			defer pool.wg.Done()
+			for datagram := range queue {
+				t.handleDatagram(datagram)
+			}
+		}()
+	}
+	t.workers = pool
+}
+
+// stopWorkers 处理完队列中剩余的数据报后停止处理协程，调用前接收循环必须已经退出
+func (t *UDPTransport) stopWorkers() {
+	pool := t.workers
+	if pool == nil {
+		return
+	}
+	t.workers = nil
+	for _, queue := range pool.queues {
+		close(queue)
+	}
+	pool.wg.Wait()
+}
+
+// queueFor 按源地址选择处理协程，使同一对等节点的数据报保持顺序
+func (p *handlerPool) queueFor(addr *net.UDPAddr) chan udpDatagram {
+	hash := uint32(addr.Port)
+	for _, b := range addr.IP {
+		hash = hash*31 + uint32(b)
+	}
+	return p.queues[hash%uint32(len(p.queues))]
+}
+
+// deliverDatagram 记录回复路径和统计后把数据报交给处理器
+// 返回 true 表示 buf 已借给处理器，调用方需要换一个新的缓冲区
+func (t *UDPTransport) deliverDatagram(socket *udpSocket, addr *net.UDPAddr, localIP net.IP, buf *[]byte, n int) bool {
+	// 空数据报也要交付，连接层用它作为保活包
+	t.recordReplyPath(socket, addr, localIP)
+	t.stats.received(addr, n)
+
+	datagram := udpDatagram{addr: addr}
+	if t.borrowBuffers {
+		datagram.data = (*buf)[:n]
+		datagram.buf = buf
+	} else {
+		datagram.data = make([]byte, n)
+		copy(datagram.data, (*buf)[:n])
+	}
+
+	if t.workers != nil {
+		t.workers.queueFor(addr) <- datagram
+	} else {
+		t.handleDatagram(datagram)
+	}
+	return datagram.buf != nil
+}
+
+// handleDatagram 调用处理器并归还借出的缓冲区
+func (t *UDPTransport) handleDatagram(datagram udpDatagram) {
+	if handler := t.getHandler(); handler != nil {
+		handler(datagram.addr, datagram.data)
+	}
+	if datagram.buf != nil {
+		t.buffers.Put(datagram.buf)
+	}
+}
+
+// writePackets 写出一组完整的数据包，超过路径MTU的数据包拆分为分片，其余的批量写出
+func (t *UDPTransport) writePackets(conn *net.UDPConn, packets []outgoingDatagram) error {
+	var firstErr error
+	batch := make([]outgoingDatagram, 0, len(packets))
+	for _, packet := range packets {
+		if t.pmtuSending() {
+			if limit := t.maxDatagramSize(packet.addr); len(packet.data) > limit {
+				if err := t.writeFragments(conn, packet.data, packet.addr, limit); err != nil && firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+		}
+		batch = append(batch, packet)
+	}
+	if err := t.writeDatagrams(conn, batch); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// writeDatagrams 写出一组数据报，支持批量写出的套接字上每次系统调用写出最多 batchSize 个
+// 设置了链路写出钩子时逐个经由钩子写出；返回第一个错误，其余数据报仍会尝试写出
+func (t *UDPTransport) writeDatagrams(fallback *net.UDPConn, datagrams []outgoingDatagram) error {
+	t.mux.RLock()
+	linkWriter := t.linkWriter
+	t.mux.RUnlock()
+
+	var firstErr error
+	record := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if linkWriter != nil || t.batchSize <= 1 || len(datagrams) < 2 {
+		for _, datagram := range datagrams {
+			record(t.writeDatagram(fallback, datagram.data, datagram.addr))
+		}
+		return firstErr
+	}
+
+	// 按选定的套接字分组，不支持批量写出的逐个写出
+	// 批量写出无法在双栈套接字上使用IPv4映射地址，这些数据报也逐个写出
+	type socketBatch struct {
+		socket    *udpSocket
+		datagrams []outgoingDatagram
+		oobs      [][]byte
+	}
+	var batches []*socketBatch
+	for _, datagram := range datagrams {
+		datagram.data = t.sealEnvelope(datagram.addr, datagram.data)
+		socket, localIP := t.selectSocket(datagram.addr)
+		if socket == nil || socket.batch == nil || (!socket.isIPv4() && datagram.addr.IP.To4() != nil) {
+			record(t.writeTo(fallback, datagram.data, datagram.addr))
+			continue
+		}
+
+		var batch *socketBatch
+		for _, b := range batches {
+			if b.socket == socket {
+				batch = b
+				break
+			}
+		}
+		if batch == nil {
+			batch = &socketBatch{socket: socket}
+			batches = append(batches, batch)
+		}
+		batch.datagrams = append(batch.datagrams, datagram)
+		batch.oobs = append(batch.oobs, t.packetInfoFor(socket, localIP))
+	}
+
+	for _, batch := range batches {
+		if writeTimeout := t.getWriteTimeout(); writeTimeout > 0 {
+			batch.socket.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		}
+		for start := 0; start < len(batch.datagrams); start += t.batchSize {
+			end := start + t.batchSize
+			if end > len(batch.datagrams) {
+				end = len(batch.datagrams)
+			}
+			sent, err := batch.socket.batch.writeBatch(batch.datagrams[start:end], batch.oobs[start:end])
+			for _, datagram := range batch.datagrams[start : start+sent] {
+				t.stats.sent(datagram.addr, len(datagram.data))
+			}
+			record(err)
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,112 @@
+//go:build linux
+
+package transport
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// batchPacketConn 是 ipv4.PacketConn 和 ipv6.PacketConn 共有的批量收发方法
+// 两者的 Message 是同一类型，Linux上分别对应 recvmmsg 和 sendmmsg
+type batchPacketConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// batchConn 在一个UDP套接字上批量收发数据报
+type batchConn struct {
+	conn batchPacketConn
+}
+
+// newBatchConn 为套接字创建批量收发包装，ipv4 表示套接字的地址族
+func newBatchConn(conn *net.UDPConn, ipv4Socket bool) *batchConn {
+	if ipv4Socket {
+		return &batchConn{conn: ipv4.NewPacketConn(conn)}
+	}
+	return &batchConn{conn: ipv6.NewPacketConn(conn)}
+}
+
+// writeBatch 用尽量少的 sendmmsg 调用写出数据报，返回成功写出的个数
+func (b *batchConn) writeBatch(datagrams []outgoingDatagram, oobs [][]byte) (int, error) {
+	messages := make([]ipv4.Message, len(datagrams))
+	for i, datagram := range datagrams {
+		messages[i].Buffers = [][]byte{datagram.data}
+		messages[i].Addr = datagram.addr
+		messages[i].OOB = oobs[i]
+	}
+
+	sent := 0
+	for sent < len(messages) {
+		n, err := b.conn.WriteBatch(messages[sent:], 0)
+		sent += n
+		if err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// receiveBatchLoop 用 recvmmsg 每次读取最多 batchSize 个数据报
+func (t *UDPTransport) receiveBatchLoop(socket *udpSocket) {
+	defer t.wg.Done()
+
+	messages := make([]ipv4.Message, t.batchSize)
+	buffers := make([]*[]byte, t.batchSize)
+	for i := range messages {
+		buffers[i] = t.getBuffer()
+		messages[i].Buffers = [][]byte{*buffers[i]}
+		if socket.pktinfo {
+			messages[i].OOB = make([]byte, 128)
+		}
+	}
+	defer func() {
+		for _, buffer := range buffers {
+			t.buffers.Put(buffer)
+		}
+	}()
+
+	var backoff time.Duration
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		default:
+		}
+
+		if readTimeout := t.getReadTimeout(); readTimeout > 0 {
+			socket.conn.SetReadDeadline(time.Now().Add(readTimeout))
+		} else {
+			socket.conn.SetReadDeadline(time.Time{})
+		}
+
+		n, err := socket.batch.conn.ReadBatch(messages, 0)
+		if err != nil {
+			if !t.receiveErrorBackoff(err, &backoff) {
+				return
+			}
+			continue
+		}
+		backoff = 0
+
+		for i := 0; i < n; i++ {
+			message := &messages[i]
+			addr, ok := message.Addr.(*net.UDPAddr)
+			if !ok {
+				continue
+			}
+			var localIP net.IP
+			if socket.pktinfo {
+				localIP = parsePacketInfo(message.OOB[:message.NN])
+			}
+
+			if t.deliverDatagram(socket, addr, localIP, buffers[i], message.N) {
+				buffers[i] = t.getBuffer()
+				message.Buffers[0] = *buffers[i]
+			}
+		}
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package transport
+
+import (
+	"errors"
+	"net"
+)
+
+// batchConn 在其他平台上不可用，套接字逐个收发数据报
+type batchConn struct{}
+
+// newBatchConn 在其他平台上返回nil
+func newBatchConn(conn *net.UDPConn, ipv4Socket bool) *batchConn {
+	return nil
+}
+
+// writeBatch 在其他平台上不可用
+func (b *batchConn) writeBatch(datagrams []outgoingDatagram, oobs [][]byte) (int, error) {
+	return 0, errors.New("batched writes are not supported on this platform")
+}
+
+// receiveBatchLoop 在其他平台上退回逐个读取
+func (t *UDPTransport) receiveBatchLoop(socket *udpSocket) {
+	t.receiveLoop(socket)
+}
@@ -0,0 +1,231 @@
+package transport
+
+import (
+	"net"
+	"time"
+)
+
+// replyPathIdleTimeout 是回复路径记录的空闲过期时间
+const replyPathIdleTimeout = 2 * time.Minute
+
+// replyPathMaxSources 是回复路径记录的条目上限，满时淘汰最久未用的记录
+const replyPathMaxSources = 4096
+
+// udpSocket 是一个已绑定的本地地址
+type udpSocket struct {
+	conn *net.UDPConn
+	addr *net.UDPAddr
+
+	// pktinfo 表示通配地址套接字已启用目的地址报告，回复时可以指定源地址
+	pktinfo bool
+
+	// batch 批量收发数据报，不支持或未启用批量收发时为nil
+	batch *batchConn
+}
+
+// replyPath 记录对等节点的数据包最近从哪个本地地址到达，回复从同一地址发出
+type replyPath struct {
+	socket   *udpSocket
+	localIP  net.IP // 通配地址套接字上数据包的目的地址，否则为nil
+	lastSeen time.Time
+}
+
+// isIPv4 判断套接字是否为IPv4套接字
+func (s *udpSocket) isIPv4() bool {
+	return s.addr.IP.To4() != nil
+}
+
+// configureBindAddrs 应用 bindAddrs 配置，配置已经过 Validate 检查
+func (t *UDPTransport) configureBindAddrs(config UDPConfig) {
+	t.bindAddrs, t.optionalBindAddrs, _ = parseBindAddrs(config.BindAddrs)
+}
+
+// bindSockets 绑定所有地址；端口为0的地址使用第一个套接字分配到的端口，使节点只有一个端口
+func (t *UDPTransport) bindSockets(addrs []*net.UDPAddr) error {
+	var sockets []*udpSocket
+	port := 0
+	for _, addr := range addrs {
+		bindAddr := &net.UDPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone}
+		if bindAddr.Port == 0 {
+			bindAddr.Port = port
+		}
+
+		// 未指定IP时使用双栈套接字，否则按地址族绑定，使 0.0.0.0 和 [::] 可以共用端口
+		network := "udp"
+		if bindAddr.IP.To4() != nil {
+			network = "udp4"
+		} else if bindAddr.IP != nil {
+			network = "udp6"
+		}
+		conn, err := net.ListenUDP(network, bindAddr)
+		if err != nil {
+			if t.optionalBindAddrs[addr.String()] {
+				continue
+			}
+			for _, s := range sockets {
+				s.conn.Close()
+			}
+			return NewTransportError("failed to bind UDP address "+bindAddr.String(), 3001, err)
+		}
+
+		socket := t.newSocket(conn)
+		if port == 0 {
+			port = socket.addr.Port
+		}
+		sockets = append(sockets, socket)
+	}
+
+	t.setSockets(sockets)
+	return nil
+}
+
+// newSocket 包装已绑定的连接并设置套接字选项
+func (t *UDPTransport) newSocket(conn *net.UDPConn) *udpSocket {
+	t.configureSocket(conn)
+	socket := &udpSocket{conn: conn, addr: conn.LocalAddr().(*net.UDPAddr)}
+	if socket.addr.IP == nil || socket.addr.IP.IsUnspecified() {
+		socket.pktinfo = enablePacketInfo(conn)
+	}
+	if t.batchSize > 1 {
+		socket.batch = newBatchConn(conn, socket.isIPv4())
+	}
+	return socket
+}
+
+// setSockets 设置已绑定的套接字，第一个套接字作为主套接字
+func (t *UDPTransport) setSockets(sockets []*udpSocket) {
+	t.sockMu.Lock()
+	t.sockets = sockets
+	t.replyPaths = make(map[string]*replyPath)
+	t.replyPathOrder = newLRUKeys()
+	t.sockMu.Unlock()
+
+	t.conn = sockets[0].conn
+	t.listenAddr = sockets[0].addr
+	t.boundAddrs = make([]*net.UDPAddr, len(sockets))
+	for i, s := range sockets {
+		t.boundAddrs[i] = s.addr
+	}
+}
+
+// closeSockets 关闭所有套接字
+func (t *UDPTransport) closeSockets() error {
+	t.sockMu.Lock()
+	sockets := t.sockets
+	t.sockets = nil
+	t.replyPaths = make(map[string]*replyPath)
+	t.replyPathOrder = newLRUKeys()
+	t.sockMu.Unlock()
+
+	var closeErr error
+	for _, s := range sockets {
+		if err := s.conn.Close(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+	return closeErr
+}
+
+// recordReplyPath 记录对等节点的数据包到达的本地地址
+// 只有一个普通套接字时没有选择余地，不需要记录；新来源未通过限速时不记录，
+// 回复按地址族选择套接字
+func (t *UDPTransport) recordReplyPath(socket *udpSocket, srcAddr *net.UDPAddr, localIP net.IP) {
+	key := srcAddr.String()
+	now := time.Now()
+
+	t.sockMu.RLock()
+	multiple := len(t.sockets) > 1
+	path, exists := t.replyPaths[key]
+	fresh := exists && path.socket == socket && path.localIP.Equal(localIP) && now.Sub(path.lastSeen) < time.Second
+	t.sockMu.RUnlock()
+	if (!multiple && !socket.pktinfo) || fresh || (!exists && !t.admitSource(srcAddr)) {
+		return
+	}
+
+	t.sockMu.Lock()
+	defer t.sockMu.Unlock()
+
+	if _, exists := t.replyPaths[key]; !exists && t.replyPathOrder.len() >= replyPathMaxSources {
+		oldestKey, _ := t.replyPathOrder.oldest()
+		delete(t.replyPaths, oldestKey)
+		t.replyPathOrder.remove(oldestKey)
+	}
+	t.replyPaths[key] = &replyPath{socket: socket, localIP: localIP, lastSeen: now}
+	t.replyPathOrder.touch(key)
+	if now.Sub(t.lastReplyPrune) > time.Second {
+		for k, p := range t.replyPaths {
+			if now.Sub(p.lastSeen) > replyPathIdleTimeout {
+				delete(t.replyPaths, k)
+				t.replyPathOrder.remove(k)
+			}
+		}
+		t.lastReplyPrune = now
+	}
+}
+
+// selectSocket 选择发往 addr 的套接字和源地址
+// 优先使用对端数据包到达的套接字，否则选择地址族匹配的套接字；没有套接字时返回nil
+func (t *UDPTransport) selectSocket(addr *net.UDPAddr) (*udpSocket, net.IP) {
+	t.sockMu.RLock()
+	defer t.sockMu.RUnlock()
+
+	if len(t.sockets) == 0 {
+		return nil, nil
+	}
+	if path, exists := t.replyPaths[addr.String()]; exists {
+		return path.socket, path.localIP
+	}
+
+	ipv4 := addr.IP.To4() != nil
+	for _, s := range t.sockets {
+		if s.isIPv4() == ipv4 {
+			return s, nil
+		}
+	}
+	return t.sockets[0], nil
+}
+
+// writeTo 从选定的套接字写出数据包，通配地址套接字按记录的源地址发出
+func (t *UDPTransport) writeTo(fallback *net.UDPConn, packet []byte, addr *net.UDPAddr) error {
+	socket, localIP := t.selectSocket(addr)
+	conn := fallback
+	if socket != nil {
+		conn = socket.conn
+	}
+
+	// Set write deadline
+	if writeTimeout := t.getWriteTimeout(); writeTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	}
+
+	var err error
+	if oob := t.packetInfoFor(socket, localIP); oob != nil {
+		_, _, err = conn.WriteMsgUDP(packet, oob, addr)
+	} else {
+		_, err = conn.WriteToUDP(packet, addr)
+	}
+	if err == nil {
+		t.stats.sent(addr, len(packet))
+	}
+	return err
+}
+
+// packetInfoFor 返回指定源地址的控制消息，双栈套接字上的IPv4对端返回nil交给内核选择源地址
+func (t *UDPTransport) packetInfoFor(socket *udpSocket, localIP net.IP) []byte {
+	if socket != nil && socket.pktinfo && localIP != nil && (socket.isIPv4() || localIP.To4() == nil) {
+		return packetInfoOOB(localIP, socket.isIPv4())
+	}
+	return nil
+}
+
+// LocalAddrs 返回所有已绑定的本地地址
+func (t *UDPTransport) LocalAddrs() []net.Addr {
+	t.sockMu.RLock()
+	defer t.sockMu.RUnlock()
+
+	addrs := make([]net.Addr, len(t.sockets))
+	for i, s := range t.sockets {
+		addrs[i] = s.addr
+	}
+	return addrs
+}
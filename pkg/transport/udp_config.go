@@ -0,0 +1,270 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// UDP传输的默认配置
+const (
+	// defaultBufferSize 是接收缓冲区大小，不足最大路径MTU时自动扩大
+	defaultBufferSize = 4096
+	// defaultMaxRetries 是可靠数据包的最大重传次数
+	defaultMaxRetries = 3
+	// defaultRetryInterval 是ACK模式下的首次重传间隔
+	defaultRetryInterval = 500 * time.Millisecond
+)
+
+// UDPConfig 是UDP传输的配置
+// 应从 DefaultUDPConfig 开始修改，零值不是有效配置。
+type UDPConfig struct {
+	// Addr 是监听地址（"host:port"），优先于 Port
+	// 默认：""（127.0.0.1 上的 Port）
+	Addr string
+	// Port 是 Addr 为空时监听的回环端口，0表示随机端口
+	// 默认：0
+	Port int
+	// BindAddrs 绑定多个本地地址（"host:port"），设置后忽略 Addr 和 Port；主机为空表示所有接口
+	// 默认：nil
+	BindAddrs []string
+	// BufferSize 是接收缓冲区大小（字节）
+	// 默认：4096
+	BufferSize int
+
+	// MaxRetries 是可靠数据包的最大重传次数，0表示不重传
+	// 默认：3
+	MaxRetries int
+	// RetryInterval 是ACK模式下的首次重传间隔
+	// 默认：500ms
+	RetryInterval time.Duration
+	// RetryExponential 表示ACK模式下重传间隔按指数退避
+	// 默认：true
+	RetryExponential bool
+	// AckHandlerEnabled 启用可靠传输（ACK和重传）；关闭时数据包按原样收发
+	// 默认：true
+	AckHandlerEnabled bool
+
+	// ReliabilityMode 是 ReliabilityModeACK 或 ReliabilityModeSACK，两端必须一致
+	// 默认：ReliabilityModeACK
+	ReliabilityMode string
+	// WindowSize 是SACK模式下每个对等节点的最大在途数据包数
+	// 默认：64
+	WindowSize int
+	// InitialRTO、MinRTO、MaxRTO 是SACK模式下重传超时的初始值和上下限
+	// 默认：1s、200ms、60s
+	InitialRTO time.Duration
+	MinRTO     time.Duration
+	MaxRTO     time.Duration
+
+	// CongestionControl 启用按对等节点的拥塞控制和发送节奏控制
+	// 默认：true
+	CongestionControl bool
+	// MaxSendRate 是每个对等节点的发送速率上限（字节/秒），0表示不限制
+	// 默认：0
+	MaxSendRate int
+
+	// PathMTUDiscovery 启用路径MTU探测和超过路径MTU的数据包分片；关闭时数据包原样发出，
+	// 但仍然回复对端的探测并重组对端的分片
+	// 默认：false
+	PathMTUDiscovery bool
+	// MaxPathMTU 是探测的路径MTU上限
+	// 默认：1500
+	MaxPathMTU int
+	// PMTUProbeTimeout 是等待探测包确认的时间
+	// 默认：500ms
+	PMTUProbeTimeout time.Duration
+
+	// FECEnabled 为 SendUnreliable 启用前向纠错：每组数据包后发送一个XOR校验包，
+	// 组内丢失一个数据包时接收端无需重传即可恢复；接收端总是能处理校验包
+	// 默认：false
+	FECEnabled bool
+	// FECGroupSize 是没有丢包时一个校验包保护的数据包数，也是组大小的上限；
+	// 组大小随对端报告的丢包率缩小，约为 0.25/丢包率
+	// 默认：8
+	FECGroupSize int
+	// FECMinGroupSize 是高丢包率时的组大小下限，与 FECGroupSize 相同时组大小固定
+	// 默认：2
+	FECMinGroupSize int
+	// FECFlushInterval 是未满的组等待多久后发送校验包
+	// 默认：20ms
+	FECFlushInterval time.Duration
+
+	// BatchSize 是每次系统调用最多收发的数据报数，1表示不批量收发
+	// 默认：32
+	BatchSize int
+	// HandlerWorkers 是运行处理器的协程数，0表示在接收循环中直接调用
+	// 默认：GOMAXPROCS
+	HandlerWorkers int
+	// BorrowBuffers 表示处理器直接使用接收缓冲区，处理器返回后不能再持有数据
+	// 默认：false
+	BorrowBuffers bool
+
+	// IdentityType 选择本地密钥类型（"c25519" 或 "p256"），空字符串保持默认
+	// 默认：""（Curve25519）
+	IdentityType string
+
+	// TestMode 不绑定套接字，用于测试
+	// 默认：false
+	TestMode bool
+}
+
+// DefaultUDPConfig 返回 NewUDPTransport 使用的默认配置
+func DefaultUDPConfig() UDPConfig {
+	return UDPConfig{
+		BufferSize:        defaultBufferSize,
+		MaxRetries:        defaultMaxRetries,
+		RetryInterval:     defaultRetryInterval,
+		RetryExponential:  true,
+		AckHandlerEnabled: true,
+		ReliabilityMode:   ReliabilityModeACK,
+		WindowSize:        defaultWindowSize,
+		InitialRTO:        defaultInitialRTO,
+		MinRTO:            defaultMinRTO,
+		MaxRTO:            defaultMaxRTO,
+		CongestionControl: true,
+		PathMTUDiscovery:  false,
+		MaxPathMTU:        defaultMaxPathMTU,
+		PMTUProbeTimeout:  defaultPMTUProbeTimeout,
+		FECGroupSize:      defaultFECGroupSize,
+		FECMinGroupSize:   defaultFECMinGroupSize,
+		FECFlushInterval:  defaultFECFlushInterval,
+		BatchSize:         defaultBatchSize,
+		HandlerWorkers:    defaultHandlerWorkers(),
+	}
+}
+
+// Validate 检查配置，不绑定套接字
+func (c UDPConfig) Validate() error {
+	if err := validatePort(c.Port); err != nil {
+		return NewTransportError(err.Error(), 3037, nil)
+	}
+	if c.Addr != "" {
+		if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+			return NewTransportError("invalid listen address: "+c.Addr, 3038, err)
+		}
+	}
+	if _, _, err := parseBindAddrs(c.BindAddrs); err != nil {
+		return err
+	}
+	if c.BufferSize < 1 {
+		return NewTransportError("bufferSize must be positive", 3039, nil)
+	}
+
+	if c.MaxRetries < 0 {
+		return NewTransportError("maxRetries cannot be negative", 3040, nil)
+	}
+	if c.RetryInterval <= 0 {
+		return NewTransportError("retryInterval must be positive", 3041, nil)
+	}
+
+	if c.ReliabilityMode != ReliabilityModeACK && c.ReliabilityMode != ReliabilityModeSACK {
+		return NewTransportError("invalid reliability mode: "+c.ReliabilityMode, 3025, nil)
+	}
+	if c.WindowSize < 1 || c.WindowSize > windowMaxAhead {
+		return NewTransportError(fmt.Sprintf("windowSize must be between 1 and %d", windowMaxAhead), 3026, nil)
+	}
+	if c.InitialRTO <= 0 || c.MinRTO <= 0 || c.MaxRTO <= 0 {
+		return NewTransportError("initialRTO, minRTO and maxRTO must be positive", 3050, nil)
+	}
+	if c.MinRTO > c.MaxRTO {
+		return NewTransportError("minRTO cannot exceed maxRTO", 3027, nil)
+	}
+
+	if c.MaxSendRate < 0 {
+		return NewTransportError("maxSendRate cannot be negative", 3031, nil)
+	}
+
+	if c.MaxPathMTU < pmtuBase || c.MaxPathMTU > pmtuMaxLimit {
+		return NewTransportError(fmt.Sprintf("maxPathMTU must be between %d and %d", pmtuBase, pmtuMaxLimit), 3033, nil)
+	}
+	if c.PMTUProbeTimeout <= 0 {
+		return NewTransportError("pmtuProbeTimeout must be positive", 3042, nil)
+	}
+
+	if c.FECMinGroupSize < 1 || c.FECGroupSize > fecMaxGroupSize || c.FECMinGroupSize > c.FECGroupSize {
+		return NewTransportError(fmt.Sprintf("fecMinGroupSize and fecGroupSize must satisfy 1 <= fecMinGroupSize <= fecGroupSize <= %d", fecMaxGroupSize), 3043, nil)
+	}
+	if c.FECFlushInterval <= 0 {
+		return NewTransportError("fecFlushInterval must be positive", 3044, nil)
+	}
+
+	if c.BatchSize < 1 {
+		return NewTransportError("batchSize must be at least 1", 3035, nil)
+	}
+	if c.HandlerWorkers < 0 {
+		return NewTransportError("handlerWorkers cannot be negative", 3036, nil)
+	}
+
+	return validateIdentityType(c.IdentityType)
+}
+
+// UDPConfigFromMap 把 Init 接受的 map 配置转换为 UDPConfig
+// 键名是字段名的小驼峰形式（TestMode 为 "test_mode"，PMTUProbeTimeout 为 "pmtuProbeTimeout"），
+// 未知的键和类型不符的值返回错误，例如 retryInterval 必须是 time.Duration；缺少的键保持默认值。
+func UDPConfigFromMap(config map[string]interface{}) (UDPConfig, error) {
+	c := DefaultUDPConfig()
+	err := decodeConfig(config, map[string]interface{}{
+		"addr":              &c.Addr,
+		"port":              &c.Port,
+		"bindAddrs":         &c.BindAddrs,
+		"bufferSize":        &c.BufferSize,
+		"maxRetries":        &c.MaxRetries,
+		"retryInterval":     &c.RetryInterval,
+		"retryExponential":  &c.RetryExponential,
+		"ackHandlerEnabled": &c.AckHandlerEnabled,
+		"reliabilityMode":   &c.ReliabilityMode,
+		"windowSize":        &c.WindowSize,
+		"initialRTO":        &c.InitialRTO,
+		"minRTO":            &c.MinRTO,
+		"maxRTO":            &c.MaxRTO,
+		"congestionControl": &c.CongestionControl,
+		"maxSendRate":       &c.MaxSendRate,
+		"pathMTUDiscovery":  &c.PathMTUDiscovery,
+		"maxPathMTU":        &c.MaxPathMTU,
+		"pmtuProbeTimeout":  &c.PMTUProbeTimeout,
+		"fecEnabled":        &c.FECEnabled,
+		"fecGroupSize":      &c.FECGroupSize,
+		"fecMinGroupSize":   &c.FECMinGroupSize,
+		"fecFlushInterval":  &c.FECFlushInterval,
+		"batchSize":         &c.BatchSize,
+		"handlerWorkers":    &c.HandlerWorkers,
+		"borrowBuffers":     &c.BorrowBuffers,
+		"identityType":      &c.IdentityType,
+		"test_mode":         &c.TestMode,
+	})
+	return c, err
+}
+
+// parseBindAddrs 解析 bindAddrs 配置（"host:port" 列表）
+// 主机为空（如 ":9993"）表示所有接口，展开为 0.0.0.0 和 [::] 两个地址，其中 [::] 在没有IPv6的主机上可以跳过
+func parseBindAddrs(bindAddrs []string) ([]*net.UDPAddr, map[string]bool, error) {
+	var addrs []*net.UDPAddr
+	optional := make(map[string]bool)
+	for _, bindAddr := range bindAddrs {
+		host, portStr, err := net.SplitHostPort(bindAddr)
+		if err != nil {
+			return nil, nil, NewTransportError("invalid bind address: "+bindAddr, 3048, err)
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port < 0 || port > 65535 {
+			return nil, nil, NewTransportError("invalid bind port: "+bindAddr, 3049, err)
+		}
+
+		if host == "" {
+			v4 := &net.UDPAddr{IP: net.IPv4zero, Port: port}
+			v6 := &net.UDPAddr{IP: net.IPv6unspecified, Port: port}
+			addrs = append(addrs, v4, v6)
+			optional[v6.String()] = true
+			continue
+		}
+
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, nil, NewTransportError("bind address must be an IP address: "+bindAddr, 3034, nil)
+		}
+		addrs = append(addrs, &net.UDPAddr{IP: ip, Port: port})
+	}
+	return addrs, optional, nil
+}
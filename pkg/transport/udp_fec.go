@@ -0,0 +1,578 @@
+package transport
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// 前向纠错（FEC）使用的数据包类型（仅在启用ACK处理或滑动窗口模式时使用）
+// 数据：类型(1字节) + 组ID(4字节) + 组内序号(1字节) + 帧（加密标志 + [nonce] + 数据）
+// 校验：类型(1字节) + 组ID(4字节) + 组内数据包数(1字节) + 帧长度异或(2字节) + 帧异或（按最长帧补零）
+// 报告：类型(1字节) + 应收数据包数(2字节) + 丢失数据包数(2字节)，由接收端定期发回，发送端据此调整组大小
+const (
+	packetTypeFECData   uint8 = 8
+	packetTypeFECParity uint8 = 9
+	packetTypeFECReport uint8 = 10
+)
+
+const (
+	fecDataHeaderSize   = 6
+	fecParityHeaderSize = 8
+	fecReportSize       = 5
+
+	// fecMaxGroupSize 是可配置的最大组大小
+	fecMaxGroupSize = 32
+
+	// fecLossTarget 决定组大小：组大小约为 fecLossTarget/丢包率，使一组内丢失两个以上数据包的概率保持较低
+	fecLossTarget = 0.25
+	// fecLossWeight 是新报告在平滑丢包率中的权重
+	fecLossWeight = 0.25
+	// fecReportPackets 是接收端累计多少个应收数据包后发送一次报告
+	fecReportPackets = 64
+
+	// fecGroupTimeout 是接收端等待一组数据包和校验包的最长时间，超时后按已收到的数据包统计丢包
+	fecGroupTimeout = time.Second
+	// fecReorderGroups 是接收端收到更新的组后，旧组还能等待迟到数据包的组数
+	fecReorderGroups = 2
+	// fecMaxOpenGroups 是每个对等节点同时跟踪的组数上限
+	fecMaxOpenGroups = 64
+	// fecIdleTimeout 是对等节点FEC状态的空闲过期时间
+	fecIdleTimeout = 10 * time.Minute
+	// fecMaxReceivers 是接收端同时跟踪的来源数上限，满时淘汰最久未用的来源
+	fecMaxReceivers = 1024
+)
+
+// 前向纠错默认参数
+const (
+	defaultFECGroupSize     = 8
+	defaultFECMinGroupSize  = 2
+	defaultFECFlushInterval = 20 * time.Millisecond
+)
+
+// FECStats 是与单个对等节点之间的前向纠错状态
+type FECStats struct {
+	GroupSize   int     // 发往该对等节点的当前组大小
+	LossRate    float64 // 对端报告的平滑丢包率（0-1）
+	ParitySent  uint64  // 发往该对等节点的校验包数
+	Recovered   uint64  // 从该对等节点丢失、由校验包恢复的数据包数
+	Unrecovered uint64  // 从该对等节点丢失且无法恢复的数据包数
+}
+
+// fecSender 是发往单个对等节点的FEC组
+type fecSender struct {
+	addr       *net.UDPAddr
+	groupID    uint32
+	frames     [][]byte // 当前组已发送的帧
+	started    time.Time
+	groupSize  int
+	loss       float64
+	reported   bool
+	paritySent uint64
+	lastUsed   time.Time
+}
+
+// fecReceiver 是来自单个对等节点的FEC组重组和丢包统计
+type fecReceiver struct {
+	addr        net.Addr
+	groups      map[uint32]*fecGroup
+	expected    int // 自上次报告以来应收的数据包数（包括校验包）
+	lost        int // 自上次报告以来丢失的数据包数（包括校验包）
+	recovered   uint64
+	unrecovered uint64
+	lastUsed    time.Time
+}
+
+// fecGroup 是接收端的一组数据包
+// 组在完成或超时后保留到过期，以便丢弃已恢复数据包迟到的原件
+type fecGroup struct {
+	frames    [fecMaxGroupSize][]byte
+	received  uint32 // 已收到或已恢复的组内序号位图
+	arrived   int    // 实际到达的数据包数
+	highest   int    // 已到达的最大组内序号+1，校验包丢失时用于估计组大小
+	count     int    // 组内数据包数，收到校验包前为0
+	parity    []byte
+	lengthXOR uint16
+	created   time.Time
+	closed    bool
+}
+
+// configureFEC 应用前向纠错配置
+func (t *UDPTransport) configureFEC(config UDPConfig) {
+	t.fecEnabled = config.FECEnabled
+	t.fecGroupSize = config.FECGroupSize
+	t.fecMinGroupSize = config.FECMinGroupSize
+	t.fecFlushInterval = config.FECFlushInterval
+}
+
+// fecActive 判断不可靠数据包是否按组发送校验包
+func (t *UDPTransport) fecActive() bool {
+	return t.fecEnabled && (t.ackHandlerEnabled || t.windowed)
+}
+
+// fecGroupSizeFor 按丢包率选择组大小
+func fecGroupSizeFor(loss float64, minSize, maxSize int) int {
+	if loss <= 0 {
+		return maxSize
+	}
+	size := int(fecLossTarget / loss)
+	if size < minSize {
+		return minSize
+	}
+	if size > maxSize {
+		return maxSize
+	}
+	return size
+}
+
+// sendFEC 把帧作为当前组的数据包发出，组满时随后发出校验包
+func (t *UDPTransport) sendFEC(udpAddr *net.UDPAddr, frame []byte) error {
+	now := time.Now()
+
+	t.fecMu.Lock()
+	s := t.getFECSender(udpAddr, now)
+	packet := make([]byte, fecDataHeaderSize+len(frame))
+	packet[0] = packetTypeFECData
+	binary.BigEndian.PutUint32(packet[1:5], s.groupID)
+	packet[5] = uint8(len(s.frames))
+	copy(packet[fecDataHeaderSize:], frame)
+
+	if len(s.frames) == 0 {
+		s.started = now
+	}
+	s.frames = append(s.frames, packet[fecDataHeaderSize:])
+	var parity []byte
+	if len(s.frames) >= s.groupSize {
+		parity = s.closeGroup()
+	}
+	t.fecMu.Unlock()
+
+	congestion := t.getCongestion(udpAddr)
+	if err := t.admit(congestion, len(packet), false); err != nil {
+		return err
+	}
+	if err := t.writePacket(t.conn, packet, udpAddr); err != nil {
+		return NewTransportError("failed to send UDP packet", 3005, err)
+	}
+	if parity != nil {
+		t.sendParity(udpAddr, parity, time.Now())
+	}
+	return nil
+}
+
+// sendParity 写出校验包；校验包占用发送预算但不等待，不延迟调用者的实时数据
+func (t *UDPTransport) sendParity(udpAddr *net.UDPAddr, parity []byte, now time.Time) {
+	t.getCongestion(udpAddr).charge(len(parity), now)
+	t.writePacket(t.conn, parity, udpAddr)
+}
+
+// getFECSender 获取或创建发往 addr 的FEC组
+// 调用时必须持有 t.fecMu
+func (t *UDPTransport) getFECSender(addr *net.UDPAddr, now time.Time) *fecSender {
+	key := addr.String()
+	s, exists := t.fecSenders[key]
+	if !exists {
+		s = &fecSender{addr: addr, groupID: randomSequenceStart(), groupSize: t.fecGroupSize}
+		t.fecSenders[key] = s
+	}
+	s.lastUsed = now
+	return s
+}
+
+// closeGroup 结束当前组并返回其校验包
+func (s *fecSender) closeGroup() []byte {
+	longest := 0
+	for _, frame := range s.frames {
+		if len(frame) > longest {
+			longest = len(frame)
+		}
+	}
+
+	parity := make([]byte, fecParityHeaderSize+longest)
+	parity[0] = packetTypeFECParity
+	binary.BigEndian.PutUint32(parity[1:5], s.groupID)
+	parity[5] = uint8(len(s.frames))
+	var lengthXOR uint16
+	for _, frame := range s.frames {
+		lengthXOR ^= uint16(len(frame))
+		xorInto(parity[fecParityHeaderSize:], frame)
+	}
+	binary.BigEndian.PutUint16(parity[6:8], lengthXOR)
+
+	s.groupID++
+	s.frames = nil
+	s.paritySent++
+	return parity
+}
+
+// xorInto 把 src 异或到 dst 的开头
+func xorInto(dst, src []byte) {
+	for i, b := range src {
+		dst[i] ^= b
+	}
+}
+
+// handleFECReport 按对端报告的丢包率调整发往该对等节点的组大小
+func (t *UDPTransport) handleFECReport(srcAddr net.Addr, data []byte) {
+	if !t.fecActive() || len(data) < fecReportSize {
+		return
+	}
+	expected := int(binary.BigEndian.Uint16(data[1:3]))
+	lost := int(binary.BigEndian.Uint16(data[3:5]))
+	if expected == 0 || lost > expected {
+		return
+	}
+	sample := float64(lost) / float64(expected)
+
+	t.fecMu.Lock()
+	defer t.fecMu.Unlock()
+	s, exists := t.fecSenders[srcAddr.String()]
+	if !exists {
+		return
+	}
+	if s.reported {
+		s.loss += fecLossWeight * (sample - s.loss)
+	} else {
+		s.loss = sample
+		s.reported = true
+	}
+	s.groupSize = fecGroupSizeFor(s.loss, t.fecMinGroupSize, t.fecGroupSize)
+}
+
+// handleFECData 交付数据包，并在它补齐校验包所缺的唯一数据包时恢复另一个
+func (t *UDPTransport) handleFECData(srcAddr net.Addr, data []byte, handler PacketHandler) error {
+	if len(data) <= fecDataHeaderSize || int(data[5]) >= fecMaxGroupSize {
+		return nil
+	}
+	groupID := binary.BigEndian.Uint32(data[1:5])
+	index := int(data[5])
+	frame := append([]byte(nil), data[fecDataHeaderSize:]...)
+	now := time.Now()
+
+	t.fecMu.Lock()
+	r := t.getFECReceiver(srcAddr, now)
+	if r == nil {
+		// 没有FEC状态时照常交付，只是不能用它恢复丢包
+		t.fecMu.Unlock()
+		return t.deliverFECFrame(srcAddr, frame, handler)
+	}
+	g := r.group(groupID, now)
+	if g.received&(1<<uint(index)) != 0 || (g.count > 0 && index >= g.count) {
+		// 重复数据包，或已由校验包恢复的数据包迟到的原件
+		t.fecMu.Unlock()
+		return nil
+	}
+	g.frames[index] = frame
+	g.received |= 1 << uint(index)
+	g.arrived++
+	if index+1 > g.highest {
+		g.highest = index + 1
+	}
+	recoveredFrame := r.recover(g)
+	r.closeIfComplete(g)
+	report := r.takeReport()
+	t.fecMu.Unlock()
+
+	t.sendFECReport(srcAddr, report)
+	err := t.deliverFECFrame(srcAddr, frame, handler)
+	if recoveredFrame != nil {
+		if recoverErr := t.deliverFECFrame(srcAddr, recoveredFrame, handler); err == nil {
+			err = recoverErr
+		}
+	}
+	return err
+}
+
+// handleFECParity 记录校验包，组内恰好丢失一个数据包时恢复它
+func (t *UDPTransport) handleFECParity(srcAddr net.Addr, data []byte, handler PacketHandler) error {
+	if len(data) < fecParityHeaderSize {
+		return nil
+	}
+	count := int(data[5])
+	if count == 0 || count > fecMaxGroupSize {
+		return nil
+	}
+	groupID := binary.BigEndian.Uint32(data[1:5])
+	now := time.Now()
+
+	t.fecMu.Lock()
+	r := t.getFECReceiver(srcAddr, now)
+	if r == nil {
+		t.fecMu.Unlock()
+		return nil
+	}
+	g := r.group(groupID, now)
+	if g.parity != nil || g.highest > count {
+		t.fecMu.Unlock()
+		return nil
+	}
+	g.count = count
+	g.lengthXOR = binary.BigEndian.Uint16(data[6:8])
+	g.parity = append([]byte(nil), data[fecParityHeaderSize:]...)
+	recoveredFrame := r.recover(g)
+	r.closeIfComplete(g)
+	report := r.takeReport()
+	t.fecMu.Unlock()
+
+	t.sendFECReport(srcAddr, report)
+	if recoveredFrame == nil {
+		return nil
+	}
+	return t.deliverFECFrame(srcAddr, recoveredFrame, handler)
+}
+
+// deliverFECFrame 解密帧并交付给处理器
+func (t *UDPTransport) deliverFECFrame(srcAddr net.Addr, frame []byte, handler PacketHandler) error {
+	payload, err := t.openFrame(srcAddr.String(), frame)
+	if err != nil {
+		t.frameFailed(srcAddr, frame)
+		return err
+	}
+	return handler(srcAddr, payload)
+}
+
+// getFECReceiver 获取或创建来自 addr 的FEC状态，新来源未通过限速时返回nil
+// 接收端不一定启用了FEC，没有 fecLoop 清理，因此创建新状态时顺带删除最久未用且已空闲的状态；
+// 来源数达到 fecMaxReceivers 时淘汰最久未用的来源，任何来源发来的校验包都不能让状态无限增长
+// 调用时必须持有 t.fecMu
+func (t *UDPTransport) getFECReceiver(addr net.Addr, now time.Time) *fecReceiver {
+	key := addr.String()
+	r, exists := t.fecReceivers[key]
+	if !exists {
+		if !t.admitSource(addr) {
+			return nil
+		}
+		for {
+			oldestKey, ok := t.fecReceiverOrder.oldest()
+			if !ok || (len(t.fecReceivers) < fecMaxReceivers && now.Sub(t.fecReceivers[oldestKey].lastUsed) <= fecIdleTimeout) {
+				break
+			}
+			t.removeFECReceiver(oldestKey)
+		}
+		r = &fecReceiver{addr: addr, groups: make(map[uint32]*fecGroup)}
+		t.fecReceivers[key] = r
+	}
+	t.fecReceiverOrder.touch(key)
+	r.lastUsed = now
+	return r
+}
+
+// removeFECReceiver 删除来自某个来源的FEC状态
+// 调用时必须持有 t.fecMu
+func (t *UDPTransport) removeFECReceiver(key string) {
+	delete(t.fecReceivers, key)
+	t.fecReceiverOrder.remove(key)
+}
+
+// group 获取或创建组
+// 创建新组时结束落后超过 fecReorderGroups 的组，删除超时的组，跟踪的组仍然过多时删除最早的组
+func (r *fecReceiver) group(groupID uint32, now time.Time) *fecGroup {
+	g, exists := r.groups[groupID]
+	if exists {
+		return g
+	}
+	for id, old := range r.groups {
+		if int32(groupID-id) > fecReorderGroups {
+			r.close(old)
+		}
+		if now.Sub(old.created) > fecGroupTimeout {
+			r.close(old)
+			delete(r.groups, id)
+		}
+	}
+	if len(r.groups) >= fecMaxOpenGroups {
+		var oldestID uint32
+		var oldest *fecGroup
+		for id, candidate := range r.groups {
+			if oldest == nil || candidate.created.Before(oldest.created) {
+				oldestID, oldest = id, candidate
+			}
+		}
+		r.close(oldest)
+		delete(r.groups, oldestID)
+	}
+	g = &fecGroup{created: now}
+	r.groups[groupID] = g
+	return g
+}
+
+// recover 在收到校验包且组内恰好缺少一个数据包时恢复它
+func (r *fecReceiver) recover(g *fecGroup) []byte {
+	if g.parity == nil || g.closed {
+		return nil
+	}
+	missing := -1
+	for index := 0; index < g.count; index++ {
+		if g.received&(1<<uint(index)) == 0 {
+			if missing >= 0 {
+				return nil
+			}
+			missing = index
+		}
+	}
+	if missing < 0 {
+		return nil
+	}
+
+	frame := append([]byte(nil), g.parity...)
+	length := g.lengthXOR
+	for index := 0; index < g.count; index++ {
+		if index == missing {
+			continue
+		}
+		if len(g.frames[index]) > len(frame) {
+			// 数据包比校验包覆盖的还长，说明不属于同一组
+			return nil
+		}
+		xorInto(frame, g.frames[index])
+		length ^= uint16(len(g.frames[index]))
+	}
+	if int(length) == 0 || int(length) > len(frame) {
+		return nil
+	}
+
+	g.received |= 1 << uint(missing)
+	r.recovered++
+	return frame[:length]
+}
+
+// closeIfComplete 在组内数据包和校验包都已处理时结束组
+func (r *fecReceiver) closeIfComplete(g *fecGroup) {
+	if !g.closed && g.parity != nil && g.received == 1<<uint(g.count)-1 {
+		r.close(g)
+	}
+}
+
+// close 结束组并统计丢包
+func (r *fecReceiver) close(g *fecGroup) {
+	if g.closed {
+		return
+	}
+	g.closed = true
+
+	count := g.count
+	lost := 0
+	if g.parity == nil {
+		count = g.highest
+		lost++
+	}
+	lost += count - g.arrived
+	r.expected += count + 1
+	r.lost += lost
+
+	for index := 0; index < count; index++ {
+		if g.received&(1<<uint(index)) == 0 {
+			r.unrecovered++
+		}
+	}
+	// 只保留去重所需的位图
+	g.frames = [fecMaxGroupSize][]byte{}
+	g.parity = nil
+}
+
+// takeReport 在累计足够的应收数据包后返回丢包报告并清零计数
+func (r *fecReceiver) takeReport() []byte {
+	if r.expected < fecReportPackets {
+		return nil
+	}
+	report := make([]byte, fecReportSize)
+	report[0] = packetTypeFECReport
+	binary.BigEndian.PutUint16(report[1:3], uint16(r.expected))
+	binary.BigEndian.PutUint16(report[3:5], uint16(r.lost))
+	r.expected, r.lost = 0, 0
+	return report
+}
+
+// sendFECReport 把丢包报告发回对等节点，与ACK一样不占用发送预算
+func (t *UDPTransport) sendFECReport(dstAddr net.Addr, report []byte) {
+	if report == nil {
+		return
+	}
+	if udpAddr, ok := dstAddr.(*net.UDPAddr); ok {
+		t.writePacket(t.conn, report, udpAddr)
+	}
+}
+
+// fecLoop 为等待超过 fecFlushInterval 的未满组发送校验包，并结束超时的接收组
+func (t *UDPTransport) fecLoop() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(t.fecFlushInterval / 2)
+	defer ticker.Stop()
+
+	type parityPacket struct {
+		addr   *net.UDPAddr
+		packet []byte
+	}
+	type reportPacket struct {
+		addr   net.Addr
+		packet []byte
+	}
+
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case now := <-ticker.C:
+			var parities []parityPacket
+			var reports []reportPacket
+
+			t.fecMu.Lock()
+			for key, s := range t.fecSenders {
+				if len(s.frames) > 0 && now.Sub(s.started) >= t.fecFlushInterval {
+					parities = append(parities, parityPacket{addr: s.addr, packet: s.closeGroup()})
+				} else if len(s.frames) == 0 && now.Sub(s.lastUsed) > fecIdleTimeout {
+					delete(t.fecSenders, key)
+				}
+			}
+			for key, r := range t.fecReceivers {
+				for groupID, g := range r.groups {
+					if now.Sub(g.created) > fecGroupTimeout {
+						r.close(g)
+						delete(r.groups, groupID)
+					}
+				}
+				if report := r.takeReport(); report != nil {
+					reports = append(reports, reportPacket{addr: r.addr, packet: report})
+				}
+				if len(r.groups) == 0 && now.Sub(r.lastUsed) > fecIdleTimeout {
+					t.removeFECReceiver(key)
+				}
+			}
+			t.fecMu.Unlock()
+
+			for _, p := range parities {
+				t.sendParity(p.addr, p.packet, now)
+			}
+			for _, r := range reports {
+				t.sendFECReport(r.addr, r.packet)
+			}
+		}
+	}
+}
+
+// GetFECStats 返回与 addr 之间的前向纠错状态
+func (t *UDPTransport) GetFECStats(addr net.Addr) (FECStats, bool) {
+	key := t.endpointKey(addr)
+
+	t.fecMu.Lock()
+	defer t.fecMu.Unlock()
+
+	s, sending := t.fecSenders[key]
+	r, receiving := t.fecReceivers[key]
+	if !sending && !receiving {
+		return FECStats{}, false
+	}
+
+	stats := FECStats{GroupSize: t.fecGroupSize}
+	if sending {
+		stats.GroupSize = s.groupSize
+		stats.LossRate = s.loss
+		stats.ParitySent = s.paritySent
+	}
+	if receiving {
+		stats.Recovered = r.recovered
+		stats.Unrecovered = r.unrecovered
+	}
+	return stats, true
+}
@@ -0,0 +1,46 @@
+package transport
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestFECReceiverLimit tests that receiver state is capped, the least recently used source is evicted and new sources need admission
+func TestFECReceiverLimit(t *testing.T) {
+	tr := NewUDPTransport()
+	now := time.Now()
+	addrAt := func(i int) net.Addr {
+		return &net.UDPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 9993}
+	}
+
+	tr.fecMu.Lock()
+	defer tr.fecMu.Unlock()
+	for i := 0; i < fecMaxReceivers; i++ {
+		tr.getFECReceiver(addrAt(i), now)
+	}
+	assert.Len(t, tr.fecReceivers, fecMaxReceivers)
+
+	// Using the first source again makes the second one the oldest
+	tr.getFECReceiver(addrAt(0), now)
+	tr.getFECReceiver(addrAt(fecMaxReceivers), now)
+	assert.Len(t, tr.fecReceivers, fecMaxReceivers)
+	assert.Equal(t, fecMaxReceivers, tr.fecReceiverOrder.len())
+	assert.Contains(t, tr.fecReceivers, addrAt(0).String())
+	assert.NotContains(t, tr.fecReceivers, addrAt(1).String())
+
+	// Idle receivers are dropped when a new source arrives
+	later := now.Add(fecIdleTimeout + time.Second)
+	tr.getFECReceiver(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 9993}, later)
+	assert.Len(t, tr.fecReceivers, 1)
+
+	// With a guard, a source whose bucket is empty gets no state
+	guard, err := NewHandshakeGuard(HandshakeGuardConfig{Rate: 0.001, Burst: 1, MaxSources: 16, LoadThreshold: 200, CookieLifetime: time.Minute})
+	assert.NoError(t, err)
+	tr.SetHandshakeGuard(guard)
+	assert.NotNil(t, tr.getFECReceiver(&net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1}, later))
+	assert.Nil(t, tr.getFECReceiver(&net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 2}, later))
+	assert.NotNil(t, tr.getFECReceiver(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 9993}, later))
+}
@@ -0,0 +1,461 @@
+package transport
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/stella/virtual-switch/pkg/address"
+	"github.com/stella/virtual-switch/pkg/crypto"
+)
+
+// packetTypeEnvelope 是发往按节点地址登记的对等节点的认证信封，包裹任意传输层数据报
+// 格式：类型(1字节) + 发送方节点地址(5字节) + 计数器(8字节) + 内层数据报 + Poly1305标签(16字节)
+// 标签覆盖标签之前的全部内容，密钥由会话密钥和计数器派生，每个计数器只使用一次
+const packetTypeEnvelope uint8 = 11
+
+const (
+	envelopeHeaderSize = 1 + address.AddressLength + 8
+	envelopeTagSize    = 16
+	// envelopeOverhead 是信封在内层数据报之外增加的字节数
+	envelopeOverhead = envelopeHeaderSize + envelopeTagSize
+
+	// envelopeWindowSize 是信封计数器的重放检测窗口大小，必须是64的倍数
+	envelopeWindowSize = 1024
+)
+
+// NodeAddr 是按节点地址标识的对等节点，通过 AddNodePeer 登记
+// 处理器收到的来源地址和投递结果中的目标地址都是 NodeAddr；发送时传入 NodeAddr，
+// 数据包发往该节点当前的端点，端点变化对调用者透明
+type NodeAddr struct {
+	Node *address.Address
+}
+
+// NewNodeAddr 创建节点地址
+func NewNodeAddr(node *address.Address) *NodeAddr {
+	return &NodeAddr{Node: node}
+}
+
+// Network 返回地址网络类型
+func (a *NodeAddr) Network() string {
+	return "node"
+}
+
+// String 返回节点地址的十六进制形式
+func (a *NodeAddr) String() string {
+	return a.Node.String()
+}
+
+// EndpointListener 在对等节点的端点迁移后调用
+type EndpointListener func(node *NodeAddr, oldEndpoint, newEndpoint net.Addr)
+
+// nodePeer 是按节点地址登记的对等节点
+type nodePeer struct {
+	addr     *NodeAddr
+	key      string // 节点地址字符串，也是会话密钥的查找键
+	endpoint *net.UDPAddr
+
+	sendCounter uint64 // 原子访问
+
+	// 以下字段由 t.roamMu 保护
+	recvHighest uint64
+	recvBitmap  [envelopeWindowSize / 64]uint64
+	recvSeen    bool
+	migrations  uint64
+}
+
+// acceptCounter 判断计数器是否第一次出现并记录，newest 表示它比之前收到的都新
+// 调用时必须持有 t.roamMu
+func (p *nodePeer) acceptCounter(counter uint64) (newest bool, ok bool) {
+	if !p.recvSeen || counter > p.recvHighest {
+		if !p.recvSeen || counter-p.recvHighest >= envelopeWindowSize {
+			p.recvBitmap = [envelopeWindowSize / 64]uint64{}
+		} else {
+			for c := p.recvHighest + 1; c < counter; c++ {
+				p.clearCounter(c)
+			}
+		}
+		p.recvSeen = true
+		p.recvHighest = counter
+		p.setCounter(counter)
+		return true, true
+	}
+
+	// 与普通数据包的重复检测不同，远落后于窗口的计数器一律拒绝，否则攻击者可以重放旧数据包
+	if p.recvHighest-counter >= envelopeWindowSize || p.isCounterSet(counter) {
+		return false, false
+	}
+	p.setCounter(counter)
+	return false, true
+}
+
+func (p *nodePeer) setCounter(counter uint64) {
+	bit := counter % envelopeWindowSize
+	p.recvBitmap[bit/64] |= 1 << (bit % 64)
+}
+
+func (p *nodePeer) clearCounter(counter uint64) {
+	bit := counter % envelopeWindowSize
+	p.recvBitmap[bit/64] &^= 1 << (bit % 64)
+}
+
+func (p *nodePeer) isCounterSet(counter uint64) bool {
+	bit := counter % envelopeWindowSize
+	return p.recvBitmap[bit/64]&(1<<(bit%64)) != 0
+}
+
+// AddNodePeer 按节点地址登记对等节点，endpoint 是它当前的UDP端点
+// 公钥必须派生出 node；登记后发往该节点的数据报都带认证信封，来自新端点的数据包
+// 通过认证后，端点和会话状态迁移到新端点。双方都需要登记对方
+func (t *UDPTransport) AddNodePeer(node *address.Address, publicKey []byte, endpoint net.Addr) (*NodeAddr, error) {
+	if node == nil || !address.NewAddressFromPublicKey(publicKey).Equals(node) {
+		return nil, NewTransportError("public key does not match node address", 3045, nil)
+	}
+	udpAddr, ok := endpoint.(*net.UDPAddr)
+	if !ok {
+		resolvedAddr, err := net.ResolveUDPAddr("udp", endpoint.String())
+		if err != nil {
+			return nil, NewTransportError("invalid endpoint address", 3051, err)
+		}
+		udpAddr = resolvedAddr
+	}
+
+	key := node.String()
+	t.SetPeerPublicKey(key, publicKey)
+	if _, ok, err := t.deriveSessionKey(key); !ok || err != nil {
+		return nil, NewTransportError("no session key for node "+key, 3046, err)
+	}
+	t.SetPeerPublicKey(udpAddr.String(), publicKey)
+
+	peer := &nodePeer{
+		addr:     NewNodeAddr(node),
+		key:      key,
+		endpoint: udpAddr,
+		// 以当前时间为计数器起点，重启后的发送方总是比接收方已见的计数器更新
+		sendCounter: uint64(time.Now().UnixNano()),
+	}
+
+	t.roamMu.Lock()
+	var staleEndpoint string
+	if old, exists := t.nodePeers[key]; exists {
+		delete(t.nodeEndpoints, old.endpoint.String())
+		if old.endpoint.String() != udpAddr.String() {
+			staleEndpoint = old.endpoint.String()
+		}
+	}
+	t.nodePeers[key] = peer
+	t.nodeEndpoints[udpAddr.String()] = peer
+	t.roamMu.Unlock()
+
+	// 重新登记到新端点时，旧端点上的公钥不再属于该节点，留着会让旧端点继续按该节点加解密
+	if staleEndpoint != "" {
+		t.removePeerKey(staleEndpoint)
+	}
+	return peer.addr, nil
+}
+
+// RemoveNodePeer 删除按节点地址登记的对等节点，之后发往其端点的数据报不再带信封
+func (t *UDPTransport) RemoveNodePeer(node *address.Address) {
+	t.roamMu.Lock()
+	defer t.roamMu.Unlock()
+
+	if peer, exists := t.nodePeers[node.String()]; exists {
+		delete(t.nodePeers, peer.key)
+		delete(t.nodeEndpoints, peer.endpoint.String())
+	}
+}
+
+// NodeEndpoint 返回节点当前的UDP端点
+func (t *UDPTransport) NodeEndpoint(node *address.Address) (net.Addr, bool) {
+	t.roamMu.RLock()
+	defer t.roamMu.RUnlock()
+
+	peer, exists := t.nodePeers[node.String()]
+	if !exists {
+		return nil, false
+	}
+	return peer.endpoint, true
+}
+
+// AddEndpointListener 注册端点迁移监听器
+func (t *UDPTransport) AddEndpointListener(listener EndpointListener) {
+	if listener == nil {
+		return
+	}
+	t.roamMu.Lock()
+	t.endpointListeners = append(t.endpointListeners, listener)
+	t.roamMu.Unlock()
+}
+
+// resolveNodeAddr 将 NodeAddr 解析为节点当前的端点，其他地址原样返回
+func (t *UDPTransport) resolveNodeAddr(addr net.Addr) (net.Addr, error) {
+	nodeAddr, ok := addr.(*NodeAddr)
+	if !ok {
+		return addr, nil
+	}
+	endpoint, exists := t.NodeEndpoint(nodeAddr.Node)
+	if !exists {
+		return nil, NewTransportError("unknown node "+nodeAddr.String(), 3047, nil)
+	}
+	return endpoint, nil
+}
+
+// endpointKey 返回用于查找按端点保存的状态的键，NodeAddr 使用其当前端点
+func (t *UDPTransport) endpointKey(addr net.Addr) string {
+	if endpoint, err := t.resolveNodeAddr(addr); err == nil {
+		return endpoint.String()
+	}
+	return addr.String()
+}
+
+// nodeAddrFor 返回端点所属的节点地址，不属于已登记节点时原样返回
+func (t *UDPTransport) nodeAddrFor(addr net.Addr) net.Addr {
+	if addr == nil {
+		return nil
+	}
+	t.roamMu.RLock()
+	defer t.roamMu.RUnlock()
+
+	if peer, exists := t.nodeEndpoints[addr.String()]; exists {
+		return peer.addr
+	}
+	return addr
+}
+
+// nodeHandler 将已登记节点的端点替换为节点地址后交给处理器
+func (t *UDPTransport) nodeHandler(handler PacketHandler) PacketHandler {
+	return func(srcAddr net.Addr, data []byte) error {
+		return handler(t.nodeAddrFor(srcAddr), data)
+	}
+}
+
+// envelopeOverheadFor 返回发往 addr 的数据报的信封开销
+func (t *UDPTransport) envelopeOverheadFor(addr *net.UDPAddr) int {
+	t.roamMu.RLock()
+	defer t.roamMu.RUnlock()
+
+	if _, exists := t.nodeEndpoints[addr.String()]; exists {
+		return envelopeOverhead
+	}
+	return 0
+}
+
+// localNodeAddress 返回本地公钥派生的节点地址，公钥不变时使用缓存
+func (t *UDPTransport) localNodeAddress() []byte {
+	publicKey := t.GetPublicKey()
+
+	t.roamMu.RLock()
+	node, nodeKey := t.localNode, t.localNodeKey
+	t.roamMu.RUnlock()
+	if node != nil && string(nodeKey) == string(publicKey) {
+		return node
+	}
+
+	node = address.NewAddressFromPublicKey(publicKey).Bytes()
+	t.roamMu.Lock()
+	t.localNode, t.localNodeKey = node, publicKey
+	t.roamMu.Unlock()
+	return node
+}
+
+// envelopeTagKey 由会话密钥和计数器派生一次性的Poly1305密钥
+func envelopeTagKey(sessionKey []byte, counter []byte) []byte {
+	material := make([]byte, 0, len(sessionKey)+len(counter))
+	material = append(material, sessionKey...)
+	material = append(material, counter...)
+	return crypto.Hash(material)[:32]
+}
+
+// sealEnvelope 为发往已登记节点的数据报加上认证信封，其他数据报原样返回
+func (t *UDPTransport) sealEnvelope(addr *net.UDPAddr, data []byte) []byte {
+	t.roamMu.RLock()
+	peer, exists := t.nodeEndpoints[addr.String()]
+	t.roamMu.RUnlock()
+	if !exists {
+		return data
+	}
+
+	sessionKey, ok, err := t.deriveSessionKey(peer.key)
+	if !ok || err != nil {
+		// 登记时已验证过密钥，只有本地密钥类型随后改变时才会发生；对端会丢弃未认证的数据报
+		return data
+	}
+
+	envelope := make([]byte, envelopeHeaderSize+len(data)+envelopeTagSize)
+	envelope[0] = packetTypeEnvelope
+	copy(envelope[1:1+address.AddressLength], t.localNodeAddress())
+	counter := envelope[1+address.AddressLength : envelopeHeaderSize]
+	binary.BigEndian.PutUint64(counter, atomic.AddUint64(&peer.sendCounter, 1))
+	copy(envelope[envelopeHeaderSize:], data)
+
+	body := envelope[:envelopeHeaderSize+len(data)]
+	tag, err := crypto.Poly1305Authenticate(body, envelopeTagKey(sessionKey, counter))
+	if err != nil {
+		return data
+	}
+	copy(envelope[len(body):], tag)
+	return envelope
+}
+
+// authenticateNodes 包装处理器，验证并拆开认证信封
+// 来自已登记节点端点的数据报必须带信封，否则丢弃（原始数据报处理器仍能查看）；
+// 信封通过认证后，内层数据报以节点当前的端点为来源交给处理器
+func (t *UDPTransport) authenticateNodes(handler PacketHandler) PacketHandler {
+	return func(srcAddr net.Addr, data []byte) error {
+		if len(data) > 0 && data[0] == packetTypeEnvelope {
+			endpoint, inner, ok := t.openEnvelope(srcAddr, data)
+			if !ok {
+				t.stats.decryptFailed(srcAddr)
+				return nil
+			}
+			return handler(endpoint, inner)
+		}
+
+		t.roamMu.RLock()
+		_, fromNode := t.nodeEndpoints[srcAddr.String()]
+		t.roamMu.RUnlock()
+		if fromNode {
+			if !t.handleRaw(srcAddr, data) {
+				t.stats.decryptFailed(srcAddr)
+			}
+			return nil
+		}
+		return handler(srcAddr, data)
+	}
+}
+
+// openEnvelope 验证信封并返回内层数据报及其来源端点
+// 通过认证、来自新端点且比之前收到的都新的信封使对等节点迁移到新端点；
+// 迟到的旧信封不会使端点回退
+func (t *UDPTransport) openEnvelope(srcAddr net.Addr, data []byte) (net.Addr, []byte, bool) {
+	if len(data) < envelopeOverhead {
+		return nil, nil, false
+	}
+	node, err := address.NewAddressFromBytes(data[1 : 1+address.AddressLength])
+	if err != nil {
+		return nil, nil, false
+	}
+	key := node.String()
+
+	t.roamMu.RLock()
+	peer, exists := t.nodePeers[key]
+	t.roamMu.RUnlock()
+	if !exists {
+		return nil, nil, false
+	}
+
+	sessionKey, ok, err := t.deriveSessionKey(key)
+	if !ok || err != nil {
+		return nil, nil, false
+	}
+	counter := data[1+address.AddressLength : envelopeHeaderSize]
+	body := data[:len(data)-envelopeTagSize]
+	if !crypto.Poly1305Verify(body, envelopeTagKey(sessionKey, counter), data[len(body):]) {
+		return nil, nil, false
+	}
+
+	t.roamMu.Lock()
+	// 登记或重启后的第一个信封没有计数器基准可比，截获的旧信封也能通过认证和计数器检查，
+	// 因此基准只由登记的端点发来的信封建立，之前来自其他端点的信封一律丢弃，不会触发迁移
+	if !peer.recvSeen && srcAddr.String() != peer.endpoint.String() {
+		t.roamMu.Unlock()
+		return nil, nil, false
+	}
+	newest, fresh := peer.acceptCounter(binary.BigEndian.Uint64(counter))
+	if !fresh || t.nodePeers[key] != peer {
+		t.roamMu.Unlock()
+		return nil, nil, false
+	}
+	oldEndpoint := peer.endpoint
+	moved := false
+	if newest && srcAddr.String() != oldEndpoint.String() {
+		if udpAddr, ok := srcAddr.(*net.UDPAddr); ok {
+			delete(t.nodeEndpoints, oldEndpoint.String())
+			peer.endpoint = udpAddr
+			peer.migrations++
+			t.nodeEndpoints[udpAddr.String()] = peer
+			moved = true
+		}
+	}
+	endpoint := peer.endpoint
+	listeners := t.endpointListeners
+	t.roamMu.Unlock()
+
+	if moved {
+		t.migrateEndpoint(oldEndpoint, endpoint)
+		for _, listener := range listeners {
+			listener(peer.addr, oldEndpoint, endpoint)
+		}
+	}
+	return endpoint, data[envelopeHeaderSize:len(body)], true
+}
+
+// migrateEndpoint 将按端点保存的会话状态从旧端点移到新端点
+// 待确认数据包、发送和接收窗口、拥塞控制、重复检测和FEC状态原样保留，
+// 后续的重传和ACK直接发往新端点；路径MTU和回复路径属于旧路径，丢弃后重新探测
+func (t *UDPTransport) migrateEndpoint(oldAddr, newAddr *net.UDPAddr) {
+	t.migrateMu.Lock()
+	defer t.migrateMu.Unlock()
+
+	oldKey, newKey := oldAddr.String(), newAddr.String()
+
+	t.movePeerKey(oldKey, newKey)
+	t.replay.move(oldKey, newKey)
+
+	t.mux.Lock()
+	for packetID, packet := range t.pendingPackets {
+		if packet.dstAddr.String() != oldKey {
+			continue
+		}
+		delete(t.pendingPackets, packetID)
+		packet.dstAddr = newAddr
+		t.pendingPackets[t.generatePacketID(newAddr, packet.sequenceNum)] = packet
+	}
+	t.mux.Unlock()
+
+	t.windowMu.Lock()
+	if w, exists := t.sendWindows[oldKey]; exists {
+		delete(t.sendWindows, oldKey)
+		w.mu.Lock()
+		w.addr = newAddr
+		w.mu.Unlock()
+		t.sendWindows[newKey] = w
+	}
+	if w, exists := t.recvWindows[oldKey]; exists {
+		delete(t.recvWindows, oldKey)
+		t.recvWindows[newKey] = w
+		t.recvWindowOrder.rename(oldKey, newKey)
+	}
+	t.windowMu.Unlock()
+
+	t.congestionMu.Lock()
+	if c, exists := t.congestion[oldKey]; exists {
+		delete(t.congestion, oldKey)
+		t.congestion[newKey] = c
+	}
+	t.congestionMu.Unlock()
+
+	t.pmtuMu.Lock()
+	delete(t.pmtuPaths, oldKey)
+	t.pmtuMu.Unlock()
+
+	t.fecMu.Lock()
+	if s, exists := t.fecSenders[oldKey]; exists {
+		delete(t.fecSenders, oldKey)
+		s.addr = newAddr
+		t.fecSenders[newKey] = s
+	}
+	if r, exists := t.fecReceivers[oldKey]; exists {
+		delete(t.fecReceivers, oldKey)
+		r.addr = newAddr
+		t.fecReceivers[newKey] = r
+		t.fecReceiverOrder.rename(oldKey, newKey)
+	}
+	t.fecMu.Unlock()
+
+	t.sockMu.Lock()
+	delete(t.replyPaths, oldKey)
+	t.replyPathOrder.remove(oldKey)
+	t.sockMu.Unlock()
+}
@@ -0,0 +1,38 @@
+package transport
+
+import "net"
+
+// Stats 返回传输层和按对等节点的收发统计快照
+// 收发计数按线路上的数据报统计，包括ACK、探测和重传；队列深度是等待确认的可靠数据包数
+func (t *UDPTransport) Stats() TransportStats {
+	depths := make(map[string]int)
+
+	t.mux.RLock()
+	for _, packet := range t.pendingPackets {
+		depths[packet.dstAddr.String()]++
+	}
+	t.mux.RUnlock()
+
+	t.windowMu.Lock()
+	windows := make([]*sendWindow, 0, len(t.sendWindows))
+	for _, w := range t.sendWindows {
+		windows = append(windows, w)
+	}
+	t.windowMu.Unlock()
+	for _, w := range windows {
+		w.mu.Lock()
+		depths[w.addr.String()] += len(w.segments)
+		w.mu.Unlock()
+	}
+
+	return t.stats.snapshot(func(addr string) (int, bool) {
+		return depths[addr], true
+	})
+}
+
+// frameFailed 在加密帧无法解密时计入解密失败
+func (t *UDPTransport) frameFailed(srcAddr net.Addr, frame []byte) {
+	if len(frame) > 0 && frame[0] == frameFlagEncrypted {
+		t.stats.decryptFailed(srcAddr)
+	}
+}
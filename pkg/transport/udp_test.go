@@ -1,11 +1,18 @@
 package transport
 
 import (
+	"context"
+	"errors"
 	"net"
+	"os"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/stella/virtual-switch/pkg/address"
+	"github.com/stella/virtual-switch/pkg/identity"
+	"github.com/stella/virtual-switch/pkg/keystore"
 )
 
 // TestUDPTransportWithEncryption tests UDP transport with encryption enabled
@@ -174,4 +181,123 @@ func TestUDPTransportWithRetryAndEncryption(t *testing.T) {
 	// Clean up resources
 	defer sender.Stop()
 	defer receiver.Stop()
-}
\ No newline at end of file
+}
+
+// TestUDPTransportP256KeyAgreement tests that key agreement follows the configured identity type
+func TestUDPTransportP256KeyAgreement(t *testing.T) {
+	t1 := NewUDPTransport()
+	err := t1.Init(map[string]interface{}{"test_mode": true, "identityType": "p256"})
+	assert.NoError(t, err)
+
+	t2 := NewUDPTransport()
+	id, err := identity.NewIdentityWithType(identity.IdentityTypeP256)
+	assert.NoError(t, err)
+	assert.NoError(t, t2.SetIdentity(id))
+
+	assert.Equal(t, identity.IdentityTypeP256, t1.GetKeyType())
+	assert.Len(t, t1.GetPublicKey(), 33) // Compressed P-256 public key size
+	assert.Equal(t, id.PublicKey, t2.GetPublicKey())
+
+	t1.SetPeerPublicKey("peer2", t2.GetPublicKey())
+	t2.SetPeerPublicKey("peer1", t1.GetPublicKey())
+
+	key1, ok, err := t1.deriveSessionKey("peer2")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	key2, ok, err := t2.deriveSessionKey("peer1")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, key1, key2)
+
+	// A Curve25519 peer key cannot be used with a P-256 transport
+	c25519 := NewUDPTransport()
+	t1.SetPeerPublicKey("peer3", c25519.GetPublicKey())
+	_, ok, err = t1.deriveSessionKey("peer3")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+// TestUDPTransportKeyStore tests key agreement through an external key store
+func TestUDPTransportKeyStore(t *testing.T) {
+	id, err := identity.NewIdentity()
+	assert.NoError(t, err)
+
+	ks, err := keystore.NewMemoryKeyStore(id)
+	assert.NoError(t, err)
+
+	t1 := NewUDPTransport()
+	assert.NoError(t, t1.SetKeyStore(ks))
+	assert.Equal(t, id.PublicKey, t1.GetPublicKey())
+
+	// The transport no longer holds a private key
+	assert.Empty(t, t1.keyPair.Private)
+
+	t2 := NewUDPTransport()
+	t1.SetPeerPublicKey("peer2", t2.GetPublicKey())
+	t2.SetPeerPublicKey("peer1", t1.GetPublicKey())
+
+	key1, ok, err := t1.deriveSessionKey("peer2")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	key2, ok, err := t2.deriveSessionKey("peer1")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, key1, key2)
+
+	// Session keys are cached and invalidated when the peer key changes
+	t1.cryptoMux.RLock()
+	_, cached := t1.sessionKeys["peer2"]
+	t1.cryptoMux.RUnlock()
+	assert.True(t, cached)
+
+	t1.SetPeerPublicKey("peer2", NewUDPTransport().GetPublicKey())
+	t1.cryptoMux.RLock()
+	_, cached = t1.sessionKeys["peer2"]
+	t1.cryptoMux.RUnlock()
+	assert.False(t, cached)
+}
+
+// TestReceiveErrorBackoff tests that persistent read errors back off and a closed socket ends the receive loop
+func TestReceiveErrorBackoff(t *testing.T) {
+	tr := NewUDPTransport()
+	tr.ctx, tr.cancel = context.WithCancel(context.Background())
+	defer tr.cancel()
+
+	// Timeouts retry at once
+	var backoff time.Duration
+	assert.True(t, tr.receiveErrorBackoff(os.ErrDeadlineExceeded, &backoff))
+	assert.Zero(t, backoff)
+
+	// Other errors wait longer each time
+	failure := errors.New("connection refused")
+	for i := 0; i < 3; i++ {
+		assert.True(t, tr.receiveErrorBackoff(failure, &backoff))
+	}
+	assert.Equal(t, 4*receiveErrorMinBackoff, backoff)
+
+	assert.False(t, tr.receiveErrorBackoff(net.ErrClosed, &backoff))
+	tr.cancel()
+	assert.False(t, tr.receiveErrorBackoff(failure, &backoff))
+}
+
+// TestAddNodePeerClearsStaleEndpointKey tests that re-registering a node at a new endpoint forgets the old endpoint's key
+func TestAddNodePeerClearsStaleEndpointKey(t *testing.T) {
+	tr := NewUDPTransport()
+	peer := NewUDPTransport()
+	node := address.NewAddressFromPublicKey(peer.GetPublicKey())
+	oldEndpoint := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 9993}
+	newEndpoint := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 9993}
+
+	_, err := tr.AddNodePeer(node, peer.GetPublicKey(), oldEndpoint)
+	assert.NoError(t, err)
+	_, err = tr.AddNodePeer(node, peer.GetPublicKey(), newEndpoint)
+	assert.NoError(t, err)
+
+	tr.cryptoMux.RLock()
+	defer tr.cryptoMux.RUnlock()
+	assert.NotContains(t, tr.peerKeys, oldEndpoint.String())
+	assert.Contains(t, tr.peerKeys, newEndpoint.String())
+	assert.Contains(t, tr.peerKeys, node.String())
+}
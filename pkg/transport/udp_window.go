@@ -0,0 +1,628 @@
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// 可靠性模式
+const (
+	// ReliabilityModeACK 逐包ACK和重传（默认）
+	ReliabilityModeACK = "ack"
+	// ReliabilityModeSACK 按对等节点的滑动窗口，累计ACK加选择性ACK
+	ReliabilityModeSACK = "sack"
+)
+
+// 滑动窗口模式的数据包类型
+// 窗口数据包：类型(1字节) + 序列号(4字节) + 窗口基序号(4字节) + 帧（加密标志 + [nonce] + 数据）
+// SACK数据包：类型(1字节) + 累计确认序号(4字节) + 选择确认位图(8字节)
+const (
+	packetTypeWindowData uint8 = 2
+	packetTypeSACK       uint8 = 3
+)
+
+const (
+	windowDataHeaderSize = 9
+	sackPacketSize       = 13
+
+	// sackBitmapBits 是选择确认位图覆盖的序列号个数，第i位表示 累计确认序号+2+i 已收到
+	sackBitmapBits = 64
+
+	// windowMaxAhead 是接收方接受的最大超前距离，超出的数据包直接丢弃
+	windowMaxAhead = 1024
+
+	// windowFastRetransmitThreshold 是触发快速重传所需的被后续SACK跳过的次数
+	windowFastRetransmitThreshold = 3
+
+	// windowClockGranularity 是重传定时器的时钟粒度（RFC 6298 中的 G）
+	windowClockGranularity = 10 * time.Millisecond
+
+	// recvWindowMaxSources 是同时保留接收窗口的来源数上限，满时淘汰最久未用的来源
+	recvWindowMaxSources = 4096
+)
+
+// 滑动窗口默认参数
+const (
+	defaultWindowSize = 64
+	defaultInitialRTO = time.Second
+	defaultMinRTO     = 200 * time.Millisecond
+	defaultMaxRTO     = 60 * time.Second
+)
+
+// WindowStats 是单个对等节点发送窗口的状态快照
+type WindowStats struct {
+	InFlight    int           // 已发送未确认的数据包数
+	SRTT        time.Duration // 平滑往返时间
+	RTTVar      time.Duration // 往返时间偏差
+	RTO         time.Duration // 当前重传超时
+	Retransmits uint64        // 累计重传次数
+}
+
+// rtoEstimator 按 RFC 6298 估算重传超时
+type rtoEstimator struct {
+	srtt   time.Duration
+	rttvar time.Duration
+	rto    time.Duration
+	hasRTT bool
+	minRTO time.Duration
+	maxRTO time.Duration
+}
+
+// sample 使用一个新的往返时间样本更新估算（仅用于未重传过的数据包，Karn算法）
+func (e *rtoEstimator) sample(rtt time.Duration) {
+	if !e.hasRTT {
+		// RFC 6298 2.2
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+		e.hasRTT = true
+	} else {
+		// RFC 6298 2.3：beta=1/4，alpha=1/8
+		delta := e.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		e.rttvar = (3*e.rttvar + delta) / 4
+		e.srtt = (7*e.srtt + rtt) / 8
+	}
+
+	variance := 4 * e.rttvar
+	if variance < windowClockGranularity {
+		variance = windowClockGranularity
+	}
+	e.rto = e.clamp(e.srtt + variance)
+}
+
+// backoff 在重传超时后将RTO加倍（RFC 6298 5.5）
+func (e *rtoEstimator) backoff() {
+	e.rto = e.clamp(2 * e.rto)
+}
+
+func (e *rtoEstimator) clamp(rto time.Duration) time.Duration {
+	if rto < e.minRTO {
+		return e.minRTO
+	}
+	if rto > e.maxRTO {
+		return e.maxRTO
+	}
+	return rto
+}
+
+// windowSegment 是发送窗口中已发送但未确认的数据包
+type windowSegment struct {
+	seq           uint32
+	frame         []byte // 加密后的帧，重传时重新加上包头
+	size          int    // 线上数据包大小，用于拥塞控制
+	firstSent     time.Time
+	lastSent      time.Time
+	deadline      time.Time
+	retries       int
+	retransmitted bool
+	missed        int // 被更高序号的SACK跳过的次数
+	result        chan DeliveryResult
+}
+
+// sendWindow 是发往单个对等节点的滑动窗口
+type sendWindow struct {
+	mu          sync.Mutex
+	addr        *net.UDPAddr
+	nextSeq     uint32
+	segments    map[uint32]*windowSegment
+	slots       chan struct{} // 容量即窗口大小，占用一个槽位表示一个在途数据包
+	rto         rtoEstimator
+	retransmits uint64
+	congestion  *congestionController
+}
+
+// base 返回最小的未确认序列号；没有在途数据包时为下一个序列号
+// 调用时必须持有 w.mu
+func (w *sendWindow) base() uint32 {
+	base := w.nextSeq
+	for seq := range w.segments {
+		if int32(seq-base) < 0 {
+			base = seq
+		}
+	}
+	return base
+}
+
+// buildPacket 以当前窗口基序号构建窗口数据包
+// 调用时必须持有 w.mu
+func (w *sendWindow) buildPacket(segment *windowSegment) []byte {
+	packet := make([]byte, windowDataHeaderSize+len(segment.frame))
+	packet[0] = packetTypeWindowData
+	binary.BigEndian.PutUint32(packet[1:5], segment.seq)
+	binary.BigEndian.PutUint32(packet[5:9], w.base())
+	copy(packet[windowDataHeaderSize:], segment.frame)
+	return packet
+}
+
+// release 从窗口中移除数据包并释放其槽位
+// 调用时必须持有 w.mu
+func (w *sendWindow) release(seq uint32) {
+	delete(w.segments, seq)
+	<-w.slots
+}
+
+// recvWindow 是来自单个对等节点的接收状态
+type recvWindow struct {
+	cumAck   uint32              // 此序号及之前的数据包都已收到
+	received map[uint32]struct{} // 累计确认序号之后乱序收到的数据包
+	lastSeen time.Time
+}
+
+// advance 将累计确认序号推进到连续收到的最高序号
+func (w *recvWindow) advance() {
+	for {
+		next := w.cumAck + 1
+		if _, ok := w.received[next]; !ok {
+			return
+		}
+		delete(w.received, next)
+		w.cumAck = next
+	}
+}
+
+// skipTo 在发送方放弃了更早的数据包后，将累计确认序号直接推进到 seq
+func (w *recvWindow) skipTo(seq uint32) {
+	w.cumAck = seq
+	for s := range w.received {
+		if int32(s-seq) <= 0 {
+			delete(w.received, s)
+		}
+	}
+	w.advance()
+}
+
+// sackBitmap 构建选择确认位图
+func (w *recvWindow) sackBitmap() uint64 {
+	var bitmap uint64
+	for seq := range w.received {
+		if offset := seq - w.cumAck - 2; offset < sackBitmapBits {
+			bitmap |= 1 << offset
+		}
+	}
+	return bitmap
+}
+
+// configureWindow 应用可靠性模式和滑动窗口相关配置
+func (t *UDPTransport) configureWindow(config UDPConfig) {
+	t.windowed = config.ReliabilityMode == ReliabilityModeSACK
+	t.windowSize = config.WindowSize
+	t.initialRTO = config.InitialRTO
+	t.minRTO = config.MinRTO
+	t.maxRTO = config.MaxRTO
+}
+
+// getSendWindow 获取或创建发往 addr 的发送窗口
+func (t *UDPTransport) getSendWindow(addr *net.UDPAddr) *sendWindow {
+	key := addr.String()
+
+	congestion := t.getCongestion(addr)
+
+	t.windowMu.Lock()
+	defer t.windowMu.Unlock()
+
+	w, exists := t.sendWindows[key]
+	if !exists {
+		w = &sendWindow{
+			addr:       addr,
+			congestion: congestion,
+			nextSeq:    randomSequenceStart(),
+			segments:   make(map[uint32]*windowSegment),
+			slots:      make(chan struct{}, t.windowSize),
+			rto: rtoEstimator{
+				rto:    t.initialRTO,
+				minRTO: t.minRTO,
+				maxRTO: t.maxRTO,
+			},
+		}
+		w.rto.rto = w.rto.clamp(w.rto.rto)
+		t.sendWindows[key] = w
+	}
+	return w
+}
+
+// sendWindowed 通过滑动窗口发送数据
+// 窗口已满时阻塞，直到有数据包被确认或超过写超时
+func (t *UDPTransport) sendWindowed(udpAddr *net.UDPAddr, data []byte, result chan DeliveryResult) error {
+	frame, err := t.sealFrame(udpAddr.String(), data)
+	if err != nil {
+		return err
+	}
+
+	w := t.getSendWindow(udpAddr)
+
+	// 占用一个在途槽位
+	var timeout <-chan time.Time
+	if writeTimeout := t.getWriteTimeout(); writeTimeout > 0 {
+		timer := time.NewTimer(writeTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case w.slots <- struct{}{}:
+	case <-timeout:
+		return NewTransportError("send window full", 3028, nil)
+	case <-t.ctx.Done():
+		return NewTransportError("transport is closed", 3002, nil)
+	}
+
+	// 有效窗口是滑动窗口和拥塞窗口中较小的一个
+	size := windowDataHeaderSize + len(frame)
+	if err := t.admit(w.congestion, size, true); err != nil {
+		<-w.slots
+		return err
+	}
+
+	now := time.Now()
+	w.mu.Lock()
+	segment := &windowSegment{
+		seq:       w.nextSeq,
+		frame:     frame,
+		size:      size,
+		firstSent: now,
+		lastSent:  now,
+		deadline:  now.Add(w.rto.rto),
+		result:    result,
+	}
+	w.nextSeq++
+	w.segments[segment.seq] = segment
+	packet := w.buildPacket(segment)
+	w.mu.Unlock()
+
+	if err := t.writePacket(t.conn, packet, udpAddr); err != nil {
+		w.mu.Lock()
+		if _, exists := w.segments[segment.seq]; exists {
+			w.release(segment.seq)
+			w.congestion.onDrop(size)
+		}
+		w.mu.Unlock()
+		return NewTransportError("failed to send UDP packet", 3005, err)
+	}
+
+	return nil
+}
+
+// handleWindowData 处理窗口数据包：记录接收状态、回复SACK，并交付第一次收到的数据
+func (t *UDPTransport) handleWindowData(srcAddr net.Addr, data []byte, handler PacketHandler) error {
+	if len(data) < windowDataHeaderSize {
+		return nil
+	}
+	seq := binary.BigEndian.Uint32(data[1:5])
+	base := binary.BigEndian.Uint32(data[5:9])
+	key := srcAddr.String()
+	now := time.Now()
+
+	t.windowMu.Lock()
+	w, exists := t.recvWindows[key]
+	if !exists {
+		// 新来源先经过限速，被拒绝的数据包不确认，由对端重传
+		if !t.admitSource(srcAddr) {
+			t.windowMu.Unlock()
+			return nil
+		}
+		if t.recvWindowOrder.len() >= recvWindowMaxSources {
+			oldestKey, _ := t.recvWindowOrder.oldest()
+			delete(t.recvWindows, oldestKey)
+			t.recvWindowOrder.remove(oldestKey)
+		}
+	}
+	if !exists || now.Sub(w.lastSeen) > replayWindowIdleTimeout {
+		w = &recvWindow{cumAck: base - 1, received: make(map[uint32]struct{})}
+		t.recvWindows[key] = w
+	}
+	t.recvWindowOrder.touch(key)
+	w.lastSeen = now
+
+	// 发送方的窗口基序号之前的数据包已确认或被放弃，不会再发送
+	if gap := int32(base - 1 - w.cumAck); gap > 0 {
+		w.skipTo(base - 1)
+	} else if gap < -windowMaxAhead {
+		// 远落后于当前状态，视为对端重启
+		w.cumAck = base - 1
+		w.received = make(map[uint32]struct{})
+	}
+
+	ahead := int32(seq - w.cumAck)
+	if ahead > windowMaxAhead {
+		// 超出接收范围，丢弃且不确认
+		t.windowMu.Unlock()
+		return nil
+	}
+
+	isNew := false
+	if ahead > 0 {
+		if _, duplicate := w.received[seq]; !duplicate {
+			isNew = true
+			w.received[seq] = struct{}{}
+			w.advance()
+		}
+	}
+
+	sack := make([]byte, sackPacketSize)
+	sack[0] = packetTypeSACK
+	binary.BigEndian.PutUint32(sack[1:5], w.cumAck)
+	binary.BigEndian.PutUint64(sack[5:13], w.sackBitmap())
+	t.windowMu.Unlock()
+
+	// 重复数据包也回复SACK，因为对端可能没收到上一次的确认
+	if udpAddr, ok := srcAddr.(*net.UDPAddr); ok {
+		t.writePacket(t.conn, sack, udpAddr)
+	}
+
+	if !isNew {
+		return nil
+	}
+
+	payload, err := t.openFrame(key, data[windowDataHeaderSize:])
+	if err != nil {
+		t.frameFailed(srcAddr, data[windowDataHeaderSize:])
+		return err
+	}
+	return handler(srcAddr, payload)
+}
+
+// handleSACK 处理SACK：移除已确认的数据包、更新RTO并在需要时快速重传
+func (t *UDPTransport) handleSACK(srcAddr net.Addr, data []byte) {
+	if len(data) < sackPacketSize {
+		return
+	}
+	cumAck := binary.BigEndian.Uint32(data[1:5])
+	bitmap := binary.BigEndian.Uint64(data[5:13])
+
+	t.windowMu.Lock()
+	w, exists := t.sendWindows[srcAddr.String()]
+	t.windowMu.Unlock()
+	if !exists {
+		return
+	}
+
+	type delivered struct {
+		result   DeliveryResult
+		resultCh chan DeliveryResult
+	}
+	var results []delivered
+	var fastRetransmits []outgoingDatagram
+
+	now := time.Now()
+	w.mu.Lock()
+
+	// 选择确认的最高序号，用于判断哪些数据包被跳过
+	highestSacked := cumAck
+	var rttSample time.Duration
+	var rttSampleSent time.Time
+	for seq, segment := range w.segments {
+		acked := int32(seq-cumAck) <= 0
+		if !acked {
+			if offset := seq - cumAck - 2; offset < sackBitmapBits && bitmap&(1<<offset) != 0 {
+				acked = true
+				if int32(seq-highestSacked) > 0 {
+					highestSacked = seq
+				}
+			}
+		}
+		if !acked {
+			continue
+		}
+
+		// Karn算法：只对未重传过的数据包采样，取最近发送的一个
+		if !segment.retransmitted && segment.lastSent.After(rttSampleSent) {
+			rttSample = now.Sub(segment.lastSent)
+			rttSampleSent = segment.lastSent
+		}
+		w.congestion.onAck(segment.size, now)
+
+		results = append(results, delivered{
+			result: DeliveryResult{
+				DstAddr:     w.addr,
+				SequenceNum: seq,
+				Delivered:   true,
+				Retries:     segment.retries,
+				RTT:         now.Sub(segment.firstSent),
+			},
+			resultCh: segment.result,
+		})
+		w.release(seq)
+	}
+
+	if !rttSampleSent.IsZero() {
+		w.rto.sample(rttSample)
+		w.congestion.onRTT(rttSample)
+		t.stats.rtt(w.addr, rttSample)
+	}
+
+	// 被更高序号跳过多次的数据包立即重传
+	for seq, segment := range w.segments {
+		if int32(seq-highestSacked) >= 0 {
+			continue
+		}
+		segment.missed++
+		if segment.missed == windowFastRetransmitThreshold {
+			segment.retries++
+			segment.retransmitted = true
+			segment.lastSent = now
+			segment.deadline = now.Add(w.rto.rto)
+			w.retransmits++
+			w.congestion.onLoss(now)
+			w.congestion.charge(segment.size, now)
+			fastRetransmits = append(fastRetransmits, outgoingDatagram{data: w.buildPacket(segment), addr: w.addr})
+		}
+	}
+	w.mu.Unlock()
+
+	t.writePackets(t.conn, fastRetransmits)
+	t.stats.retransmitted(w.addr, len(fastRetransmits))
+	for _, d := range results {
+		t.publishDelivery(d.result, d.resultCh)
+	}
+}
+
+// windowTimerLoop 按RTO重传超时的窗口数据包
+func (t *UDPTransport) windowTimerLoop() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(windowClockGranularity)
+	defer ticker.Stop()
+
+	// 每秒清理一次空闲对等节点的接收状态
+	lastExpire := time.Now()
+
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case now := <-ticker.C:
+			t.windowMu.Lock()
+			if now.Sub(lastExpire) >= time.Second {
+				for key, w := range t.recvWindows {
+					if now.Sub(w.lastSeen) > replayWindowIdleTimeout {
+						delete(t.recvWindows, key)
+						t.recvWindowOrder.remove(key)
+					}
+				}
+				lastExpire = now
+			}
+			windows := make([]*sendWindow, 0, len(t.sendWindows))
+			for _, w := range t.sendWindows {
+				windows = append(windows, w)
+			}
+			t.windowMu.Unlock()
+
+			for _, w := range windows {
+				t.retransmitExpired(w, now)
+			}
+		}
+	}
+}
+
+// retransmitExpired 重传单个窗口中超时的数据包，超过最大重传次数的数据包报告投递失败
+func (t *UDPTransport) retransmitExpired(w *sendWindow, now time.Time) {
+	var expired []*windowSegment
+	var packets []outgoingDatagram
+	var failed []DeliveryResult
+	var failedCh []chan DeliveryResult
+	var failedSizes []int
+
+	w.mu.Lock()
+	timedOut := false
+	for seq, segment := range w.segments {
+		if now.Before(segment.deadline) {
+			continue
+		}
+		timedOut = true
+
+		if segment.retries >= t.maxRetries {
+			failed = append(failed, DeliveryResult{
+				DstAddr:     w.addr,
+				SequenceNum: seq,
+				Retries:     segment.retries,
+				Err:         NewTransportError(fmt.Sprintf("no ACK from %s after %d retries", w.addr, segment.retries), 3023, nil),
+			})
+			failedCh = append(failedCh, segment.result)
+			failedSizes = append(failedSizes, segment.size)
+			w.release(seq)
+			w.congestion.onDrop(segment.size)
+			continue
+		}
+
+		segment.retries++
+		segment.retransmitted = true
+		segment.lastSent = now
+		w.retransmits++
+		expired = append(expired, segment)
+	}
+
+	// 每次超时只退避一次，再为所有重传的数据包设置新的截止时间
+	if timedOut {
+		w.rto.backoff()
+		w.congestion.onTimeout(now)
+	}
+	for _, segment := range expired {
+		segment.deadline = now.Add(w.rto.rto)
+		w.congestion.charge(segment.size, now)
+		packets = append(packets, outgoingDatagram{data: w.buildPacket(segment), addr: w.addr})
+	}
+	w.mu.Unlock()
+
+	t.writePackets(t.conn, packets)
+	t.stats.retransmitted(w.addr, len(packets))
+	for i, result := range failed {
+		t.stats.gaveUp(w.addr)
+		t.pathMTUFailure(w.addr, failedSizes[i])
+		t.publishDelivery(result, failedCh[i])
+	}
+}
+
+// failWindows 在停止时报告所有在途窗口数据包投递失败
+func (t *UDPTransport) failWindows() {
+	t.windowMu.Lock()
+	windows := t.sendWindows
+	t.sendWindows = make(map[string]*sendWindow)
+	t.recvWindows = make(map[string]*recvWindow)
+	t.recvWindowOrder = newLRUKeys()
+	t.windowMu.Unlock()
+
+	for _, w := range windows {
+		w.mu.Lock()
+		var results []DeliveryResult
+		var resultChs []chan DeliveryResult
+		for seq, segment := range w.segments {
+			results = append(results, DeliveryResult{
+				DstAddr:     w.addr,
+				SequenceNum: seq,
+				Retries:     segment.retries,
+				Err:         NewTransportError("transport stopped before delivery was confirmed", 3024, nil),
+			})
+			resultChs = append(resultChs, segment.result)
+			w.release(seq)
+		}
+		w.mu.Unlock()
+
+		for i, result := range results {
+			t.publishDelivery(result, resultChs[i])
+		}
+	}
+}
+
+// GetWindowStats 返回发往 addr 的发送窗口状态
+func (t *UDPTransport) GetWindowStats(addr net.Addr) (WindowStats, bool) {
+	t.windowMu.Lock()
+	w, exists := t.sendWindows[t.endpointKey(addr)]
+	t.windowMu.Unlock()
+	if !exists {
+		return WindowStats{}, false
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return WindowStats{
+		InFlight:    len(w.segments),
+		SRTT:        w.rto.srtt,
+		RTTVar:      w.rto.rttvar,
+		RTO:         w.rto.rto,
+		Retransmits: w.retransmits,
+	}, true
+}
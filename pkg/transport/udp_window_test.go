@@ -0,0 +1,100 @@
+package transport
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRTOEstimator tests RFC 6298 smoothing, clamping and backoff
+func TestRTOEstimator(t *testing.T) {
+	e := rtoEstimator{rto: defaultInitialRTO, minRTO: 10 * time.Millisecond, maxRTO: time.Second}
+
+	// First sample: SRTT = R, RTTVAR = R/2, RTO = SRTT + 4*RTTVAR
+	e.sample(100 * time.Millisecond)
+	assert.Equal(t, 100*time.Millisecond, e.srtt)
+	assert.Equal(t, 50*time.Millisecond, e.rttvar)
+	assert.Equal(t, 300*time.Millisecond, e.rto)
+
+	// Second sample: RTTVAR = 3/4*50 + 1/4*|100-200|, SRTT = 7/8*100 + 1/8*200
+	e.sample(200 * time.Millisecond)
+	assert.Equal(t, 62500*time.Microsecond, e.rttvar)
+	assert.Equal(t, 112500*time.Microsecond, e.srtt)
+	assert.Equal(t, 362500*time.Microsecond, e.rto)
+
+	e.backoff()
+	assert.Equal(t, 725*time.Millisecond, e.rto)
+	e.backoff()
+	assert.Equal(t, time.Second, e.rto, "RTO is capped at maxRTO")
+
+	// Stable tiny RTTs are floored at minRTO plus clock granularity
+	e = rtoEstimator{minRTO: 10 * time.Millisecond, maxRTO: time.Second}
+	for i := 0; i < 50; i++ {
+		e.sample(time.Millisecond)
+	}
+	assert.Equal(t, time.Millisecond+windowClockGranularity, e.rto)
+}
+
+// TestRecvWindowSACK tests cumulative advancement and the selective ACK bitmap
+func TestRecvWindowSACK(t *testing.T) {
+	w := &recvWindow{cumAck: 0xFFFFFFFE, received: make(map[uint32]struct{})}
+
+	// 0xFFFFFFFF is missing; 0, 1 and 5 arrive out of order across the wrap
+	for _, seq := range []uint32{0, 1, 5} {
+		w.received[seq] = struct{}{}
+	}
+	w.advance()
+	assert.Equal(t, uint32(0xFFFFFFFE), w.cumAck)
+	// Bit i means cumAck+2+i: 0 -> bit 0, 1 -> bit 1, 5 -> bit 5
+	assert.Equal(t, uint64(0b100011), w.sackBitmap())
+
+	w.received[0xFFFFFFFF] = struct{}{}
+	w.advance()
+	assert.Equal(t, uint32(1), w.cumAck)
+	assert.Equal(t, uint64(1<<2), w.sackBitmap())
+
+	// The sender gave up on 2-4
+	w.skipTo(4)
+	assert.Equal(t, uint32(5), w.cumAck)
+	assert.Empty(t, w.received)
+}
+
+// TestRecvWindowLimit tests that new sources need the guard's admission and the least recently used source is evicted
+func TestRecvWindowLimit(t *testing.T) {
+	tr := NewUDPTransport()
+	assert.NoError(t, tr.Init(map[string]interface{}{"addr": "127.0.0.1:0"}))
+	defer tr.Stop()
+
+	packet := make([]byte, windowDataHeaderSize)
+	packet[0] = packetTypeWindowData
+	binary.BigEndian.PutUint32(packet[1:5], 1)
+	binary.BigEndian.PutUint32(packet[5:9], 1)
+	handler := func(net.Addr, []byte) error { return nil }
+	addrAt := func(i int) *net.UDPAddr {
+		return &net.UDPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 9993}
+	}
+
+	for i := 0; i < recvWindowMaxSources+1; i++ {
+		tr.handleWindowData(addrAt(i), packet, handler)
+	}
+	assert.Len(t, tr.recvWindows, recvWindowMaxSources)
+	assert.Equal(t, recvWindowMaxSources, tr.recvWindowOrder.len())
+	assert.NotContains(t, tr.recvWindows, addrAt(0).String())
+
+	guard, err := NewHandshakeGuard(HandshakeGuardConfig{Rate: 0.001, Burst: 1, MaxSources: 16, LoadThreshold: 200, CookieLifetime: time.Minute})
+	assert.NoError(t, err)
+	tr.SetHandshakeGuard(guard)
+
+	// One new window per source until its bucket refills; known sources are not charged
+	spoofed := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}
+	tr.handleWindowData(spoofed, packet, handler)
+	spoofed.Port = 2
+	tr.handleWindowData(spoofed, packet, handler)
+	tr.handleWindowData(addrAt(recvWindowMaxSources), packet, handler)
+	assert.Contains(t, tr.recvWindows, "192.0.2.1:1")
+	assert.NotContains(t, tr.recvWindows, "192.0.2.1:2")
+	assert.Equal(t, uint64(1), guard.Stats().Accepted)
+}
@@ -0,0 +1,681 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket transport modes
+const (
+	// WebSocketModeServer listens for WebSocket connections and can also dial out
+	WebSocketModeServer = "server"
+	// WebSocketModeClient only dials out, for nodes behind restrictive networks
+	WebSocketModeClient = "client"
+)
+
+// wsHelloSize is the size of the hello message, the first binary message on a
+// dialed connection; it carries the dialer's listen port, or 0 in client mode
+const wsHelloSize = 2
+
+// websocketGUID is the magic value from RFC 6455 used to compute Sec-WebSocket-Accept
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes (RFC 6455 section 5.2)
+const (
+	wsOpContinuation uint8 = 0x0
+	wsOpText         uint8 = 0x1
+	wsOpBinary       uint8 = 0x2
+	wsOpClose        uint8 = 0x8
+	wsOpPing         uint8 = 0x9
+	wsOpPong         uint8 = 0xA
+)
+
+// WebSocketTransport implements the Transport interface by tunnelling packets
+// over WebSocket connections, one binary message per packet
+// In server mode the transport accepts connections on an HTTP path; in both
+// modes Send dials ws://<addr><path> when there is no connection to the peer.
+// Like TCPTransport, the dialer announces its listen port in a hello message and
+// the handler sees that listen address as the source; client-mode dialers do not
+// listen and are identified by the remote address of their connection.
+type WebSocketTransport struct {
+	BaseTransport
+	sessionCrypto
+
+	mode       string
+	path       string
+	listenAddr *net.TCPAddr
+	tlsConfig  *tls.Config
+	listener   net.Listener
+	server     *http.Server
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+
+	// peers maps a peer's canonical address to its WebSocket connection; conns
+	// holds every open connection, registered or not, so Stop can close them all
+	peersMu sync.Mutex
+	peers   map[string]*wsPeer
+	conns   map[net.Conn]struct{}
+
+	maxFrameSize int
+	dialTimeout  time.Duration
+}
+
+// wsPeer is a WebSocket connection to a single peer
+type wsPeer struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	addr    *net.TCPAddr
+	client  bool // client side connections mask outgoing frames
+	writeMu sync.Mutex
+}
+
+// NewWebSocketTransport creates a new WebSocket transport instance with encryption support
+func NewWebSocketTransport() *WebSocketTransport {
+	t := &WebSocketTransport{
+		BaseTransport: *NewBaseTransport(),
+		mode:          WebSocketModeServer,
+		path:          defaultWebSocketPath,
+		peers:         make(map[string]*wsPeer),
+		conns:         make(map[net.Conn]struct{}),
+		maxFrameSize:  defaultMaxFrameSize,
+		dialTimeout:   defaultDialTimeout,
+	}
+	t.initSessionCrypto()
+	return t
+}
+
+// Init initializes the WebSocket transport from a map config; see WebSocketConfigFromMap
+func (t *WebSocketTransport) Init(config map[string]interface{}) error {
+	c, err := WebSocketConfigFromMap(config)
+	if err != nil {
+		return err
+	}
+	return t.Configure(c)
+}
+
+// Configure validates the configuration and, in server mode, binds the listening socket
+func (t *WebSocketTransport) Configure(config WebSocketConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	if err := t.applyKeyType(config.IdentityType); err != nil {
+		return err
+	}
+
+	t.mode = config.Mode
+	t.path = config.Path
+	t.tlsConfig = config.TLSConfig
+	t.maxFrameSize = config.MaxFrameSize
+	t.dialTimeout = config.DialTimeout
+
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+
+	if t.mode == WebSocketModeClient {
+		return nil
+	}
+
+	// Loopback and a random port by default, like the other transports
+	t.listenAddr = &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: config.Port}
+	if config.Addr != "" {
+		parsedAddr, err := net.ResolveTCPAddr("tcp", config.Addr)
+		if err != nil {
+			return NewTransportError("invalid listen address", 6003, err)
+		}
+		t.listenAddr = parsedAddr
+	}
+
+	listener, err := net.ListenTCP("tcp", t.listenAddr)
+	if err != nil {
+		return NewTransportError("failed to bind WebSocket port", 6004, err)
+	}
+
+	t.listenAddr = listener.Addr().(*net.TCPAddr)
+	t.setLocalAddr(t.listenAddr)
+
+	t.listener = listener
+	if t.tlsConfig != nil {
+		t.listener = tls.NewListener(listener, t.tlsConfig)
+	}
+	return nil
+}
+
+// Start begins serving WebSocket upgrades in server mode
+func (t *WebSocketTransport) Start(handler PacketHandler) error {
+	if t.ctx == nil {
+		return NewTransportError("transport is not initialized", 6005, nil)
+	}
+
+	if err := t.BaseTransport.Start(handler); err != nil {
+		return err
+	}
+
+	if t.listener != nil {
+		mux := http.NewServeMux()
+		mux.HandleFunc(t.path, t.handleUpgrade)
+		t.server = &http.Server{Handler: mux, ReadHeaderTimeout: t.getReadTimeout()}
+
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			t.server.Serve(t.listener)
+		}()
+	}
+
+	return nil
+}
+
+// Stop closes the HTTP server and all peer connections
+func (t *WebSocketTransport) Stop() error {
+	if err := t.BaseTransport.Stop(); err != nil {
+		return err
+	}
+
+	if t.cancel != nil {
+		t.cancel()
+	}
+
+	var closeErr error
+	if t.server != nil {
+		closeErr = t.server.Close()
+	} else if t.listener != nil {
+		closeErr = t.listener.Close()
+	}
+
+	t.peersMu.Lock()
+	for key := range t.peers {
+		delete(t.peers, key)
+	}
+	for conn := range t.conns {
+		conn.Close()
+		delete(t.conns, conn)
+	}
+	t.peersMu.Unlock()
+
+	t.wg.Wait()
+	return closeErr
+}
+
+// Send sends a packet to the peer at dstAddr, dialing a WebSocket connection if needed
+func (t *WebSocketTransport) Send(dstAddr net.Addr, data []byte) error {
+	if t.isClosed() {
+		return NewTransportError("transport is closed", 6006, nil)
+	}
+
+	tcpAddr, ok := dstAddr.(*net.TCPAddr)
+	if !ok {
+		resolvedAddr, err := net.ResolveTCPAddr("tcp", dstAddr.String())
+		if err != nil {
+			return NewTransportError("invalid destination address", 6007, err)
+		}
+		tcpAddr = resolvedAddr
+	}
+	key := tcpAddr.String()
+
+	frame, err := t.sealFrame(key, data)
+	if err != nil {
+		return err
+	}
+	if len(frame) > t.maxFrameSize {
+		return NewTransportError("packet exceeds maximum frame size", 6008, nil)
+	}
+
+	peer, err := t.getOrDialPeer(tcpAddr)
+	if err != nil {
+		return err
+	}
+
+	if err := t.writeMessage(peer, wsOpBinary, frame); err != nil {
+		// Drop the broken connection so the next send redials
+		t.removePeer(key, peer)
+		return NewTransportError("failed to send WebSocket message", 6009, err)
+	}
+
+	return nil
+}
+
+// PeerCount returns the number of peers with an open connection
+func (t *WebSocketTransport) PeerCount() int {
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+	return len(t.peers)
+}
+
+// getOrDialPeer returns the connection for a peer, dialing a new one if needed
+func (t *WebSocketTransport) getOrDialPeer(addr *net.TCPAddr) (*wsPeer, error) {
+	key := addr.String()
+
+	t.peersMu.Lock()
+	peer, exists := t.peers[key]
+	t.peersMu.Unlock()
+	if exists {
+		return peer, nil
+	}
+
+	peer, err := t.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Another goroutine may have connected in the meantime; keep the first one
+	t.peersMu.Lock()
+	if t.ctx.Err() != nil {
+		t.peersMu.Unlock()
+		peer.conn.Close()
+		return nil, NewTransportError("transport is closed", 6006, nil)
+	}
+	if existing, exists := t.peers[key]; exists {
+		t.peersMu.Unlock()
+		peer.conn.Close()
+		return existing, nil
+	}
+	t.peers[key] = peer
+	t.conns[peer.conn] = struct{}{}
+	// Added under the lock so Stop cannot be waiting yet
+	t.wg.Add(1)
+	t.peersMu.Unlock()
+
+	go func() {
+		defer t.wg.Done()
+		t.readLoop(peer)
+	}()
+
+	return peer, nil
+}
+
+// dial opens a TCP (or TLS) connection and performs the client side of the WebSocket handshake
+func (t *WebSocketTransport) dial(addr *net.TCPAddr) (*wsPeer, error) {
+	dialer := net.Dialer{Timeout: t.dialTimeout}
+	conn, err := dialer.DialContext(t.ctx, "tcp", addr.String())
+	if err != nil {
+		return nil, NewTransportError("failed to connect to peer", 6010, err)
+	}
+
+	scheme := "ws"
+	if t.tlsConfig != nil {
+		scheme = "wss"
+		tlsConfig := t.tlsConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = addr.IP.String()
+		}
+		conn = tls.Client(conn, tlsConfig)
+	}
+
+	// The whole handshake must complete within the dial timeout
+	conn.SetDeadline(time.Now().Add(t.dialTimeout))
+
+	challenge := make([]byte, 16)
+	if _, err := rand.Read(challenge); err != nil {
+		conn.Close()
+		return nil, NewTransportError("failed to generate WebSocket key", 6011, err)
+	}
+	challengeKey := base64.StdEncoding.EncodeToString(challenge)
+
+	req, err := http.NewRequest(http.MethodGet, scheme+"://"+addr.String()+t.path, nil)
+	if err != nil {
+		conn.Close()
+		return nil, NewTransportError("failed to build WebSocket request", 6017, err)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", challengeKey)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, NewTransportError("failed to send WebSocket handshake", 6012, err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, NewTransportError("failed to read WebSocket handshake", 6018, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != websocketAccept(challengeKey) {
+		conn.Close()
+		return nil, NewTransportError("WebSocket handshake rejected: "+resp.Status, 6013, nil)
+	}
+
+	peer := &wsPeer{conn: conn, reader: reader, addr: addr, client: true}
+
+	// Announce our listen port so the peer can reply over this connection
+	hello := make([]byte, wsHelloSize)
+	if t.listenAddr != nil {
+		binary.BigEndian.PutUint16(hello, uint16(t.listenAddr.Port))
+	}
+	if err := t.writeMessage(peer, wsOpBinary, hello); err != nil {
+		conn.Close()
+		return nil, NewTransportError("failed to send WebSocket hello", 6019, err)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return peer, nil
+}
+
+// handleUpgrade performs the server side of the WebSocket handshake and serves the connection
+func (t *WebSocketTransport) handleUpgrade(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet ||
+		!strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		!headerContainsToken(r.Header, "Connection", "upgrade") {
+		http.Error(w, "WebSocket upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	challengeKey := r.Header.Get("Sec-WebSocket-Key")
+	if challengeKey == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection cannot be upgraded", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	// The HTTP server may have set deadlines for the request
+	conn.SetDeadline(time.Time{})
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(challengeKey) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return
+	}
+
+	remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		conn.Close()
+		return
+	}
+
+	// Tracked under the lock so Stop closes it even before its hello arrives
+	t.peersMu.Lock()
+	if t.ctx.Err() != nil {
+		t.peersMu.Unlock()
+		conn.Close()
+		return
+	}
+	t.conns[conn] = struct{}{}
+	t.wg.Add(1)
+	t.peersMu.Unlock()
+	defer t.wg.Done()
+
+	peer := &wsPeer{conn: conn, reader: rw.Reader, addr: remote}
+
+	// The hello message must arrive within the read timeout
+	if readTimeout := t.getReadTimeout(); readTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+	}
+	hello, err := t.readMessage(peer)
+	if err != nil || len(hello) != wsHelloSize {
+		t.closeConn(conn)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// The canonical address is the remote IP with the announced listen port;
+	// client-mode dialers announce 0 and keep the connection's remote address
+	if port := binary.BigEndian.Uint16(hello); port != 0 {
+		peer.addr = &net.TCPAddr{IP: remote.IP, Port: int(port), Zone: remote.Zone}
+	}
+
+	// Reuse this connection for replies unless we already have one
+	key := peer.addr.String()
+	t.peersMu.Lock()
+	if t.ctx.Err() != nil {
+		// Stop already closed every connection
+		t.peersMu.Unlock()
+		conn.Close()
+		return
+	}
+	if _, exists := t.peers[key]; !exists {
+		t.peers[key] = peer
+	}
+	t.peersMu.Unlock()
+
+	t.readLoop(peer)
+}
+
+// readLoop delivers binary messages from a peer connection to the handler
+func (t *WebSocketTransport) readLoop(peer *wsPeer) {
+	key := peer.addr.String()
+	defer t.removePeer(key, peer)
+
+	for {
+		payload, err := t.readMessage(peer)
+		if err != nil {
+			return
+		}
+
+		data, err := t.openFrame(key, payload)
+		if err != nil {
+			continue
+		}
+
+		handler := t.getHandler()
+		if handler != nil {
+			handler(peer.addr, data)
+		}
+	}
+}
+
+// removePeer closes and forgets a peer connection if it is still the registered one
+func (t *WebSocketTransport) removePeer(key string, peer *wsPeer) {
+	t.peersMu.Lock()
+	if current, exists := t.peers[key]; exists && current == peer {
+		delete(t.peers, key)
+	}
+	t.peersMu.Unlock()
+	t.closeConn(peer.conn)
+}
+
+// closeConn closes a connection and stops tracking it
+func (t *WebSocketTransport) closeConn(conn net.Conn) {
+	t.peersMu.Lock()
+	delete(t.conns, conn)
+	t.peersMu.Unlock()
+	conn.Close()
+}
+
+// readMessage reads the next binary message, answering control frames and
+// reassembling fragmented messages along the way
+func (t *WebSocketTransport) readMessage(peer *wsPeer) ([]byte, error) {
+	var message []byte
+	var messageOp uint8
+	fragmented := false
+
+	for {
+		fin, opcode, payload, err := t.readFrame(peer)
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case wsOpPing:
+			if err := t.writeMessage(peer, wsOpPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			// Echo the close frame and end the connection
+			t.writeMessage(peer, wsOpClose, payload)
+			return nil, io.EOF
+		case wsOpContinuation:
+			if !fragmented {
+				return nil, errors.New("unexpected WebSocket continuation frame")
+			}
+		case wsOpText, wsOpBinary:
+			if fragmented {
+				return nil, errors.New("interleaved WebSocket data frames")
+			}
+			messageOp = opcode
+			fragmented = true
+		default:
+			return nil, errors.New("unknown WebSocket opcode")
+		}
+
+		if len(message)+len(payload) > t.maxFrameSize {
+			return nil, errors.New("WebSocket message exceeds maximum frame size")
+		}
+		message = append(message, payload...)
+
+		if fin {
+			// Only binary messages carry packets
+			if messageOp != wsOpBinary {
+				message = nil
+				fragmented = false
+				continue
+			}
+			return message, nil
+		}
+	}
+}
+
+// readFrame reads a single WebSocket frame and unmasks its payload
+func (t *WebSocketTransport) readFrame(peer *wsPeer) (fin bool, opcode uint8, payload []byte, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(peer.reader, header); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	// Clients must mask every frame they send (RFC 6455 section 5.1)
+	if !peer.client && !masked {
+		return false, 0, nil, errors.New("unmasked WebSocket frame from client")
+	}
+
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err = io.ReadFull(peer.reader, extended); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err = io.ReadFull(peer.reader, extended); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended)
+	}
+
+	if length > uint64(t.maxFrameSize) {
+		return false, 0, nil, errors.New("WebSocket frame exceeds maximum frame size")
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(peer.reader, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(peer.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// writeMessage writes a single unfragmented WebSocket frame
+func (t *WebSocketTransport) writeMessage(peer *wsPeer, opcode uint8, payload []byte) error {
+	frame := make([]byte, 0, len(payload)+14)
+	frame = append(frame, 0x80|opcode)
+
+	maskBit := uint8(0)
+	if peer.client {
+		maskBit = 0x80
+	}
+
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|uint8(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+
+	if peer.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range payload {
+			frame[start+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	peer.writeMu.Lock()
+	defer peer.writeMu.Unlock()
+
+	if writeTimeout := t.getWriteTimeout(); writeTimeout > 0 {
+		peer.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	}
+	_, err := peer.conn.Write(frame)
+	return err
+}
+
+// websocketAccept computes the Sec-WebSocket-Accept value for a handshake key
+func websocketAccept(challengeKey string) string {
+	hash := sha1.Sum([]byte(challengeKey + websocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// headerContainsToken reports whether a comma-separated header contains a token
+func headerContainsToken(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -142,4 +142,63 @@ func TestIdentityValidation(t *testing.T) {
 
 	// Verify invalid identity should fail validation
 	assert.False(t, invalidId.Validate(), "Invalid identity should fail validation")
-}
\ No newline at end of file
+}
+
+func TestP256Identity(t *testing.T) {
+	// Generate P-256 identity
+	id, err := identity.NewIdentityWithType(identity.IdentityTypeP256)
+	assert.NoError(t, err, "Creating P-256 identity should succeed")
+	assert.Equal(t, identity.IdentityTypeP256, id.Type, "Identity type should be P-256")
+	assert.Len(t, id.PublicKey, 33, "Compressed P-256 public key should be 33 bytes")
+	assert.True(t, id.Validate(), "P-256 identity should be valid")
+
+	// Serialization keeps the type field
+	restored, err := identity.NewIdentityFromString(id.Serialize())
+	assert.NoError(t, err, "Creating identity from serialized string should succeed")
+	assert.Equal(t, identity.IdentityTypeP256, restored.Type, "Restored identity type should be P-256")
+	assert.Equal(t, id.PublicKey, restored.PublicKey, "Public keys should match")
+	assert.Equal(t, id.PrivateKey, restored.PrivateKey, "Private keys should match")
+
+	// Type is inferred from the public key when only the key is known
+	publicId, err := identity.NewIdentityFromPublic(id.PublicKey)
+	assert.NoError(t, err, "Creating identity from public key should succeed")
+	assert.Equal(t, identity.IdentityTypeP256, publicId.Type, "Type should be inferred from key length")
+}
+
+func TestP256SharedSecret(t *testing.T) {
+	id1, err := identity.NewIdentityWithType(identity.IdentityTypeP256)
+	assert.NoError(t, err, "Creating first identity should succeed")
+
+	id2, err := identity.NewIdentityWithType(identity.IdentityTypeP256)
+	assert.NoError(t, err, "Creating second identity should succeed")
+
+	secret1, err := id1.GetSharedSecret(id2)
+	assert.NoError(t, err, "Calculating shared secret should succeed")
+
+	secret2, err := id2.GetSharedSecret(id1)
+	assert.NoError(t, err, "Calculating shared secret should succeed")
+	assert.Equal(t, secret1, secret2, "Shared secrets calculated in both directions should be the same")
+
+	// Key agreement across identity types is rejected
+	c25519Id, _ := identity.NewIdentity()
+	_, err = id1.GetSharedSecret(c25519Id)
+	assert.Error(t, err, "Shared secret between different identity types should fail")
+}
+
+func TestIdentityTypeParsing(t *testing.T) {
+	idType, err := identity.ParseIdentityType("p256")
+	assert.NoError(t, err)
+	assert.Equal(t, identity.IdentityTypeP256, idType)
+
+	idType, err = identity.ParseIdentityType("0")
+	assert.NoError(t, err)
+	assert.Equal(t, identity.IdentityTypeC25519, idType)
+
+	_, err = identity.ParseIdentityType("rsa")
+	assert.Error(t, err, "Unknown identity type should fail to parse")
+
+	// Unsupported type field in serialized form is rejected
+	id, _ := identity.NewIdentity()
+	_, err = identity.NewIdentityFromString(id.Address.String() + ":7:" + base64.StdEncoding.EncodeToString(id.PublicKey))
+	assert.Error(t, err, "Unsupported identity type should fail to deserialize")
+}
@@ -0,0 +1,206 @@
+package keystore_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stella/virtual-switch/pkg/identity"
+	"github.com/stella/virtual-switch/pkg/keystore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMemoryKeyStore tests key operations through the in-memory backend
+func TestMemoryKeyStore(t *testing.T) {
+	id, err := identity.NewIdentityWithType(identity.IdentityTypeP256)
+	require.NoError(t, err)
+
+	ks, err := keystore.NewMemoryKeyStore(id)
+	require.NoError(t, err)
+
+	// The public identity never carries the private key
+	publicId, err := ks.Identity()
+	require.NoError(t, err)
+	assert.False(t, publicId.HasPrivateKey())
+	assert.True(t, id.Address.Equals(publicId.Address))
+
+	// Key agreement matches the identity's own computation
+	peer, err := identity.NewIdentityWithType(identity.IdentityTypeP256)
+	require.NoError(t, err)
+	secret, err := ks.DeriveSharedSecret(peer.PublicKey)
+	require.NoError(t, err)
+	expected, err := peer.GetSharedSecret(id)
+	require.NoError(t, err)
+	assert.Equal(t, expected, secret)
+
+	// Signatures verify against the public identity
+	message := []byte("signed by the key store")
+	signature, err := ks.Sign(message)
+	require.NoError(t, err)
+	assert.True(t, publicId.Verify(message, signature))
+	assert.False(t, publicId.Verify([]byte("tampered"), signature))
+
+	// Closed stores refuse further operations
+	require.NoError(t, ks.Close())
+	_, err = ks.Sign(message)
+	assert.ErrorIs(t, err, keystore.ErrClosed)
+
+	// Identities without a private key cannot back a key store
+	_, err = keystore.NewMemoryKeyStore(publicId)
+	assert.Error(t, err)
+}
+
+// TestCurve25519Signing tests that Curve25519 identities report signing as unsupported
+func TestCurve25519Signing(t *testing.T) {
+	id, err := identity.NewIdentity()
+	require.NoError(t, err)
+
+	ks, err := keystore.NewMemoryKeyStore(id)
+	require.NoError(t, err)
+	defer ks.Close()
+
+	_, err = ks.Sign([]byte("message"))
+	assert.ErrorIs(t, err, identity.ErrSigningUnsupported)
+}
+
+// TestFileKeyStore tests loading a key store from a JSON identity file
+func TestFileKeyStore(t *testing.T) {
+	id, err := identity.NewIdentity()
+	require.NoError(t, err)
+
+	data, err := json.Marshal(id)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "identity.json")
+	require.NoError(t, os.WriteFile(path, data, 0600))
+
+	ks, err := keystore.OpenFileKeyStore(path)
+	require.NoError(t, err)
+	defer ks.Close()
+
+	publicId, err := ks.Identity()
+	require.NoError(t, err)
+	assert.True(t, id.Address.Equals(publicId.Address))
+	assert.Equal(t, id.PublicKey, publicId.PublicKey)
+
+	// Missing files are reported
+	_, err = keystore.OpenFileKeyStore(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
+
+// TestAgentKeyStore tests key operations forwarded to an agent over a Unix socket
+func TestAgentKeyStore(t *testing.T) {
+	id, err := identity.NewIdentityWithType(identity.IdentityTypeP256)
+	require.NoError(t, err)
+
+	store, err := keystore.NewMemoryKeyStore(id)
+	require.NoError(t, err)
+
+	// Start the agent
+	socketPath := filepath.Join(t.TempDir(), "agent.sock")
+	server := keystore.NewAgentServer(store)
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- server.ListenAndServe(socketPath) }()
+
+	// Wait for the socket to appear
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(socketPath)
+		return err == nil
+	}, 2*time.Second, 10*time.Millisecond)
+
+	client, err := keystore.NewAgentKeyStore(socketPath)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// Identity comes back without the private key
+	publicId, err := client.Identity()
+	require.NoError(t, err)
+	assert.False(t, publicId.HasPrivateKey())
+	assert.Equal(t, identity.IdentityTypeP256, publicId.Type)
+	assert.Equal(t, id.PublicKey, publicId.PublicKey)
+
+	// ECDH through the agent
+	peer, err := identity.NewIdentityWithType(identity.IdentityTypeP256)
+	require.NoError(t, err)
+	secret, err := client.DeriveSharedSecret(peer.PublicKey)
+	require.NoError(t, err)
+	expected, err := peer.GetSharedSecret(id)
+	require.NoError(t, err)
+	assert.Equal(t, expected, secret)
+
+	// Signing through the agent
+	message := []byte("signed by the agent")
+	signature, err := client.Sign(message)
+	require.NoError(t, err)
+	assert.True(t, publicId.Verify(message, signature))
+
+	// Errors from the backing store are forwarded
+	_, err = client.DeriveSharedSecret([]byte{0x01, 0x02})
+	assert.Error(t, err)
+
+	require.NoError(t, server.Close())
+	assert.NoError(t, <-serveErr)
+}
+
+// TestAgentSocket tests socket permissions, refusing to replace other files and reconnecting
+func TestAgentSocket(t *testing.T) {
+	id, err := identity.NewIdentityWithType(identity.IdentityTypeP256)
+	require.NoError(t, err)
+	store, err := keystore.NewMemoryKeyStore(id)
+	require.NoError(t, err)
+
+	// A regular file at the socket path is not removed
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "not-a-socket")
+	require.NoError(t, os.WriteFile(filePath, []byte("keep"), 0644))
+	assert.Error(t, keystore.NewAgentServer(store).ListenAndServe(filePath))
+	content, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	assert.Equal(t, "keep", string(content))
+
+	socketPath := filepath.Join(dir, "agent.sock")
+	startAgent := func() (*keystore.AgentServer, chan error) {
+		server := keystore.NewAgentServer(store)
+		serveErr := make(chan error, 1)
+		go func() { serveErr <- server.ListenAndServe(socketPath) }()
+		require.Eventually(t, func() bool {
+			_, err := os.Stat(socketPath)
+			return err == nil
+		}, 2*time.Second, 10*time.Millisecond)
+		return server, serveErr
+	}
+
+	server, serveErr := startAgent()
+	info, err := os.Lstat(socketPath)
+	require.NoError(t, err)
+	assert.NotZero(t, info.Mode()&os.ModeSocket)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	client, err := keystore.NewAgentKeyStore(socketPath)
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Identity()
+	require.NoError(t, err)
+
+	// The agent restarts; the failed call drops the connection and the next one reconnects
+	require.NoError(t, server.Close())
+	require.NoError(t, <-serveErr)
+	_, err = os.Lstat(socketPath)
+	assert.True(t, os.IsNotExist(err))
+	_, err = client.Identity()
+	assert.Error(t, err)
+
+	server, serveErr = startAgent()
+	publicId, err := client.Identity()
+	require.NoError(t, err)
+	assert.Equal(t, id.PublicKey, publicId.PublicKey)
+
+	require.NoError(t, client.Close())
+	_, err = client.Identity()
+	assert.ErrorIs(t, err, keystore.ErrClosed)
+	require.NoError(t, server.Close())
+	require.NoError(t, <-serveErr)
+}
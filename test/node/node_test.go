@@ -1,6 +1,9 @@
 package node_test
 
 import (
+	"context"
+	"encoding/base64"
+	"net"
 	"os"
 	"path/filepath"
 	"testing"
@@ -8,7 +11,10 @@ import (
 
 	"github.com/stella/virtual-switch/pkg/identity"
 	"github.com/stella/virtual-switch/pkg/node"
+	"github.com/stella/virtual-switch/pkg/portmap"
+	"github.com/stella/virtual-switch/pkg/transport"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNodeCreation(t *testing.T) {
@@ -127,6 +133,198 @@ func TestConfigManagement(t *testing.T) {
 	assert.NotNil(t, loadedIdentity.Address)
 }
 
+// TestLoadLegacyIdentity tests that identity files written before addresses were encoded as text still load
+func TestLoadLegacyIdentity(t *testing.T) {
+	id, err := identity.NewIdentity()
+	require.NoError(t, err)
+
+	// The format written by earlier releases: the address is an empty object and there is no type
+	legacy := `{"Address":{},"PublicKey":"` + base64.StdEncoding.EncodeToString(id.PublicKey) +
+		`","PrivateKey":"` + base64.StdEncoding.EncodeToString(id.PrivateKey) + `"}`
+	config := node.DefaultConfig()
+	config.IdentityFile = filepath.Join(t.TempDir(), "identity.json")
+	require.NoError(t, os.WriteFile(config.IdentityFile, []byte(legacy), 0600))
+
+	loaded, err := config.LoadIdentity()
+	require.NoError(t, err)
+	assert.Equal(t, identity.IdentityTypeC25519, loaded.Type)
+	assert.True(t, id.Address.Equals(loaded.Address))
+	assert.True(t, loaded.Validate())
+
+	ks, err := config.OpenKeyStore()
+	require.NoError(t, err)
+	defer ks.Close()
+	publicId, err := ks.Identity()
+	require.NoError(t, err)
+	assert.True(t, id.Address.Equals(publicId.Address))
+}
+
+// TestConfigIdentityType tests that a new identity and the transport use the configured key type
+func TestConfigIdentityType(t *testing.T) {
+	config := node.DefaultConfig()
+	config.IdentityFile = filepath.Join(t.TempDir(), "identity.json")
+	config.IdentityType = "p256"
+
+	// The missing identity file is created with the configured type
+	created, err := config.LoadIdentity()
+	require.NoError(t, err)
+	assert.Equal(t, identity.IdentityTypeP256, created.Type)
+
+	// An existing file keeps its own type
+	config.IdentityType = "c25519"
+	loaded, err := config.LoadIdentity()
+	require.NoError(t, err)
+	assert.Equal(t, identity.IdentityTypeP256, loaded.Type)
+	assert.True(t, created.Address.Equals(loaded.Address))
+
+	config.IdentityType = "p256"
+	transportConfig, err := config.TransportConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "p256", transportConfig["identityType"])
+
+	// Unknown types are rejected
+	config.IdentityType = "rsa"
+	config.IdentityFile = filepath.Join(t.TempDir(), "identity.json")
+	_, err = config.LoadIdentity()
+	assert.Error(t, err)
+}
+
+func TestConfigListenAddrs(t *testing.T) {
+	// Default config listens on all interfaces
+	addrs, err := node.DefaultConfig().ListenAddrs()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{":9993"}, addrs)
+
+	// Explicit addresses inherit the BindAddr port
+	config := &node.Config{
+		BindAddr:  ":12345",
+		BindAddrs: []string{"192.0.2.1", "2001:db8::1", "[2001:db8::2]", "198.51.100.1:4000"},
+	}
+	addrs, err = config.ListenAddrs()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1:12345", "[2001:db8::1]:12345", "[2001:db8::2]:12345", "198.51.100.1:4000"}, addrs)
+
+	// A host in BindAddr is kept alongside BindAddrs
+	config = &node.Config{BindAddr: "10.0.0.1:9993", BindAddrs: []string{"10.0.0.1", "10.0.0.2"}}
+	transportConfig, err := config.TransportConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:9993", "10.0.0.2:9993"}, transportConfig["bindAddrs"])
+
+	// Invalid entries are rejected
+	_, err = (&node.Config{BindAddr: ":9993", BindAddrs: []string{"localhost"}}).ListenAddrs()
+	assert.Error(t, err)
+	_, err = (&node.Config{BindAddr: "9993"}).ListenAddrs()
+	assert.Error(t, err)
+}
+
+func TestNodeNATStatus(t *testing.T) {
+	id, _ := identity.NewIdentity()
+	n, _ := node.NewNode("nat-node", id)
+	_, reported := node.GetNodeStatus(n)["nat"]
+	assert.False(t, reported)
+
+	// Two reflection servers and the node share an in-memory network, the node behind a NAT
+	network := transport.NewMemoryNetwork()
+	_, err := network.AddNAT(transport.NATConfig{Type: transport.NATPortRestrictedCone, PublicIP: "198.51.100.1", PrivateNetwork: "10.1.0.0/24"})
+	require.NoError(t, err)
+	attach := func(addr string, ident *identity.Identity) (transport.Transport, *transport.RendezvousManager) {
+		memTransport, err := transport.NewTransport(transport.TransportTypeMemory, map[string]interface{}{"network": network, "addr": addr})
+		require.NoError(t, err)
+		rendezvous := transport.NewRendezvousManager(ident, memTransport)
+		require.NoError(t, memTransport.Start(rendezvous.Handler(nil)))
+		t.Cleanup(func() {
+			rendezvous.Stop()
+			memTransport.Stop()
+		})
+		return memTransport, rendezvous
+	}
+
+	var servers []net.Addr
+	for _, addr := range []string{"203.0.113.1:9993", "203.0.113.2:9993"} {
+		serverIdentity, _ := identity.NewIdentity()
+		serverTransport, _ := attach(addr, serverIdentity)
+		servers = append(servers, serverTransport.GetLocalAddr())
+	}
+	localTransport, reflector := attach("10.1.0.2:9993", id)
+
+	report, err := n.DetectNAT(reflector, servers, []net.Addr{localTransport.GetLocalAddr()}, 50*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, report, n.GetNATReport())
+
+	// The servers cannot answer change requests, so only the mapping is known
+	nat, reported := node.GetNodeStatus(n)["nat"].(map[string]interface{})
+	require.True(t, reported)
+	assert.Equal(t, "unknown", nat["type"])
+	endpoints := nat["externalEndpoints"].([]string)
+	require.Len(t, endpoints, 1)
+	assert.Contains(t, endpoints[0], "198.51.100.1:")
+}
+
+// staticMapClient is a port mapping client that always grants the same mapping
+type staticMapClient struct {
+	deleted bool
+}
+
+func (c *staticMapClient) Name() string { return "static" }
+
+func (c *staticMapClient) AddMapping(ctx context.Context, internalPort, externalPort int, lifetime time.Duration) (*portmap.Mapping, error) {
+	return &portmap.Mapping{
+		Protocol:     c.Name(),
+		InternalPort: internalPort,
+		ExternalIP:   net.ParseIP("198.51.100.1"),
+		ExternalPort: 45000,
+		Lifetime:     lifetime,
+		CreatedAt:    time.Now(),
+	}, nil
+}
+
+func (c *staticMapClient) DeleteMapping(ctx context.Context, mapping *portmap.Mapping) error {
+	c.deleted = true
+	return nil
+}
+
+func TestNodePortMapping(t *testing.T) {
+	id, err := identity.NewIdentity()
+	require.NoError(t, err)
+	n, err := node.NewNode("test-portmap-node", id)
+	require.NoError(t, err)
+
+	// Disabled mapping needs no gateway
+	config := node.DefaultConfig()
+	assert.False(t, config.PortMapping)
+	mapper, err := config.NewPortMapper(context.Background())
+	assert.NoError(t, err)
+	assert.Nil(t, mapper)
+	assert.Error(t, n.StartPortMapping(mapper, nil))
+	config.PortMapping = true
+	config.BindAddr = ":0"
+	_, err = config.NewPortMapper(context.Background())
+	assert.Error(t, err)
+
+	client := &staticMapClient{}
+	var advertised []net.Addr
+	require.NoError(t, n.StartPortMapping(portmap.NewMapper(9993, client), func(addr net.Addr) error {
+		advertised = append(advertised, addr)
+		return nil
+	}))
+	require.Len(t, advertised, 1)
+	assert.Equal(t, "198.51.100.1:45000", advertised[0].String())
+
+	status := node.GetNodeStatus(n)
+	mapping, ok := status["portMapping"].(map[string]interface{})
+	require.True(t, ok)
+	assert.Equal(t, "static", mapping["protocol"])
+	assert.Equal(t, "198.51.100.1:45000", mapping["externalEndpoint"])
+
+	// Stopping removes the mapping from the router and withdraws the endpoint
+	require.NoError(t, n.StopPortMapping())
+	assert.True(t, client.deleted)
+	require.Len(t, advertised, 2)
+	assert.Nil(t, advertised[1])
+	assert.Nil(t, n.GetPortMapping())
+	assert.NotContains(t, node.GetNodeStatus(n), "portMapping")
+}
+
 func TestLogger(t *testing.T) {
 	// Create a logger with debug level
 	logger := node.NewLogger("test-logger", "debug")
@@ -0,0 +1,433 @@
+package portmap_test
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stella/virtual-switch/pkg/portmap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeGateway answers NAT-PMP and, if pcp is set, PCP requests on a loopback UDP socket
+type fakeGateway struct {
+	conn *net.UDPConn
+	pcp  bool
+
+	mu       sync.Mutex
+	mappings map[int]int // internal port -> external port
+	requests int
+	silent   bool
+}
+
+// startFakeGateway starts a fake NAT-PMP gateway, with PCP support if pcp is true
+func startFakeGateway(t *testing.T, pcp bool) *fakeGateway {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	gateway := &fakeGateway{conn: conn, pcp: pcp, mappings: make(map[int]int)}
+	go gateway.serve()
+	return gateway
+}
+
+// addr returns the gateway's UDP address
+func (g *fakeGateway) addr() *net.UDPAddr {
+	return g.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// setSilent makes the gateway ignore all requests
+func (g *fakeGateway) setSilent(silent bool) {
+	g.mu.Lock()
+	g.silent = silent
+	g.mu.Unlock()
+}
+
+// mapped returns the external port for internalPort, if mapped
+func (g *fakeGateway) mapped(internalPort int) (int, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	port, exists := g.mappings[internalPort]
+	return port, exists
+}
+
+// mapRequests returns the number of mapping requests answered
+func (g *fakeGateway) mapRequests() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.requests
+}
+
+// serve answers requests until the socket is closed
+func (g *fakeGateway) serve() {
+	buffer := make([]byte, 1100)
+	for {
+		n, addr, err := g.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		g.mu.Lock()
+		silent := g.silent
+		g.mu.Unlock()
+		if silent || n < 2 {
+			continue
+		}
+
+		request := buffer[:n]
+		var reply []byte
+		switch {
+		case request[0] == 2 && g.pcp:
+			reply = g.handlePCP(request, addr)
+		case request[0] != 0:
+			// NAT-PMP gateways answer other versions with "unsupported version"
+			reply = []byte{0, 128 + request[1]&0x7f, 0, 1, 0, 0, 0, 1}
+		case request[1] == 0:
+			reply = []byte{0, 128, 0, 0, 0, 0, 0, 1, 203, 0, 113, 7}
+		case request[1] == 1 && n == 12:
+			internal := int(binary.BigEndian.Uint16(request[4:6]))
+			external := g.update(internal, int(binary.BigEndian.Uint16(request[6:8])), binary.BigEndian.Uint32(request[8:12]))
+			reply = []byte{0, 129, 0, 0, 0, 0, 0, 1}
+			reply = binary.BigEndian.AppendUint16(reply, uint16(internal))
+			reply = binary.BigEndian.AppendUint16(reply, uint16(external))
+			reply = append(reply, request[8:12]...)
+		default:
+			reply = []byte{0, 128 + request[1], 0, 5, 0, 0, 0, 1}
+		}
+		g.conn.WriteToUDP(reply, addr)
+	}
+}
+
+// handlePCP answers a PCP MAP request
+func (g *fakeGateway) handlePCP(request []byte, addr *net.UDPAddr) []byte {
+	if len(request) != 60 || request[1] != 1 {
+		return []byte{2, 0x80 | request[1], 0, 3}
+	}
+	reply := make([]byte, 60)
+	reply[0], reply[1] = 2, 0x81
+	copy(reply[4:8], request[4:8])
+	copy(reply[24:], request[24:])
+
+	// The client address in the request must match the packet's source
+	if !net.IP(request[8:24]).Equal(addr.IP) {
+		reply[3] = 12
+		return reply
+	}
+
+	internal := int(binary.BigEndian.Uint16(request[40:42]))
+	external := g.update(internal, int(binary.BigEndian.Uint16(request[42:44])), binary.BigEndian.Uint32(request[4:8]))
+	binary.BigEndian.PutUint16(reply[42:44], uint16(external))
+	copy(reply[44:60], net.ParseIP("203.0.113.7").To16())
+	return reply
+}
+
+// update creates, renews or (with a zero lifetime) deletes a mapping
+func (g *fakeGateway) update(internal, suggested int, lifetime uint32) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.requests++
+	if lifetime == 0 {
+		delete(g.mappings, internal)
+		return 0
+	}
+	if external, exists := g.mappings[internal]; exists {
+		return external
+	}
+	external := suggested
+	if external == 0 {
+		external = 40000 + len(g.mappings)
+	}
+	g.mappings[internal] = external
+	return external
+}
+
+// fakeUPnPGateway is an Internet Gateway Device with an SSDP responder
+type fakeUPnPGateway struct {
+	server *httptest.Server
+	ssdp   *net.UDPConn
+
+	// onlyPermanent rejects leases other than 0, like many consumer routers
+	onlyPermanent bool
+
+	mu       sync.Mutex
+	mappings map[string]string // external port -> internal client:port
+}
+
+// upnpArgument extracts an argument from a SOAP request body
+var upnpArgument = regexp.MustCompile(`<(New\w+)>([^<]*)</New\w+>`)
+
+// startFakeUPnPGateway starts the device description, control and SSDP endpoints
+func startFakeUPnPGateway(t *testing.T, onlyPermanent bool) *fakeUPnPGateway {
+	gateway := &fakeUPnPGateway{onlyPermanent: onlyPermanent, mappings: make(map[string]string)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rootDesc.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+        <deviceList>
+          <device>
+            <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+            <serviceList>
+              <service>
+                <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+                <controlURL>/ctl/IPConn</controlURL>
+              </service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`)
+	})
+	mux.HandleFunc("/ctl/IPConn", gateway.control)
+	gateway.server = httptest.NewServer(mux)
+	t.Cleanup(gateway.server.Close)
+
+	var err error
+	gateway.ssdp, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	t.Cleanup(func() { gateway.ssdp.Close() })
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			_, addr, err := gateway.ssdp.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			response := "HTTP/1.1 200 OK\r\n" +
+				"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+				"LOCATION: " + gateway.server.URL + "/rootDesc.xml\r\n\r\n"
+			gateway.ssdp.WriteToUDP([]byte(response), addr)
+		}
+	}()
+	return gateway
+}
+
+// control answers SOAP actions
+func (g *fakeUPnPGateway) control(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	args := make(map[string]string)
+	for _, match := range upnpArgument.FindAllStringSubmatch(string(body), -1) {
+		args[match[1]] = match[2]
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch r.Header.Get("SOAPAction") {
+	case `"urn:schemas-upnp-org:service:WANIPConnection:1#AddPortMapping"`:
+		if g.onlyPermanent && args["NewLeaseDuration"] != "0" {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>`+
+				`<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>725</errorCode>`+
+				`<errorDescription>OnlyPermanentLeasesSupported</errorDescription></UPnPError></detail>`+
+				`</s:Fault></s:Body></s:Envelope>`)
+			return
+		}
+		g.mappings[args["NewExternalPort"]] = args["NewInternalClient"] + ":" + args["NewInternalPort"]
+		fmt.Fprint(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+			`<u:AddPortMappingResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"/></s:Body></s:Envelope>`)
+	case `"urn:schemas-upnp-org:service:WANIPConnection:1#GetExternalIPAddress"`:
+		fmt.Fprint(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+			`<u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">`+
+			`<NewExternalIPAddress>198.51.100.9</NewExternalIPAddress></u:GetExternalIPAddressResponse></s:Body></s:Envelope>`)
+	case `"urn:schemas-upnp-org:service:WANIPConnection:1#DeletePortMapping"`:
+		delete(g.mappings, args["NewExternalPort"])
+		fmt.Fprint(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+			`<u:DeletePortMappingResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"/></s:Body></s:Envelope>`)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// mapping returns the internal endpoint forwarded from externalPort
+func (g *fakeUPnPGateway) mapping(externalPort int) (string, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	internal, exists := g.mappings[fmt.Sprint(externalPort)]
+	return internal, exists
+}
+
+// TestPCPClient tests MAP requests against a PCP gateway
+func TestPCPClient(t *testing.T) {
+	gateway := startFakeGateway(t, true)
+	client := portmap.NewPCPClient(gateway.addr())
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	mapping, err := client.AddMapping(ctx, 9993, 0, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, "pcp", mapping.Protocol)
+	assert.Equal(t, "203.0.113.7:40000", mapping.ExternalAddr().String())
+	assert.Equal(t, time.Hour, mapping.Lifetime)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), mapping.Expiry(), time.Second)
+
+	// Renewal keeps the external port
+	renewed, err := client.AddMapping(ctx, 9993, mapping.ExternalPort, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, mapping.ExternalPort, renewed.ExternalPort)
+
+	require.NoError(t, client.DeleteMapping(ctx, mapping))
+	_, exists := gateway.mapped(9993)
+	assert.False(t, exists)
+
+	// Gateways that only speak NAT-PMP reject PCP
+	legacy := portmap.NewPCPClient(startFakeGateway(t, false).addr())
+	_, err = legacy.AddMapping(ctx, 9993, 0, time.Hour)
+	assert.ErrorContains(t, err, "unsupported version")
+}
+
+// TestNATPMPClient tests mappings and external address requests against a NAT-PMP gateway
+func TestNATPMPClient(t *testing.T) {
+	gateway := startFakeGateway(t, false)
+	client := portmap.NewNATPMPClient(gateway.addr())
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	ip, err := client.ExternalIP(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "203.0.113.7", ip.String())
+
+	mapping, err := client.AddMapping(ctx, 9993, 9993, 2*time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, "nat-pmp", mapping.Protocol)
+	assert.Equal(t, "203.0.113.7:9993", mapping.ExternalAddr().String())
+	assert.Equal(t, 2*time.Hour, mapping.Lifetime)
+
+	require.NoError(t, client.DeleteMapping(ctx, mapping))
+	_, exists := gateway.mapped(9993)
+	assert.False(t, exists)
+
+	// A gateway that does not answer fails once the context is done
+	gateway.setSilent(true)
+	short, cancelShort := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelShort()
+	_, err = client.AddMapping(short, 9993, 0, time.Hour)
+	assert.Error(t, err)
+}
+
+// TestUPnPClient tests SSDP discovery and SOAP port mapping
+func TestUPnPClient(t *testing.T) {
+	gateway := startFakeUPnPGateway(t, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	client, err := portmap.DiscoverUPnPAt(ctx, gateway.ssdp.LocalAddr().String())
+	require.NoError(t, err)
+
+	ip, err := client.ExternalIP(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "198.51.100.9", ip.String())
+
+	// The gateway only allows permanent leases, so the client falls back to one
+	mapping, err := client.AddMapping(ctx, 9993, 0, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, "upnp", mapping.Protocol)
+	assert.Equal(t, "198.51.100.9:9993", mapping.ExternalAddr().String())
+	assert.Zero(t, mapping.Lifetime)
+	assert.True(t, mapping.Expiry().IsZero())
+	internal, exists := gateway.mapping(9993)
+	require.True(t, exists)
+	assert.Equal(t, "127.0.0.1:9993", internal)
+
+	require.NoError(t, client.DeleteMapping(ctx, mapping))
+	_, exists = gateway.mapping(9993)
+	assert.False(t, exists)
+
+	// Nothing answers on an unused port
+	quiet, cancelQuiet := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelQuiet()
+	_, err = portmap.DiscoverUPnPAt(quiet, "127.0.0.1:9")
+	assert.Error(t, err)
+}
+
+// TestMapper tests client fallback, lease renewal and listener notification
+func TestMapper(t *testing.T) {
+	legacy := startFakeGateway(t, false)
+	upnpGateway := startFakeUPnPGateway(t, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	upnp, err := portmap.DiscoverUPnPAt(ctx, upnpGateway.ssdp.LocalAddr().String())
+	require.NoError(t, err)
+
+	mapper := portmap.NewMapper(9993,
+		portmap.NewPCPClient(legacy.addr()),
+		portmap.NewNATPMPClient(legacy.addr()),
+		upnp,
+	)
+	require.NoError(t, mapper.SetLifetime(2*time.Second))
+	require.NoError(t, mapper.SetRequestTimeout(200*time.Millisecond))
+	require.NoError(t, mapper.SetRetryInterval(100*time.Millisecond))
+
+	var mu sync.Mutex
+	var events []string
+	mapper.AddListener(func(mapping *portmap.Mapping) {
+		mu.Lock()
+		defer mu.Unlock()
+		if mapping == nil {
+			events = append(events, "lost")
+			return
+		}
+		events = append(events, mapping.Protocol+" "+mapping.ExternalAddr().String())
+	})
+	seen := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), events...)
+	}
+
+	// PCP is rejected, so NAT-PMP holds the mapping
+	require.NoError(t, mapper.Start())
+	require.NotNil(t, mapper.Mapping())
+	assert.Equal(t, "nat-pmp", mapper.Mapping().Protocol)
+	assert.Equal(t, []string{"nat-pmp 203.0.113.7:40000"}, seen())
+
+	// The lease is renewed halfway through without notifying listeners again
+	assert.Eventually(t, func() bool { return legacy.mapRequests() >= 2 }, 3*time.Second, 20*time.Millisecond)
+	assert.Len(t, seen(), 1)
+
+	// When the gateway stops answering, the mapper moves to UPnP, asking for the same port
+	legacy.setSilent(true)
+	assert.Eventually(t, func() bool { return len(seen()) == 2 }, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, "upnp 198.51.100.9:40000", seen()[1])
+	_, exists := upnpGateway.mapping(40000)
+	assert.True(t, exists)
+
+	require.NoError(t, mapper.Stop())
+	assert.Nil(t, mapper.Mapping())
+	_, exists = upnpGateway.mapping(40000)
+	assert.False(t, exists)
+	assert.Equal(t, "lost", seen()[2])
+	assert.Error(t, mapper.Stop())
+}
+
+// TestMapperWithoutGateway tests that a mapper without a working client reports the failure
+func TestMapperWithoutGateway(t *testing.T) {
+	assert.ErrorIs(t, portmap.NewMapper(9993).Start(), portmap.ErrNoClients)
+
+	gateway := startFakeGateway(t, false)
+	gateway.setSilent(true)
+	mapper := portmap.NewMapper(9993, portmap.NewNATPMPClient(gateway.addr()))
+	require.NoError(t, mapper.SetRequestTimeout(50*time.Millisecond))
+	assert.Error(t, mapper.SetLifetime(0))
+
+	err := mapper.Start()
+	assert.ErrorContains(t, err, "nat-pmp")
+	assert.Nil(t, mapper.Mapping())
+	assert.Equal(t, err, mapper.Err())
+	require.NoError(t, mapper.Stop())
+}
@@ -0,0 +1,143 @@
+package transport_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stella/virtual-switch/pkg/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestUDPTransportBatchConfig tests validation of the batching options
+func TestUDPTransportBatchConfig(t *testing.T) {
+	var transportErr *transport.TransportError
+
+	err := transport.NewUDPTransport().Init(map[string]interface{}{"batchSize": 0})
+	require.True(t, errors.As(err, &transportErr))
+	assert.Equal(t, 3035, transportErr.Code)
+
+	err = transport.NewUDPTransport().Init(map[string]interface{}{"handlerWorkers": -1})
+	require.True(t, errors.As(err, &transportErr))
+	assert.Equal(t, 3036, transportErr.Code)
+}
+
+// TestUDPTransportBatchedReceive tests that every packet arrives, in order per sender,
+// with batched reads, handler workers and borrowed buffers in every combination
+func TestUDPTransportBatchedReceive(t *testing.T) {
+	const senders, perSender = 3, 200
+
+	for _, config := range []map[string]interface{}{
+		{"batchSize": 1, "handlerWorkers": 0},
+		{"batchSize": 16, "handlerWorkers": 0},
+		{"batchSize": 16, "handlerWorkers": 4},
+		{"batchSize": 16, "handlerWorkers": 4, "borrowBuffers": true},
+	} {
+		config["ackHandlerEnabled"] = false
+		config["pathMTUDiscovery"] = false
+
+		var mu sync.Mutex
+		received := make(map[string][]uint32)
+		done := make(chan struct{})
+		total := 0
+
+		server := transport.NewUDPTransport()
+		require.NoError(t, server.Init(config))
+		require.NoError(t, server.Start(func(addr net.Addr, data []byte) error {
+			// The payload repeats its sequence number, so a reused buffer would show
+			if len(data) != 64 || !bytes.Equal(data[:4], data[60:]) {
+				t.Errorf("corrupted packet %x", data)
+				return nil
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			received[addr.String()] = append(received[addr.String()], binary.BigEndian.Uint32(data))
+			if total++; total == senders*perSender {
+				close(done)
+			}
+			return nil
+		}))
+
+		clients := make([]*transport.UDPTransport, senders)
+		var wg sync.WaitGroup
+		for i := range clients {
+			clients[i] = transport.NewUDPTransport()
+			require.NoError(t, clients[i].Init(map[string]interface{}{"ackHandlerEnabled": false, "pathMTUDiscovery": false}))
+			require.NoError(t, clients[i].Start(func(addr net.Addr, data []byte) error { return nil }))
+
+			wg.Add(1)
+			go func(client *transport.UDPTransport) {
+				defer wg.Done()
+				for seq := uint32(0); seq < perSender; seq++ {
+					packet := make([]byte, 64)
+					for offset := 0; offset < len(packet); offset += 4 {
+						binary.BigEndian.PutUint32(packet[offset:], seq)
+					}
+					client.Send(server.GetLocalAddr(), packet)
+					if seq%50 == 49 {
+						// Stay within the receive socket buffer
+						time.Sleep(5 * time.Millisecond)
+					}
+				}
+			}(clients[i])
+		}
+		wg.Wait()
+
+		select {
+		case <-done:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("%v: received %d of %d packets", config, total, senders*perSender)
+		}
+
+		mu.Lock()
+		for _, client := range clients {
+			sequence := received[client.GetLocalAddr().String()]
+			require.Len(t, sequence, perSender, "%v", config)
+			for i, seq := range sequence {
+				require.Equal(t, uint32(i), seq, "%v: packets from one sender stay in order", config)
+			}
+		}
+		mu.Unlock()
+
+		for _, client := range clients {
+			client.Stop()
+		}
+		server.Stop()
+	}
+}
+
+// TestUDPTransportBatchedFragments tests that fragments written in one batch are reassembled
+func TestUDPTransportBatchedFragments(t *testing.T) {
+	received := make(chan receivedPacket, 1)
+	server := transport.NewUDPTransport()
+	require.NoError(t, server.Init(map[string]interface{}{"batchSize": 8}))
+	require.NoError(t, server.Start(func(addr net.Addr, data []byte) error {
+		received <- receivedPacket{addr: addr, data: data}
+		return nil
+	}))
+	defer server.Stop()
+
+	// Only the sender needs path MTU discovery; the receiver always reassembles
+	client := transport.NewUDPTransport()
+	require.NoError(t, client.Init(map[string]interface{}{"batchSize": 8, "pathMTUDiscovery": true}))
+	require.NoError(t, client.Start(func(addr net.Addr, data []byte) error { return nil }))
+	defer client.Stop()
+
+	// Larger than the 1280-byte starting path MTU, so it is split into fragments
+	payload := bytes.Repeat([]byte("fragmented "), 1000)
+	results, err := client.SendWithResult(server.GetLocalAddr(), payload)
+	require.NoError(t, err)
+	assert.True(t, waitForResult(t, results).Delivered)
+
+	packet := waitForPacket(t, received)
+	assert.Equal(t, payload, packet.data)
+
+	toServer, ok := client.Stats().Peer(server.GetLocalAddr())
+	require.True(t, ok)
+	assert.GreaterOrEqual(t, toServer.PacketsSent, uint64(9), "each fragment counts as a datagram")
+}
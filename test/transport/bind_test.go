@@ -0,0 +1,103 @@
+package transport_test
+
+import (
+	"net"
+	"runtime"
+	"testing"
+
+	"github.com/stella/virtual-switch/pkg/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newEchoServer starts a UDP transport on bindAddrs that echoes every packet back
+func newEchoServer(t *testing.T, bindAddrs []string) *transport.UDPTransport {
+	server := transport.NewUDPTransport()
+	require.NoError(t, server.Init(map[string]interface{}{"bindAddrs": bindAddrs}))
+	require.NoError(t, server.Start(func(addr net.Addr, data []byte) error {
+		return server.Send(addr, data)
+	}))
+	t.Cleanup(func() { server.Stop() })
+	return server
+}
+
+// echoFrom sends data to dst and returns the address the echo came from
+func echoFrom(t *testing.T, dst *net.UDPAddr) *net.UDPAddr {
+	clientAddr := "127.0.0.1:0"
+	if dst.IP.To4() == nil {
+		clientAddr = "[::1]:0"
+	}
+	client := transport.NewUDPTransport()
+	require.NoError(t, client.Init(map[string]interface{}{"addr": clientAddr}))
+	packets := make(chan receivedPacket, 4)
+	require.NoError(t, client.Start(func(addr net.Addr, data []byte) error {
+		packets <- receivedPacket{addr: addr, data: append([]byte(nil), data...)}
+		return nil
+	}))
+	defer client.Stop()
+
+	// The ACK must also come from dst, or it would not match the pending packet
+	result, err := client.SendWithResult(dst, []byte("ping"))
+	require.NoError(t, err)
+	assert.True(t, waitForResult(t, result).Delivered)
+
+	packet := waitForPacket(t, packets)
+	assert.Equal(t, "ping", string(packet.data))
+	return packet.addr.(*net.UDPAddr)
+}
+
+// TestUDPTransportMultipleBindAddrs tests binding several addresses on one port
+func TestUDPTransportMultipleBindAddrs(t *testing.T) {
+	server := newEchoServer(t, []string{"127.0.0.1:0", "127.0.0.2:0"})
+
+	addrs := server.LocalAddrs()
+	require.Len(t, addrs, 2)
+	first, second := addrs[0].(*net.UDPAddr), addrs[1].(*net.UDPAddr)
+	assert.Equal(t, first.Port, second.Port, "addresses without a port share the first one's port")
+
+	// Each echo leaves from the address the request arrived on
+	for _, addr := range []*net.UDPAddr{first, second} {
+		assert.Equal(t, addr.String(), echoFrom(t, addr).String())
+	}
+}
+
+// TestUDPTransportWildcardReplySource tests the reply source address on an all-interfaces socket
+func TestUDPTransportWildcardReplySource(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("reply source selection on wildcard sockets needs IP_PKTINFO")
+	}
+
+	server := newEchoServer(t, []string{":0"})
+	addrs := server.LocalAddrs()
+	require.NotEmpty(t, addrs)
+	assert.True(t, addrs[0].(*net.UDPAddr).IP.IsUnspecified())
+
+	// The kernel would answer 127.0.0.2 from 127.0.0.1 without packet info
+	dst := &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: addrs[0].(*net.UDPAddr).Port}
+	assert.Equal(t, dst.String(), echoFrom(t, dst).String())
+}
+
+// TestUDPTransportBindAddrsIPv6 tests an explicit IPv6 bind address
+func TestUDPTransportBindAddrsIPv6(t *testing.T) {
+	probe, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skip("IPv6 loopback is not available")
+	}
+	probe.Close()
+
+	server := newEchoServer(t, []string{"[::1]:0", "127.0.0.1:0"})
+	addrs := server.LocalAddrs()
+	require.Len(t, addrs, 2)
+	v6 := addrs[0].(*net.UDPAddr)
+	assert.Equal(t, v6.String(), echoFrom(t, v6).String())
+}
+
+// TestUDPTransportInvalidBindAddrs tests bind address validation
+func TestUDPTransportInvalidBindAddrs(t *testing.T) {
+	for _, bindAddr := range []string{"127.0.0.1", "example.com:9993", "127.0.0.1:99999"} {
+		_, err := transport.NewTransport(transport.TransportTypeUDP, map[string]interface{}{
+			"bindAddrs": []string{bindAddr},
+		})
+		assert.Error(t, err, bindAddr)
+	}
+}
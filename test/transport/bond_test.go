@@ -0,0 +1,268 @@
+package transport_test
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stella/virtual-switch/pkg/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// hostPacket records a packet that reached a multihomed host
+type hostPacket struct {
+	via  string // local address the packet arrived at
+	from net.Addr
+	data []byte
+}
+
+// multihomedHost is a peer reachable at several addresses, echoing every packet back
+type multihomedHost struct {
+	addrs    []net.Addr
+	received chan hostPacket
+}
+
+// newMultihomedHost attaches one bonded transport per address, so probes are answered on each
+func newMultihomedHost(t *testing.T, network *transport.MemoryNetwork, addrs ...string) *multihomedHost {
+	host := &multihomedHost{received: make(chan hostPacket, 1024)}
+	for _, addr := range addrs {
+		inner, err := transport.NewTransport(transport.TransportTypeMemory, map[string]interface{}{"network": network, "addr": addr})
+		require.NoError(t, err)
+		bonded := transport.NewBondedTransport(inner)
+		local := addr
+		require.NoError(t, bonded.Start(func(srcAddr net.Addr, data []byte) error {
+			host.received <- hostPacket{via: local, from: srcAddr, data: data}
+			return bonded.Send(srcAddr, data)
+		}))
+		t.Cleanup(func() { bonded.Stop() })
+		host.addrs = append(host.addrs, bonded.GetLocalAddr())
+	}
+	return host
+}
+
+// nextPacket waits for the next packet to reach the host
+func (h *multihomedHost) nextPacket(t *testing.T) hostPacket {
+	select {
+	case packet := <-h.received:
+		return packet
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a packet")
+		return hostPacket{}
+	}
+}
+
+// drain discards packets received so far
+func (h *multihomedHost) drain() {
+	for {
+		select {
+		case <-h.received:
+		default:
+			return
+		}
+	}
+}
+
+// bondedSender is the local end of a bond, with impairments per path
+type bondedSender struct {
+	bonded   *transport.BondedTransport
+	impaired *transport.ImpairedTransport
+	received chan receivedPacket
+
+	mu     sync.Mutex
+	events []transport.BondEvent
+}
+
+// newBondedSender creates a started bonded transport probing every 20ms
+func newBondedSender(t *testing.T, network *transport.MemoryNetwork) *bondedSender {
+	inner, err := transport.NewTransport(transport.TransportTypeMemory, map[string]interface{}{"network": network, "addr": "10.0.0.1:9993"})
+	require.NoError(t, err)
+
+	sender := &bondedSender{received: make(chan receivedPacket, 1024)}
+	sender.impaired = transport.NewImpairedTransport(inner, 1)
+	sender.bonded = transport.NewBondedTransport(sender.impaired)
+	require.NoError(t, sender.bonded.SetProbeTiming(20*time.Millisecond, 100*time.Millisecond))
+	sender.bonded.AddBondListener(func(event transport.BondEvent) {
+		sender.mu.Lock()
+		sender.events = append(sender.events, event)
+		sender.mu.Unlock()
+	})
+	require.NoError(t, sender.bonded.Start(func(srcAddr net.Addr, data []byte) error {
+		sender.received <- receivedPacket{addr: srcAddr, data: data}
+		return nil
+	}))
+	t.Cleanup(func() { sender.bonded.Stop() })
+	return sender
+}
+
+// activePath returns the bond's active path
+func (s *bondedSender) activePath(peer net.Addr) net.Addr {
+	status, _ := s.bonded.Bond(peer)
+	return status.Active
+}
+
+// hasEvent reports whether an event of the given type for path was fired
+func (s *bondedSender) hasEvent(eventType transport.BondEventType, path net.Addr) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, event := range s.events {
+		if event.Type == eventType && event.Path.String() == path.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// udpFrame builds an Ethernet/IPv4/UDP frame for the given source port
+func udpFrame(srcPort uint16, vlan bool) []byte {
+	frame := make([]byte, 12, 64)
+	copy(frame, []byte{0x02, 0, 0, 0, 0, 1, 0x02, 0, 0, 0, 0, 2})
+	if vlan {
+		frame = append(frame, 0x81, 0x00, 0x00, 0x2a)
+	}
+	frame = append(frame, 0x08, 0x00)
+
+	ip := make([]byte, 28)
+	ip[0] = 0x45
+	ip[9] = 17
+	copy(ip[12:16], net.IPv4(192, 168, 0, 1).To4())
+	copy(ip[16:20], net.IPv4(192, 168, 0, 2).To4())
+	binary.BigEndian.PutUint16(ip[20:22], srcPort)
+	binary.BigEndian.PutUint16(ip[22:24], 27015)
+	return append(frame, ip...)
+}
+
+// TestBondActiveBackup tests failover to the backup path and back, with replies
+// from either path reported from the peer address
+func TestBondActiveBackup(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	host := newMultihomedHost(t, network, "192.168.1.2:9993", "203.0.113.2:9993")
+	primary, backup := host.addrs[0], host.addrs[1]
+	sender := newBondedSender(t, network)
+	require.NoError(t, sender.bonded.AddBond(primary, transport.BondPolicyActiveBackup, primary, backup))
+
+	require.NoError(t, sender.bonded.Send(primary, []byte("before")))
+	assert.Equal(t, primary.String(), host.nextPacket(t).via)
+	assert.Equal(t, primary, waitForPacket(t, sender.received).addr)
+
+	// The primary path goes dark; the game session moves to the backup
+	require.NoError(t, sender.impaired.SetImpairment(primary, transport.Impairment{Loss: 1}))
+	require.Eventually(t, func() bool { return sender.activePath(primary).String() == backup.String() }, 2*time.Second, 10*time.Millisecond)
+	assert.True(t, sender.hasEvent(transport.BondPathDown, primary))
+	assert.True(t, sender.hasEvent(transport.BondActivePathChanged, backup))
+
+	host.drain()
+	require.NoError(t, sender.bonded.Send(primary, []byte("after")))
+	packet := host.nextPacket(t)
+	assert.Equal(t, backup.String(), packet.via)
+	reply := waitForPacket(t, sender.received)
+	assert.Equal(t, primary, reply.addr, "replies over the backup still come from the peer address")
+	assert.Equal(t, []byte("after"), reply.data)
+
+	// The primary recovers and takes the traffic back
+	sender.impaired.ClearImpairment(primary)
+	require.Eventually(t, func() bool { return sender.activePath(primary).String() == primary.String() }, 2*time.Second, 10*time.Millisecond)
+	assert.True(t, sender.hasEvent(transport.BondPathUp, primary))
+}
+
+// TestBondLatencyPolicy tests that the latency policy moves to the path with the better quality score
+func TestBondLatencyPolicy(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	host := newMultihomedHost(t, network, "203.0.113.2:9993", "[2001:db8::2]:9993")
+	slow, fast := host.addrs[0], host.addrs[1]
+	sender := newBondedSender(t, network)
+	require.NoError(t, sender.impaired.SetImpairment(slow, transport.Impairment{Latency: 40 * time.Millisecond}))
+	require.NoError(t, sender.bonded.AddBond(slow, transport.BondPolicyLatency, slow, fast))
+
+	require.Eventually(t, func() bool { return sender.activePath(slow).String() == fast.String() }, 2*time.Second, 10*time.Millisecond)
+
+	status, ok := sender.bonded.Bond(slow)
+	require.True(t, ok)
+	require.Len(t, status.Paths, 2)
+	assert.GreaterOrEqual(t, status.Paths[0].Path.Latency, 40)
+	assert.Greater(t, status.Paths[1].Quality, status.Paths[0].Quality)
+
+	host.drain()
+	require.NoError(t, sender.bonded.Send(slow, []byte("fast")))
+	assert.Equal(t, fast.String(), host.nextPacket(t).via)
+}
+
+// TestBondBalanceXOR tests that flows keep their path, and that only flows on a failed path move
+func TestBondBalanceXOR(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	host := newMultihomedHost(t, network, "192.168.1.2:9993", "203.0.113.2:9993")
+	peer := host.addrs[0]
+	sender := newBondedSender(t, network)
+	require.NoError(t, sender.bonded.AddBond(peer, transport.BondPolicyBalanceXOR, host.addrs...))
+
+	const flows = 32
+	sendFlows := func() map[uint16]string {
+		host.drain()
+		paths := make(map[uint16]string)
+		for port := uint16(0); port < flows; port++ {
+			require.NoError(t, sender.bonded.Send(peer, udpFrame(40000+port, false)))
+			paths[port] = host.nextPacket(t).via
+		}
+		return paths
+	}
+
+	before := sendFlows()
+	counts := make(map[string]int)
+	for _, via := range before {
+		counts[via]++
+	}
+	assert.Len(t, counts, 2, "flows are spread over both paths")
+	assert.Equal(t, before, sendFlows(), "each flow stays on its path")
+
+	require.NoError(t, sender.impaired.SetImpairment(peer, transport.Impairment{Loss: 1}))
+	require.Eventually(t, func() bool { return sender.hasEvent(transport.BondPathDown, peer) }, 2*time.Second, 10*time.Millisecond)
+
+	after := sendFlows()
+	for port, via := range before {
+		if via != peer.String() {
+			assert.Equal(t, via, after[port], "flows on the healthy path do not move")
+		}
+		assert.Equal(t, host.addrs[1].String(), after[port])
+	}
+}
+
+// TestBondConfiguration tests bond setup errors
+func TestBondConfiguration(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	inner, err := transport.NewTransport(transport.TransportTypeMemory, map[string]interface{}{"network": network})
+	require.NoError(t, err)
+	bonded := transport.NewBondedTransport(inner)
+
+	a := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 9993}
+	b := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 9993}
+
+	requireTransportError(t, bonded.AddBond(a, "round-robin"), 4024)
+	require.NoError(t, bonded.AddBond(a, transport.BondPolicyActiveBackup))
+	requireTransportError(t, bonded.AddBond(a, transport.BondPolicyLatency, b), 4025)
+	requireTransportError(t, bonded.AddPath(b, a), 4040)
+	requireTransportError(t, bonded.RemovePath(a, a), 4027)
+	requireTransportError(t, bonded.SetProbeTiming(time.Second, time.Second), 4028)
+
+	require.NoError(t, bonded.AddPath(a, b))
+	requireTransportError(t, bonded.AddPath(a, b), 4039)
+	requireTransportError(t, bonded.RemovePath(a, &net.UDPAddr{IP: net.ParseIP("192.0.2.3"), Port: 9993}), 4026)
+	require.NoError(t, bonded.SetBondPolicy(a, transport.BondPolicyBalanceXOR))
+	status, ok := bonded.Bond(a)
+	require.True(t, ok)
+	assert.Nil(t, status.Active)
+	assert.Len(t, status.Paths, 2)
+
+	bonded.RemoveBond(a)
+	_, ok = bonded.Bond(a)
+	assert.False(t, ok)
+}
+
+// TestDefaultFlowHash tests that frames hash by flow
+func TestDefaultFlowHash(t *testing.T) {
+	assert.Equal(t, transport.DefaultFlowHash(udpFrame(40000, false)), transport.DefaultFlowHash(udpFrame(40000, false)))
+	assert.Equal(t, transport.DefaultFlowHash(udpFrame(40000, false)), transport.DefaultFlowHash(udpFrame(40000, true)), "VLAN tags are skipped")
+	assert.NotEqual(t, transport.DefaultFlowHash(udpFrame(40000, false)), transport.DefaultFlowHash(udpFrame(40001, false)))
+	assert.Zero(t, transport.DefaultFlowHash([]byte("short")))
+}
@@ -0,0 +1,151 @@
+package transport_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stella/virtual-switch/pkg/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// requireTransportError asserts that err is a TransportError with the given code
+func requireTransportError(t *testing.T, err error, code int) *transport.TransportError {
+	var transportErr *transport.TransportError
+	require.True(t, errors.As(err, &transportErr), "%v", err)
+	assert.Equal(t, code, transportErr.Code, transportErr.Message)
+	return transportErr
+}
+
+// TestConfigFromMapRejectsMistakes tests that misspelled keys and wrong value types are errors
+func TestConfigFromMapRejectsMistakes(t *testing.T) {
+	_, err := transport.UDPConfigFromMap(map[string]interface{}{"maxRetry": 5})
+	assert.Contains(t, requireTransportError(t, err, 1004).Message, `"maxRetry"`)
+
+	_, err = transport.UDPConfigFromMap(map[string]interface{}{"retryinterval": time.Second})
+	assert.Contains(t, requireTransportError(t, err, 1004).Message, `did you mean "retryInterval"`)
+
+	// A bare 500 would be 500ns
+	_, err = transport.UDPConfigFromMap(map[string]interface{}{"retryInterval": 500})
+	assert.Contains(t, requireTransportError(t, err, 1005).Message, "time.Duration")
+
+	_, err = transport.TCPConfigFromMap(map[string]interface{}{"port": "9993"})
+	requireTransportError(t, err, 1005)
+
+	_, err = transport.WebSocketConfigFromMap(map[string]interface{}{"tlsConfig": true})
+	requireTransportError(t, err, 1005)
+
+	_, err = transport.MemoryConfigFromMap(map[string]interface{}{"network": transport.NewMemoryNetwork(), "nat": true})
+	requireTransportError(t, err, 1004)
+
+	// Init goes through the same adapter
+	_, err = transport.NewTransport(transport.TransportTypeUDP, map[string]interface{}{"bufferSzie": 8192})
+	requireTransportError(t, err, 1004)
+}
+
+// TestConfigFromMapKeepsDefaults tests that missing keys keep the documented defaults
+func TestConfigFromMapKeepsDefaults(t *testing.T) {
+	config, err := transport.UDPConfigFromMap(map[string]interface{}{"maxRetries": 5, "bindAddrs": nil})
+	require.NoError(t, err)
+
+	expected := transport.DefaultUDPConfig()
+	expected.MaxRetries = 5
+	assert.Equal(t, expected, config)
+	assert.Equal(t, 500*time.Millisecond, config.RetryInterval)
+	assert.True(t, config.AckHandlerEnabled)
+
+	tcpConfig, err := transport.TCPConfigFromMap(nil)
+	require.NoError(t, err)
+	assert.Equal(t, transport.DefaultTCPConfig(), tcpConfig)
+
+	wsConfig, err := transport.WebSocketConfigFromMap(map[string]interface{}{"mode": transport.WebSocketModeClient})
+	require.NoError(t, err)
+	assert.Equal(t, "/stella", wsConfig.Path)
+}
+
+// TestConfigValidate tests that invalid values are reported before anything is bound
+func TestConfigValidate(t *testing.T) {
+	assert.NoError(t, transport.DefaultUDPConfig().Validate())
+	assert.NoError(t, transport.DefaultTCPConfig().Validate())
+	assert.NoError(t, transport.DefaultWebSocketConfig().Validate())
+
+	for code, mutate := range map[int]func(c *transport.UDPConfig){
+		3037: func(c *transport.UDPConfig) { c.Port = 70000 },
+		3038: func(c *transport.UDPConfig) { c.Addr = "127.0.0.1" },
+		3034: func(c *transport.UDPConfig) { c.BindAddrs = []string{"example.com:9993"} },
+		3048: func(c *transport.UDPConfig) { c.BindAddrs = []string{"127.0.0.1"} },
+		3049: func(c *transport.UDPConfig) { c.BindAddrs = []string{"127.0.0.1:70000"} },
+		3039: func(c *transport.UDPConfig) { c.BufferSize = 0 },
+		3040: func(c *transport.UDPConfig) { c.MaxRetries = -1 },
+		3041: func(c *transport.UDPConfig) { c.RetryInterval = 0 },
+		3025: func(c *transport.UDPConfig) { c.ReliabilityMode = "" },
+		3026: func(c *transport.UDPConfig) { c.WindowSize = 0 },
+		3027: func(c *transport.UDPConfig) { c.MinRTO = 2 * c.MaxRTO },
+		3050: func(c *transport.UDPConfig) { c.InitialRTO = 0 },
+		3031: func(c *transport.UDPConfig) { c.MaxSendRate = -1 },
+		3033: func(c *transport.UDPConfig) { c.MaxPathMTU = 576 },
+		3042: func(c *transport.UDPConfig) { c.PMTUProbeTimeout = 0 },
+		3043: func(c *transport.UDPConfig) { c.FECMinGroupSize = c.FECGroupSize + 1 },
+		3044: func(c *transport.UDPConfig) { c.FECFlushInterval = 0 },
+		3035: func(c *transport.UDPConfig) { c.BatchSize = 0 },
+		3036: func(c *transport.UDPConfig) { c.HandlerWorkers = -1 },
+		3013: func(c *transport.UDPConfig) { c.IdentityType = "rsa" },
+	} {
+		config := transport.DefaultUDPConfig()
+		mutate(&config)
+		requireTransportError(t, config.Validate(), code)
+		requireTransportError(t, transport.NewUDPTransport().Configure(config), code)
+	}
+
+	tcpConfig := transport.DefaultTCPConfig()
+	tcpConfig.DialTimeout = 0
+	requireTransportError(t, tcpConfig.Validate(), 5012)
+
+	wsConfig := transport.DefaultWebSocketConfig()
+	wsConfig.Path = "stella"
+	requireTransportError(t, wsConfig.Validate(), 6002)
+
+	requireTransportError(t, transport.MemoryConfig{}.Validate(), 7001)
+	requireTransportError(t, transport.MemoryConfig{Network: transport.NewMemoryNetwork(), Addr: "host:1"}.Validate(), 7002)
+}
+
+// TestUDPTransportConfigure tests configuring a UDP transport with a typed config
+func TestUDPTransportConfigure(t *testing.T) {
+	config := transport.DefaultUDPConfig()
+	config.Addr = "127.0.0.1:0"
+	config.MaxRetries = 0
+	config.PathMTUDiscovery = false
+
+	client := transport.NewUDPTransport()
+	require.NoError(t, client.Configure(config))
+	require.NoError(t, client.Start(func(addr net.Addr, data []byte) error { return nil }))
+	defer client.Stop()
+
+	results, err := client.SendWithResult(deadUDPAddr(t), []byte("hello?"))
+	require.NoError(t, err)
+	result := waitForResult(t, results)
+	assert.False(t, result.Delivered)
+	assert.Equal(t, 0, result.Retries)
+}
+
+// TestUDPTransportDefaultRetryInterval tests that Init keeps the 500ms default retry interval
+func TestUDPTransportDefaultRetryInterval(t *testing.T) {
+	client := transport.NewUDPTransport()
+	require.NoError(t, client.Init(map[string]interface{}{"pathMTUDiscovery": false}))
+	require.NoError(t, client.Start(func(addr net.Addr, data []byte) error { return nil }))
+	defer client.Stop()
+
+	require.NoError(t, client.Send(deadUDPAddr(t), []byte("hello?")))
+	time.Sleep(200 * time.Millisecond)
+	assert.Zero(t, client.Stats().Retransmits, "nothing is retransmitted before the first interval")
+}
+
+// TestMemoryTransportConfigure tests attaching a memory transport with a typed config
+func TestMemoryTransportConfigure(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	memTransport := transport.NewMemoryTransport()
+	require.NoError(t, memTransport.Configure(transport.MemoryConfig{Network: network, Addr: "10.0.0.1:9993"}))
+	assert.Equal(t, "10.0.0.1:9993", memTransport.GetLocalAddr().String())
+}
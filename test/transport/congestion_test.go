@@ -0,0 +1,107 @@
+package transport_test
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stella/virtual-switch/pkg/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestUDPTransportCongestionOnSlowLink tests that the sender backs off on a narrow, shallow link
+func TestUDPTransportCongestionOnSlowLink(t *testing.T) {
+	server := transport.NewUDPTransport()
+	require.NoError(t, server.Init(windowTestConfig(64)))
+	client := transport.NewUDPTransport()
+	require.NoError(t, client.Init(windowTestConfig(64)))
+
+	var mu sync.Mutex
+	received := 0
+	require.NoError(t, server.Start(func(addr net.Addr, data []byte) error {
+		mu.Lock()
+		received++
+		mu.Unlock()
+		return nil
+	}))
+	defer server.Stop()
+
+	// A 500KB/s uplink with 20ms of buffering drops bursts
+	impaired := transport.NewImpairedTransport(client, 21)
+	require.NoError(t, impaired.SetImpairment(server.GetLocalAddr(), transport.Impairment{
+		Latency:       5 * time.Millisecond,
+		Bandwidth:     500000,
+		MaxQueueDelay: 20 * time.Millisecond,
+	}))
+	require.NoError(t, impaired.Start(func(addr net.Addr, data []byte) error { return nil }))
+	defer impaired.Stop()
+
+	const count = 300
+	payload := bytes.Repeat([]byte{0xAB}, 1000)
+	results := make([]<-chan transport.DeliveryResult, count)
+	for i := range results {
+		var err error
+		results[i], err = client.SendWithResult(server.GetLocalAddr(), payload)
+		require.NoError(t, err)
+	}
+	for _, result := range results {
+		outcome := waitForResult(t, result)
+		require.True(t, outcome.Delivered, "delivery failed: %v", outcome.Err)
+	}
+
+	mu.Lock()
+	assert.Equal(t, count, received)
+	mu.Unlock()
+
+	stats, ok := client.GetCongestionStats(server.GetLocalAddr())
+	require.True(t, ok)
+	assert.Greater(t, stats.LossEvents, uint64(0), "queue drops must shrink the window")
+	assert.Less(t, stats.SlowStartThreshold, 1024*1200)
+	assert.Greater(t, stats.PacingRate, int64(0))
+	assert.GreaterOrEqual(t, stats.SRTT, 5*time.Millisecond)
+	assert.Equal(t, 0, stats.BytesInFlight)
+}
+
+// TestUDPTransportUnreliableSharesPacing tests that unreliable sends are paced by maxSendRate
+func TestUDPTransportUnreliableSharesPacing(t *testing.T) {
+	config := windowTestConfig(16)
+	config["maxSendRate"] = 100000
+	server := transport.NewUDPTransport()
+	require.NoError(t, server.Init(windowTestConfig(16)))
+	client := transport.NewUDPTransport()
+	require.NoError(t, client.Init(config))
+
+	packets := make(chan receivedPacket, 64)
+	require.NoError(t, server.Start(func(addr net.Addr, data []byte) error {
+		packets <- receivedPacket{addr: addr, data: append([]byte(nil), data...)}
+		return nil
+	}))
+	defer server.Stop()
+	require.NoError(t, client.Start(func(addr net.Addr, data []byte) error { return nil }))
+	defer client.Stop()
+
+	payload := bytes.Repeat([]byte{0xCD}, 1000)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, client.SendUnreliable(server.GetLocalAddr(), payload))
+		require.NoError(t, client.Send(server.GetLocalAddr(), payload))
+	}
+	// 20KB at 100KB/s after a 2.4KB burst
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+
+	for i := 0; i < 20; i++ {
+		packet := waitForPacket(t, packets)
+		assert.Equal(t, payload, packet.data)
+	}
+
+	stats, ok := client.GetCongestionStats(server.GetLocalAddr())
+	require.True(t, ok)
+	assert.LessOrEqual(t, stats.PacingRate, int64(100000))
+	assert.Greater(t, stats.PacedPackets, uint64(0))
+
+	_, err := transport.NewTransport(transport.TransportTypeUDP, map[string]interface{}{"maxSendRate": -1})
+	assert.Error(t, err)
+}
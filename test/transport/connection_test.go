@@ -0,0 +1,340 @@
+package transport_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stella/virtual-switch/pkg/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connectionEvent is a connection event seen by a listener
+type connectionEvent struct {
+	event transport.ConnectionEvent
+	data  string
+	err   error
+}
+
+// managedPeer is a memory transport with a connection manager routing its packets
+type managedPeer struct {
+	transport transport.Transport
+	manager   *transport.DefaultConnectionManager
+
+	mu        sync.Mutex
+	events    []connectionEvent
+	unmanaged []string
+	sources   []net.Addr
+}
+
+// newManagedPeer attaches a memory transport at addr with a connection manager as its handler
+func newManagedPeer(t *testing.T, network *transport.MemoryNetwork, addr string) *managedPeer {
+	memTransport, err := transport.NewTransport(transport.TransportTypeMemory, map[string]interface{}{"network": network, "addr": addr})
+	require.NoError(t, err)
+
+	peer := &managedPeer{transport: memTransport, manager: transport.NewDefaultConnectionManager(memTransport)}
+	peer.manager.AddConnectionListener(func(conn transport.Connection, event transport.ConnectionEvent, data []byte, err error) {
+		peer.mu.Lock()
+		peer.events = append(peer.events, connectionEvent{event: event, data: string(data), err: err})
+		peer.mu.Unlock()
+	})
+	require.NoError(t, memTransport.Start(peer.manager.Handler(func(srcAddr net.Addr, data []byte) error {
+		peer.mu.Lock()
+		peer.unmanaged = append(peer.unmanaged, string(data))
+		peer.sources = append(peer.sources, srcAddr)
+		peer.mu.Unlock()
+		return nil
+	})))
+	t.Cleanup(func() { memTransport.Stop() })
+	return peer
+}
+
+// seen returns a copy of the events the listener received
+func (p *managedPeer) seen() []connectionEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]connectionEvent(nil), p.events...)
+}
+
+// TestConnectionSendReceive tests data flowing between two managed connections
+func TestConnectionSendReceive(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	alice := newManagedPeer(t, network, "192.0.2.1:9993")
+	bob := newManagedPeer(t, network, "192.0.2.2:9993")
+
+	toBob, err := alice.manager.CreateConnection(bob.transport.GetLocalAddr())
+	require.NoError(t, err)
+	toAlice, err := bob.manager.CreateConnection(alice.transport.GetLocalAddr())
+	require.NoError(t, err)
+	assert.Equal(t, transport.StateConnected, toBob.GetState())
+	assert.Equal(t, alice.transport.GetLocalAddr().String(), toBob.GetLocalAddr().String())
+
+	require.NoError(t, toBob.Send([]byte("hello bob")))
+	require.NoError(t, toAlice.SetReadTimeout(time.Second))
+	buffer := make([]byte, 64)
+	n, err := toAlice.Receive(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, "hello bob", string(buffer[:n]))
+
+	require.NoError(t, toAlice.Send([]byte("hello alice")))
+	require.NoError(t, toBob.SetReadTimeout(time.Second))
+	n, err = toBob.Receive(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, "hello alice", string(buffer[:n]))
+
+	// Listeners see the connection and the data
+	events := bob.seen()
+	require.Len(t, events, 2)
+	assert.Equal(t, transport.EventConnected, events[0].event)
+	assert.Equal(t, connectionEvent{event: transport.EventDataReceived, data: "hello bob"}, events[1])
+
+	// Packets from peers without a connection go to the next handler
+	carol := newManagedPeer(t, network, "192.0.2.3:9993")
+	require.NoError(t, carol.transport.Send(bob.transport.GetLocalAddr(), []byte("stranger")))
+	network.WaitIdle()
+	bob.mu.Lock()
+	assert.Equal(t, []string{"stranger"}, bob.unmanaged)
+	bob.mu.Unlock()
+}
+
+// TestConnectionInboundQueue tests the bounded queue, read timeouts and truncation
+func TestConnectionInboundQueue(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	alice := newManagedPeer(t, network, "192.0.2.1:9993")
+	bob := newManagedPeer(t, network, "192.0.2.2:9993")
+	require.NoError(t, bob.manager.SetQueueSize(2))
+	requireTransportError(t, bob.manager.SetQueueSize(0), 4035)
+
+	conn, err := bob.manager.CreateConnection(alice.transport.GetLocalAddr())
+	require.NoError(t, err)
+	for _, message := range []string{"one", "two", "three"} {
+		require.NoError(t, alice.transport.Send(bob.transport.GetLocalAddr(), []byte(message)))
+	}
+	network.WaitIdle()
+
+	// The third packet found the queue full
+	events := bob.seen()
+	require.Len(t, events, 4)
+	assert.Equal(t, transport.EventError, events[3].event)
+	var transportErr *transport.TransportError
+	require.True(t, errors.As(events[3].err, &transportErr))
+	assert.Equal(t, 4022, transportErr.Code)
+
+	// Oversized packets are truncated like datagrams
+	small := make([]byte, 2)
+	n, err := conn.Receive(small)
+	assert.Equal(t, 2, n)
+	require.True(t, errors.As(err, &transportErr))
+	assert.Equal(t, 4020, transportErr.Code)
+
+	buffer := make([]byte, 64)
+	n, err = conn.Receive(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, "two", string(buffer[:n]))
+
+	require.NoError(t, conn.SetReadTimeout(20*time.Millisecond))
+	requireTransportError(t, conn.SetReadTimeout(-time.Second), 4016)
+	requireTransportError(t, conn.SetWriteTimeout(-time.Second), 4034)
+	start := time.Now()
+	_, err = conn.Receive(buffer)
+	require.True(t, errors.As(err, &transportErr))
+	assert.Equal(t, 4018, transportErr.Code)
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+}
+
+// TestConnectionStateTransitions tests disconnecting and reconnecting a connection
+func TestConnectionStateTransitions(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	alice := newManagedPeer(t, network, "192.0.2.1:9993")
+	bob := newManagedPeer(t, network, "192.0.2.2:9993")
+
+	conn, err := bob.manager.CreateConnection(alice.transport.GetLocalAddr())
+	require.NoError(t, err)
+	require.NoError(t, alice.transport.Send(bob.transport.GetLocalAddr(), []byte("queued")))
+	network.WaitIdle()
+
+	// A blocked reader is woken when the connection closes
+	done := make(chan error, 1)
+	go func() {
+		buffer := make([]byte, 64)
+		conn.Receive(buffer) // consumes "queued"
+		_, err := conn.Receive(buffer)
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	require.NoError(t, conn.Disconnect())
+	select {
+	case err := <-done:
+		assert.True(t, errors.Is(err, io.EOF))
+		requireTransportError(t, err, 4036)
+	case <-time.After(time.Second):
+		t.Fatal("Receive was not woken by Disconnect")
+	}
+	assert.Equal(t, transport.StateDisconnected, conn.GetState())
+	assert.Nil(t, bob.manager.GetConnection(alice.transport.GetLocalAddr()))
+	requireTransportError(t, conn.Send([]byte("closed")), 4017)
+	require.NoError(t, conn.Disconnect(), "disconnecting twice is a no-op")
+
+	// Packets from the peer now go to the next handler
+	require.NoError(t, alice.transport.Send(bob.transport.GetLocalAddr(), []byte("after")))
+	network.WaitIdle()
+	bob.mu.Lock()
+	assert.Equal(t, []string{"after"}, bob.unmanaged)
+	bob.mu.Unlock()
+
+	// Reconnecting registers the connection again
+	var transportErr *transport.TransportError
+	err = conn.Connect(&net.UDPAddr{IP: net.ParseIP("192.0.2.9"), Port: 1})
+	require.True(t, errors.As(err, &transportErr))
+	assert.Equal(t, 4021, transportErr.Code)
+	require.NoError(t, conn.Connect(nil))
+	assert.Equal(t, transport.StateConnected, conn.GetState())
+	assert.Equal(t, conn, bob.manager.GetConnection(alice.transport.GetLocalAddr()))
+
+	var kinds []transport.ConnectionEvent
+	for _, event := range bob.seen() {
+		kinds = append(kinds, event.event)
+	}
+	assert.Equal(t, []transport.ConnectionEvent{
+		transport.EventConnected,
+		transport.EventDataReceived,
+		transport.EventDisconnected,
+		transport.EventConnected,
+	}, kinds)
+
+	// Closing through the manager disconnects the connection too
+	require.NoError(t, bob.manager.CloseAllConnections())
+	assert.Equal(t, transport.StateDisconnected, conn.GetState())
+	assert.Equal(t, transport.EventDisconnected, bob.seen()[4].event)
+	assert.Empty(t, bob.manager.GetConnections())
+}
+
+// TestConnectionKeepalive tests keepalives on idle connections and dead-peer detection
+func TestConnectionKeepalive(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	alice := newManagedPeer(t, network, "192.0.2.1:9993")
+	bob := newManagedPeer(t, network, "192.0.2.2:9993")
+
+	requireTransportError(t, bob.manager.SetKeepalive(-time.Second, 0), 4037)
+	requireTransportError(t, bob.manager.SetKeepalive(time.Second, time.Second), 4038) // timeout must exceed the interval
+
+	toBob, err := alice.manager.CreateConnection(bob.transport.GetLocalAddr())
+	require.NoError(t, err)
+	toAlice, err := bob.manager.CreateConnection(alice.transport.GetLocalAddr())
+	require.NoError(t, err)
+	require.NoError(t, alice.manager.SetKeepalive(20*time.Millisecond, 0))
+	require.NoError(t, bob.manager.SetKeepalive(0, 100*time.Millisecond))
+	t.Cleanup(func() {
+		alice.manager.SetKeepalive(0, 0)
+		bob.manager.SetKeepalive(0, 0)
+	})
+
+	// Alice's keepalives keep the idle connection alive without surfacing as data
+	time.Sleep(250 * time.Millisecond)
+	assert.Equal(t, transport.StateConnected, toAlice.GetState())
+	tracker, ok := toAlice.(transport.ActivityTracker)
+	require.True(t, ok)
+	assert.WithinDuration(t, time.Now(), tracker.LastReceived(), 60*time.Millisecond)
+	assert.WithinDuration(t, time.Now(), toBob.(transport.ActivityTracker).LastSent(), 60*time.Millisecond)
+	require.NoError(t, toAlice.SetReadTimeout(10*time.Millisecond))
+	_, err = toAlice.Receive(make([]byte, 64))
+	var transportErr *transport.TransportError
+	require.True(t, errors.As(err, &transportErr))
+	assert.Equal(t, 4018, transportErr.Code)
+
+	// Once alice goes quiet bob declares her dead
+	require.NoError(t, alice.manager.SetKeepalive(0, 0))
+	require.Eventually(t, func() bool {
+		return toAlice.GetState() == transport.StateDisconnected
+	}, time.Second, 10*time.Millisecond)
+	assert.Nil(t, bob.manager.GetConnection(alice.transport.GetLocalAddr()))
+
+	events := bob.seen()
+	require.Len(t, events, 2)
+	assert.Equal(t, transport.EventConnected, events[0].event)
+	assert.Equal(t, transport.EventDisconnected, events[1].event)
+	require.True(t, errors.As(events[1].err, &transportErr))
+	assert.Equal(t, 4023, transportErr.Code)
+}
+
+// TestConnectionKeepaliveHoldsNATMapping tests that keepalives stop a NAT mapping from expiring
+func TestConnectionKeepaliveHoldsNATMapping(t *testing.T) {
+	for _, keepalive := range []bool{false, true} {
+		network := transport.NewMemoryNetwork()
+		_, err := network.AddNAT(transport.NATConfig{Type: transport.NATFullCone, PublicIP: "198.51.100.1", PrivateNetwork: "10.1.0.0/24", MappingTimeout: 60 * time.Millisecond})
+		require.NoError(t, err)
+		alice := newManagedPeer(t, network, "10.1.0.2:9993")
+		bob := newManagedPeer(t, network, "192.0.2.2:9993")
+
+		toBob, err := alice.manager.CreateConnection(bob.transport.GetLocalAddr())
+		require.NoError(t, err)
+		if keepalive {
+			require.NoError(t, alice.manager.SetKeepalive(20*time.Millisecond, 0))
+			t.Cleanup(func() { alice.manager.SetKeepalive(0, 0) })
+		}
+
+		// Bob learns alice's public endpoint from her first packet
+		require.NoError(t, toBob.Send([]byte("hello")))
+		network.WaitIdle()
+		bob.mu.Lock()
+		require.Equal(t, []string{"hello"}, bob.unmanaged)
+		public := bob.sources[0]
+		bob.mu.Unlock()
+		assert.Contains(t, public.String(), "198.51.100.1:")
+		conn, err := bob.manager.CreateConnection(public)
+		require.NoError(t, err)
+
+		time.Sleep(200 * time.Millisecond)
+		require.NoError(t, conn.Send([]byte("still there?")))
+		network.WaitIdle()
+		require.NoError(t, toBob.SetReadTimeout(50*time.Millisecond))
+		buffer := make([]byte, 64)
+		n, err := toBob.Receive(buffer)
+		if keepalive {
+			require.NoError(t, err)
+			assert.Equal(t, "still there?", string(buffer[:n]))
+		} else {
+			assert.Error(t, err, "the mapping expired without keepalives")
+		}
+	}
+}
+
+// TestConnectionKeepaliveUDP tests keepalives between UDP transports, with and without ACKs
+func TestConnectionKeepaliveUDP(t *testing.T) {
+	for _, acks := range []bool{true, false} {
+		testConnectionKeepaliveUDP(t, acks)
+	}
+}
+
+// testConnectionKeepaliveUDP checks that keepalives keep two UDP connections alive
+// Without ACKs a keepalive is a zero-length datagram on the wire.
+func testConnectionKeepaliveUDP(t *testing.T, acks bool) {
+	managers := make([]*transport.DefaultConnectionManager, 2)
+	transports := make([]*transport.UDPTransport, 2)
+	for i := range transports {
+		transports[i] = transport.NewUDPTransport()
+		require.NoError(t, transports[i].Init(map[string]interface{}{"addr": "127.0.0.1:0", "ackHandlerEnabled": acks}))
+		managers[i] = transport.NewDefaultConnectionManager(transports[i])
+		require.NoError(t, transports[i].Start(managers[i].Handler(nil)))
+		t.Cleanup(func() { transports[i].Stop() })
+	}
+
+	conns := make([]transport.Connection, 2)
+	for i, manager := range managers {
+		var err error
+		conns[i], err = manager.CreateConnection(transports[1-i].GetLocalAddr())
+		require.NoError(t, err)
+		require.NoError(t, manager.SetKeepalive(20*time.Millisecond, 100*time.Millisecond))
+		t.Cleanup(func() { manager.SetKeepalive(0, 0) })
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	for _, conn := range conns {
+		assert.Equal(t, transport.StateConnected, conn.GetState())
+	}
+}
@@ -0,0 +1,146 @@
+package transport_test
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stella/virtual-switch/pkg/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// deliveryTestConfig retries quickly so failures are reported within a test
+var deliveryTestConfig = map[string]interface{}{
+	"maxRetries":       2,
+	"retryInterval":    10 * time.Millisecond,
+	"retryExponential": false,
+}
+
+// deadUDPAddr returns a loopback address with nothing listening on it
+func deadUDPAddr(t *testing.T) net.Addr {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	addr := conn.LocalAddr()
+	conn.Close()
+	return addr
+}
+
+// waitForResult waits for a delivery result or fails the test
+func waitForResult(t *testing.T, results <-chan transport.DeliveryResult) transport.DeliveryResult {
+	select {
+	case result := <-results:
+		return result
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timed out waiting for delivery result")
+		return transport.DeliveryResult{}
+	}
+}
+
+// TestUDPTransportDeliveryResult tests per-send results for acknowledged and unacknowledged packets
+func TestUDPTransportDeliveryResult(t *testing.T) {
+	server := transport.NewUDPTransport()
+	require.NoError(t, server.Init(deliveryTestConfig))
+	require.NoError(t, server.Start(func(addr net.Addr, data []byte) error { return nil }))
+	defer server.Stop()
+
+	client := transport.NewUDPTransport()
+	require.NoError(t, client.Init(deliveryTestConfig))
+	require.NoError(t, client.Start(func(addr net.Addr, data []byte) error { return nil }))
+	defer client.Stop()
+
+	var mu sync.Mutex
+	var observed []transport.DeliveryResult
+	client.AddDeliveryListener(func(result transport.DeliveryResult) {
+		mu.Lock()
+		observed = append(observed, result)
+		mu.Unlock()
+	})
+
+	// Acknowledged packet
+	results, err := client.SendWithResult(server.GetLocalAddr(), []byte("hello"))
+	require.NoError(t, err)
+	result := waitForResult(t, results)
+	assert.True(t, result.Delivered)
+	assert.NoError(t, result.Err)
+	assert.Equal(t, server.GetLocalAddr().String(), result.DstAddr.String())
+
+	// Nobody ACKs packets sent to a closed port
+	deadAddr := deadUDPAddr(t)
+	results, err = client.SendWithResult(deadAddr, []byte("hello?"))
+	require.NoError(t, err)
+	result = waitForResult(t, results)
+	assert.False(t, result.Delivered)
+	assert.Equal(t, 2, result.Retries)
+
+	var transportErr *transport.TransportError
+	require.True(t, errors.As(result.Err, &transportErr))
+	assert.Equal(t, 3023, transportErr.Code)
+
+	mu.Lock()
+	assert.Len(t, observed, 2)
+	mu.Unlock()
+
+	// Results need ACK handling
+	noAck := transport.NewUDPTransport()
+	require.NoError(t, noAck.Init(map[string]interface{}{"ackHandlerEnabled": false}))
+	defer noAck.Stop()
+	_, err = noAck.SendWithResult(server.GetLocalAddr(), []byte("hello"))
+	assert.Error(t, err)
+}
+
+// TestUDPTransportDeliveryResultOnStop tests that pending packets fail when the transport stops
+func TestUDPTransportDeliveryResultOnStop(t *testing.T) {
+	client := transport.NewUDPTransport()
+	require.NoError(t, client.Init(map[string]interface{}{"maxRetries": 10, "retryInterval": time.Second}))
+	require.NoError(t, client.Start(func(addr net.Addr, data []byte) error { return nil }))
+
+	results, err := client.SendWithResult(deadUDPAddr(t), []byte("hello?"))
+	require.NoError(t, err)
+	require.NoError(t, client.Stop())
+
+	result := waitForResult(t, results)
+	assert.False(t, result.Delivered)
+	assert.Error(t, result.Err)
+}
+
+// TestConnectionManagerDeliveryFailure tests error and disconnect events when a peer stops ACKing
+func TestConnectionManagerDeliveryFailure(t *testing.T) {
+	udpTransport, err := transport.NewTransport(transport.TransportTypeUDP, deliveryTestConfig)
+	require.NoError(t, err)
+	require.NoError(t, udpTransport.Start(func(addr net.Addr, data []byte) error { return nil }))
+	defer udpTransport.Stop()
+
+	manager := transport.NewDefaultConnectionManager(udpTransport)
+	require.NoError(t, manager.SetFailureThreshold(2))
+
+	events := make(chan transport.ConnectionEvent, 10)
+	manager.AddConnectionListener(func(conn transport.Connection, event transport.ConnectionEvent, data []byte, err error) {
+		if event == transport.EventError {
+			assert.Error(t, err)
+		}
+		events <- event
+	})
+
+	deadAddr := deadUDPAddr(t)
+	conn, err := manager.CreateConnection(deadAddr)
+	require.NoError(t, err)
+	assert.Equal(t, transport.EventConnected, <-events)
+
+	require.NoError(t, conn.Send([]byte("first")))
+	require.NoError(t, conn.Send([]byte("second")))
+
+	var received []transport.ConnectionEvent
+	for len(received) < 3 {
+		select {
+		case event := <-events:
+			received = append(received, event)
+		case <-time.After(3 * time.Second):
+			t.Fatalf("Timed out waiting for events, got %v", received)
+		}
+	}
+	assert.Equal(t, []transport.ConnectionEvent{transport.EventError, transport.EventError, transport.EventDisconnected}, received)
+	assert.Nil(t, manager.GetConnection(deadAddr))
+}
@@ -0,0 +1,132 @@
+package transport_test
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stella/virtual-switch/pkg/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fecPair is a UDP client sending with FEC to a server that records what it receives
+type fecPair struct {
+	client *transport.UDPTransport
+	server *transport.UDPTransport
+
+	mu       sync.Mutex
+	received []string
+}
+
+// newFECPair starts a server and a client configured with config plus FEC enabled
+func newFECPair(t *testing.T, config map[string]interface{}) *fecPair {
+	pair := &fecPair{server: transport.NewUDPTransport(), client: transport.NewUDPTransport()}
+	require.NoError(t, pair.server.Init(map[string]interface{}{"addr": "127.0.0.1:0"}))
+	require.NoError(t, pair.server.Start(func(addr net.Addr, data []byte) error {
+		pair.mu.Lock()
+		pair.received = append(pair.received, string(data))
+		pair.mu.Unlock()
+		return nil
+	}))
+	t.Cleanup(func() { pair.server.Stop() })
+
+	config["addr"] = "127.0.0.1:0"
+	config["fecEnabled"] = true
+	require.NoError(t, pair.client.Init(config))
+	require.NoError(t, pair.client.Start(func(addr net.Addr, data []byte) error { return nil }))
+	t.Cleanup(func() { pair.client.Stop() })
+	return pair
+}
+
+// dropFECIndex makes the client's link drop the FEC data packet at index in every group
+func (p *fecPair) dropFECIndex(index byte) {
+	p.client.SetLinkWriter(func(dstAddr net.Addr, data []byte, write func([]byte) error) error {
+		if len(data) > 6 && data[0] == 8 && data[5] == index {
+			return nil
+		}
+		return write(data)
+	})
+}
+
+// waitReceived waits until the server has received count packets and returns them sorted
+func (p *fecPair) waitReceived(t *testing.T, count int) []string {
+	require.Eventually(t, func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return len(p.received) >= count
+	}, 2*time.Second, 5*time.Millisecond)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	received := append([]string(nil), p.received...)
+	sort.Strings(received)
+	return received
+}
+
+// TestUDPTransportFECRecoversLoss tests that a lost packet in each group is rebuilt from parity
+func TestUDPTransportFECRecoversLoss(t *testing.T) {
+	pair := newFECPair(t, map[string]interface{}{"fecGroupSize": 4, "fecMinGroupSize": 4})
+	pair.dropFECIndex(1)
+
+	var expected []string
+	for i := 0; i < 20; i++ {
+		message := fmt.Sprintf("state-%02d", i)
+		expected = append(expected, message)
+		require.NoError(t, pair.client.SendUnreliable(pair.server.GetLocalAddr(), []byte(message)))
+	}
+
+	assert.Equal(t, expected, pair.waitReceived(t, 20))
+
+	serverStats, ok := pair.server.GetFECStats(pair.client.GetLocalAddr())
+	require.True(t, ok)
+	assert.Equal(t, uint64(5), serverStats.Recovered)
+	assert.Zero(t, serverStats.Unrecovered)
+
+	clientStats, ok := pair.client.GetFECStats(pair.server.GetLocalAddr())
+	require.True(t, ok)
+	assert.Equal(t, uint64(5), clientStats.ParitySent)
+	assert.Equal(t, 4, clientStats.GroupSize)
+}
+
+// TestUDPTransportFECFlushesPartialGroup tests that a group that does not fill up is still protected
+func TestUDPTransportFECFlushesPartialGroup(t *testing.T) {
+	pair := newFECPair(t, map[string]interface{}{"fecGroupSize": 8, "fecFlushInterval": 10 * time.Millisecond})
+	pair.dropFECIndex(1)
+
+	require.NoError(t, pair.client.SendUnreliable(pair.server.GetLocalAddr(), []byte("move")))
+	require.NoError(t, pair.client.SendUnreliable(pair.server.GetLocalAddr(), []byte("shoot")))
+
+	assert.Equal(t, []string{"move", "shoot"}, pair.waitReceived(t, 2))
+}
+
+// TestUDPTransportFECAdaptsGroupSize tests that reported loss shrinks the group size
+func TestUDPTransportFECAdaptsGroupSize(t *testing.T) {
+	pair := newFECPair(t, map[string]interface{}{"fecGroupSize": 16, "fecMinGroupSize": 2})
+
+	impaired := transport.NewImpairedTransport(pair.client, 48)
+	require.NoError(t, impaired.SetImpairment(pair.server.GetLocalAddr(), transport.Impairment{Loss: 0.2}))
+
+	for i := 0; i < 600; i++ {
+		require.NoError(t, pair.client.SendUnreliable(pair.server.GetLocalAddr(), []byte(fmt.Sprintf("state-%03d", i))))
+		if i%50 == 49 {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	require.Eventually(t, func() bool {
+		stats, _ := pair.client.GetFECStats(pair.server.GetLocalAddr())
+		return stats.GroupSize <= 4
+	}, 2*time.Second, 10*time.Millisecond)
+
+	stats, ok := pair.client.GetFECStats(pair.server.GetLocalAddr())
+	require.True(t, ok)
+	assert.InDelta(t, 0.2, stats.LossRate, 0.1)
+
+	serverStats, ok := pair.server.GetFECStats(pair.client.GetLocalAddr())
+	require.True(t, ok)
+	assert.Greater(t, serverStats.Recovered, uint64(0))
+}
@@ -0,0 +1,227 @@
+package transport_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stella/virtual-switch/pkg/identity"
+	"github.com/stella/virtual-switch/pkg/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestGuard creates a handshake guard from the default config changed by mutate
+func newTestGuard(t *testing.T, mutate func(c *transport.HandshakeGuardConfig)) *transport.HandshakeGuard {
+	config := transport.DefaultHandshakeGuardConfig()
+	mutate(&config)
+	guard, err := transport.NewHandshakeGuard(config)
+	require.NoError(t, err)
+	return guard
+}
+
+// udpAddr parses a UDP address for tests
+func udpAddr(t *testing.T, s string) *net.UDPAddr {
+	addr, err := net.ResolveUDPAddr("udp", s)
+	require.NoError(t, err)
+	return addr
+}
+
+// TestHandshakeGuardRateLimit tests per-source token buckets
+func TestHandshakeGuardRateLimit(t *testing.T) {
+	guard := newTestGuard(t, func(c *transport.HandshakeGuardConfig) {
+		c.Rate = 0.001
+		c.Burst = 2
+	})
+
+	assert.True(t, guard.Allow(udpAddr(t, "192.0.2.1:9993")))
+	// Another port on the same host shares the bucket
+	assert.True(t, guard.Allow(udpAddr(t, "192.0.2.1:9994")))
+	assert.False(t, guard.Allow(udpAddr(t, "192.0.2.1:9993")))
+	assert.True(t, guard.Allow(udpAddr(t, "192.0.2.2:9993")))
+
+	// So does another address in the same IPv6 /64
+	assert.Equal(t, transport.GuardAccept, guard.Admit(udpAddr(t, "[2001:db8::1]:9993"), nil))
+	assert.Equal(t, transport.GuardAccept, guard.Admit(udpAddr(t, "[2001:db8::2]:9993"), nil))
+	assert.Equal(t, transport.GuardDrop, guard.Admit(udpAddr(t, "[2001:db8::3]:9993"), nil))
+
+	stats := guard.Stats()
+	assert.Equal(t, uint64(5), stats.Accepted)
+	assert.Equal(t, uint64(2), stats.RateLimited)
+	assert.Equal(t, 3, stats.Sources)
+	assert.False(t, stats.UnderLoad)
+}
+
+// TestHandshakeGuardMaxSources tests that sources beyond the table share one bucket
+func TestHandshakeGuardMaxSources(t *testing.T) {
+	guard := newTestGuard(t, func(c *transport.HandshakeGuardConfig) {
+		c.Rate = 0.001
+		c.Burst = 1
+		c.MaxSources = 2
+	})
+
+	assert.True(t, guard.Allow(udpAddr(t, "192.0.2.1:9993")))
+	assert.True(t, guard.Allow(udpAddr(t, "192.0.2.2:9993")))
+	assert.True(t, guard.Allow(udpAddr(t, "192.0.2.3:9993")))
+	assert.False(t, guard.Allow(udpAddr(t, "192.0.2.4:9993")))
+	assert.Equal(t, 2, guard.Stats().Sources)
+}
+
+// TestHandshakeGuardPrunesOncePerRefill tests that a full table is pruned at most once per refill period
+func TestHandshakeGuardPrunesOncePerRefill(t *testing.T) {
+	guard := newTestGuard(t, func(c *transport.HandshakeGuardConfig) {
+		c.Rate = 5 // a bucket refills in 200ms
+		c.Burst = 1
+		c.MaxSources = 2
+	})
+
+	assert.True(t, guard.Allow(udpAddr(t, "192.0.2.1:9993")))
+	time.Sleep(120 * time.Millisecond)
+	assert.True(t, guard.Allow(udpAddr(t, "192.0.2.2:9993")))
+	time.Sleep(120 * time.Millisecond)
+
+	// The first bucket has refilled and is pruned to make room
+	assert.True(t, guard.Allow(udpAddr(t, "192.0.2.3:9993")))
+	assert.Equal(t, 2, guard.Stats().Sources)
+	time.Sleep(120 * time.Millisecond)
+
+	// The second bucket has refilled too, but the table was pruned less than a
+	// refill period ago, so new sources share the overflow bucket
+	assert.True(t, guard.Allow(udpAddr(t, "192.0.2.4:9993")))
+	assert.False(t, guard.Allow(udpAddr(t, "192.0.2.5:9993")))
+	assert.Equal(t, 2, guard.Stats().Sources)
+}
+
+// TestHandshakeGuardCookies tests that handshakes under load need the cookie for their source address
+func TestHandshakeGuardCookies(t *testing.T) {
+	guard := newTestGuard(t, func(c *transport.HandshakeGuardConfig) { c.LoadThreshold = 0 })
+	addr := udpAddr(t, "192.0.2.1:9993")
+	require.True(t, guard.UnderLoad())
+
+	assert.Equal(t, transport.GuardChallenge, guard.Admit(addr, nil))
+	cookie := guard.Cookie(addr)
+	assert.Len(t, cookie, transport.CookieSize)
+	assert.Equal(t, transport.GuardAccept, guard.Admit(addr, cookie))
+
+	// A cookie is bound to the address it was issued to
+	assert.Equal(t, transport.GuardChallenge, guard.Admit(udpAddr(t, "192.0.2.1:9994"), cookie))
+
+	stats := guard.Stats()
+	assert.Equal(t, uint64(2), stats.Challenged)
+	assert.Equal(t, uint64(1), stats.BadCookies)
+	assert.Equal(t, uint64(1), stats.Accepted)
+	// Cookieless handshakes do not create buckets
+	assert.Equal(t, 1, stats.Sources)
+}
+
+// TestHandshakeGuardLoad tests that cookies are only required above the load threshold
+func TestHandshakeGuardLoad(t *testing.T) {
+	guard := newTestGuard(t, func(c *transport.HandshakeGuardConfig) { c.LoadThreshold = 3 })
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, transport.GuardAccept, guard.Admit(udpAddr(t, "192.0.2.1:9993"), nil))
+	}
+	assert.False(t, guard.UnderLoad())
+	assert.Equal(t, transport.GuardChallenge, guard.Admit(udpAddr(t, "192.0.2.2:9993"), nil))
+	assert.True(t, guard.UnderLoad())
+}
+
+// TestHandshakeGuardConfig tests guard configuration errors
+func TestHandshakeGuardConfig(t *testing.T) {
+	assert.NoError(t, transport.DefaultHandshakeGuardConfig().Validate())
+
+	for code, mutate := range map[int]func(c *transport.HandshakeGuardConfig){
+		9018: func(c *transport.HandshakeGuardConfig) { c.Rate = 0 },
+		9019: func(c *transport.HandshakeGuardConfig) { c.Burst = 0 },
+		9020: func(c *transport.HandshakeGuardConfig) { c.MaxSources = 0 },
+		9021: func(c *transport.HandshakeGuardConfig) { c.LoadThreshold = -1 },
+		9022: func(c *transport.HandshakeGuardConfig) { c.CookieLifetime = 0 },
+	} {
+		config := transport.DefaultHandshakeGuardConfig()
+		mutate(&config)
+		_, err := transport.NewHandshakeGuard(config)
+		requireTransportError(t, err, code)
+	}
+}
+
+// TestDiscoveryHandshakeCookie tests that discovery completes through a cookie exchange
+func TestDiscoveryHandshakeCookie(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+
+	nodeA, err := identity.NewIdentity()
+	require.NoError(t, err)
+	nodeB, err := identity.NewIdentity()
+	require.NoError(t, err)
+
+	var discoveryA, discoveryB *transport.DiscoveryManager
+	transportA := newMemoryTestTransport(t, network, func(addr net.Addr, data []byte) error {
+		return discoveryA.HandleDiscoveryMessage(addr, data)
+	})
+	transportB := newMemoryTestTransport(t, network, func(addr net.Addr, data []byte) error {
+		return discoveryB.HandleDiscoveryMessage(addr, data)
+	})
+	discoveryA = transport.NewDiscoveryManager(nodeA, transportA)
+	discoveryB = transport.NewDiscoveryManager(nodeB, transportB)
+	guard := newTestGuard(t, func(c *transport.HandshakeGuardConfig) { c.LoadThreshold = 0 })
+	discoveryB.SetHandshakeGuard(guard)
+
+	// Hello, Cookie, Hello with cookie, Response
+	require.NoError(t, discoveryA.SendDiscoveryHello(transportB.GetLocalAddr()))
+	network.WaitIdle()
+
+	peerOfB, exists := discoveryB.GetPeerByAddress(transportA.GetLocalAddr().String())
+	require.True(t, exists)
+	assert.Equal(t, nodeA.Address, peerOfB.Identity.Address)
+	peerOfA, exists := discoveryA.GetPeerByAddress(transportB.GetLocalAddr().String())
+	require.True(t, exists)
+	assert.True(t, peerOfA.Connected)
+
+	stats := guard.Stats()
+	assert.Equal(t, uint64(1), stats.Challenged)
+	assert.Equal(t, uint64(1), stats.Accepted)
+
+	// A spoofed Hello that never returns the cookie leaves no peer behind
+	spoofed := newMemoryTestTransport(t, network, func(addr net.Addr, data []byte) error { return nil })
+	other, err := identity.NewIdentity()
+	require.NoError(t, err)
+	require.NoError(t, transport.NewDiscoveryManager(other, spoofed).SendDiscoveryHello(transportB.GetLocalAddr()))
+	network.WaitIdle()
+	_, exists = discoveryB.GetPeerByAddress(spoofed.GetLocalAddr().String())
+	assert.False(t, exists)
+}
+
+// TestRendezvousHandshakeCookie tests registration and hole punching while every node requires cookies
+func TestRendezvousHandshakeCookie(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	_, err := network.AddNAT(transport.NATConfig{Type: transport.NATPortRestrictedCone, PublicIP: "198.51.100.1", PrivateNetwork: "10.1.0.0/24"})
+	require.NoError(t, err)
+	_, err = network.AddNAT(transport.NATConfig{Type: transport.NATPortRestrictedCone, PublicIP: "198.51.100.2", PrivateNetwork: "10.2.0.0/24"})
+	require.NoError(t, err)
+
+	coordinator := newRendezvousNode(t, network, "203.0.113.1:9993", nil)
+	coordinatorGuard := newTestGuard(t, func(c *transport.HandshakeGuardConfig) { c.LoadThreshold = 0 })
+	coordinator.rendezvous.SetHandshakeGuard(coordinatorGuard)
+
+	memberA := newRendezvousNode(t, network, "10.1.0.2:9993", coordinator.transport.GetLocalAddr())
+	memberB := newRendezvousNode(t, network, "10.2.0.2:9993", coordinator.transport.GetLocalAddr())
+	for _, member := range []*rendezvousNode{memberA, memberB} {
+		member.rendezvous.SetHandshakeGuard(newTestGuard(t, func(c *transport.HandshakeGuardConfig) { c.LoadThreshold = 0 }))
+	}
+	network.WaitIdle()
+
+	require.NotNil(t, memberA.rendezvous.PublicEndpoint())
+	require.NotNil(t, memberB.rendezvous.PublicEndpoint())
+	_, registered := coordinator.rendezvous.MemberEndpoint(memberA.identity.Address)
+	assert.True(t, registered)
+	assert.Equal(t, uint64(2), coordinatorGuard.Stats().Challenged)
+
+	result, err := memberA.rendezvous.Connect(memberB.identity.Address)
+	require.NoError(t, err)
+	select {
+	case r := <-result:
+		require.NoError(t, r.Err)
+		assert.True(t, r.Direct)
+	case <-time.After(2 * time.Second):
+		t.Fatal("hole punching did not finish")
+	}
+}
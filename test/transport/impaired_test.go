@@ -0,0 +1,236 @@
+package transport_test
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stella/virtual-switch/pkg/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// impairedTestPair creates an impaired memory transport and a receiver that records packets
+func impairedTestPair(t *testing.T, seed int64) (*transport.ImpairedTransport, transport.Transport, *transport.MemoryNetwork, chan receivedPacket) {
+	network := transport.NewMemoryNetwork()
+	received := make(chan receivedPacket, 1000)
+	receiver := newMemoryTestTransport(t, network, func(addr net.Addr, data []byte) error {
+		received <- receivedPacket{addr: addr, data: data}
+		return nil
+	})
+	sender := transport.NewImpairedTransport(newMemoryTestTransport(t, network, func(net.Addr, []byte) error { return nil }), seed)
+	t.Cleanup(func() { sender.Stop() })
+	return sender, receiver, network, received
+}
+
+// TestImpairedTransportLossIsSeeded tests that the same seed loses the same packets
+func TestImpairedTransportLossIsSeeded(t *testing.T) {
+	lost := func(seed int64) []int {
+		sender, receiver, network, received := impairedTestPair(t, seed)
+		require.NoError(t, sender.SetDefaultImpairment(transport.Impairment{Loss: 0.5}))
+
+		for i := 0; i < 100; i++ {
+			require.NoError(t, sender.Send(receiver.GetLocalAddr(), []byte{byte(i)}))
+		}
+		network.WaitIdle()
+
+		seen := make(map[byte]bool)
+		for len(received) > 0 {
+			seen[(<-received).data[0]] = true
+		}
+		var missing []int
+		for i := 0; i < 100; i++ {
+			if !seen[byte(i)] {
+				missing = append(missing, i)
+			}
+		}
+		assert.Equal(t, uint64(len(missing)), sender.Stats().Dropped)
+		return missing
+	}
+
+	first := lost(42)
+	assert.Greater(t, len(first), 25)
+	assert.Less(t, len(first), 75)
+	assert.Equal(t, first, lost(42))
+}
+
+// TestImpairedTransportDuplicateAndCorrupt tests duplication and single-bit corruption
+func TestImpairedTransportDuplicateAndCorrupt(t *testing.T) {
+	sender, receiver, _, received := impairedTestPair(t, 1)
+	require.NoError(t, sender.SetImpairment(receiver.GetLocalAddr(), transport.Impairment{Duplicate: 1, Corrupt: 1}))
+
+	original := []byte("impaired payload")
+	require.NoError(t, sender.Send(receiver.GetLocalAddr(), original))
+
+	for i := 0; i < 2; i++ {
+		packet := waitForPacket(t, received)
+		require.Len(t, packet.data, len(original))
+		flipped := 0
+		for j := range original {
+			diff := original[j] ^ packet.data[j]
+			for ; diff != 0; diff &= diff - 1 {
+				flipped++
+			}
+		}
+		assert.Equal(t, 1, flipped)
+	}
+
+	stats := sender.Stats()
+	assert.Equal(t, uint64(1), stats.Duplicated)
+	assert.Equal(t, uint64(2), stats.Corrupted)
+	assert.Equal(t, []byte("impaired payload"), original, "Caller's buffer must not be modified")
+}
+
+// TestImpairedTransportLatencyAndBandwidth tests fixed delay and serialization at a bandwidth cap
+func TestImpairedTransportLatencyAndBandwidth(t *testing.T) {
+	sender, receiver, _, received := impairedTestPair(t, 1)
+	require.NoError(t, sender.SetDefaultImpairment(transport.Impairment{
+		Latency:   30 * time.Millisecond,
+		Bandwidth: 100 * 1000, // 10ms per 1000-byte packet
+	}))
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		packet := make([]byte, 1000)
+		packet[0] = byte(i)
+		require.NoError(t, sender.Send(receiver.GetLocalAddr(), packet))
+	}
+
+	for i := 0; i < 5; i++ {
+		packet := waitForPacket(t, received)
+		assert.Equal(t, byte(i), packet.data[0], "Packets must stay in order without jitter or reordering")
+	}
+	// 30ms latency plus five 10ms transmissions
+	assert.GreaterOrEqual(t, time.Since(start), 80*time.Millisecond)
+}
+
+// TestImpairedTransportBandwidthQueueLimit tests tail drop when the bandwidth queue is full
+func TestImpairedTransportBandwidthQueueLimit(t *testing.T) {
+	sender, receiver, _, _ := impairedTestPair(t, 1)
+	require.NoError(t, sender.SetDefaultImpairment(transport.Impairment{
+		Bandwidth:     100 * 1000,
+		MaxQueueDelay: 25 * time.Millisecond,
+	}))
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, sender.Send(receiver.GetLocalAddr(), make([]byte, 1000)))
+	}
+	// Packets queued 0, 10 and 20ms are accepted; the rest would wait too long
+	assert.Equal(t, uint64(7), sender.Stats().Dropped)
+}
+
+// TestImpairedTransportReorder tests that held-back packets are overtaken
+func TestImpairedTransportReorder(t *testing.T) {
+	sender, receiver, _, received := impairedTestPair(t, 7)
+	require.NoError(t, sender.SetDefaultImpairment(transport.Impairment{Reorder: 0.3, ReorderDelay: 20 * time.Millisecond}))
+
+	for i := 0; i < 50; i++ {
+		require.NoError(t, sender.Send(receiver.GetLocalAddr(), []byte{byte(i)}))
+	}
+
+	order := make([]byte, 0, 50)
+	for i := 0; i < 50; i++ {
+		order = append(order, waitForPacket(t, received).data[0])
+	}
+	inOrder := true
+	for i := 1; i < len(order); i++ {
+		if order[i] < order[i-1] {
+			inOrder = false
+		}
+	}
+	assert.False(t, inOrder)
+	assert.Greater(t, sender.Stats().Reordered, uint64(0))
+
+	assert.Error(t, sender.SetDefaultImpairment(transport.Impairment{Loss: 1.5}))
+}
+
+// TestImpairedTransportUDPRetransmission tests that UDP retransmissions recover from wire loss
+func TestImpairedTransportUDPRetransmission(t *testing.T) {
+	config := map[string]interface{}{
+		"maxRetries":       8,
+		"retryInterval":    20 * time.Millisecond,
+		"retryExponential": false,
+	}
+	serverTransport, err := transport.NewTransport(transport.TransportTypeUDP, config)
+	require.NoError(t, err)
+	clientTransport, err := transport.NewTransport(transport.TransportTypeUDP, config)
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	received := make(map[string]bool)
+	require.NoError(t, serverTransport.Start(func(addr net.Addr, data []byte) error {
+		mu.Lock()
+		received[string(data)] = true
+		mu.Unlock()
+		return nil
+	}))
+	defer serverTransport.Stop()
+
+	impaired := transport.NewImpairedTransport(clientTransport, 3)
+	require.NoError(t, impaired.SetDefaultImpairment(transport.Impairment{Loss: 0.3}))
+	require.NoError(t, impaired.Start(func(addr net.Addr, data []byte) error { return nil }))
+	defer impaired.Stop()
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, impaired.Send(serverTransport.GetLocalAddr(), []byte(fmt.Sprintf("message-%d", i))))
+	}
+
+	// Loss is applied on the wire, so every message is recovered by retransmission
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 20
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.Greater(t, impaired.Stats().Dropped, uint64(0))
+}
+
+// TestUDPTransportSuppressesDuplicates tests that lost ACKs cause retransmissions but not redelivery
+func TestUDPTransportSuppressesDuplicates(t *testing.T) {
+	config := map[string]interface{}{
+		"maxRetries":       12,
+		"retryInterval":    20 * time.Millisecond,
+		"retryExponential": false,
+	}
+	serverTransport, err := transport.NewTransport(transport.TransportTypeUDP, config)
+	require.NoError(t, err)
+	clientTransport, err := transport.NewTransport(transport.TransportTypeUDP, config)
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	deliveries := make(map[string]int)
+	// The server's ACKs are lost half of the time
+	impairedServer := transport.NewImpairedTransport(serverTransport, 5)
+	require.NoError(t, impairedServer.SetDefaultImpairment(transport.Impairment{Loss: 0.5}))
+	require.NoError(t, impairedServer.Start(func(addr net.Addr, data []byte) error {
+		mu.Lock()
+		deliveries[string(data)]++
+		mu.Unlock()
+		return nil
+	}))
+	defer impairedServer.Stop()
+
+	require.NoError(t, clientTransport.Start(func(addr net.Addr, data []byte) error { return nil }))
+	defer clientTransport.Stop()
+
+	results := make([]<-chan transport.DeliveryResult, 20)
+	for i := range results {
+		results[i], err = clientTransport.(*transport.UDPTransport).SendWithResult(serverTransport.GetLocalAddr(), []byte(fmt.Sprintf("frame-%d", i)))
+		require.NoError(t, err)
+	}
+	retransmitted := 0
+	for _, result := range results {
+		outcome := waitForResult(t, result)
+		require.True(t, outcome.Delivered)
+		retransmitted += outcome.Retries
+	}
+	require.Greater(t, retransmitted, 0, "Lost ACKs should cause retransmissions")
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, deliveries, 20)
+	for frame, count := range deliveries {
+		assert.Equal(t, 1, count, "%s delivered more than once", frame)
+	}
+}
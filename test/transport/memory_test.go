@@ -0,0 +1,129 @@
+package transport_test
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stella/virtual-switch/pkg/identity"
+	"github.com/stella/virtual-switch/pkg/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newMemoryTestTransport attaches a started memory transport to the network
+func newMemoryTestTransport(t *testing.T, network *transport.MemoryNetwork, handler transport.PacketHandler) transport.Transport {
+	memTransport, err := transport.NewTransport(transport.TransportTypeMemory, map[string]interface{}{"network": network})
+	require.NoError(t, err)
+	require.NoError(t, memTransport.Start(handler))
+	t.Cleanup(func() { memTransport.Stop() })
+	return memTransport
+}
+
+// TestMemoryTransportOrderedDelivery tests FIFO delivery from several senders
+func TestMemoryTransportOrderedDelivery(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+
+	var mu sync.Mutex
+	received := make(map[string][]byte)
+	receiver := newMemoryTestTransport(t, network, func(addr net.Addr, data []byte) error {
+		mu.Lock()
+		received[addr.String()] = append(received[addr.String()], data[0])
+		mu.Unlock()
+		return nil
+	})
+
+	senders := []transport.Transport{
+		newMemoryTestTransport(t, network, func(net.Addr, []byte) error { return nil }),
+		newMemoryTestTransport(t, network, func(net.Addr, []byte) error { return nil }),
+	}
+	assert.NotEqual(t, senders[0].GetLocalAddr().String(), senders[1].GetLocalAddr().String())
+
+	buffer := make([]byte, 1)
+	for i := 0; i < 100; i++ {
+		for _, sender := range senders {
+			// The network copies the data, so reusing the buffer is safe
+			buffer[0] = byte(i)
+			require.NoError(t, sender.Send(receiver.GetLocalAddr(), buffer))
+		}
+	}
+	network.WaitIdle()
+
+	for _, sender := range senders {
+		data := received[sender.GetLocalAddr().String()]
+		require.Len(t, data, 100)
+		for i, b := range data {
+			assert.Equal(t, byte(i), b)
+		}
+	}
+	assert.Equal(t, uint64(200), network.Delivered())
+}
+
+// TestMemoryTransportDrops tests sends to unknown or stopped endpoints
+func TestMemoryTransportDrops(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	sender := newMemoryTestTransport(t, network, func(net.Addr, []byte) error { return nil })
+
+	unknown := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 9993}
+	require.NoError(t, sender.Send(unknown, []byte("lost")))
+	network.WaitIdle()
+	assert.Equal(t, uint64(1), network.Dropped())
+
+	receiver := newMemoryTestTransport(t, network, func(net.Addr, []byte) error { return nil })
+	receiverAddr := receiver.GetLocalAddr()
+	require.NoError(t, receiver.Stop())
+	require.NoError(t, sender.Send(receiverAddr, []byte("lost")))
+	network.WaitIdle()
+	assert.Equal(t, uint64(2), network.Dropped())
+	assert.Error(t, receiver.Send(sender.GetLocalAddr(), []byte("closed")))
+
+	// Explicit addresses can be reused once the previous owner stops
+	first, err := transport.NewTransport(transport.TransportTypeMemory, map[string]interface{}{"network": network, "addr": "10.0.0.1:9993"})
+	require.NoError(t, err)
+	_, err = transport.NewTransport(transport.TransportTypeMemory, map[string]interface{}{"network": network, "addr": "10.0.0.1:9993"})
+	assert.Error(t, err)
+
+	// A configured transport that was never started drops packets instead of queueing them forever
+	require.NoError(t, sender.Send(first.GetLocalAddr(), []byte("lost")))
+	network.WaitIdle()
+	assert.Equal(t, uint64(3), network.Dropped())
+	require.NoError(t, first.Stop())
+	_, err = transport.NewTransport(transport.TransportTypeMemory, map[string]interface{}{"network": network, "addr": "10.0.0.1:9993"})
+	assert.NoError(t, err)
+
+	_, err = transport.NewTransport(transport.TransportTypeMemory, map[string]interface{}{})
+	assert.Error(t, err)
+}
+
+// TestMemoryTransportDiscovery tests a discovery exchange between two nodes on one network
+func TestMemoryTransportDiscovery(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+
+	nodeA, err := identity.NewIdentity()
+	require.NoError(t, err)
+	nodeB, err := identity.NewIdentity()
+	require.NoError(t, err)
+
+	var discoveryA, discoveryB *transport.DiscoveryManager
+	transportA := newMemoryTestTransport(t, network, func(addr net.Addr, data []byte) error {
+		return discoveryA.HandleDiscoveryMessage(addr, data)
+	})
+	transportB := newMemoryTestTransport(t, network, func(addr net.Addr, data []byte) error {
+		return discoveryB.HandleDiscoveryMessage(addr, data)
+	})
+	discoveryA = transport.NewDiscoveryManager(nodeA, transportA)
+	discoveryB = transport.NewDiscoveryManager(nodeB, transportB)
+
+	// Hello from A, Response from B; WaitIdle covers both legs
+	require.NoError(t, discoveryA.SendDiscoveryHello(transportB.GetLocalAddr()))
+	network.WaitIdle()
+
+	peerOfB, exists := discoveryB.GetPeerByAddress(transportA.GetLocalAddr().String())
+	require.True(t, exists)
+	assert.Equal(t, nodeA.Address, peerOfB.Identity.Address)
+
+	peerOfA, exists := discoveryA.GetPeerByAddress(transportB.GetLocalAddr().String())
+	require.True(t, exists)
+	assert.True(t, peerOfA.Connected)
+	assert.Equal(t, nodeB.Address, peerOfA.Identity.Address)
+}
@@ -0,0 +1,188 @@
+package transport_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stella/virtual-switch/pkg/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newReflectionServers starts two reflection servers on different IPs
+// The first can answer change requests from another port and from another IP.
+func newReflectionServers(t *testing.T, network *transport.MemoryNetwork) []net.Addr {
+	primary := newRendezvousNode(t, network, "203.0.113.1:9993", nil)
+	secondary := newRendezvousNode(t, network, "203.0.113.2:9993", nil)
+
+	alternate := func(addr string) transport.Transport {
+		sender, err := transport.NewTransport(transport.TransportTypeMemory, map[string]interface{}{"network": network, "addr": addr})
+		require.NoError(t, err)
+		require.NoError(t, sender.Start(func(net.Addr, []byte) error { return nil }))
+		t.Cleanup(func() { sender.Stop() })
+		return sender
+	}
+	primary.rendezvous.SetReflectionAlternates(alternate("203.0.113.1:9994"), alternate("203.0.113.3:9995"))
+
+	return []net.Addr{primary.transport.GetLocalAddr(), secondary.transport.GetLocalAddr()}
+}
+
+// TestDetectNATWithReflection tests NAT classification against the simulated NAT types
+func TestDetectNATWithReflection(t *testing.T) {
+	for _, natType := range []transport.NATType{
+		transport.NATFullCone,
+		transport.NATRestrictedCone,
+		transport.NATPortRestrictedCone,
+		transport.NATSymmetric,
+	} {
+		t.Run(natType.String(), func(t *testing.T) {
+			network := transport.NewMemoryNetwork()
+			_, err := network.AddNAT(transport.NATConfig{Type: natType, PublicIP: "198.51.100.1", PrivateNetwork: "10.1.0.0/24"})
+			require.NoError(t, err)
+			servers := newReflectionServers(t, network)
+			client := newRendezvousNode(t, network, "10.1.0.2:9993", nil)
+
+			report, err := transport.DetectNAT(client.rendezvous, servers, []net.Addr{client.transport.GetLocalAddr()}, 100*time.Millisecond)
+			require.NoError(t, err)
+			assert.Equal(t, natType, report.Type)
+			require.NotEmpty(t, report.ExternalEndpoints)
+			assert.Equal(t, "198.51.100.1", report.ExternalEndpoints[0].(*net.UDPAddr).IP.String())
+			if natType == transport.NATSymmetric {
+				assert.Len(t, report.ExternalEndpoints, 2)
+			} else {
+				assert.Len(t, report.ExternalEndpoints, 1)
+			}
+			assert.False(t, report.DetectedAt.IsZero())
+		})
+	}
+
+	t.Run("no NAT", func(t *testing.T) {
+		network := transport.NewMemoryNetwork()
+		servers := newReflectionServers(t, network)
+		client := newRendezvousNode(t, network, "192.0.2.10:9993", nil)
+
+		report, err := transport.DetectNAT(client.rendezvous, servers, []net.Addr{client.transport.GetLocalAddr()}, 100*time.Millisecond)
+		require.NoError(t, err)
+		assert.Equal(t, transport.NATNone, report.Type)
+		assert.Equal(t, "192.0.2.10:9993", report.ExternalEndpoints[0].String())
+	})
+
+	t.Run("blocked", func(t *testing.T) {
+		network := transport.NewMemoryNetwork()
+		client := newRendezvousNode(t, network, "192.0.2.10:9993", nil)
+		servers := []net.Addr{
+			&net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 9993},
+			&net.UDPAddr{IP: net.ParseIP("203.0.113.2"), Port: 9993},
+		}
+
+		report, err := transport.DetectNAT(client.rendezvous, servers, nil, 50*time.Millisecond)
+		require.NoError(t, err)
+		assert.Equal(t, transport.NATBlocked, report.Type)
+
+		_, err = transport.DetectNAT(client.rendezvous, servers[:1], nil, 50*time.Millisecond)
+		assert.Error(t, err)
+	})
+
+	t.Run("change requests unsupported", func(t *testing.T) {
+		network := transport.NewMemoryNetwork()
+		_, err := network.AddNAT(transport.NATConfig{Type: transport.NATFullCone, PublicIP: "198.51.100.1", PrivateNetwork: "10.1.0.0/24"})
+		require.NoError(t, err)
+		primary := newRendezvousNode(t, network, "203.0.113.1:9993", nil)
+		secondary := newRendezvousNode(t, network, "203.0.113.2:9993", nil)
+		client := newRendezvousNode(t, network, "10.1.0.2:9993", nil)
+
+		_, err = client.rendezvous.Reflect(primary.transport.GetLocalAddr(), transport.ChangeRequest{ChangePort: true}, time.Second)
+		var transportErr *transport.TransportError
+		require.True(t, errors.As(err, &transportErr))
+		assert.Equal(t, 9014, transportErr.Code)
+
+		servers := []net.Addr{primary.transport.GetLocalAddr(), secondary.transport.GetLocalAddr()}
+		report, err := transport.DetectNAT(client.rendezvous, servers, nil, 100*time.Millisecond)
+		require.NoError(t, err)
+		assert.Equal(t, transport.NATUnknown, report.Type)
+		assert.Len(t, report.ExternalEndpoints, 1)
+	})
+}
+
+// startFakeSTUNServer answers binding requests with the sender's XOR-mapped address
+// Requests carrying CHANGE-REQUEST get a 420 Unknown Attribute error, like most public servers.
+func startFakeSTUNServer(t *testing.T) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			if n < 20 || binary.BigEndian.Uint16(buffer[0:2]) != 0x0001 {
+				continue
+			}
+			request := buffer[:n]
+
+			var attrs []byte
+			msgType := uint16(0x0101)
+			if n > 20 && binary.BigEndian.Uint16(request[20:22]) == 0x0003 {
+				msgType = 0x0111
+				attrs = []byte{0x00, 0x09, 0x00, 0x04, 0x00, 0x00, 4, 20}
+			} else {
+				ip := addr.IP.To4()
+				attrs = []byte{0x00, 0x20, 0x00, 0x08, 0x00, 0x01}
+				attrs = binary.BigEndian.AppendUint16(attrs, uint16(addr.Port)^0x2112)
+				for i := range ip {
+					attrs = append(attrs, ip[i]^request[4+i])
+				}
+			}
+
+			response := make([]byte, 20, 20+len(attrs))
+			binary.BigEndian.PutUint16(response[0:2], msgType)
+			binary.BigEndian.PutUint16(response[2:4], uint16(len(attrs)))
+			copy(response[4:20], request[4:20])
+			conn.WriteToUDP(append(response, attrs...), addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// TestSTUNClientOverUDP tests STUN binding requests sharing the UDP transport's socket
+func TestSTUNClientOverUDP(t *testing.T) {
+	client := transport.NewUDPTransport()
+	require.NoError(t, client.Init(map[string]interface{}{"addr": "127.0.0.1:0"}))
+	packets := make(chan receivedPacket, 4)
+	require.NoError(t, client.Start(func(addr net.Addr, data []byte) error {
+		packets <- receivedPacket{addr: addr, data: data}
+		return nil
+	}))
+	t.Cleanup(func() { client.Stop() })
+
+	stun := transport.NewSTUNClient(client)
+	servers := []net.Addr{startFakeSTUNServer(t), startFakeSTUNServer(t)}
+
+	// The mapped address is the transport's own socket
+	mapped, err := stun.Reflect(servers[0], transport.ChangeRequest{}, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, client.GetLocalAddr().String(), mapped.String())
+
+	// Servers without CHANGE-REQUEST support are reported as such
+	_, err = stun.Reflect(servers[0], transport.ChangeRequest{ChangeIP: true, ChangePort: true}, time.Second)
+	var transportErr *transport.TransportError
+	require.True(t, errors.As(err, &transportErr))
+	assert.Equal(t, 9036, transportErr.Code)
+
+	report, err := transport.DetectNAT(stun, servers, []net.Addr{client.GetLocalAddr()}, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, transport.NATNone, report.Type)
+
+	// STUN responses never reach the packet handler
+	select {
+	case packet := <-packets:
+		t.Fatalf("unexpected packet from %s", packet.addr)
+	default:
+	}
+}
@@ -0,0 +1,72 @@
+package transport_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stella/virtual-switch/pkg/topology"
+	"github.com/stella/virtual-switch/pkg/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestUDPTransportPathMTUDiscovery tests probing through a path that drops large datagrams
+func TestUDPTransportPathMTUDiscovery(t *testing.T) {
+	config := map[string]interface{}{
+		"pathMTUDiscovery": true,
+		"pmtuProbeTimeout": 20 * time.Millisecond,
+		"maxPathMTU":       1500,
+	}
+	server := transport.NewUDPTransport()
+	require.NoError(t, server.Init(config))
+	client := transport.NewUDPTransport()
+	require.NoError(t, client.Init(config))
+
+	packets := make(chan receivedPacket, 16)
+	require.NoError(t, server.Start(func(addr net.Addr, data []byte) error {
+		packets <- receivedPacket{addr: addr, data: append([]byte(nil), data...)}
+		return nil
+	}))
+	defer server.Stop()
+
+	// A PPPoE-like path: 1420-byte IP MTU, larger datagrams vanish
+	impaired := transport.NewImpairedTransport(client, 1)
+	require.NoError(t, impaired.SetImpairment(server.GetLocalAddr(), transport.Impairment{MaxPacketSize: 1420 - 28}))
+	require.NoError(t, impaired.Start(func(addr net.Addr, data []byte) error { return nil }))
+	defer impaired.Stop()
+
+	// Discovered MTUs flow into the topology
+	tm := topology.NewTopologyManager()
+	defer tm.Stop()
+	node := &topology.Node{ID: uuid.New(), Address: server.GetLocalAddr().String(), MTU: 1500}
+	require.NoError(t, tm.AddNode(node))
+	client.AddPathMTUListener(func(addr net.Addr, mtu int) {
+		tm.UpdateNodeMTU(addr.String(), mtu)
+	})
+
+	require.NoError(t, impaired.Send(server.GetLocalAddr(), []byte("hello")))
+	waitForPacket(t, packets)
+
+	require.Eventually(t, func() bool {
+		_, complete := client.PathMTU(server.GetLocalAddr())
+		return complete
+	}, 5*time.Second, 10*time.Millisecond)
+	mtu, _ := client.PathMTU(server.GetLocalAddr())
+	assert.Equal(t, 1420, mtu)
+
+	updated, _ := tm.GetNode(node.ID)
+	assert.Equal(t, 1420, updated.MTU)
+
+	// Payloads above the path MTU are fragmented and reassembled
+	large := bytes.Repeat([]byte("0123456789"), 600)
+	result, err := client.SendWithResult(server.GetLocalAddr(), large)
+	require.NoError(t, err)
+	assert.True(t, waitForResult(t, result).Delivered)
+	assert.Equal(t, large, waitForPacket(t, packets).data)
+
+	_, err = transport.NewTransport(transport.TransportTypeUDP, map[string]interface{}{"maxPathMTU": 576})
+	assert.Error(t, err)
+}
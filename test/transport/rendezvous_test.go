@@ -0,0 +1,315 @@
+package transport_test
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stella/virtual-switch/pkg/address"
+	"github.com/stella/virtual-switch/pkg/identity"
+	"github.com/stella/virtual-switch/pkg/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rendezvousNode is a memory transport with a rendezvous manager and the frames it received
+type rendezvousNode struct {
+	identity   *identity.Identity
+	transport  transport.Transport
+	rendezvous *transport.RendezvousManager
+
+	mu     sync.Mutex
+	frames []string
+}
+
+// newRendezvousNode attaches a node at addr, registering with coordinator if it is not nil
+func newRendezvousNode(t *testing.T, network *transport.MemoryNetwork, addr string, coordinator net.Addr) *rendezvousNode {
+	nodeIdentity, err := identity.NewIdentity()
+	require.NoError(t, err)
+
+	node := &rendezvousNode{identity: nodeIdentity}
+	node.transport, err = transport.NewTransport(transport.TransportTypeMemory, map[string]interface{}{"network": network, "addr": addr})
+	require.NoError(t, err)
+
+	node.rendezvous = transport.NewRendezvousManager(nodeIdentity, node.transport)
+	require.NoError(t, node.rendezvous.SetPunchTiming(10*time.Millisecond, 10))
+	node.rendezvous.SetFrameHandler(func(peer *address.Address, data []byte) {
+		node.mu.Lock()
+		node.frames = append(node.frames, string(data))
+		node.mu.Unlock()
+	})
+	node.rendezvous.SetCoordinator(coordinator)
+
+	require.NoError(t, node.transport.Start(node.rendezvous.Handler(nil)))
+	require.NoError(t, node.rendezvous.Start())
+	t.Cleanup(func() {
+		node.rendezvous.Stop()
+		node.transport.Stop()
+	})
+	return node
+}
+
+// received returns a copy of the frames the node received
+func (n *rendezvousNode) received() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]string(nil), n.frames...)
+}
+
+// newNATPair builds a coordinator and two members, each behind its own NAT of the given type
+func newNATPair(t *testing.T, natType transport.NATType) (*transport.MemoryNetwork, *rendezvousNode, *rendezvousNode, *rendezvousNode) {
+	network := transport.NewMemoryNetwork()
+	_, err := network.AddNAT(transport.NATConfig{Type: natType, PublicIP: "198.51.100.1", PrivateNetwork: "10.1.0.0/24"})
+	require.NoError(t, err)
+	_, err = network.AddNAT(transport.NATConfig{Type: natType, PublicIP: "198.51.100.2", PrivateNetwork: "10.2.0.0/24"})
+	require.NoError(t, err)
+
+	coordinator := newRendezvousNode(t, network, "203.0.113.1:9993", nil)
+	memberA := newRendezvousNode(t, network, "10.1.0.2:9993", coordinator.transport.GetLocalAddr())
+	memberB := newRendezvousNode(t, network, "10.2.0.2:9993", coordinator.transport.GetLocalAddr())
+	network.WaitIdle()
+	return network, coordinator, memberA, memberB
+}
+
+// TestMemoryNATFiltering tests mapping and filtering of the simulated NAT types
+func TestMemoryNATFiltering(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	restricted, err := network.AddNAT(transport.NATConfig{Type: transport.NATPortRestrictedCone, PublicIP: "198.51.100.1", PrivateNetwork: "10.1.0.0/24"})
+	require.NoError(t, err)
+	symmetric, err := network.AddNAT(transport.NATConfig{Type: transport.NATSymmetric, PublicIP: "198.51.100.2", PrivateNetwork: "10.2.0.0/24"})
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	seen := make(map[string][]string)
+	record := func(name string) transport.PacketHandler {
+		return func(addr net.Addr, data []byte) error {
+			mu.Lock()
+			seen[name] = append(seen[name], addr.String())
+			mu.Unlock()
+			return nil
+		}
+	}
+	attach := func(name, addr string) transport.Transport {
+		memTransport, err := transport.NewTransport(transport.TransportTypeMemory, map[string]interface{}{"network": network, "addr": addr})
+		require.NoError(t, err)
+		require.NoError(t, memTransport.Start(record(name)))
+		t.Cleanup(func() { memTransport.Stop() })
+		return memTransport
+	}
+
+	inside := attach("inside", "10.1.0.2:9993")
+	server := attach("server", "203.0.113.1:9993")
+	stranger := attach("stranger", "203.0.113.2:9993")
+
+	// Outbound packets leave with the NAT's public address
+	require.NoError(t, inside.Send(server.GetLocalAddr(), []byte("out")))
+	network.WaitIdle()
+	require.Len(t, seen["server"], 1)
+	public, err := net.ResolveUDPAddr("udp", seen["server"][0])
+	require.NoError(t, err)
+	assert.True(t, public.IP.Equal(restricted.PublicIP()))
+
+	// Replies from the contacted endpoint pass, others are blocked
+	require.NoError(t, server.Send(public, []byte("reply")))
+	require.NoError(t, stranger.Send(public, []byte("unsolicited")))
+	network.WaitIdle()
+	assert.Equal(t, []string{"203.0.113.1:9993"}, seen["inside"])
+	assert.Equal(t, uint64(1), restricted.Blocked())
+	assert.Equal(t, 1, restricted.Mappings())
+
+	// A symmetric NAT uses a different public port per destination
+	behindSymmetric := attach("symmetric", "10.2.0.2:9993")
+	require.NoError(t, behindSymmetric.Send(server.GetLocalAddr(), []byte("a")))
+	require.NoError(t, behindSymmetric.Send(stranger.GetLocalAddr(), []byte("b")))
+	network.WaitIdle()
+	require.Len(t, seen["stranger"], 1)
+	assert.NotEqual(t, seen["server"][1], seen["stranger"][0])
+	assert.Equal(t, 2, symmetric.Mappings())
+
+	// Invalid configurations are rejected
+	_, err = network.AddNAT(transport.NATConfig{PublicIP: "10.3.0.1", PrivateNetwork: "10.3.0.0/24"})
+	requireTransportError(t, err, 7011)
+	_, err = network.AddNAT(transport.NATConfig{PublicIP: "198.51.100.1", PrivateNetwork: "10.4.0.0/24"})
+	requireTransportError(t, err, 7014)
+}
+
+// TestRendezvousHolePunching tests relayed frames triggering an upgrade to a direct path
+func TestRendezvousHolePunching(t *testing.T) {
+	network, coordinator, memberA, memberB := newNATPair(t, transport.NATPortRestrictedCone)
+
+	// Registration reports the public endpoint each member was seen at
+	publicA := memberA.rendezvous.PublicEndpoint()
+	require.NotNil(t, publicA)
+	assert.Equal(t, "198.51.100.1", publicA.(*net.UDPAddr).IP.String())
+	endpointA, registered := coordinator.rendezvous.MemberEndpoint(memberA.identity.Address)
+	require.True(t, registered)
+	assert.Equal(t, publicA.String(), endpointA.String())
+
+	// Neither member can reach the other directly before punching
+	require.NoError(t, memberA.transport.Send(memberB.rendezvous.PublicEndpoint(), []byte("blocked")))
+	network.WaitIdle()
+
+	// The first frame is relayed by the coordinator, which then introduces both members
+	var results []transport.PunchResult
+	var mu sync.Mutex
+	memberA.rendezvous.AddPunchListener(func(result transport.PunchResult) {
+		mu.Lock()
+		results = append(results, result)
+		mu.Unlock()
+	})
+	require.NoError(t, memberA.rendezvous.Send(memberB.identity.Address, []byte("relayed")))
+
+	assert.Eventually(t, func() bool {
+		_, directA := memberA.rendezvous.DirectPath(memberB.identity.Address)
+		_, directB := memberB.rendezvous.DirectPath(memberA.identity.Address)
+		return directA && directB
+	}, 2*time.Second, 10*time.Millisecond)
+	network.WaitIdle()
+
+	pathToB, _ := memberA.rendezvous.DirectPath(memberB.identity.Address)
+	assert.Equal(t, memberB.rendezvous.PublicEndpoint().String(), pathToB.String())
+	mu.Lock()
+	require.NotEmpty(t, results)
+	assert.True(t, results[0].Direct)
+	assert.True(t, results[0].Peer.Equals(memberB.identity.Address))
+	mu.Unlock()
+
+	// Later frames take the direct path; the coordinator is no longer involved
+	require.NoError(t, coordinator.transport.Stop())
+	require.NoError(t, memberA.rendezvous.Send(memberB.identity.Address, []byte("direct")))
+	require.NoError(t, memberB.rendezvous.Send(memberA.identity.Address, []byte("back")))
+	network.WaitIdle()
+	assert.Equal(t, []string{"relayed", "direct"}, memberB.received())
+	assert.Equal(t, []string{"back"}, memberA.received())
+}
+
+// TestRendezvousConnect tests explicit introductions and their failure modes
+func TestRendezvousConnect(t *testing.T) {
+	t.Run("cone NATs", func(t *testing.T) {
+		_, _, memberA, memberB := newNATPair(t, transport.NATRestrictedCone)
+
+		resultCh, err := memberA.rendezvous.Connect(memberB.identity.Address)
+		require.NoError(t, err)
+		result := <-resultCh
+		require.NoError(t, result.Err)
+		assert.True(t, result.Direct)
+		assert.Equal(t, memberB.rendezvous.PublicEndpoint().String(), result.Endpoint.String())
+		assert.GreaterOrEqual(t, result.Attempts, 1)
+
+		// Connecting again reuses the path
+		resultCh, err = memberA.rendezvous.Connect(memberB.identity.Address)
+		require.NoError(t, err)
+		assert.True(t, (<-resultCh).Direct)
+	})
+
+	t.Run("symmetric NATs", func(t *testing.T) {
+		_, _, memberA, memberB := newNATPair(t, transport.NATSymmetric)
+
+		resultCh, err := memberA.rendezvous.Connect(memberB.identity.Address)
+		require.NoError(t, err)
+		result := <-resultCh
+		assert.False(t, result.Direct)
+		assert.Equal(t, 10, result.Attempts)
+
+		var transportErr *transport.TransportError
+		require.True(t, errors.As(result.Err, &transportErr))
+		assert.Equal(t, 9012, transportErr.Code)
+		_, direct := memberA.rendezvous.DirectPath(memberB.identity.Address)
+		assert.False(t, direct)
+
+		// Frames still arrive through the coordinator
+		require.NoError(t, memberA.rendezvous.Send(memberB.identity.Address, []byte("relayed")))
+		assert.Eventually(t, func() bool { return len(memberB.received()) == 1 }, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("symmetric NATs with a port mapping", func(t *testing.T) {
+		network := transport.NewMemoryNetwork()
+		_, err := network.AddNAT(transport.NATConfig{Type: transport.NATSymmetric, PublicIP: "198.51.100.1", PrivateNetwork: "10.1.0.0/24"})
+		require.NoError(t, err)
+		natB, err := network.AddNAT(transport.NATConfig{Type: transport.NATSymmetric, PublicIP: "198.51.100.2", PrivateNetwork: "10.2.0.0/24"})
+		require.NoError(t, err)
+		coordinator := newRendezvousNode(t, network, "203.0.113.1:9993", nil)
+		memberA := newRendezvousNode(t, network, "10.1.0.2:9993", coordinator.transport.GetLocalAddr())
+		memberB := newRendezvousNode(t, network, "10.2.0.2:9993", coordinator.transport.GetLocalAddr())
+
+		// B's router forwards a port, which B advertises with its registration
+		mapped, err := natB.AddPortMapping("10.2.0.2:9993", 9993)
+		require.NoError(t, err)
+		_, err = natB.AddPortMapping("10.1.0.2:9993", 0)
+		requireTransportError(t, err, 7015) // endpoints outside the NAT cannot be forwarded
+		_, err = natB.AddPortMapping("10.2.0.3:9993", 9993)
+		requireTransportError(t, err, 7017)
+		require.NoError(t, memberB.rendezvous.SetAdvertisedEndpoint(mapped))
+		network.WaitIdle()
+		advertised, ok := coordinator.rendezvous.MemberAdvertisedEndpoint(memberB.identity.Address)
+		require.True(t, ok)
+		assert.Equal(t, "198.51.100.2:9993", advertised.String())
+
+		resultCh, err := memberA.rendezvous.Connect(memberB.identity.Address)
+		require.NoError(t, err)
+		result := <-resultCh
+		require.NoError(t, result.Err)
+		assert.Equal(t, "198.51.100.2:9993", result.Endpoint.String())
+
+		// Withdrawing the endpoint updates the coordinator
+		require.NoError(t, memberB.rendezvous.SetAdvertisedEndpoint(nil))
+		network.WaitIdle()
+		_, ok = coordinator.rendezvous.MemberAdvertisedEndpoint(memberB.identity.Address)
+		assert.False(t, ok)
+	})
+
+	t.Run("unknown peer", func(t *testing.T) {
+		_, _, memberA, _ := newNATPair(t, transport.NATFullCone)
+		stranger, err := identity.NewIdentity()
+		require.NoError(t, err)
+
+		resultCh, err := memberA.rendezvous.Connect(stranger.Address)
+		require.NoError(t, err)
+		result := <-resultCh
+		var transportErr *transport.TransportError
+		require.True(t, errors.As(result.Err, &transportErr))
+		assert.Equal(t, 9009, transportErr.Code)
+	})
+
+	t.Run("no coordinator", func(t *testing.T) {
+		network := transport.NewMemoryNetwork()
+		node := newRendezvousNode(t, network, "203.0.113.1:9993", nil)
+		other, err := identity.NewIdentity()
+		require.NoError(t, err)
+
+		_, err = node.rendezvous.Connect(other.Address)
+		assert.Error(t, err)
+		assert.Error(t, node.rendezvous.Send(other.Address, []byte("nowhere")))
+		assert.Error(t, node.rendezvous.SetPunchTiming(0, 1))
+	})
+}
+
+// TestRendezvousRegistrationTakeover tests that another host cannot re-register a live member's address
+func TestRendezvousRegistrationTakeover(t *testing.T) {
+	network, coordinator, memberA, memberB := newNATPair(t, transport.NATRestrictedCone)
+	network.WaitIdle()
+	endpointA, registered := coordinator.rendezvous.MemberEndpoint(memberA.identity.Address)
+	require.True(t, registered)
+
+	// An attacker claims A's node address from its own endpoint
+	attackerTransport, err := transport.NewTransport(transport.TransportTypeMemory, map[string]interface{}{"network": network, "addr": "203.0.113.66:9993"})
+	require.NoError(t, err)
+	attacker := transport.NewRendezvousManager(memberA.identity, attackerTransport)
+	attacker.SetCoordinator(coordinator.transport.GetLocalAddr())
+	require.NoError(t, attackerTransport.Start(attacker.Handler(nil)))
+	defer attackerTransport.Stop()
+	require.NoError(t, attacker.Register())
+	network.WaitIdle()
+
+	endpoint, registered := coordinator.rendezvous.MemberEndpoint(memberA.identity.Address)
+	require.True(t, registered)
+	assert.Equal(t, endpointA.String(), endpoint.String())
+	assert.Nil(t, attacker.PublicEndpoint())
+
+	// Frames for A still reach A
+	require.NoError(t, memberB.rendezvous.Send(memberA.identity.Address, []byte("for A")))
+	network.WaitIdle()
+	assert.Equal(t, []string{"for A"}, memberA.received())
+}
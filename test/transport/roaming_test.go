@@ -0,0 +1,313 @@
+package transport_test
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stella/virtual-switch/pkg/address"
+	"github.com/stella/virtual-switch/pkg/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rebindingNAT forwards a client's datagrams to a server from an external socket
+// that can be replaced, like a NAT that assigns a new mapping when the client roams
+type rebindingNAT struct {
+	t        *testing.T
+	inside   *net.UDPConn
+	server   *net.UDPAddr
+	mu       sync.Mutex
+	outside  *net.UDPConn
+	client   *net.UDPAddr
+	captured [][]byte
+}
+
+// newRebindingNAT creates a NAT in front of server
+func newRebindingNAT(t *testing.T, server net.Addr) *rebindingNAT {
+	inside, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	n := &rebindingNAT{t: t, inside: inside, server: server.(*net.UDPAddr)}
+	t.Cleanup(func() {
+		inside.Close()
+		n.mu.Lock()
+		n.outside.Close()
+		n.mu.Unlock()
+	})
+	n.rebind()
+
+	go func() {
+		buffer := make([]byte, 65536)
+		for {
+			size, from, err := inside.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			packet := append([]byte(nil), buffer[:size]...)
+			n.mu.Lock()
+			n.client = from
+			n.captured = append(n.captured, packet)
+			outside := n.outside
+			n.mu.Unlock()
+			outside.WriteToUDP(packet, n.server)
+		}
+	}()
+	return n
+}
+
+// rebind replaces the external socket; the old mapping stops forwarding
+func (n *rebindingNAT) rebind() {
+	outside, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(n.t, err)
+
+	n.mu.Lock()
+	if n.outside != nil {
+		n.outside.Close()
+	}
+	n.outside = outside
+	n.mu.Unlock()
+
+	go func() {
+		buffer := make([]byte, 65536)
+		for {
+			size, _, err := outside.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			client := n.client
+			n.mu.Unlock()
+			if client != nil {
+				n.inside.WriteToUDP(buffer[:size], client)
+			}
+		}
+	}()
+}
+
+// external returns the address the server sees the client at
+func (n *rebindingNAT) external() net.Addr {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.outside.LocalAddr()
+}
+
+// lastCaptured returns the last datagram forwarded from the client
+func (n *rebindingNAT) lastCaptured() []byte {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.captured[len(n.captured)-1]
+}
+
+// roamingPeer is a UDP transport that records what it receives and from whom
+type roamingPeer struct {
+	transport *transport.UDPTransport
+	node      *address.Address
+
+	mu       sync.Mutex
+	received []string
+	from     []net.Addr
+}
+
+// newRoamingPeer starts a UDP transport on loopback
+func newRoamingPeer(t *testing.T) *roamingPeer {
+	p := &roamingPeer{transport: transport.NewUDPTransport()}
+	require.NoError(t, p.transport.Init(map[string]interface{}{"addr": "127.0.0.1:0"}))
+	require.NoError(t, p.transport.Start(func(addr net.Addr, data []byte) error {
+		p.mu.Lock()
+		p.received = append(p.received, string(data))
+		p.from = append(p.from, addr)
+		p.mu.Unlock()
+		return nil
+	}))
+	t.Cleanup(func() { p.transport.Stop() })
+	p.node = address.NewAddressFromPublicKey(p.transport.GetPublicKey())
+	return p
+}
+
+// waitFor waits until message has been received and returns its source address
+func (p *roamingPeer) waitFor(t *testing.T, message string) net.Addr {
+	var from net.Addr
+	require.Eventually(t, func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for i, received := range p.received {
+			if received == message {
+				from = p.from[i]
+				return true
+			}
+		}
+		return false
+	}, 2*time.Second, 5*time.Millisecond)
+	return from
+}
+
+// count returns how many packets have been received
+func (p *roamingPeer) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.received)
+}
+
+// roamingPair is a client behind a rebinding NAT and a server, registered with each other by node address
+type roamingPair struct {
+	client, server         *roamingPeer
+	nat                    *rebindingNAT
+	clientNode, serverNode *transport.NodeAddr
+}
+
+// newRoamingPair starts a client and a server and registers them as node peers
+func newRoamingPair(t *testing.T) *roamingPair {
+	pair := &roamingPair{client: newRoamingPeer(t), server: newRoamingPeer(t)}
+	pair.nat = newRebindingNAT(t, pair.server.transport.GetLocalAddr())
+
+	var err error
+	pair.serverNode, err = pair.client.transport.AddNodePeer(pair.server.node, pair.server.transport.GetPublicKey(), pair.nat.inside.LocalAddr())
+	require.NoError(t, err)
+	pair.clientNode, err = pair.server.transport.AddNodePeer(pair.client.node, pair.client.transport.GetPublicKey(), pair.nat.external())
+	require.NoError(t, err)
+	return pair
+}
+
+// TestUDPTransportRoamingMigratesSession tests that a session survives the client's address changing
+func TestUDPTransportRoamingMigratesSession(t *testing.T) {
+	pair := newRoamingPair(t)
+
+	migrated := make(chan net.Addr, 1)
+	pair.server.transport.AddEndpointListener(func(node *transport.NodeAddr, oldEndpoint, newEndpoint net.Addr) {
+		migrated <- newEndpoint
+	})
+
+	require.NoError(t, pair.client.transport.Send(pair.serverNode, []byte("hello-1")))
+	from := pair.server.waitFor(t, "hello-1")
+	assert.Equal(t, pair.client.node.String(), from.String())
+	require.NoError(t, pair.server.transport.Send(from, []byte("reply-1")))
+	assert.Equal(t, pair.server.node.String(), pair.client.waitFor(t, "reply-1").String())
+
+	// The client's mapping changes, e.g. after moving from Wi-Fi to Ethernet
+	pair.nat.rebind()
+	result, err := pair.client.transport.SendWithResult(pair.serverNode, []byte("hello-2"))
+	require.NoError(t, err)
+	assert.Equal(t, pair.client.node.String(), pair.server.waitFor(t, "hello-2").String())
+
+	select {
+	case endpoint := <-migrated:
+		assert.Equal(t, pair.nat.external().String(), endpoint.String())
+	case <-time.After(2 * time.Second):
+		t.Fatal("endpoint did not migrate")
+	}
+	endpoint, ok := pair.server.transport.NodeEndpoint(pair.client.node)
+	require.True(t, ok)
+	assert.Equal(t, pair.nat.external().String(), endpoint.String())
+
+	select {
+	case delivery := <-result:
+		assert.True(t, delivery.Delivered)
+		assert.Equal(t, pair.server.node.String(), delivery.DstAddr.String())
+	case <-time.After(2 * time.Second):
+		t.Fatal("no delivery result")
+	}
+
+	// Replies reach the client at its new address
+	require.NoError(t, pair.server.transport.Send(pair.clientNode, []byte("reply-2")))
+	pair.client.waitFor(t, "reply-2")
+	require.NoError(t, pair.server.transport.SendUnreliable(pair.clientNode, []byte("state-2")))
+	pair.client.waitFor(t, "state-2")
+}
+
+// TestUDPTransportRoamingRejectsUnauthenticated tests that forged and replayed packets do not move the endpoint
+func TestUDPTransportRoamingRejectsUnauthenticated(t *testing.T) {
+	pair := newRoamingPair(t)
+	require.NoError(t, pair.client.transport.Send(pair.serverNode, []byte("hello")))
+	pair.server.waitFor(t, "hello")
+	captured := pair.nat.lastCaptured()
+	before := pair.server.count()
+
+	attacker, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer attacker.Close()
+	serverAddr := pair.server.transport.GetLocalAddr().(*net.UDPAddr)
+
+	// A captured packet replayed from another address
+	_, err = attacker.WriteToUDP(captured, serverAddr)
+	require.NoError(t, err)
+
+	// A packet claiming the client's node with a bad tag
+	forged := append([]byte(nil), captured...)
+	forged[len(forged)-1] ^= 0xff
+	forged[14] ^= 0xff
+	_, err = attacker.WriteToUDP(forged, serverAddr)
+	require.NoError(t, err)
+
+	// A plain packet from the client's current address
+	pair.nat.mu.Lock()
+	_, err = pair.nat.outside.WriteToUDP([]byte("plain"), serverAddr)
+	pair.nat.mu.Unlock()
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, before, pair.server.count())
+	endpoint, ok := pair.server.transport.NodeEndpoint(pair.client.node)
+	require.True(t, ok)
+	assert.Equal(t, pair.nat.external().String(), endpoint.String())
+
+	// The real session is unaffected
+	require.NoError(t, pair.client.transport.Send(pair.serverNode, []byte("still-here")))
+	pair.server.waitFor(t, "still-here")
+}
+
+// TestUDPTransportRoamingRejectsReplayAfterRestart tests that captured packets cannot move a freshly registered peer
+func TestUDPTransportRoamingRejectsReplayAfterRestart(t *testing.T) {
+	pair := newRoamingPair(t)
+	require.NoError(t, pair.client.transport.Send(pair.serverNode, []byte("hello-1")))
+	pair.server.waitFor(t, "hello-1")
+	first := pair.nat.lastCaptured()
+	require.NoError(t, pair.client.transport.Send(pair.serverNode, []byte("hello-2")))
+	pair.server.waitFor(t, "hello-2")
+	second := pair.nat.lastCaptured()
+
+	// Registering again forgets the counters seen so far, like a restart
+	_, err := pair.server.transport.AddNodePeer(pair.client.node, pair.client.transport.GetPublicKey(), pair.nat.external())
+	require.NoError(t, err)
+	before := pair.server.count()
+
+	attacker, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer attacker.Close()
+	serverAddr := pair.server.transport.GetLocalAddr().(*net.UDPAddr)
+	for _, packet := range [][]byte{first, second} {
+		_, err = attacker.WriteToUDP(packet, serverAddr)
+		require.NoError(t, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, before, pair.server.count())
+	endpoint, ok := pair.server.transport.NodeEndpoint(pair.client.node)
+	require.True(t, ok)
+	assert.Equal(t, pair.nat.external().String(), endpoint.String())
+
+	// The client still reaches the server from its registered endpoint
+	require.NoError(t, pair.client.transport.Send(pair.serverNode, []byte("hello-3")))
+	pair.server.waitFor(t, "hello-3")
+}
+
+// TestUDPTransportAddNodePeer tests node peer registration errors
+func TestUDPTransportAddNodePeer(t *testing.T) {
+	peer := newRoamingPeer(t)
+	other := newRoamingPeer(t)
+
+	_, err := peer.transport.AddNodePeer(other.node, peer.transport.GetPublicKey(), other.transport.GetLocalAddr())
+	requireTransportError(t, err, 3045)
+
+	unknown := transport.NewNodeAddr(other.node)
+	requireTransportError(t, peer.transport.Send(unknown, []byte("x")), 3047)
+	_, err = peer.transport.AddNodePeer(other.node, other.transport.GetPublicKey(), unknown)
+	requireTransportError(t, err, 3051)
+
+	nodeAddr, err := peer.transport.AddNodePeer(other.node, other.transport.GetPublicKey(), other.transport.GetLocalAddr())
+	require.NoError(t, err)
+	assert.Equal(t, "node", nodeAddr.Network())
+	peer.transport.RemoveNodePeer(other.node)
+	_, ok := peer.transport.NodeEndpoint(other.node)
+	assert.False(t, ok)
+}
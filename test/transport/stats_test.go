@@ -0,0 +1,235 @@
+package transport_test
+
+import (
+	"encoding/json"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stella/virtual-switch/pkg/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// statsTestConfig retries quickly and sends no path MTU probes, so packet counts are exact
+var statsTestConfig = map[string]interface{}{
+	"maxRetries":       2,
+	"retryInterval":    10 * time.Millisecond,
+	"retryExponential": false,
+	"pathMTUDiscovery": false,
+}
+
+// TestUDPTransportStats tests the transport-wide and per-peer counters of a UDP transport
+func TestUDPTransportStats(t *testing.T) {
+	server := transport.NewUDPTransport()
+	require.NoError(t, server.Init(statsTestConfig))
+	require.NoError(t, server.Start(func(addr net.Addr, data []byte) error { return nil }))
+	defer server.Stop()
+
+	client := transport.NewUDPTransport()
+	require.NoError(t, client.Init(statsTestConfig))
+	require.NoError(t, client.Start(func(addr net.Addr, data []byte) error { return nil }))
+	defer client.Stop()
+
+	// The first transmission of the second packet is lost and retransmitted
+	var writes atomic.Int32
+	client.SetLinkWriter(func(dstAddr net.Addr, data []byte, write func([]byte) error) error {
+		if writes.Add(1) == 2 {
+			return nil
+		}
+		return write(data)
+	})
+	for _, message := range []string{"one", "two"} {
+		results, err := client.SendWithResult(server.GetLocalAddr(), []byte(message))
+		require.NoError(t, err)
+		assert.True(t, waitForResult(t, results).Delivered)
+	}
+
+	// Nobody ACKs packets sent to a closed port
+	deadAddr := deadUDPAddr(t)
+	results, err := client.SendWithResult(deadAddr, []byte("hello?"))
+	require.NoError(t, err)
+	assert.False(t, waitForResult(t, results).Delivered)
+
+	stats := client.Stats()
+	assert.Equal(t, uint64(3), stats.Retransmits)
+	assert.Equal(t, uint64(1), stats.GiveUps)
+	assert.Equal(t, uint64(5), stats.PacketsSent, "two packets to the server and three to the dead address")
+	assert.Equal(t, 0, stats.QueueDepth)
+	require.Len(t, stats.Peers, 2)
+
+	toServer, ok := stats.Peer(server.GetLocalAddr())
+	require.True(t, ok)
+	assert.Equal(t, uint64(2), toServer.PacketsSent, "the lost transmission never reached the wire")
+	assert.Equal(t, uint64(2), toServer.PacketsReceived, "one ACK per packet")
+	assert.Equal(t, uint64(1), toServer.Retransmits)
+	assert.Equal(t, uint64(1), toServer.RTT.Samples, "retransmitted packets give no RTT sample")
+	assert.Greater(t, toServer.RTT.Smoothed, time.Duration(0))
+	assert.False(t, toServer.LastSent.IsZero())
+
+	toDead, ok := stats.Peer(deadAddr)
+	require.True(t, ok)
+	assert.Equal(t, uint64(1), toDead.GiveUps)
+	assert.Equal(t, uint64(2), toDead.Retransmits)
+	assert.Equal(t, uint64(3), toDead.PacketsSent)
+
+	fromClient, ok := server.Stats().Peer(client.GetLocalAddr())
+	require.True(t, ok)
+	assert.Equal(t, uint64(2), fromClient.PacketsReceived)
+	assert.Equal(t, toServer.BytesSent, fromClient.BytesReceived)
+	assert.Equal(t, toServer.BytesReceived, fromClient.BytesSent)
+
+	// Snapshots are ready for a metrics endpoint
+	encoded, err := json.Marshal(stats)
+	require.NoError(t, err)
+	assert.Contains(t, string(encoded), `"giveUps":1`)
+}
+
+// TestUDPTransportStatsQueueDepth tests that packets awaiting an ACK show up as queue depth
+func TestUDPTransportStatsQueueDepth(t *testing.T) {
+	client := transport.NewUDPTransport()
+	require.NoError(t, client.Init(map[string]interface{}{"maxRetries": 10, "retryInterval": time.Second, "pathMTUDiscovery": false}))
+	require.NoError(t, client.Start(func(addr net.Addr, data []byte) error { return nil }))
+	defer client.Stop()
+
+	deadAddr := deadUDPAddr(t)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, client.Send(deadAddr, []byte("waiting")))
+	}
+	stats := client.Stats()
+	assert.Equal(t, 3, stats.QueueDepth)
+	peer, ok := stats.Peer(deadAddr)
+	require.True(t, ok)
+	assert.Equal(t, 3, peer.QueueDepth)
+}
+
+// TestUDPTransportStatsDecryptFailures tests counting encrypted packets without a usable key
+func TestUDPTransportStatsDecryptFailures(t *testing.T) {
+	received := make(chan receivedPacket, 4)
+	server := transport.NewUDPTransport()
+	require.NoError(t, server.Init(map[string]interface{}{"ackHandlerEnabled": false}))
+	server.SetEncryptionEnabled(true)
+	require.NoError(t, server.Start(func(addr net.Addr, data []byte) error {
+		received <- receivedPacket{addr: addr, data: data}
+		return nil
+	}))
+	defer server.Stop()
+
+	client := transport.NewUDPTransport()
+	require.NoError(t, client.Init(map[string]interface{}{"ackHandlerEnabled": false}))
+	client.SetEncryptionEnabled(true)
+	require.NoError(t, client.Start(func(addr net.Addr, data []byte) error { return nil }))
+	defer client.Stop()
+	client.SetPeerPublicKey(server.GetLocalAddr().String(), server.GetPublicKey())
+
+	// The server does not know the client's key
+	require.NoError(t, client.Send(server.GetLocalAddr(), []byte("secret")))
+	waitForPacket(t, received)
+
+	peer, ok := server.Stats().Peer(client.GetLocalAddr())
+	require.True(t, ok)
+	assert.Equal(t, uint64(1), peer.DecryptFailures)
+	assert.Equal(t, uint64(1), server.Stats().DecryptFailures)
+}
+
+// TestUDPTransportUndecryptableNotRecorded tests that an ACK-mode packet that fails to decrypt is
+// neither acknowledged nor recorded, so its retransmission is delivered once the key is known
+func TestUDPTransportUndecryptableNotRecorded(t *testing.T) {
+	config := map[string]interface{}{
+		"maxRetries":       50,
+		"retryInterval":    20 * time.Millisecond,
+		"retryExponential": false,
+		"pathMTUDiscovery": false,
+	}
+
+	received := make(chan receivedPacket, 4)
+	server := transport.NewUDPTransport()
+	require.NoError(t, server.Init(config))
+	server.SetEncryptionEnabled(true)
+	require.NoError(t, server.Start(func(addr net.Addr, data []byte) error {
+		received <- receivedPacket{addr: addr, data: data}
+		return nil
+	}))
+	defer server.Stop()
+
+	client := transport.NewUDPTransport()
+	require.NoError(t, client.Init(config))
+	client.SetEncryptionEnabled(true)
+	require.NoError(t, client.Start(func(addr net.Addr, data []byte) error { return nil }))
+	defer client.Stop()
+	client.SetPeerPublicKey(server.GetLocalAddr().String(), server.GetPublicKey())
+
+	// The server does not know the client's key yet, so every transmission is dropped
+	require.NoError(t, client.Send(server.GetLocalAddr(), []byte("secret")))
+	require.Eventually(t, func() bool {
+		return server.Stats().DecryptFailures >= 2
+	}, 2*time.Second, 10*time.Millisecond)
+	select {
+	case packet := <-received:
+		t.Fatalf("undecryptable packet delivered: %q", packet.data)
+	default:
+	}
+
+	// Once the key is known the retransmission is decrypted and delivered
+	server.SetPeerPublicKey(client.GetLocalAddr().String(), client.GetPublicKey())
+	assert.Equal(t, "secret", string(waitForPacket(t, received).data))
+}
+
+// TestUDPTransportStatsPlaintextNotDecryptFailure tests that ACK-mode packets sent without a peer key are not counted as decrypt failures
+func TestUDPTransportStatsPlaintextNotDecryptFailure(t *testing.T) {
+	received := make(chan receivedPacket, 4)
+	server := transport.NewUDPTransport()
+	require.NoError(t, server.Init(statsTestConfig))
+	require.NoError(t, server.Start(func(addr net.Addr, data []byte) error {
+		received <- receivedPacket{addr: addr, data: data}
+		return nil
+	}))
+	defer server.Stop()
+
+	client := transport.NewUDPTransport()
+	require.NoError(t, client.Init(statsTestConfig))
+	require.NoError(t, client.Start(func(addr net.Addr, data []byte) error { return nil }))
+	defer client.Stop()
+
+	// Neither side knows the other's key, so the payload goes out in plaintext
+	require.NoError(t, client.Send(server.GetLocalAddr(), []byte("plaintext payload")))
+	assert.Equal(t, "plaintext payload", string(waitForPacket(t, received).data))
+	assert.Zero(t, server.Stats().DecryptFailures)
+}
+
+// TestConnectionManagerStats tests the counters of managed connections
+func TestConnectionManagerStats(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	alice := newManagedPeer(t, network, "192.0.2.1:9993")
+	bob := newManagedPeer(t, network, "192.0.2.2:9993")
+	require.NoError(t, bob.manager.SetQueueSize(2))
+
+	toBob, err := alice.manager.CreateConnection(bob.transport.GetLocalAddr())
+	require.NoError(t, err)
+	_, err = bob.manager.CreateConnection(alice.transport.GetLocalAddr())
+	require.NoError(t, err)
+
+	for _, message := range []string{"one", "two", "three"} {
+		require.NoError(t, toBob.Send([]byte(message)))
+	}
+	network.WaitIdle()
+
+	sent := alice.manager.Stats()
+	assert.Equal(t, uint64(3), sent.PacketsSent)
+	assert.Equal(t, uint64(11), sent.BytesSent)
+
+	stats := bob.manager.Stats()
+	assert.Equal(t, uint64(3), stats.PacketsReceived)
+	assert.Equal(t, uint64(1), stats.Drops, "the queue holds two packets")
+	assert.Equal(t, 2, stats.QueueDepth)
+	require.Len(t, stats.Peers, 1)
+	assert.Equal(t, alice.transport.GetLocalAddr().String(), stats.Peers[0].Addr)
+	assert.Equal(t, 2, stats.Peers[0].QueueDepth)
+
+	// Closed connections leave the peer list but stay in the totals
+	require.NoError(t, bob.manager.CloseAllConnections())
+	stats = bob.manager.Stats()
+	assert.Empty(t, stats.Peers)
+	assert.Equal(t, uint64(3), stats.PacketsReceived)
+}
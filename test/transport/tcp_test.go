@@ -0,0 +1,186 @@
+package transport_test
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stella/virtual-switch/pkg/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// receivedPacket records a packet delivered to a test handler
+type receivedPacket struct {
+	addr net.Addr
+	data []byte
+}
+
+// newTCPTestTransport creates a started TCP transport on a random loopback port
+func newTCPTestTransport(t *testing.T, received chan<- receivedPacket) *transport.TCPTransport {
+	tcpTransport := transport.NewTCPTransport()
+	require.NoError(t, tcpTransport.Init(map[string]interface{}{"addr": "127.0.0.1:0"}))
+	require.NoError(t, tcpTransport.Start(func(addr net.Addr, data []byte) error {
+		received <- receivedPacket{addr: addr, data: data}
+		return nil
+	}))
+	t.Cleanup(func() { tcpTransport.Stop() })
+	return tcpTransport
+}
+
+// TestTCPTransportSendReceive tests framed delivery and connection reuse in both directions
+func TestTCPTransportSendReceive(t *testing.T) {
+	serverReceived := make(chan receivedPacket, 10)
+	clientReceived := make(chan receivedPacket, 10)
+	server := newTCPTestTransport(t, serverReceived)
+	client := newTCPTestTransport(t, clientReceived)
+
+	// Several frames in a row must arrive intact and in order
+	messages := [][]byte{[]byte("first"), bytes.Repeat([]byte("x"), 10000), []byte("third")}
+	for _, message := range messages {
+		require.NoError(t, client.Send(server.GetLocalAddr(), message))
+	}
+
+	var from net.Addr
+	for _, message := range messages {
+		select {
+		case packet := <-serverReceived:
+			assert.Equal(t, message, packet.data)
+			from = packet.addr
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timed out waiting for message to be received")
+		}
+	}
+
+	// The source address is the client's listen address, so replies reuse the connection
+	assert.Equal(t, client.GetLocalAddr().String(), from.String())
+	require.NoError(t, server.Send(from, []byte("reply")))
+
+	select {
+	case packet := <-clientReceived:
+		assert.Equal(t, []byte("reply"), packet.data)
+		assert.Equal(t, server.GetLocalAddr().String(), packet.addr.String())
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for reply to be received")
+	}
+
+	assert.Equal(t, 1, client.PeerCount())
+	assert.Equal(t, 1, server.PeerCount())
+}
+
+// TestTCPTransportEncryption tests that frames are encrypted once public keys are exchanged
+func TestTCPTransportEncryption(t *testing.T) {
+	serverReceived := make(chan receivedPacket, 10)
+	server := newTCPTestTransport(t, serverReceived)
+	client := newTCPTestTransport(t, make(chan receivedPacket, 10))
+
+	server.SetPeerPublicKey(client.GetLocalAddr().String(), client.GetPublicKey())
+	client.SetPeerPublicKey(server.GetLocalAddr().String(), server.GetPublicKey())
+
+	message := []byte("This is a secure TCP message")
+	require.NoError(t, client.Send(server.GetLocalAddr(), message))
+
+	select {
+	case packet := <-serverReceived:
+		assert.Equal(t, message, packet.data)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for message to be received")
+	}
+}
+
+// TestTCPTransportReconnect tests that a send after the peer restarts redials
+func TestTCPTransportReconnect(t *testing.T) {
+	client := newTCPTestTransport(t, make(chan receivedPacket, 10))
+
+	var mu sync.Mutex
+	var received [][]byte
+	server, err := transport.NewTransport(transport.TransportTypeTCP, map[string]interface{}{"addr": "127.0.0.1:0"})
+	require.NoError(t, err)
+	require.NoError(t, server.Start(func(addr net.Addr, data []byte) error {
+		mu.Lock()
+		received = append(received, data)
+		mu.Unlock()
+		return nil
+	}))
+	serverAddr := server.GetLocalAddr()
+
+	require.NoError(t, client.Send(serverAddr, []byte("before")))
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// Restart the server on the same port
+	require.NoError(t, server.Stop())
+	require.Eventually(t, func() bool { return client.PeerCount() == 0 }, 2*time.Second, 10*time.Millisecond)
+
+	restarted, err := transport.NewTransport(transport.TransportTypeTCP, map[string]interface{}{"addr": serverAddr.String()})
+	require.NoError(t, err)
+	done := make(chan []byte, 1)
+	require.NoError(t, restarted.Start(func(addr net.Addr, data []byte) error {
+		done <- data
+		return nil
+	}))
+	defer restarted.Stop()
+
+	require.NoError(t, client.Send(serverAddr, []byte("after")))
+	select {
+	case data := <-done:
+		assert.Equal(t, []byte("after"), data)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for message after reconnect")
+	}
+}
+
+// TestTCPTransportFrameLimit tests that oversized packets are rejected
+func TestTCPTransportFrameLimit(t *testing.T) {
+	tcpTransport, err := transport.NewTransport(transport.TransportTypeTCP, map[string]interface{}{
+		"addr":         "127.0.0.1:0",
+		"maxFrameSize": 128,
+	})
+	require.NoError(t, err)
+	require.NoError(t, tcpTransport.Start(func(addr net.Addr, data []byte) error { return nil }))
+	defer tcpTransport.Stop()
+
+	err = tcpTransport.Send(tcpTransport.GetLocalAddr(), make([]byte, 256))
+	assert.Error(t, err)
+}
+
+// TestTCPTransportStopClosesUnregistered tests that Stop does not wait for connections that are not registered peers
+func TestTCPTransportStopClosesUnregistered(t *testing.T) {
+	server := transport.NewTCPTransport()
+	require.NoError(t, server.Init(map[string]interface{}{"addr": "127.0.0.1:0"}))
+	require.NoError(t, server.Start(func(addr net.Addr, data []byte) error { return nil }))
+	serverAddr := server.GetLocalAddr().String()
+
+	// A client that connects and never sends its hello
+	silent, err := net.Dial("tcp", serverAddr)
+	require.NoError(t, err)
+	defer silent.Close()
+
+	// Two connections announcing the same listen port; only the first is registered
+	hello := []byte{0, 0, 0, 3, 1, 0x26, 0xe1}
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", serverAddr)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write(hello)
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool { return server.PeerCount() == 1 }, time.Second, 5*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		server.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop waited for unregistered connections")
+	}
+}
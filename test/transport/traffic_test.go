@@ -0,0 +1,248 @@
+package transport_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stella/virtual-switch/pkg/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gatedTransport is a transport whose sends block until the test lets them finish,
+// like a paced link that is busy with the previous packet
+type gatedTransport struct {
+	*transport.BaseTransport
+	entered chan string
+	release chan struct{}
+}
+
+// newGatedTransport creates a gated transport
+func newGatedTransport() *gatedTransport {
+	return &gatedTransport{
+		BaseTransport: transport.NewBaseTransport(),
+		entered:       make(chan string, 64),
+		release:       make(chan struct{}),
+	}
+}
+
+// Send reports the packet and waits to be released
+func (g *gatedTransport) Send(dstAddr net.Addr, data []byte) error {
+	g.entered <- string(data)
+	<-g.release
+	return nil
+}
+
+// scheduledLink is a scheduled transport over a gated transport
+type scheduledLink struct {
+	gated     *gatedTransport
+	scheduled *transport.ScheduledTransport
+	dst       net.Addr
+	errs      chan error
+}
+
+// newScheduledLink creates a scheduled transport with the given config over a gated transport
+func newScheduledLink(t *testing.T, config transport.TrafficSchedulerConfig) *scheduledLink {
+	gated := newGatedTransport()
+	scheduled, err := transport.NewScheduledTransport(gated, config)
+	require.NoError(t, err)
+	link := &scheduledLink{
+		gated:     gated,
+		scheduled: scheduled,
+		dst:       &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 9993},
+		errs:      make(chan error, 64),
+	}
+	t.Cleanup(func() {
+		// Let any send still waiting finish
+		for {
+			select {
+			case link.gated.release <- struct{}{}:
+			case <-time.After(50 * time.Millisecond):
+				return
+			}
+		}
+	})
+	return link
+}
+
+// hold starts a bulk send that occupies the link until released
+func (l *scheduledLink) hold(t *testing.T) {
+	go func() { l.errs <- l.scheduled.SendClass(l.dst, []byte("hold"), transport.TrafficClassBulk) }()
+	assert.Equal(t, "hold", l.next(t))
+}
+
+// queue starts a send in class and waits until it is queued
+func (l *scheduledLink) queue(t *testing.T, data string, class transport.TrafficClass) {
+	before := l.queued(class)
+	go func() { l.errs <- l.scheduled.SendClass(l.dst, []byte(data), class) }()
+	require.Eventually(t, func() bool { return l.queued(class) == before+1 }, 2*time.Second, time.Millisecond)
+}
+
+// queued returns how many packets of class are waiting
+func (l *scheduledLink) queued(class transport.TrafficClass) int {
+	stats := l.scheduled.ClassStats()
+	return []transport.TrafficClassStats{stats.Control, stats.Realtime, stats.Bulk}[class].Queued
+}
+
+// next waits for the next packet to reach the gated transport
+func (l *scheduledLink) next(t *testing.T) string {
+	select {
+	case data := <-l.gated.entered:
+		return data
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a send")
+		return ""
+	}
+}
+
+// drain releases the holder and every queued send, returning the order they were sent in
+func (l *scheduledLink) drain(t *testing.T, count int) []string {
+	var order []string
+	for i := 0; i < count; i++ {
+		l.gated.release <- struct{}{}
+		order = append(order, l.next(t))
+	}
+	l.gated.release <- struct{}{}
+	for i := 0; i <= count; i++ {
+		require.NoError(t, <-l.errs)
+	}
+	return order
+}
+
+// TestScheduledTransportStrictPriority tests that a realtime packet overtakes queued bulk packets
+func TestScheduledTransportStrictPriority(t *testing.T) {
+	link := newScheduledLink(t, transport.DefaultTrafficSchedulerConfig())
+	link.hold(t)
+
+	link.queue(t, "chunk-1", transport.TrafficClassBulk)
+	link.queue(t, "chunk-2", transport.TrafficClassBulk)
+	link.queue(t, "tick", transport.TrafficClassRealtime)
+	link.queue(t, "ping", transport.TrafficClassControl)
+
+	assert.Equal(t, []string{"ping", "tick", "chunk-1", "chunk-2"}, link.drain(t, 4))
+
+	stats := link.scheduled.ClassStats()
+	assert.Equal(t, uint64(3), stats.Bulk.Sent)
+	assert.Equal(t, uint64(2), stats.Bulk.Waited)
+	assert.Equal(t, uint64(1), stats.Realtime.Sent)
+	assert.Zero(t, stats.Realtime.Queued)
+	assert.Greater(t, stats.Bulk.MaxWait, time.Duration(0))
+}
+
+// TestScheduledTransportWeighted tests that weighted scheduling keeps sending bulk under realtime load
+func TestScheduledTransportWeighted(t *testing.T) {
+	config := transport.DefaultTrafficSchedulerConfig()
+	config.Policy = transport.SchedulingWeighted
+	config.Weights = map[transport.TrafficClass]int{
+		transport.TrafficClassControl:  1,
+		transport.TrafficClassRealtime: 2,
+		transport.TrafficClassBulk:     1,
+	}
+	link := newScheduledLink(t, config)
+	link.hold(t)
+
+	for _, data := range []string{"chunk-1", "chunk-2", "chunk-3"} {
+		link.queue(t, data, transport.TrafficClassBulk)
+	}
+	for _, data := range []string{"tick-1", "tick-2", "tick-3", "tick-4"} {
+		link.queue(t, data, transport.TrafficClassRealtime)
+	}
+
+	assert.Equal(t, []string{"tick-1", "tick-2", "chunk-1", "tick-3", "tick-4", "chunk-2", "chunk-3"}, link.drain(t, 7))
+}
+
+// TestScheduledTransportQueueLimit tests that a full class queue drops packets of that class only
+func TestScheduledTransportQueueLimit(t *testing.T) {
+	config := transport.DefaultTrafficSchedulerConfig()
+	config.QueueLimit = 1
+	link := newScheduledLink(t, config)
+	link.hold(t)
+
+	link.queue(t, "chunk-1", transport.TrafficClassBulk)
+	requireTransportError(t, link.scheduled.SendClass(link.dst, []byte("chunk-2"), transport.TrafficClassBulk), 4032)
+	link.queue(t, "tick", transport.TrafficClassRealtime)
+
+	assert.Equal(t, []string{"tick", "chunk-1"}, link.drain(t, 2))
+	assert.Equal(t, uint64(1), link.scheduled.ClassStats().Bulk.Dropped)
+}
+
+// TestScheduledTransportClassifier tests how untagged packets are classified
+func TestScheduledTransportClassifier(t *testing.T) {
+	link := newScheduledLink(t, transport.DefaultTrafficSchedulerConfig())
+	link.hold(t)
+
+	send := func(send func() error, class transport.TrafficClass) {
+		before := link.queued(class)
+		go func() { link.errs <- send() }()
+		require.Eventually(t, func() bool { return link.queued(class) == before+1 }, 2*time.Second, time.Millisecond)
+	}
+	send(func() error { return link.scheduled.Send(link.dst, []byte("chunk")) }, transport.TrafficClassBulk)
+	send(func() error { return link.scheduled.SendUnreliable(link.dst, []byte("tick")) }, transport.TrafficClassRealtime)
+	send(func() error { return link.scheduled.SendUnreliable(link.dst, nil) }, transport.TrafficClassControl)
+	assert.Equal(t, []string{"", "tick", "chunk"}, link.drain(t, 3))
+
+	// A custom classifier sees the payload
+	link.scheduled.SetClassifier(func(dstAddr net.Addr, data []byte, reliable bool) transport.TrafficClass {
+		if string(data) == "state" {
+			return transport.TrafficClassRealtime
+		}
+		return transport.TrafficClassBulk
+	})
+	link.hold(t)
+	send(func() error { return link.scheduled.Send(link.dst, []byte("chunk")) }, transport.TrafficClassBulk)
+	send(func() error { return link.scheduled.Send(link.dst, []byte("state")) }, transport.TrafficClassRealtime)
+	assert.Equal(t, []string{"state", "chunk"}, link.drain(t, 2))
+
+	requireTransportError(t, link.scheduled.SendClass(link.dst, []byte("x"), transport.TrafficClass(7)), 4033)
+}
+
+// TestScheduledTransportConfig tests scheduler configuration errors
+func TestScheduledTransportConfig(t *testing.T) {
+	assert.NoError(t, transport.DefaultTrafficSchedulerConfig().Validate())
+
+	for code, mutate := range map[int]func(c *transport.TrafficSchedulerConfig){
+		4029: func(c *transport.TrafficSchedulerConfig) { c.Policy = "fair" },
+		4030: func(c *transport.TrafficSchedulerConfig) {
+			c.Policy = transport.SchedulingWeighted
+			c.Weights[transport.TrafficClassBulk] = 0
+		},
+		4031: func(c *transport.TrafficSchedulerConfig) { c.QueueLimit = 0 },
+		4041: func(c *transport.TrafficSchedulerConfig) { c.Weights[transport.TrafficClass(9)] = 1 },
+	} {
+		config := transport.DefaultTrafficSchedulerConfig()
+		mutate(&config)
+		_, err := transport.NewScheduledTransport(newGatedTransport(), config)
+		requireTransportError(t, err, code)
+	}
+}
+
+// TestConnectionSendClass tests tagging packets on a managed connection over a scheduled transport
+func TestConnectionSendClass(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	bob := newManagedPeer(t, network, "192.0.2.2:9993")
+
+	inner, err := transport.NewTransport(transport.TransportTypeMemory, map[string]interface{}{"network": network, "addr": "192.0.2.1:9993"})
+	require.NoError(t, err)
+	scheduled, err := transport.NewScheduledTransport(inner, transport.DefaultTrafficSchedulerConfig())
+	require.NoError(t, err)
+	manager := transport.NewDefaultConnectionManager(scheduled)
+	require.NoError(t, scheduled.Start(manager.Handler(func(srcAddr net.Addr, data []byte) error { return nil })))
+	t.Cleanup(func() { scheduled.Stop() })
+
+	conn, err := manager.CreateConnection(bob.transport.GetLocalAddr())
+	require.NoError(t, err)
+	classConn, ok := conn.(transport.ClassConnection)
+	require.True(t, ok)
+	require.NoError(t, classConn.SendClass([]byte("tick"), transport.TrafficClassRealtime))
+	require.NoError(t, conn.Send([]byte("chunk")))
+	network.WaitIdle()
+
+	bob.mu.Lock()
+	assert.Equal(t, []string{"tick", "chunk"}, bob.unmanaged)
+	bob.mu.Unlock()
+
+	stats := scheduled.ClassStats()
+	assert.Equal(t, uint64(1), stats.Realtime.Sent)
+	assert.Equal(t, uint64(1), stats.Bulk.Sent)
+}
@@ -0,0 +1,196 @@
+package transport_test
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stella/virtual-switch/pkg/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newWebSocketTestTransport creates a started WebSocket transport in the given mode
+func newWebSocketTestTransport(t *testing.T, mode string, received chan<- receivedPacket) *transport.WebSocketTransport {
+	wsTransport := transport.NewWebSocketTransport()
+	require.NoError(t, wsTransport.Init(map[string]interface{}{
+		"mode": mode,
+		"addr": "127.0.0.1:0",
+		"path": "/tunnel",
+		// Large enough to exercise 64-bit frame lengths
+		"maxFrameSize": 128 * 1024,
+	}))
+	require.NoError(t, wsTransport.Start(func(addr net.Addr, data []byte) error {
+		received <- receivedPacket{addr: addr, data: data}
+		return nil
+	}))
+	t.Cleanup(func() { wsTransport.Stop() })
+	return wsTransport
+}
+
+// waitForPacket waits for a packet on the channel or fails the test
+func waitForPacket(t *testing.T, received <-chan receivedPacket) receivedPacket {
+	select {
+	case packet := <-received:
+		return packet
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for packet")
+		return receivedPacket{}
+	}
+}
+
+// TestWebSocketTransportClientServer tests packets in both directions over one WebSocket connection
+func TestWebSocketTransportClientServer(t *testing.T) {
+	serverReceived := make(chan receivedPacket, 10)
+	clientReceived := make(chan receivedPacket, 10)
+	server := newWebSocketTestTransport(t, transport.WebSocketModeServer, serverReceived)
+	client := newWebSocketTestTransport(t, transport.WebSocketModeClient, clientReceived)
+
+	assert.Nil(t, client.GetLocalAddr(), "Client mode should not listen")
+
+	// Small, 16-bit length and 64-bit length messages
+	messages := [][]byte{[]byte("hello"), make([]byte, 1000), make([]byte, 70000)}
+	for i := range messages[2] {
+		messages[2][i] = byte(i)
+	}
+	for _, message := range messages {
+		require.NoError(t, client.Send(server.GetLocalAddr(), message))
+	}
+
+	var from net.Addr
+	for _, message := range messages {
+		packet := waitForPacket(t, serverReceived)
+		assert.Equal(t, message, packet.data)
+		from = packet.addr
+	}
+
+	// Messages above the frame limit are rejected
+	assert.Error(t, client.Send(server.GetLocalAddr(), make([]byte, 200*1024)))
+
+	// Replies go back over the client's connection
+	require.NoError(t, server.Send(from, []byte("reply")))
+	packet := waitForPacket(t, clientReceived)
+	assert.Equal(t, []byte("reply"), packet.data)
+	assert.Equal(t, server.GetLocalAddr().String(), packet.addr.String())
+
+	assert.Equal(t, 1, client.PeerCount())
+	assert.Equal(t, 1, server.PeerCount())
+}
+
+// TestWebSocketTransportEncryption tests encrypted messages once both sides know each other's keys
+func TestWebSocketTransportEncryption(t *testing.T) {
+	serverReceived := make(chan receivedPacket, 10)
+	clientReceived := make(chan receivedPacket, 10)
+	server := newWebSocketTestTransport(t, transport.WebSocketModeServer, serverReceived)
+	client := newWebSocketTestTransport(t, transport.WebSocketModeClient, clientReceived)
+
+	// The server only learns the client's address once it connects
+	require.NoError(t, client.Send(server.GetLocalAddr(), []byte("hello")))
+	from := waitForPacket(t, serverReceived).addr
+
+	server.SetPeerPublicKey(from.String(), client.GetPublicKey())
+	client.SetPeerPublicKey(server.GetLocalAddr().String(), server.GetPublicKey())
+
+	message := []byte("This is a secure WebSocket message")
+	require.NoError(t, client.Send(server.GetLocalAddr(), message))
+	assert.Equal(t, message, waitForPacket(t, serverReceived).data)
+
+	require.NoError(t, server.Send(from, message))
+	assert.Equal(t, message, waitForPacket(t, clientReceived).data)
+}
+
+// TestWebSocketTransportListenAddress tests that a dialer in server mode is identified by its listen address
+func TestWebSocketTransportListenAddress(t *testing.T) {
+	aReceived := make(chan receivedPacket, 10)
+	bReceived := make(chan receivedPacket, 10)
+	a := newWebSocketTestTransport(t, transport.WebSocketModeServer, aReceived)
+	b := newWebSocketTestTransport(t, transport.WebSocketModeServer, bReceived)
+
+	// Keys can be set in advance because both sides know the listen addresses
+	a.SetPeerPublicKey(b.GetLocalAddr().String(), b.GetPublicKey())
+	b.SetPeerPublicKey(a.GetLocalAddr().String(), a.GetPublicKey())
+
+	message := []byte("This is a secure WebSocket message")
+	require.NoError(t, a.Send(b.GetLocalAddr(), message))
+	packet := waitForPacket(t, bReceived)
+	assert.Equal(t, message, packet.data)
+	assert.Equal(t, a.GetLocalAddr().String(), packet.addr.String())
+
+	// The reply reuses the dialed connection
+	require.NoError(t, b.Send(packet.addr, []byte("reply")))
+	packet = waitForPacket(t, aReceived)
+	assert.Equal(t, []byte("reply"), packet.data)
+	assert.Equal(t, b.GetLocalAddr().String(), packet.addr.String())
+
+	assert.Equal(t, 1, a.PeerCount())
+	assert.Equal(t, 1, b.PeerCount())
+}
+
+// TestWebSocketTransportStopClosesUnregistered tests that Stop does not wait for connections that are not registered peers
+func TestWebSocketTransportStopClosesUnregistered(t *testing.T) {
+	server := newWebSocketTestTransport(t, transport.WebSocketModeServer, make(chan receivedPacket, 10))
+	serverAddr := server.GetLocalAddr().String()
+
+	upgrade := func() net.Conn {
+		conn, err := net.Dial("tcp", serverAddr)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		_, err = conn.Write([]byte("GET /tunnel HTTP/1.1\r\nHost: " + serverAddr + "\r\n" +
+			"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+		return conn
+	}
+
+	// A client that upgrades and never sends its hello
+	upgrade()
+
+	// Two connections announcing the same listen port; only the first is registered
+	hello := []byte{0x82, 0x82, 0, 0, 0, 0, 0x26, 0xe1}
+	for i := 0; i < 2; i++ {
+		_, err := upgrade().Write(hello)
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool { return server.PeerCount() == 1 }, time.Second, 5*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		server.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop waited for unregistered connections")
+	}
+}
+
+// TestWebSocketTransportHandshake tests that non-WebSocket requests and wrong paths are rejected
+func TestWebSocketTransportHandshake(t *testing.T) {
+	server := newWebSocketTestTransport(t, transport.WebSocketModeServer, make(chan receivedPacket, 10))
+
+	// A plain HTTP request is refused
+	resp, err := http.Get("http://" + server.GetLocalAddr().String() + "/tunnel")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUpgradeRequired, resp.StatusCode)
+
+	// A client configured with a different path fails the handshake
+	client := transport.NewWebSocketTransport()
+	require.NoError(t, client.Init(map[string]interface{}{"mode": "client", "path": "/other"}))
+	require.NoError(t, client.Start(func(addr net.Addr, data []byte) error { return nil }))
+	defer client.Stop()
+
+	assert.Error(t, client.Send(server.GetLocalAddr(), []byte("hello")))
+	assert.Equal(t, 0, server.PeerCount())
+
+	// Invalid modes are rejected at init
+	_, err = transport.NewTransport(transport.TransportTypeWebSocket, map[string]interface{}{"mode": "relay"})
+	assert.Error(t, err)
+}
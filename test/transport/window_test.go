@@ -0,0 +1,116 @@
+package transport_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stella/virtual-switch/pkg/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// windowTestConfig enables SACK mode with timers short enough for tests
+func windowTestConfig(windowSize int) map[string]interface{} {
+	return map[string]interface{}{
+		"reliabilityMode": transport.ReliabilityModeSACK,
+		"windowSize":      windowSize,
+		"initialRTO":      50 * time.Millisecond,
+		"minRTO":          20 * time.Millisecond,
+		"maxRTO":          500 * time.Millisecond,
+		"maxRetries":      20,
+	}
+}
+
+// TestUDPTransportSACKBulkTransfer tests a lossy, reordering bulk transfer in SACK mode
+func TestUDPTransportSACKBulkTransfer(t *testing.T) {
+	server := transport.NewUDPTransport()
+	require.NoError(t, server.Init(windowTestConfig(16)))
+	client := transport.NewUDPTransport()
+	require.NoError(t, client.Init(windowTestConfig(16)))
+
+	var mu sync.Mutex
+	deliveries := make(map[string]int)
+	// SACKs from the server are lost too
+	impairedServer := transport.NewImpairedTransport(server, 11)
+	require.NoError(t, impairedServer.SetDefaultImpairment(transport.Impairment{Loss: 0.1}))
+	require.NoError(t, impairedServer.Start(func(addr net.Addr, data []byte) error {
+		mu.Lock()
+		deliveries[string(data)]++
+		mu.Unlock()
+		return nil
+	}))
+	defer impairedServer.Stop()
+
+	impairedClient := transport.NewImpairedTransport(client, 12)
+	require.NoError(t, impairedClient.SetDefaultImpairment(transport.Impairment{
+		Loss:         0.1,
+		Reorder:      0.1,
+		ReorderDelay: 5 * time.Millisecond,
+	}))
+	require.NoError(t, impairedClient.Start(func(addr net.Addr, data []byte) error { return nil }))
+	defer impairedClient.Stop()
+
+	const count = 300
+	results := make([]<-chan transport.DeliveryResult, count)
+	for i := range results {
+		var err error
+		results[i], err = client.SendWithResult(server.GetLocalAddr(), []byte(fmt.Sprintf("chunk-%d", i)))
+		require.NoError(t, err)
+
+		// The window bounds the number of unacknowledged packets
+		stats, ok := client.GetWindowStats(server.GetLocalAddr())
+		require.True(t, ok)
+		assert.LessOrEqual(t, stats.InFlight, 16)
+	}
+
+	for _, result := range results {
+		outcome := waitForResult(t, result)
+		require.True(t, outcome.Delivered, "delivery failed: %v", outcome.Err)
+	}
+
+	mu.Lock()
+	assert.Len(t, deliveries, count)
+	for chunk, n := range deliveries {
+		assert.Equal(t, 1, n, "%s delivered more than once", chunk)
+	}
+	mu.Unlock()
+
+	stats, ok := client.GetWindowStats(server.GetLocalAddr())
+	require.True(t, ok)
+	assert.Equal(t, 0, stats.InFlight)
+	assert.Greater(t, stats.Retransmits, uint64(0))
+	assert.Greater(t, stats.SRTT, time.Duration(0))
+	assert.GreaterOrEqual(t, stats.RTO, 20*time.Millisecond)
+}
+
+// TestUDPTransportSACKWindowFull tests that senders block and time out when the window is full
+func TestUDPTransportSACKWindowFull(t *testing.T) {
+	client := transport.NewUDPTransport()
+	require.NoError(t, client.Init(windowTestConfig(2)))
+	require.NoError(t, client.Start(func(addr net.Addr, data []byte) error { return nil }))
+	require.NoError(t, client.SetWriteTimeout(50*time.Millisecond))
+
+	deadAddr := deadUDPAddr(t)
+	first, err := client.SendWithResult(deadAddr, []byte("one"))
+	require.NoError(t, err)
+	require.NoError(t, client.Send(deadAddr, []byte("two")))
+
+	start := time.Now()
+	err = client.Send(deadAddr, []byte("three"))
+	var transportErr *transport.TransportError
+	require.True(t, errors.As(err, &transportErr))
+	assert.Equal(t, 3028, transportErr.Code)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	// Stopping fails the packets still in flight
+	require.NoError(t, client.Stop())
+	result := waitForResult(t, first)
+	assert.False(t, result.Delivered)
+
+	_, err = transport.NewTransport(transport.TransportTypeUDP, map[string]interface{}{"reliabilityMode": "fountain"})
+	assert.Error(t, err)
+}